@@ -0,0 +1,140 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+// interceptAccountSwitch is called for every Discord event before it's dispatched. If the stored token
+// authenticated as a different Discord account than the one the user logged in with, the session is
+// disconnected and events are dropped until the user confirms the switch. The return value is true
+// if the event should be dropped.
+func (user *User) interceptAccountSwitch(rawEvt any) bool {
+	user.accountSwitchLock.Lock()
+	defer user.accountSwitchLock.Unlock()
+	ready, ok := rawEvt.(*discordgo.Ready)
+	if user.pendingAccountSwitch != nil {
+		if ok {
+			// Something reconnected the session before the switch was confirmed
+			go user.Disconnect()
+		}
+		return true
+	} else if !ok || user.DiscordID == "" || ready.User.ID == user.DiscordID {
+		return false
+	} else if ready.User.ID == user.confirmedAccountSwitch {
+		user.confirmedAccountSwitch = ""
+		return false
+	}
+	user.pendingAccountSwitch = ready.User
+	go user.handleAccountSwitch(ready.User)
+	return true
+}
+
+func (user *User) handleAccountSwitch(newAccount *discordgo.User) {
+	user.log.Warn().
+		Str("expected_discord_id", user.DiscordID).
+		Str("new_discord_id", newAccount.ID).
+		Str("new_username", newAccount.Username).
+		Msg("Discord token authenticated as a different account, pausing bridging until the switch is confirmed")
+	user.BridgeState.Send(status.BridgeState{
+		StateEvent: status.StateBadCredentials,
+		Error:      "dc-account-switch",
+		Message:    fmt.Sprintf("Discord login switched to a different account (%s), confirm the switch to continue", newAccount.Username),
+	})
+	err := user.Disconnect()
+	if err != nil {
+		user.log.Warn().Err(err).Msg("Failed to disconnect after account switch")
+	}
+	if user.ManagementRoom == "" {
+		return
+	}
+	var previousName string
+	if puppet := user.bridge.GetPuppetByID(user.DiscordID); puppet != nil && puppet.Username != "" {
+		previousName = puppet.Username
+	} else {
+		previousName = user.DiscordID
+	}
+	content := format.RenderMarkdown(fmt.Sprintf(
+		"**Warning:** your Discord login is now authenticated as `%s` (`%s`) instead of `%s` (`%s`). "+
+			"This can happen if someone else logged into Discord with the same session on a shared computer, "+
+			"or if your account was compromised.\n\n"+
+			"Bridging is paused. Use `%s confirm-account-switch confirm` to continue as the new account, "+
+			"or `%s confirm-account-switch logout` to log out.",
+		newAccount.Username, newAccount.ID, previousName, user.DiscordID,
+		user.bridge.Config.Bridge.CommandPrefix, user.bridge.Config.Bridge.CommandPrefix,
+	), true, false)
+	content.Mentions = &event.Mentions{UserIDs: []id.UserID{user.MXID}}
+	_, err = user.bridge.Bot.SendMessageEvent(user.ManagementRoom, event.EventMessage, &content)
+	if err != nil {
+		user.log.Warn().Err(err).Msg("Failed to send account switch alert")
+	}
+}
+
+var cmdConfirmAccountSwitch = &commands.FullHandler{
+	Func: wrapCommand(fnConfirmAccountSwitch),
+	Name: "confirm-account-switch",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Continue bridging after your Discord login switched to a different account, or log out.",
+		Args:        "<confirm|logout>",
+	},
+}
+
+func fnConfirmAccountSwitch(ce *WrappedCommandEvent) {
+	ce.User.accountSwitchLock.Lock()
+	newAccount := ce.User.pendingAccountSwitch
+	ce.User.accountSwitchLock.Unlock()
+	if newAccount == nil {
+		ce.Reply("Your Discord login hasn't switched accounts")
+		return
+	}
+	var action string
+	if len(ce.Args) > 0 {
+		action = strings.ToLower(ce.Args[0])
+	}
+	switch action {
+	case "confirm":
+		ce.User.accountSwitchLock.Lock()
+		ce.User.pendingAccountSwitch = nil
+		ce.User.confirmedAccountSwitch = newAccount.ID
+		ce.User.accountSwitchLock.Unlock()
+		ce.ZLog.Info().Str("new_discord_id", newAccount.ID).Msg("User confirmed Discord account switch")
+		if err := ce.User.Connect(); err != nil {
+			ce.Reply("Error while reconnecting: %v", err)
+		} else {
+			ce.Reply("Continuing as `%s`", newAccount.Username)
+		}
+	case "logout":
+		ce.User.accountSwitchLock.Lock()
+		ce.User.pendingAccountSwitch = nil
+		ce.User.accountSwitchLock.Unlock()
+		ce.User.Logout(false)
+		ce.Reply("Logged out")
+	default:
+		ce.Reply("Your Discord login is now authenticated as `%s` (`%s`).\n\n**Usage:** `$cmdprefix confirm-account-switch <confirm|logout>`",
+			newAccount.Username, newAccount.ID)
+	}
+}
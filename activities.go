@@ -0,0 +1,99 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"maunium.net/go/mautrix/event"
+)
+
+type embeddedActivityUpdate struct {
+	ChannelID        string `json:"channel_id"`
+	GuildID          string `json:"guild_id"`
+	EmbeddedActivity struct {
+		ApplicationID string `json:"application_id"`
+		Name          string `json:"name"`
+	} `json:"embedded_activity"`
+	Users []string `json:"users"`
+}
+
+func (user *User) embeddedActivityUpdateHandler(update *embeddedActivityUpdate) {
+	if !user.bridge.Config.Bridge.ActivityNotices || update.EmbeddedActivity.ApplicationID == "" {
+		return
+	}
+	portal := user.GetExistingPortalByID(update.ChannelID)
+	if portal == nil || portal.MXID == "" || !user.bridge.ownsChannel(portal.Key.ChannelID) {
+		return
+	}
+	started, ended := portal.updateEmbeddedActivity(update.EmbeddedActivity.ApplicationID, update.Users)
+	if !started && !ended {
+		return
+	}
+	name := update.EmbeddedActivity.Name
+	if name == "" {
+		name = "An activity"
+	}
+	var notice string
+	if ended {
+		notice = fmt.Sprintf("%s ended in the call", name)
+	} else {
+		names := make([]string, len(update.Users))
+		for i, userID := range update.Users {
+			puppet := user.bridge.GetPuppetByID(userID)
+			names[i] = puppet.Name
+			if names[i] == "" {
+				names[i] = userID
+			}
+		}
+		notice = fmt.Sprintf("%s started in the call with %s", name, strings.Join(names, ", "))
+	}
+	go func() {
+		_, err := portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    notice,
+		}, nil, 0)
+		if err != nil {
+			portal.log.Err(err).
+				Str("application_id", update.EmbeddedActivity.ApplicationID).
+				Msg("Failed to send activity notice")
+		}
+	}()
+}
+
+// updateEmbeddedActivity stores the participants of an activity and reports whether it just started or ended.
+// Every logged-in user in the call receives the same updates, so only actual changes are reported.
+func (portal *Portal) updateEmbeddedActivity(applicationID string, users []string) (started, ended bool) {
+	portal.activitiesLock.Lock()
+	defer portal.activitiesLock.Unlock()
+	existing, ok := portal.activities[applicationID]
+	if len(users) == 0 {
+		delete(portal.activities, applicationID)
+		return false, ok
+	}
+	if portal.activities == nil {
+		portal.activities = make(map[string][]string)
+	}
+	users = slices.Clone(users)
+	slices.Sort(users)
+	if !ok || !slices.Equal(existing, users) {
+		portal.activities[applicationID] = users
+	}
+	return !ok, false
+}
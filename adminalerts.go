@@ -0,0 +1,120 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	adminAlertDatabase       = "database"
+	adminAlertAppserviceAuth = "appservice_auth"
+	adminAlertRateLimit      = "discord_rate_limit"
+
+	// rateLimitAlertThreshold is the retry delay above which a Discord rate limit is considered a ban rather than normal throttling.
+	rateLimitAlertThreshold = time.Minute
+)
+
+// adminAlerts keeps track of recently sent alerts, so that repeated failures only produce one alert per cooldown.
+type adminAlerts struct {
+	lastSent map[string]time.Time
+	lock     sync.Mutex
+}
+
+// sendAdminAlert sends a notice about a systemic failure to the configured admin alert room.
+func (br *DiscordBridge) sendAdminAlert(key, message string) {
+	cfg := &br.Config.Bridge.AdminAlerts
+	if cfg.Room == "" {
+		return
+	}
+	br.adminAlerts.lock.Lock()
+	if time.Since(br.adminAlerts.lastSent[key]) < time.Duration(cfg.Cooldown)*time.Second {
+		br.adminAlerts.lock.Unlock()
+		return
+	}
+	if br.adminAlerts.lastSent == nil {
+		br.adminAlerts.lastSent = make(map[string]time.Time)
+	}
+	br.adminAlerts.lastSent[key] = time.Now()
+	br.adminAlerts.lock.Unlock()
+	// The alert may not be deliverable (e.g. if the appservice token was rejected), so log it too
+	br.ZLog.Warn().Str("alert_key", key).Str("alert_message", message).Msg("Sending admin alert")
+	go func() {
+		_, err := br.Bot.SendMessageEvent(cfg.Room, event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    message,
+		})
+		if err != nil {
+			br.ZLog.Warn().Err(err).Str("alert_key", key).Msg("Failed to send admin alert")
+		}
+	}()
+}
+
+// appserviceAuthWatcher watches homeserver responses to appservice requests for authentication failures,
+// which mean the registration is broken and nothing will be bridged to Matrix.
+type appserviceAuthWatcher struct {
+	bridge *DiscordBridge
+	next   http.RoundTripper
+}
+
+func (aw *appserviceAuthWatcher) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := aw.next.RoundTrip(req)
+	// Double puppeting clients share the HTTP client, so only requests made with the as_token are checked
+	if err == nil && resp.StatusCode == http.StatusUnauthorized &&
+		req.Header.Get("Authorization") == "Bearer "+aw.bridge.AS.Registration.AppToken {
+		aw.bridge.sendAdminAlert(adminAlertAppserviceAuth, fmt.Sprintf(
+			"The homeserver rejected the bridge's appservice token (%s %s). Check that the registration file is up to date.",
+			req.Method, req.URL.Path,
+		))
+	}
+	return resp, err
+}
+
+func (br *DiscordBridge) startAdminAlerts() {
+	if br.Config.Bridge.AdminAlerts.Room == "" {
+		return
+	}
+	next := br.AS.HTTPClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	br.AS.HTTPClient.Transport = &appserviceAuthWatcher{bridge: br, next: next}
+	_, err := br.Bot.JoinRoomByID(br.Config.Bridge.AdminAlerts.Room)
+	if err != nil {
+		br.ZLog.Warn().Err(err).Msg("Failed to join admin alert room")
+	}
+}
+
+func (user *User) rateLimitHandler(evt *discordgo.RateLimit) {
+	if evt.TooManyRequests == nil || evt.RetryAfter < rateLimitAlertThreshold {
+		return
+	}
+	user.log.Warn().
+		Str("url", evt.URL).
+		Dur("retry_after", evt.RetryAfter).
+		Msg("Got long Discord rate limit")
+	user.bridge.sendAdminAlert(adminAlertRateLimit, fmt.Sprintf(
+		"Discord rate limited %s for %s (%s). The bridge's IP or account may be temporarily banned.",
+		user.MXID, evt.RetryAfter, evt.Message,
+	))
+}
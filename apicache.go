@@ -0,0 +1,233 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/sync/singleflight"
+)
+
+// apiCacheMaxEntries is the number of entries after which expired entries are pruned when adding new ones.
+const apiCacheMaxEntries = 10000
+
+type ttlCacheEntry[T any] struct {
+	value   T
+	expires time.Time
+}
+
+// ttlCache is a simple map-based cache where entries expire after a fixed time.
+type ttlCache[T any] struct {
+	ttl     time.Duration
+	entries map[string]ttlCacheEntry[T]
+	lock    sync.Mutex
+}
+
+func newTTLCache[T any](ttlSeconds int) *ttlCache[T] {
+	return &ttlCache[T]{
+		ttl:     time.Duration(ttlSeconds) * time.Second,
+		entries: make(map[string]ttlCacheEntry[T]),
+	}
+}
+
+func (tc *ttlCache[T]) Get(key string) (val T, ok bool) {
+	if tc.ttl <= 0 {
+		return
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	entry, ok := tc.entries[key]
+	if !ok {
+		return
+	} else if time.Now().After(entry.expires) {
+		delete(tc.entries, key)
+		return val, false
+	}
+	return entry.value, true
+}
+
+func (tc *ttlCache[T]) Set(key string, val T) {
+	if tc.ttl <= 0 {
+		return
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	now := time.Now()
+	if len(tc.entries) >= apiCacheMaxEntries {
+		for k, entry := range tc.entries {
+			if now.After(entry.expires) {
+				delete(tc.entries, k)
+			}
+		}
+	}
+	tc.entries[key] = ttlCacheEntry[T]{value: val, expires: now.Add(tc.ttl)}
+}
+
+func (tc *ttlCache[T]) Delete(key string) {
+	tc.lock.Lock()
+	delete(tc.entries, key)
+	tc.lock.Unlock()
+}
+
+func (tc *ttlCache[T]) Len() int {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	return len(tc.entries)
+}
+
+// discordAPICache caches REST lookups that are repeated often, like fetching info of unknown channels and users.
+// Entries are invalidated when the gateway sends updates for them.
+type discordAPICache struct {
+	channels *ttlCache[*discordgo.Channel]
+	users    *ttlCache[*discordgo.User]
+	members  *ttlCache[*discordgo.Member]
+	// missingMembers remembers users who aren't members of a guild anymore,
+	// so that their old messages don't cause a request each.
+	missingMembers *ttlCache[struct{}]
+	// memberFetches deduplicates concurrent fetches of the same member, e.g. when many messages
+	// from someone who isn't in the state cache are received at once.
+	memberFetches singleflight.Group
+}
+
+func (br *DiscordBridge) newDiscordAPICache() *discordAPICache {
+	cfg := &br.Config.Bridge.APICache
+	return &discordAPICache{
+		channels: newTTLCache[*discordgo.Channel](cfg.ChannelTTL),
+		users:    newTTLCache[*discordgo.User](cfg.UserTTL),
+		members:  newTTLCache[*discordgo.Member](cfg.MemberTTL),
+
+		missingMembers: newTTLCache[struct{}](cfg.MemberTTL),
+	}
+}
+
+func (user *User) getChannel(channelID string) (*discordgo.Channel, error) {
+	cache := user.bridge.apiCache
+	if channel, ok := cache.channels.Get(channelID); ok {
+		return channel, nil
+	}
+	channel, err := user.Session.Channel(channelID)
+	if err == nil {
+		cache.channels.Set(channelID, channel)
+	}
+	return channel, err
+}
+
+func (user *User) getUser(userID string) (*discordgo.User, error) {
+	cache := user.bridge.apiCache
+	if info, ok := cache.users.Get(userID); ok {
+		return info, nil
+	}
+	info, err := user.Session.User(userID)
+	if err == nil {
+		cache.users.Set(userID, info)
+	}
+	return info, err
+}
+
+func (user *User) getGuildMember(guildID, userID string) (*discordgo.Member, error) {
+	cache := user.bridge.apiCache
+	key := guildID + "-" + userID
+	if member, ok := cache.members.Get(key); ok {
+		return member, nil
+	}
+	if _, missing := cache.missingMembers.Get(key); missing {
+		return nil, errMemberNotInGuild
+	}
+	// The session is captured here, as the fetch may be shared with other users' calls
+	session := user.Session
+	val, err, _ := cache.memberFetches.Do(key, func() (any, error) {
+		member, err := session.GuildMember(guildID, userID)
+		var restErr *discordgo.RESTError
+		if err == nil {
+			cache.members.Set(key, member)
+		} else if errors.As(err, &restErr) && restErr.Response.StatusCode == http.StatusNotFound {
+			cache.missingMembers.Set(key, struct{}{})
+		}
+		return member, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*discordgo.Member), nil
+}
+
+var errMemberNotInGuild = errors.New("user is not a member of the guild")
+
+// getMessageAuthorMember finds the guild member object of the author of a message that didn't include it,
+// like messages fetched over REST. The member is taken from the state cache if possible, otherwise it's
+// fetched and added to the state cache. The return value is nil if the member couldn't be found.
+func (user *User) getMessageAuthorMember(guildID string, msg *discordgo.Message) *discordgo.Member {
+	if guildID == "" || msg.Author == nil || msg.WebhookID != "" || user.Session == nil {
+		return nil
+	}
+	if member, err := user.Session.State.Member(guildID, msg.Author.ID); err == nil {
+		return member
+	} else if !user.bridge.Config.Bridge.StateCache.FetchMissingMembers {
+		return nil
+	}
+	member, err := user.getGuildMember(guildID, msg.Author.ID)
+	if err != nil {
+		if !errors.Is(err, errMemberNotInGuild) {
+			user.log.Debug().Err(err).
+				Str("guild_id", guildID).
+				Str("author_id", msg.Author.ID).
+				Msg("Failed to fetch guild member of message author")
+		}
+		return nil
+	}
+	if member.GuildID == "" {
+		member.GuildID = guildID
+	}
+	_ = user.Session.State.MemberAdd(member)
+	return member
+}
+
+// invalidateAPICache removes cached REST responses that are outdated by a gateway event.
+func (br *DiscordBridge) invalidateAPICache(rawEvt any) {
+	cache := br.apiCache
+	switch evt := rawEvt.(type) {
+	case *discordgo.ChannelUpdate:
+		cache.channels.Delete(evt.ID)
+	case *discordgo.ChannelDelete:
+		cache.channels.Delete(evt.ID)
+	case *discordgo.ChannelRecipientAdd:
+		cache.channels.Delete(evt.ChannelID)
+	case *discordgo.ChannelRecipientRemove:
+		cache.channels.Delete(evt.ChannelID)
+	case *discordgo.ThreadUpdate:
+		cache.channels.Delete(evt.ID)
+	case *discordgo.UserUpdate:
+		cache.users.Delete(evt.ID)
+	case *discordgo.GuildMemberUpdate:
+		if evt.User != nil {
+			cache.members.Delete(evt.GuildID + "-" + evt.User.ID)
+			cache.users.Delete(evt.User.ID)
+		}
+	case *discordgo.GuildMemberAdd:
+		if evt.User != nil {
+			cache.missingMembers.Delete(evt.GuildID + "-" + evt.User.ID)
+		}
+	case *discordgo.GuildMemberRemove:
+		if evt.User != nil {
+			cache.members.Delete(evt.GuildID + "-" + evt.User.ID)
+		}
+	}
+}
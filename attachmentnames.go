@@ -0,0 +1,102 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path"
+	"strings"
+	"unicode"
+
+	"go.mau.fi/util/exmime"
+)
+
+// discordMaxFilenameLength is the maximum length of attachment filenames that Discord accepts.
+const discordMaxFilenameLength = 260
+
+// genericFilenames are names that clients use for pasted or recorded media. Many files end up with the same name,
+// so they're made unique to avoid them overwriting each other when saved.
+var genericFilenames = map[string]struct{}{
+	"image":         {},
+	"unknown":       {},
+	"blob":          {},
+	"file":          {},
+	"pasted image":  {},
+	"voice-message": {},
+	"video":         {},
+}
+
+// splitFilename splits a filename into the name and extension, ignoring leading dots of hidden files.
+func splitFilename(name string) (string, string) {
+	ext := path.Ext(name)
+	if ext == name {
+		return name, ""
+	}
+	return name[:len(name)-len(ext)], ext
+}
+
+// cleanFilename removes directories and characters that can't be used in filenames, but keeps any other unicode.
+// If nothing usable is left, the name is replaced with a generic one based on the mime type.
+func cleanFilename(name, mimeType string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if strings.Trim(name, ".") == "" {
+		name = "file"
+	}
+	if _, ext := splitFilename(name); ext == "" {
+		name += exmime.ExtensionFromMimetype(mimeType)
+	}
+	return name
+}
+
+// uniqueFilename adds the given suffix to generic filenames like image.png.
+func uniqueFilename(name, suffix string) string {
+	stem, ext := splitFilename(name)
+	if _, isGeneric := genericFilenames[strings.ToLower(stem)]; !isGeneric || suffix == "" {
+		return name
+	}
+	return stem + "-" + suffix + ext
+}
+
+// truncateFilename shortens a filename to fit in the given number of characters, keeping the extension.
+func truncateFilename(name string, maxLength int) string {
+	runes := []rune(name)
+	if len(runes) <= maxLength {
+		return name
+	}
+	stem, ext := splitFilename(name)
+	extRunes := []rune(ext)
+	if len(extRunes) >= maxLength {
+		return string(runes[:maxLength])
+	}
+	return string([]rune(stem)[:maxLength-len(extRunes)]) + ext
+}
+
+// matrixFilename returns the filename to use for a Discord attachment on Matrix.
+func matrixFilename(name, mimeType, attachmentID string) string {
+	return uniqueFilename(cleanFilename(name, mimeType), attachmentID)
+}
+
+// discordFilename returns the filename to use when uploading a Matrix file to Discord.
+func discordFilename(name, mimeType, suffix string) string {
+	return truncateFilename(uniqueFilename(cleanFilename(name, mimeType), suffix), discordMaxFilenameLength)
+}
@@ -29,7 +29,50 @@ import (
 	"go.mau.fi/mautrix-discord/database"
 )
 
-func downloadDiscordAttachment(cli *http.Client, url string, maxSize int64) ([]byte, error) {
+var errAttachmentTooLarge = errors.New("attachment too large")
+
+// downloadedAttachment is a Discord attachment that is either held in memory or,
+// if it's larger than the configured memory threshold, spilled to a temporary file.
+type downloadedAttachment struct {
+	data []byte
+	file *os.File
+	size int64
+}
+
+// Close removes the temporary file of the attachment, if there is one.
+func (da *downloadedAttachment) Close() {
+	if da.file != nil {
+		_ = da.file.Close()
+		_ = os.Remove(da.file.Name())
+	}
+}
+
+func readAttachmentBody(body io.Reader, memoryThreshold int64) (*downloadedAttachment, error) {
+	if memoryThreshold <= 0 {
+		data, err := io.ReadAll(body)
+		return &downloadedAttachment{data: data, size: int64(len(data))}, err
+	}
+	data, err := io.ReadAll(io.LimitReader(body, memoryThreshold+1))
+	if err != nil || int64(len(data)) <= memoryThreshold {
+		return &downloadedAttachment{data: data, size: int64(len(data))}, err
+	}
+	file, err := os.CreateTemp("", "mautrix_discord_attachment_")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	da := &downloadedAttachment{file: file}
+	da.size, err = io.Copy(file, io.MultiReader(bytes.NewReader(data), body))
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		da.Close()
+		return nil, err
+	}
+	return da, nil
+}
+
+func downloadDiscordAttachment(cli *http.Client, url string, maxSize, memoryThreshold int64) (*downloadedAttachment, error) {
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
@@ -52,16 +95,16 @@ func downloadDiscordAttachment(cli *http.Client, url string, maxSize int64) ([]b
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse content length: %w", err)
 		} else if length > maxSize {
-			return nil, fmt.Errorf("attachment too large (%d > %d)", length, maxSize)
+			return nil, fmt.Errorf("%w (%d > %d)", errAttachmentTooLarge, length, maxSize)
 		}
-		return io.ReadAll(resp.Body)
+		return readAttachmentBody(resp.Body, memoryThreshold)
 	} else {
 		var mbe *http.MaxBytesError
-		data, err := io.ReadAll(http.MaxBytesReader(nil, resp.Body, maxSize))
+		da, err := readAttachmentBody(http.MaxBytesReader(nil, resp.Body, maxSize), memoryThreshold)
 		if err != nil && errors.As(err, &mbe) {
-			return nil, fmt.Errorf("attachment too large (over %d)", maxSize)
+			return nil, fmt.Errorf("%w (over %d)", errAttachmentTooLarge, maxSize)
 		}
-		return data, err
+		return da, err
 	}
 }
 
@@ -120,17 +163,22 @@ func downloadMatrixAttachment(intent *appservice.IntentAPI, content *event.Messa
 	return data, nil
 }
 
-func (br *DiscordBridge) uploadMatrixAttachment(intent *appservice.IntentAPI, data []byte, url string, encrypt bool, meta AttachmentMeta, semaWg *sync.WaitGroup) (*database.File, error) {
+func (br *DiscordBridge) newAttachmentDBFile(url string, meta *AttachmentMeta, size int64, mime string) *database.File {
 	dbFile := br.DB.File.New()
 	dbFile.Timestamp = time.Now()
 	dbFile.URL = url
 	dbFile.ID = meta.AttachmentID
 	dbFile.EmojiName = meta.EmojiName
-	dbFile.Size = len(data)
-	dbFile.MimeType = mimetype.Detect(data).String()
+	dbFile.Size = int(size)
+	dbFile.MimeType = mime
 	if meta.MimeType == "" {
 		meta.MimeType = dbFile.MimeType
 	}
+	return dbFile
+}
+
+func (br *DiscordBridge) uploadMatrixAttachment(intent *appservice.IntentAPI, data []byte, url string, encrypt bool, meta AttachmentMeta, semaWg *sync.WaitGroup) (*database.File, error) {
+	dbFile := br.newAttachmentDBFile(url, &meta, int64(len(data)), mimetype.Detect(data).String())
 	if strings.HasPrefix(meta.MimeType, "image/") {
 		cfg, _, _ := image.DecodeConfig(bytes.NewReader(data))
 		dbFile.Width = cfg.Width
@@ -148,10 +196,125 @@ func (br *DiscordBridge) uploadMatrixAttachment(intent *appservice.IntentAPI, da
 		ContentBytes: data,
 		ContentType:  uploadMime,
 	}
-	if br.Config.Homeserver.AsyncMedia {
+	return dbFile, br.doMatrixAttachmentUpload(intent, dbFile, req, semaWg, nil)
+}
+
+// uploadMatrixAttachmentFile is like uploadMatrixAttachment, but streams the attachment from its temporary file.
+// The temporary file is removed after the upload is done.
+func (br *DiscordBridge) uploadMatrixAttachmentFile(intent *appservice.IntentAPI, da *downloadedAttachment, url string, encrypt bool, meta AttachmentMeta, semaWg *sync.WaitGroup) (*database.File, error) {
+	file := da.file
+	mime, err := mimetype.DetectReader(file)
+	if err != nil {
+		da.Close()
+		return nil, fmt.Errorf("failed to detect mime type: %w", err)
+	}
+	dbFile := br.newAttachmentDBFile(url, &meta, da.size, mime.String())
+	if strings.HasPrefix(meta.MimeType, "image/") {
+		_, err = file.Seek(0, io.SeekStart)
+		if err == nil {
+			cfg, _, _ := image.DecodeConfig(file)
+			dbFile.Width = cfg.Width
+			dbFile.Height = cfg.Height
+		}
+	}
+
+	uploadMime := meta.MimeType
+	var content io.Reader = file
+	if encrypt {
+		dbFile.Encrypted = true
+		dbFile.DecryptionInfo = attachment.NewEncryptedFile()
+		// The hash is only known after the whole file has been encrypted, but it's needed before the
+		// upload finishes when using async media, so calculate it in a separate pass first.
+		_, err = file.Seek(0, io.SeekStart)
+		if err == nil {
+			hashStream := dbFile.DecryptionInfo.EncryptStream(struct{ io.Reader }{file})
+			_, err = io.Copy(io.Discard, hashStream)
+			if err == nil {
+				err = hashStream.Close()
+			}
+		}
+		content = dbFile.DecryptionInfo.EncryptStream(file)
+		uploadMime = "application/octet-stream"
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		da.Close()
+		return nil, fmt.Errorf("failed to read temp file: %w", err)
+	}
+	req := mautrix.ReqUploadMedia{
+		Content:       content,
+		ContentLength: da.size,
+		ContentType:   uploadMime,
+	}
+	return dbFile, br.doMatrixAttachmentUpload(intent, dbFile, req, semaWg, da.Close)
+}
+
+// canDeferAttachmentDownload checks if an attachment can be downloaded after the mxc URI has already been returned.
+// Encrypted files can't be deferred, as the hash of the encrypted file is needed for the event content.
+func (br *DiscordBridge) canDeferAttachmentDownload(encrypt bool, meta AttachmentMeta, maxSize int64) bool {
+	return br.Config.Homeserver.AsyncMedia && !br.usesMediaStorage() && !encrypt && meta.Converter == nil &&
+		meta.MimeType != "" && meta.Size > 0 && meta.Size <= maxSize
+}
+
+// deferredMatrixAttachmentUpload creates an mxc URI immediately using the metadata from Discord,
+// and downloads and uploads the file in the background, so that sending the Matrix event isn't delayed.
+func (br *DiscordBridge) deferredMatrixAttachmentUpload(intent *appservice.IntentAPI, url string, meta AttachmentMeta, maxSize, memoryThreshold int64, semaWg *sync.WaitGroup) (*database.File, error) {
+	resp, err := intent.CreateMXC()
+	if err != nil {
+		return nil, err
+	}
+	dbFile := br.newAttachmentDBFile(url, &meta, meta.Size, meta.MimeType)
+	dbFile.MXC = resp.ContentURI
+	semaWg.Add(1)
+	go func() {
+		defer semaWg.Done()
+		log := br.ZLog.With().Str("mxc", resp.ContentURI.String()).Logger()
+		downloaded, err := downloadDiscordAttachment(http.DefaultClient, url, maxSize, memoryThreshold)
+		if err != nil {
+			log.Err(err).Msg("Failed to download attachment for async upload")
+			dbFile.Delete()
+			return
+		}
+		defer downloaded.Close()
+		req := mautrix.ReqUploadMedia{
+			ContentType:       meta.MimeType,
+			MXC:               resp.ContentURI,
+			UnstableUploadURL: resp.UnstableUploadURL,
+		}
+		if downloaded.file != nil {
+			req.Content = downloaded.file
+			req.ContentLength = downloaded.size
+		} else {
+			req.ContentBytes = downloaded.data
+		}
+		_, err = intent.UploadMedia(req)
+		if err != nil {
+			log.Err(err).Msg("Failed to upload attachment asynchronously")
+			dbFile.Delete()
+		}
+	}()
+	return dbFile, nil
+}
+
+func (br *DiscordBridge) doMatrixAttachmentUpload(intent *appservice.IntentAPI, dbFile *database.File, req mautrix.ReqUploadMedia, semaWg *sync.WaitGroup, cleanup func()) error {
+	if br.usesMediaStorage() {
+		if cleanup != nil {
+			defer cleanup()
+		}
+		mxc, err := br.DMA.storeMedia(req)
+		if err != nil {
+			return fmt.Errorf("failed to upload to media storage: %w", err)
+		}
+		dbFile.MXC = mxc
+	} else if br.Config.Homeserver.AsyncMedia {
 		resp, err := intent.CreateMXC()
 		if err != nil {
-			return nil, err
+			if cleanup != nil {
+				cleanup()
+			}
+			return err
 		}
 		dbFile.MXC = resp.ContentURI
 		req.MXC = resp.ContentURI
@@ -159,6 +322,9 @@ func (br *DiscordBridge) uploadMatrixAttachment(intent *appservice.IntentAPI, da
 		semaWg.Add(1)
 		go func() {
 			defer semaWg.Done()
+			if cleanup != nil {
+				defer cleanup()
+			}
 			_, err = intent.UploadMedia(req)
 			if err != nil {
 				br.Log.Errorfln("Failed to upload %s: %v", req.MXC, err)
@@ -166,13 +332,16 @@ func (br *DiscordBridge) uploadMatrixAttachment(intent *appservice.IntentAPI, da
 			}
 		}()
 	} else {
+		if cleanup != nil {
+			defer cleanup()
+		}
 		uploaded, err := intent.UploadMedia(req)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		dbFile.MXC = uploaded.ContentURI
 	}
-	return dbFile, nil
+	return nil
 }
 
 type AttachmentMeta struct {
@@ -181,6 +350,11 @@ type AttachmentMeta struct {
 	EmojiName     string
 	CopyIfMissing bool
 	Converter     func([]byte) ([]byte, string, error)
+	// MaxSize overrides the homeserver upload size limit if it's lower.
+	MaxSize int64
+	// Size is the size of the file reported by Discord. If it and MimeType are known, async media uploads
+	// don't need to wait for the download to finish before returning the mxc URI.
+	Size int64
 }
 
 var NoMeta = AttachmentMeta{}
@@ -299,21 +473,45 @@ func (br *DiscordBridge) copyAttachmentToMatrix(intent *appservice.IntentAPI, ur
 				br.parallelAttachmentSemaphore.Release(attachmentSizeVal)
 			}()
 
-			var data []byte
-			data, onceErr = downloadDiscordAttachment(http.DefaultClient, url, br.MediaConfig.UploadSize)
-			if onceErr != nil {
-				return
+			maxSize := br.MediaConfig.UploadSize
+			if meta.MaxSize > 0 && meta.MaxSize < maxSize {
+				maxSize = meta.MaxSize
 			}
-
+			memoryThreshold := br.Config.Bridge.AttachmentMemoryThreshold
 			if meta.Converter != nil {
-				data, meta.MimeType, onceErr = meta.Converter(data)
+				// Converters need the whole file in memory anyway
+				memoryThreshold = 0
+			}
+			if br.canDeferAttachmentDownload(encrypt, meta, maxSize) {
+				onceDBFile, onceErr = br.deferredMatrixAttachmentUpload(intent, url, meta, maxSize, memoryThreshold, &semaWg)
 				if onceErr != nil {
-					onceErr = fmt.Errorf("failed to convert attachment: %w", onceErr)
 					return
 				}
+				if isCacheable {
+					onceDBFile.Insert(nil)
+				}
+				br.attachmentTransfers.Delete(transferKey)
+				return
+			}
+			var downloaded *downloadedAttachment
+			downloaded, onceErr = downloadDiscordAttachment(http.DefaultClient, url, maxSize, memoryThreshold)
+			if onceErr != nil {
+				return
 			}
 
-			onceDBFile, onceErr = br.uploadMatrixAttachment(intent, data, url, encrypt, meta, &semaWg)
+			if downloaded.file != nil {
+				onceDBFile, onceErr = br.uploadMatrixAttachmentFile(intent, downloaded, url, encrypt, meta, &semaWg)
+			} else {
+				data := downloaded.data
+				if meta.Converter != nil {
+					data, meta.MimeType, onceErr = meta.Converter(data)
+					if onceErr != nil {
+						onceErr = fmt.Errorf("failed to convert attachment: %w", onceErr)
+						return
+					}
+				}
+				onceDBFile, onceErr = br.uploadMatrixAttachment(intent, data, url, encrypt, meta, &semaWg)
+			}
 			if onceErr != nil {
 				return
 			}
@@ -328,7 +526,11 @@ func (br *DiscordBridge) copyAttachmentToMatrix(intent *appservice.IntentAPI, ur
 }
 
 func (portal *Portal) getEmojiMXCByDiscordID(emojiID, name string, animated bool) id.ContentURI {
-	mxc := portal.bridge.DMA.EmojiMXC(emojiID, name, animated)
+	return portal.bridge.getEmojiMXCByDiscordID(portal.MainIntent(), emojiID, name, animated)
+}
+
+func (br *DiscordBridge) getEmojiMXCByDiscordID(intent *appservice.IntentAPI, emojiID, name string, animated bool) id.ContentURI {
+	mxc := br.DMA.EmojiMXC(emojiID, name, animated)
 	if !mxc.IsEmpty() {
 		return mxc
 	}
@@ -340,13 +542,13 @@ func (portal *Portal) getEmojiMXCByDiscordID(emojiID, name string, animated bool
 		url = discordgo.EndpointEmoji(emojiID)
 		mimeType = "image/png"
 	}
-	dbFile, err := portal.bridge.copyAttachmentToMatrix(portal.MainIntent(), url, false, AttachmentMeta{
+	dbFile, err := br.copyAttachmentToMatrix(intent, url, false, AttachmentMeta{
 		AttachmentID: emojiID,
 		MimeType:     mimeType,
 		EmojiName:    name,
 	})
 	if err != nil {
-		portal.log.Warn().Err(err).Str("emoji_id", emojiID).Msg("Failed to copy emoji to Matrix")
+		br.ZLog.Warn().Err(err).Str("emoji_id", emojiID).Msg("Failed to copy emoji to Matrix")
 		return id.ContentURI{}
 	}
 	return dbFile.MXC
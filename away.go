@@ -0,0 +1,107 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// awayCursor identifies a portal or thread where messages were skipped while the user was away.
+type awayCursor struct {
+	portal *Portal
+	thread *Thread
+}
+
+// isLowPriority checks if live events in the portal can be paused while the user is away.
+// DMs are always bridged in real time.
+func (portal *Portal) isLowPriority() bool {
+	return portal.GuildID != ""
+}
+
+func messageMentionsUser(msg *discordgo.Message, userID string) bool {
+	for _, mention := range msg.Mentions {
+		if mention.ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// markSkippedWhileAway remembers the last message skipped in a portal, so that it can be backfilled later.
+func (user *User) markSkippedWhileAway(portal *Portal, thread *Thread, lastMessageID string) {
+	if lastMessageID == "" {
+		return
+	}
+	user.awayLock.Lock()
+	defer user.awayLock.Unlock()
+	if user.awaySkipped == nil {
+		user.awaySkipped = make(map[awayCursor]string)
+	}
+	key := awayCursor{portal: portal, thread: thread}
+	if existing, ok := user.awaySkipped[key]; !ok || shouldBackfill(existing, lastMessageID) {
+		user.awaySkipped[key] = lastMessageID
+	}
+}
+
+// skipWhileAway checks if a live Discord event should be skipped because the user is away.
+// Messages that mention the user trigger an immediate catch-up of the portal instead.
+func (user *User) skipWhileAway(portal *Portal, thread *Thread, msg any) bool {
+	if !user.Away || !portal.isLowPriority() || portal.MXID == "" {
+		return false
+	}
+	msgCreate, ok := msg.(*discordgo.MessageCreate)
+	if !ok {
+		// Edits, deletions and reactions of old messages can't be caught up later, so they're just dropped
+		return true
+	}
+	if messageMentionsUser(msgCreate.Message, user.DiscordID) {
+		user.awayLock.Lock()
+		delete(user.awaySkipped, awayCursor{portal: portal, thread: thread})
+		user.awayLock.Unlock()
+		user.log.Debug().
+			Str("channel_id", msgCreate.ChannelID).
+			Str("message_id", msgCreate.ID).
+			Msg("Catching up portal while away due to mention")
+		go portal.ForwardBackfillMissed(user, msgCreate.ID, thread)
+		return true
+	}
+	user.markSkippedWhileAway(portal, thread, msgCreate.ID)
+	return true
+}
+
+// SetAway enables or disables away mode. When disabling it, all portals with skipped messages are backfilled.
+func (user *User) SetAway(away bool) int {
+	user.Away = away
+	user.Update()
+	if away {
+		return 0
+	}
+	user.awayLock.Lock()
+	skipped := user.awaySkipped
+	user.awaySkipped = nil
+	user.awayLock.Unlock()
+	go func() {
+		for cursor, lastMessageID := range skipped {
+			if cursor.thread != nil {
+				cursor.thread.Parent.ForwardBackfillMissed(user, lastMessageID, cursor.thread)
+			} else {
+				cursor.portal.ForwardBackfillMissed(user, lastMessageID, nil)
+			}
+		}
+	}()
+	return len(skipped)
+}
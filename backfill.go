@@ -4,8 +4,11 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"sort"
+	"strconv"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/rs/zerolog"
@@ -26,6 +29,10 @@ func (portal *Portal) forwardBackfillInitial(source *User, thread *Thread) {
 	if portal.forwardBackfillLock.TryLock() {
 		panic("forwardBackfillInitial() called without locking forwardBackfillLock")
 	}
+	// Forums don't have messages of their own, posts are backfilled when their threads are found
+	if thread == nil && portal.IsForum() {
+		return
+	}
 
 	limit := portal.bridge.Config.Bridge.Backfill.Limits.Initial.Channel
 	if portal.GuildID == "" {
@@ -52,7 +59,7 @@ func (portal *Portal) forwardBackfillInitial(source *User, thread *Thread) {
 }
 
 func (portal *Portal) ForwardBackfillMissed(source *User, serverLastMessageID string, thread *Thread) {
-	if portal.MXID == "" {
+	if portal.MXID == "" || portal.PausedToMatrix.Load() || (thread == nil && portal.IsForum()) {
 		return
 	}
 
@@ -63,7 +70,12 @@ func (portal *Portal) ForwardBackfillMissed(source *User, serverLastMessageID st
 			limit = portal.bridge.Config.Bridge.Backfill.Limits.Missed.Thread
 		}
 	}
-	if limit == 0 {
+	var threadID string
+	if thread != nil {
+		threadID = thread.ID
+	}
+	checkpoint := portal.bridge.DB.BackfillCheckpoint.Get(portal.Key, threadID)
+	if limit == 0 && checkpoint == nil {
 		return
 	}
 	with := portal.log.With().
@@ -75,9 +87,30 @@ func (portal *Portal) ForwardBackfillMissed(source *User, serverLastMessageID st
 	}
 	log := with.Logger()
 
+	if thread == nil {
+		// Live events received during the backfill are flushed after the lock below is released
+		defer source.finishPortalCatchup(portal)
+	}
 	portal.forwardBackfillLock.Lock()
 	defer portal.forwardBackfillLock.Unlock()
 
+	if checkpoint != nil {
+		if limit == 0 {
+			log.Info().Msg("Dropping interrupted backfill, as missed message backfill is disabled")
+			checkpoint.Delete()
+			return
+		}
+		sent, ok := portal.resumeBackfill(log, source, checkpoint, thread, limit)
+		if !ok {
+			return
+		} else if limit > 0 {
+			limit -= sent
+			if limit <= 0 {
+				return
+			}
+		}
+	}
+
 	var lastMessage *database.Message
 	if thread != nil {
 		lastMessage = portal.bridge.DB.Message.GetLastInThread(portal.Key, thread.ID)
@@ -87,34 +120,117 @@ func (portal *Portal) ForwardBackfillMissed(source *User, serverLastMessageID st
 	if lastMessage == nil || serverLastMessageID == "" {
 		log.Debug().Msg("Not backfilling, no last message in database or no last message in metadata")
 		return
-	} else if !shouldBackfill(lastMessage.DiscordID, serverLastMessageID) {
+	}
+	after := lastMessage.DiscordID
+	if thread == nil && compareMessageIDs(portal.SkippedUntil, after) > 0 {
+		// Messages that were dropped for being too old shouldn't come back through backfill
+		after = portal.SkippedUntil
+	}
+	if !shouldBackfill(after, serverLastMessageID) {
 		log.Debug().
-			Str("last_bridged_message", lastMessage.DiscordID).
+			Str("last_bridged_message", after).
 			Str("last_server_message", serverLastMessageID).
 			Msg("Not backfilling, last message in database is newer than last message in metadata")
 		return
 	}
 	log.Debug().
-		Str("last_bridged_message", lastMessage.DiscordID).
+		Str("last_bridged_message", after).
 		Str("last_server_message", serverLastMessageID).
 		Msg("Backfilling missed messages")
 	if limit < 0 {
-		portal.backfillUnlimitedMissed(log, source, lastMessage.DiscordID, thread)
+		portal.backfillUnlimitedMissed(log, source, after, serverLastMessageID, thread)
 	} else {
-		portal.backfillLimited(log, source, limit, lastMessage.DiscordID, thread)
+		portal.backfillLimited(log, source, limit, after, thread)
 	}
 }
 
 const messageFetchChunkSize = 50
 
+// BackfillRecent backfills up to limit messages newer than the newest bridged message,
+// or the most recent messages if nothing has been bridged yet.
+func (portal *Portal) BackfillRecent(source *User, limit int) {
+	log := portal.log.With().
+		Str("action", "on-demand backfill").
+		Str("room_id", portal.MXID.String()).
+		Int("limit", limit).
+		Logger()
+	if portal.IsForum() {
+		return
+	}
+	portal.forwardBackfillLock.Lock()
+	defer portal.forwardBackfillLock.Unlock()
+	if checkpoint := portal.bridge.DB.BackfillCheckpoint.Get(portal.Key, ""); checkpoint != nil {
+		sent, ok := portal.resumeBackfill(log, source, checkpoint, nil, limit)
+		if !ok {
+			return
+		}
+		limit -= sent
+		if limit <= 0 {
+			return
+		}
+	}
+	var after string
+	if lastMessage := portal.bridge.DB.Message.GetLast(portal.Key); lastMessage != nil {
+		after = lastMessage.DiscordID
+	}
+	portal.backfillLimited(log, source, limit, after, nil)
+}
+
+var errNoBridgedMessages = errors.New("no bridged messages in portal")
+
+// FillGap backfills all messages between the newest bridged message in the portal and the newest message on Discord,
+// regardless of the missed message backfill limits. The returned bool is false if there was no gap to fill.
+func (portal *Portal) FillGap(source *User) (bool, error) {
+	log := portal.log.With().
+		Str("action", "fill gap").
+		Str("room_id", portal.MXID.String()).
+		Logger()
+	if portal.IsForum() {
+		return false, nil
+	}
+	newest, err := source.Session.ChannelMessages(portal.Key.ChannelID, 1, "", "", "", portal.RefererOptIfUser(source.Session, portal.Key.ChannelID)...)
+	if err != nil {
+		return false, fmt.Errorf("failed to get newest message: %w", err)
+	} else if len(newest) == 0 {
+		return false, nil
+	}
+
+	portal.forwardBackfillLock.Lock()
+	defer portal.forwardBackfillLock.Unlock()
+	if checkpoint := portal.bridge.DB.BackfillCheckpoint.Get(portal.Key, ""); checkpoint != nil {
+		if _, ok := portal.resumeBackfill(log, source, checkpoint, nil, -1); !ok {
+			return false, fmt.Errorf("failed to resume interrupted backfill")
+		}
+	}
+	lastMessage := portal.bridge.DB.Message.GetLast(portal.Key)
+	if lastMessage == nil {
+		return false, errNoBridgedMessages
+	} else if !shouldBackfill(lastMessage.DiscordID, newest[0].ID) {
+		return false, nil
+	}
+	log.Info().
+		Str("last_bridged_message", lastMessage.DiscordID).
+		Str("last_server_message", newest[0].ID).
+		Msg("Filling gap of missed messages")
+	portal.backfillUnlimitedMissed(log, source, lastMessage.DiscordID, newest[0].ID, nil)
+	if portal.bridge.DB.BackfillCheckpoint.Get(portal.Key, "") != nil {
+		return true, fmt.Errorf("backfill was interrupted, it will be resumed on the next reconnect")
+	}
+	return true, nil
+}
+
 func (portal *Portal) collectBackfillMessages(log zerolog.Logger, source *User, limit int, until string, thread *Thread) ([]*discordgo.Message, bool, error) {
 	var messages []*discordgo.Message
 	var before string
-	var foundAll bool
+	var foundAll, reachedMaxAge bool
 	protoChannelID := portal.Key.ChannelID
 	if thread != nil {
 		protoChannelID = thread.ID
 	}
+	var cutoff time.Time
+	if maxAge := portal.bridge.Config.Bridge.Backfill.MaxAge; maxAge > 0 {
+		cutoff = time.Now().Add(-time.Duration(maxAge) * time.Second)
+	}
 	for {
 		log.Debug().Str("before_id", before).Msg("Fetching messages for backfill")
 		newMessages, err := source.Session.ChannelMessages(protoChannelID, messageFetchChunkSize, before, "", "", portal.RefererOptIfUser(source.Session, protoChannelID)...)
@@ -134,9 +250,22 @@ func (portal *Portal) collectBackfillMessages(log zerolog.Logger, source *User,
 				}
 			}
 		}
+		if !cutoff.IsZero() {
+			for i, msg := range newMessages {
+				if ts, _ := discordgo.SnowflakeTimestamp(msg.ID); ts.Before(cutoff) {
+					log.Debug().
+						Str("message_id", msg.ID).
+						Time("cutoff", cutoff).
+						Msg("Found message older than backfill max age")
+					newMessages = newMessages[:i]
+					reachedMaxAge = true
+					break
+				}
+			}
+		}
 		messages = append(messages, newMessages...)
 		log.Debug().Int("count", len(newMessages)).Msg("Added messages to backfill collection")
-		if len(newMessages) < messageFetchChunkSize || len(messages) >= limit {
+		if len(newMessages) < messageFetchChunkSize || len(messages) >= limit || reachedMaxAge {
 			break
 		}
 		before = newMessages[len(newMessages)-1].ID
@@ -173,14 +302,30 @@ func (portal *Portal) backfillLimited(log zerolog.Logger, source *User, limit in
 			log.Debug().Msg("Sent warning about possibly missed messages")
 		}
 	}
-	portal.sendBackfillBatch(log, source, messages, thread)
+	if len(messages) == 0 {
+		return
+	}
+	if after == "" {
+		after = previousMessageID(messages[0].ID)
+	}
+	checkpoint := portal.newBackfillCheckpoint(thread, after, messages[len(messages)-1].ID)
+	for len(messages) > 0 {
+		chunk := messages[:min(messageFetchChunkSize, len(messages))]
+		messages = messages[len(chunk):]
+		if !portal.sendBackfillBatch(log, source, chunk, thread) {
+			return
+		}
+		advanceBackfillCheckpoint(checkpoint, chunk)
+	}
+	checkpoint.Delete()
 }
 
-func (portal *Portal) backfillUnlimitedMissed(log zerolog.Logger, source *User, after string, thread *Thread) {
+func (portal *Portal) backfillUnlimitedMissed(log zerolog.Logger, source *User, after, until string, thread *Thread) {
 	protoChannelID := portal.Key.ChannelID
 	if thread != nil {
 		protoChannelID = thread.ID
 	}
+	checkpoint := portal.newBackfillCheckpoint(thread, after, until)
 	for {
 		log.Debug().Str("after_id", after).Msg("Fetching chunk of messages to backfill")
 		messages, err := source.Session.ChannelMessages(protoChannelID, messageFetchChunkSize, "", after, "", portal.RefererOptIfUser(source.Session, protoChannelID)...)
@@ -191,43 +336,251 @@ func (portal *Portal) backfillUnlimitedMissed(log zerolog.Logger, source *User,
 		log.Debug().Int("count", len(messages)).Msg("Fetched chunk of messages to backfill")
 		sort.Sort(MessageSlice(messages))
 
-		portal.sendBackfillBatch(log, source, messages, thread)
+		if !portal.sendBackfillBatch(log, source, messages, thread) {
+			return
+		}
+		advanceBackfillCheckpoint(checkpoint, messages)
 
 		if len(messages) < messageFetchChunkSize {
 			// Assume that was all the missing messages
 			log.Debug().Msg("Chunk had less than 50 messages, stopping backfill")
+			checkpoint.Delete()
 			return
 		}
 		after = messages[len(messages)-1].ID
 	}
 }
 
-func (portal *Portal) sendBackfillBatch(log zerolog.Logger, source *User, messages []*discordgo.Message, thread *Thread) {
+// resumeBackfill continues a backfill that was interrupted (e.g. by the bridge restarting)
+// from the last bridged message up to the message that the backfill was originally supposed to reach.
+// At most limit messages are bridged (-1 means no limit), the rest of the range is dropped like in a limited backfill.
+// The returned count is the number of bridged messages, and the bool is false if the backfill was interrupted again.
+func (portal *Portal) resumeBackfill(log zerolog.Logger, source *User, checkpoint *database.BackfillCheckpoint, thread *Thread, limit int) (int, bool) {
+	protoChannelID := portal.Key.ChannelID
+	var lastMessage *database.Message
+	if thread != nil {
+		protoChannelID = thread.ID
+		lastMessage = portal.bridge.DB.Message.GetLastInThread(portal.Key, thread.ID)
+	} else {
+		lastMessage = portal.bridge.DB.Message.GetLast(portal.Key)
+	}
+	after := checkpoint.AfterID
+	// The checkpoint is only updated after a batch is sent, so the last batch may have been bridged already
+	if lastMessage != nil && compareMessageIDs(lastMessage.DiscordID, after) > 0 {
+		after = lastMessage.DiscordID
+	}
+	log.Info().
+		Str("after_id", after).
+		Str("until_id", checkpoint.UntilID).
+		Int("batch", checkpoint.Batch).
+		Int("limit", limit).
+		Msg("Resuming interrupted backfill")
+	sent := 0
+	for compareMessageIDs(after, checkpoint.UntilID) < 0 {
+		messages, err := source.Session.ChannelMessages(protoChannelID, messageFetchChunkSize, "", after, "", portal.RefererOptIfUser(source.Session, protoChannelID)...)
+		if err != nil {
+			log.Err(err).Msg("Error fetching chunk of messages to resume backfill")
+			return sent, false
+		}
+		fetchedCount := len(messages)
+		sort.Sort(MessageSlice(messages))
+		for i, msg := range messages {
+			if compareMessageIDs(msg.ID, checkpoint.UntilID) > 0 {
+				messages = messages[:i]
+				break
+			}
+		}
+		reachedLimit := limit >= 0 && sent+len(messages) >= limit
+		if reachedLimit {
+			messages = messages[:limit-sent]
+		}
+		if len(messages) == 0 {
+			break
+		} else if !portal.sendBackfillBatch(log, source, messages, thread) {
+			return sent, false
+		}
+		sent += len(messages)
+		advanceBackfillCheckpoint(checkpoint, messages)
+		after = checkpoint.AfterID
+		if reachedLimit {
+			log.Info().Msg("Reached backfill limit while resuming, dropping the rest of the interrupted backfill")
+			break
+		} else if fetchedCount < messageFetchChunkSize {
+			break
+		}
+	}
+	log.Info().Int("batch", checkpoint.Batch).Msg("Finished resuming interrupted backfill")
+	checkpoint.Delete()
+	return sent, true
+}
+
+// newBackfillCheckpoint saves the range of messages that a backfill is about to bridge,
+// so that the backfill can be resumed if the bridge is stopped before it finishes.
+func (portal *Portal) newBackfillCheckpoint(thread *Thread, after, until string) *database.BackfillCheckpoint {
+	checkpoint := portal.bridge.DB.BackfillCheckpoint.New()
+	checkpoint.Channel = portal.Key
+	if thread != nil {
+		checkpoint.ThreadID = thread.ID
+	}
+	checkpoint.Direction = database.BackfillDirectionForward
+	checkpoint.AfterID = after
+	checkpoint.UntilID = until
+	checkpoint.Upsert()
+	return checkpoint
+}
+
+func advanceBackfillCheckpoint(checkpoint *database.BackfillCheckpoint, sentMessages []*discordgo.Message) {
+	if len(sentMessages) == 0 {
+		return
+	}
+	checkpoint.AfterID = sentMessages[len(sentMessages)-1].ID
+	checkpoint.Batch++
+	checkpoint.Upsert()
+}
+
+// previousMessageID returns the snowflake just before the given one, which can be used as an exclusive lower bound.
+func previousMessageID(messageID string) string {
+	parsed, err := strconv.ParseUint(messageID, 10, 64)
+	if err != nil || parsed == 0 {
+		return "0"
+	}
+	return strconv.FormatUint(parsed-1, 10)
+}
+
+func (portal *Portal) sendBackfillBatch(log zerolog.Logger, source *User, messages []*discordgo.Message, thread *Thread) bool {
 	if portal.bridge.SpecVersions.Supports(mautrix.BeeperFeatureBatchSending) {
 		log.Debug().Msg("Using hungryserv, sending messages with batch send endpoint")
-		portal.forwardBatchSend(log, source, messages, thread)
+		if !portal.forwardBatchSend(log, source, messages, thread) {
+			return false
+		}
 	} else {
 		log.Debug().Msg("Not using hungryserv, sending messages one by one")
 		for _, msg := range messages {
-			portal.handleDiscordMessageCreate(source, msg, thread)
+			portal.handleDiscordMessageCreate(source, msg, thread, time.Time{})
+		}
+	}
+	portal.bridge.metrics.recordBackfill(len(messages))
+	portal.markBackfillRead(log, source, messages, thread)
+	return true
+}
+
+func (user *User) setReadState(channelID, messageID string) {
+	if messageID == "" {
+		return
+	}
+	user.readStatesLock.Lock()
+	defer user.readStatesLock.Unlock()
+	if user.readStates == nil {
+		user.readStates = make(map[string]string)
+	}
+	if existing, ok := user.readStates[channelID]; !ok || compareMessageIDs(existing, messageID) < 0 {
+		user.readStates[channelID] = messageID
+	}
+}
+
+func (user *User) getReadState(channelID string) string {
+	user.readStatesLock.Lock()
+	defer user.readStatesLock.Unlock()
+	return user.readStates[channelID]
+}
+
+type unreadPortal struct {
+	portal      *Portal
+	lastRead    *database.Message
+	lastMessage *database.Message
+}
+
+// GetUnreadPortals finds portals where the newest bridged message is newer than the Discord read state,
+// sorted so that the most recently active portals are first.
+func (user *User) GetUnreadPortals() []unreadPortal {
+	user.readStatesLock.Lock()
+	readStates := make(map[string]string, len(user.readStates))
+	for channelID, messageID := range user.readStates {
+		readStates[channelID] = messageID
+	}
+	user.readStatesLock.Unlock()
+
+	var unreads []unreadPortal
+	for channelID, lastReadID := range readStates {
+		portal := user.GetExistingPortalByID(channelID)
+		if portal == nil || portal.MXID == "" {
+			continue
 		}
+		lastMessage := user.bridge.DB.Message.GetLast(portal.Key)
+		if lastMessage == nil || lastMessage.SenderID == user.DiscordID || compareMessageIDs(lastMessage.DiscordID, lastReadID) <= 0 {
+			continue
+		}
+		unreads = append(unreads, unreadPortal{
+			portal:      portal,
+			lastRead:    user.bridge.DB.Message.GetLastByDiscordID(portal.Key, lastReadID),
+			lastMessage: lastMessage,
+		})
 	}
+	sort.Slice(unreads, func(i, j int) bool {
+		return compareMessageIDs(unreads[i].lastMessage.DiscordID, unreads[j].lastMessage.DiscordID) > 0
+	})
+	return unreads
 }
 
-func (portal *Portal) forwardBatchSend(log zerolog.Logger, source *User, messages []*discordgo.Message, thread *Thread) {
+// markBackfillRead moves the double puppet's read markers to the newest backfilled message that the user
+// has already read on Discord, so that backfilled history doesn't appear as entirely read or unread.
+func (portal *Portal) markBackfillRead(log zerolog.Logger, source *User, messages []*discordgo.Message, thread *Thread) {
+	dp := source.GetIDoublePuppet()
+	if dp == nil || len(messages) == 0 {
+		return
+	}
+	protoChannelID := portal.Key.ChannelID
+	var threadID string
+	if thread != nil {
+		protoChannelID = thread.ID
+		threadID = thread.ID
+	}
+	lastRead := source.getReadState(protoChannelID)
+	if lastRead != "" && compareMessageIDs(lastRead, messages[len(messages)-1].ID) < 0 {
+		portal.markUnreadAfterBackfill(source)
+	}
+	if lastRead == "" || compareMessageIDs(lastRead, messages[0].ID) < 0 {
+		// None of the backfilled messages have been read
+		return
+	}
+	readTS, err := discordgo.SnowflakeTimestamp(lastRead)
+	if err != nil {
+		return
+	}
+	msg := portal.bridge.DB.Message.GetClosestBefore(portal.Key, threadID, readTS)
+	if msg == nil || msg.MXID == "" {
+		return
+	}
+	err = dp.CustomIntent().SetReadMarkers(portal.MXID, source.makeReadMarkerContent(msg.MXID))
+	if err != nil {
+		log.Warn().Err(err).Str("event_id", msg.MXID.String()).Msg("Failed to set read marker after backfill")
+	} else {
+		log.Debug().
+			Str("event_id", msg.MXID.String()).
+			Str("last_read_message_id", lastRead).
+			Msg("Set read marker after backfill based on Discord read state")
+	}
+}
+
+func (portal *Portal) forwardBatchSend(log zerolog.Logger, source *User, messages []*discordgo.Message, thread *Thread) bool {
+	return portal.batchSend(log, source, messages, thread, true)
+}
+
+func (portal *Portal) batchSend(log zerolog.Logger, source *User, messages []*discordgo.Message, thread *Thread, forward bool) bool {
 	evts, metas, dbMessages := portal.convertMessageBatch(log, source, messages, thread)
 	if len(evts) == 0 {
 		log.Warn().Msg("Didn't get any events to backfill")
-		return
+		return true
 	}
 	log.Info().Int("events", len(evts)).Msg("Converted messages to backfill")
 	resp, err := portal.MainIntent().BeeperBatchSend(portal.MXID, &mautrix.ReqBeeperBatchSend{
-		Forward: true,
-		Events:  evts,
+		Forward:             forward,
+		ForwardIfNoMessages: !forward,
+		Events:              evts,
 	})
 	if err != nil {
 		log.Err(err).Msg("Error sending backfill batch")
-		return
+		return false
 	}
 	for i, evtID := range resp.EventIDs {
 		dbMessages[i].MXID = evtID
@@ -238,6 +591,7 @@ func (portal *Portal) forwardBatchSend(log zerolog.Logger, source *User, message
 		}
 	}
 	portal.bridge.DB.Message.MassInsert(portal.Key, dbMessages)
+	return true
 }
 
 func (portal *Portal) convertMessageBatch(log zerolog.Logger, source *User, messages []*discordgo.Message, thread *Thread) ([]*event.Event, []*discordgo.Message, []database.Message) {
@@ -258,6 +612,9 @@ func (portal *Portal) convertMessageBatch(log zerolog.Logger, source *User, mess
 	metas := make([]*discordgo.Message, 0, len(messages))
 	ctx := context.Background()
 	for _, msg := range messages {
+		if portal.isMessageFromIgnoredBot(msg) {
+			continue
+		}
 		for _, mention := range msg.Mentions {
 			puppet := portal.bridge.GetPuppetByID(mention.ID)
 			puppet.UpdateInfo(nil, mention, nil)
@@ -265,6 +622,10 @@ func (portal *Portal) convertMessageBatch(log zerolog.Logger, source *User, mess
 
 		puppet := portal.bridge.GetPuppetByID(msg.Author.ID)
 		puppet.UpdateInfo(source, msg.Author, msg)
+		if msg.Member == nil && source != nil {
+			// Messages fetched over REST don't include the author's member info
+			msg.Member = source.getMessageAuthorMember(portal.GuildID, msg)
+		}
 		intent := puppet.IntentFor(portal)
 		replyTo := portal.getReplyTarget(source, discordThreadID, msg.MessageReference, msg.Embeds, true)
 		mentions := portal.convertDiscordMentions(msg, false)
@@ -303,7 +664,7 @@ func (portal *Portal) convertMessageBatch(log zerolog.Logger, source *User, mess
 				ID:        portal.deterministicEventID(msg.ID, partName),
 				Type:      part.Type,
 				Sender:    intent.UserID,
-				Timestamp: ts.UnixMilli(),
+				Timestamp: snowflakeToMatrixTS(msg.ID),
 				Content: event.Content{
 					Parsed: part.Content,
 					Raw:    part.Extra,
@@ -381,3 +742,58 @@ func (a MessageSlice) Swap(i, j int) {
 func (a MessageSlice) Less(i, j int) bool {
 	return compareMessageIDs(a[i].ID, a[j].ID) == -1
 }
+
+// startCatchup makes pushPortalMessage buffer live events until the missed message backfill
+// of the portal is done, so that live messages can't get in front of the missed ones.
+func (user *User) startCatchup() {
+	user.catchupLock.Lock()
+	user.catchupBuffers = make(map[*Portal][]portalDiscordMessage)
+	user.catchupFinished = make(map[*Portal]struct{})
+	user.catchupLock.Unlock()
+}
+
+func (user *User) bufferDuringCatchup(portal *Portal, msg portalDiscordMessage) bool {
+	user.catchupLock.Lock()
+	defer user.catchupLock.Unlock()
+	if user.catchupBuffers == nil {
+		return false
+	} else if _, finished := user.catchupFinished[portal]; finished {
+		return false
+	}
+	user.catchupBuffers[portal] = append(user.catchupBuffers[portal], msg)
+	return true
+}
+
+// finishPortalCatchup flushes the live events buffered for the given portal.
+// The lock is held while flushing to ensure new events don't get in front of the buffered ones.
+func (user *User) finishPortalCatchup(portal *Portal) {
+	user.catchupLock.Lock()
+	defer user.catchupLock.Unlock()
+	if user.catchupBuffers == nil {
+		return
+	}
+	user.catchupFinished[portal] = struct{}{}
+	user.flushCatchupBuffer(portal)
+}
+
+// finishCatchup flushes the buffers of all portals that didn't need a missed message backfill.
+func (user *User) finishCatchup() {
+	user.catchupLock.Lock()
+	defer user.catchupLock.Unlock()
+	for portal := range user.catchupBuffers {
+		user.flushCatchupBuffer(portal)
+	}
+	user.catchupBuffers = nil
+	user.catchupFinished = nil
+}
+
+func (user *User) flushCatchupBuffer(portal *Portal) {
+	buffered := user.catchupBuffers[portal]
+	delete(user.catchupBuffers, portal)
+	if len(buffered) > 0 {
+		portal.log.Debug().Int("count", len(buffered)).Msg("Flushing live events buffered during catch-up")
+	}
+	for _, msg := range buffered {
+		user.sendPortalMessage(portal, msg, "buffered event")
+	}
+}
@@ -0,0 +1,75 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+const (
+	// backfillMarkerKey is added to the content of backfilled events that are sent individually
+	// (i.e. without batch sending), so that push rules can suppress notifications for them.
+	backfillMarkerKey = "com.beeper.backfill"
+	// backfillPushRuleID is the ID of the push rule added for double puppeted users to suppress notifications of backfilled events.
+	backfillPushRuleID = "fi.mau.discord.suppress_backfill"
+	// markedUnreadEventType is the room account data event type for marking rooms as unread.
+	markedUnreadEventType = "m.marked_unread"
+)
+
+func addBackfillMarker(extra map[string]any) map[string]any {
+	if extra == nil {
+		extra = make(map[string]any)
+	}
+	extra[backfillMarkerKey] = true
+	return extra
+}
+
+// ensureBackfillPushRule adds a push rule for the double puppeted user that prevents backfilled events from notifying.
+// Push rules can't see the content of encrypted events, so this only applies to unencrypted portals.
+func (puppet *Puppet) ensureBackfillPushRule() {
+	if !puppet.bridge.Config.Bridge.Backfill.SuppressNotifications || puppet.customIntent == nil {
+		return
+	}
+	err := puppet.customIntent.PutPushRule("global", pushrules.OverrideRule, backfillPushRuleID, &mautrix.ReqPutPushRule{
+		Actions: []pushrules.PushActionType{pushrules.ActionDontNotify},
+		Conditions: []pushrules.PushCondition{{
+			Kind:  pushrules.KindEventPropertyIs,
+			Key:   "content.com\\.beeper\\.backfill",
+			Value: true,
+		}},
+	})
+	if err != nil {
+		puppet.log.Warn().Err(err).Msg("Failed to add push rule for suppressing backfill notifications")
+	}
+}
+
+// markUnreadAfterBackfill marks the portal as unread for the double puppeted user,
+// which is used when backfilled messages include messages the user hasn't read on Discord.
+func (portal *Portal) markUnreadAfterBackfill(source *User) {
+	if !portal.bridge.Config.Bridge.Backfill.MarkUnread {
+		return
+	}
+	dp := source.GetIDoublePuppet()
+	if dp == nil {
+		return
+	}
+	err := dp.CustomIntent().SetRoomAccountData(portal.MXID, markedUnreadEventType, map[string]any{"unread": true})
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to mark room as unread after backfill")
+	}
+}
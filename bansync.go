@@ -0,0 +1,243 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var cmdGuildBans = &commands.FullHandler{
+	Func: wrapCommand(fnGuildBans),
+	Name: "guild-bans",
+	Help: commands.HelpMeta{
+		Section: HelpSectionPortalManagement,
+		Description: "Import the Discord guild's ban list as Matrix bans in all of the guild's portals, " +
+			"or export the Matrix bans in this room to the Discord guild.",
+		Args: "<import|export>",
+	},
+	RequiresPortal:     true,
+	RequiresLogin:      true,
+	RequiresEventLevel: roomModerator,
+}
+
+func fnGuildBans(ce *WrappedCommandEvent) {
+	if ce.Portal.GuildID == "" {
+		ce.Reply("This command can only be used in guild portals")
+		return
+	}
+	var action string
+	if len(ce.Args) > 0 {
+		action = strings.ToLower(ce.Args[0])
+	}
+	switch action {
+	case "import":
+		bans, err := ce.User.fetchGuildBans(ce.Portal.GuildID)
+		if err != nil {
+			ce.Reply("Failed to get guild bans: %v", err)
+			return
+		}
+		portals := ce.Bridge.GetAllPortalsInGuild(ce.Portal.GuildID)
+		banned := 0
+		for _, ban := range bans {
+			for _, portal := range portals {
+				banned += portal.banDiscordUserOnMatrix(ban.User.ID, ban.Reason)
+			}
+		}
+		ce.Reply("Imported %d Discord bans as %d Matrix bans", len(bans), banned)
+	case "export":
+		members, err := ce.Portal.MainIntent().Members(ce.Portal.MXID, mautrix.ReqMembers{Membership: event.MembershipBan})
+		if err != nil {
+			ce.Reply("Failed to get banned members: %v", err)
+			return
+		}
+		exported := 0
+		for _, evt := range members.Chunk {
+			discordID := ce.Bridge.discordIDForMatrixUser(id.UserID(evt.GetStateKey()))
+			if discordID == "" {
+				continue
+			}
+			err = ce.User.Session.GuildBanCreateWithReason(ce.Portal.GuildID, discordID, evt.Content.AsMember().Reason, 0)
+			if err != nil {
+				ce.Reply("Failed to ban %s on Discord: %v", discordID, err)
+				return
+			}
+			exported++
+		}
+		ce.Reply("Exported %d Matrix bans to Discord", exported)
+	default:
+		ce.Reply("**Usage:** `$cmdprefix guild-bans <import|export>`")
+	}
+}
+
+// fetchGuildBans gets the full ban list of a guild, which requires the Ban Members permission.
+func (user *User) fetchGuildBans(guildID string) ([]*discordgo.GuildBan, error) {
+	const pageSize = 1000
+	var bans []*discordgo.GuildBan
+	var after string
+	for {
+		page, err := user.Session.GuildBans(guildID, pageSize, "", after)
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, page...)
+		if len(page) < pageSize {
+			return bans, nil
+		}
+		after = page[len(page)-1].User.ID
+	}
+}
+
+// discordIDForMatrixUser returns the Discord user ID of a ghost or a logged-in Matrix user.
+func (br *DiscordBridge) discordIDForMatrixUser(userID id.UserID) string {
+	if discordID, ok := br.ParsePuppetMXID(userID); ok {
+		return discordID
+	} else if user := br.GetCachedUserByMXID(userID); user != nil {
+		return user.DiscordID
+	}
+	return ""
+}
+
+// matrixUsersForDiscordUser returns the ghost of a Discord user, and their Matrix account if they use the bridge.
+// Puppets aren't created for unknown users, so that importing large ban lists doesn't fill the database.
+func (br *DiscordBridge) matrixUsersForDiscordUser(discordID string) []id.UserID {
+	userIDs := []id.UserID{br.FormatPuppetMXID(discordID)}
+	if puppet := br.DB.Puppet.Get(discordID); puppet != nil && puppet.CustomMXID != "" {
+		userIDs = append(userIDs, puppet.CustomMXID)
+	}
+	if user := br.GetCachedUserByID(discordID); user != nil && !slices.Contains(userIDs, user.MXID) {
+		userIDs = append(userIDs, user.MXID)
+	}
+	return userIDs
+}
+
+// banDiscordUserOnMatrix bans the Matrix accounts of a Discord user in the portal and returns the number of new bans.
+func (portal *Portal) banDiscordUserOnMatrix(discordID, reason string) int {
+	if portal.MXID == "" {
+		return 0
+	}
+	banned := 0
+	for _, userID := range portal.bridge.matrixUsersForDiscordUser(discordID) {
+		if portal.bridge.StateStore.GetMembership(portal.MXID, userID) == event.MembershipBan {
+			continue
+		}
+		_, err := portal.MainIntent().BanUser(portal.MXID, &mautrix.ReqBanUser{UserID: userID, Reason: reason})
+		if err != nil {
+			portal.log.Warn().Err(err).Str("user_id", userID.String()).Msg("Failed to ban user synced from Discord")
+		} else {
+			banned++
+		}
+	}
+	return banned
+}
+
+// unbanDiscordUserOnMatrix unbans the Matrix accounts of a Discord user in the portal.
+func (portal *Portal) unbanDiscordUserOnMatrix(discordID string) {
+	if portal.MXID == "" {
+		return
+	}
+	for _, userID := range portal.bridge.matrixUsersForDiscordUser(discordID) {
+		if portal.bridge.StateStore.GetMembership(portal.MXID, userID) != event.MembershipBan {
+			continue
+		}
+		_, err := portal.MainIntent().UnbanUser(portal.MXID, &mautrix.ReqUnbanUser{UserID: userID})
+		if err != nil {
+			portal.log.Warn().Err(err).Str("user_id", userID.String()).Msg("Failed to unban user synced from Discord")
+		}
+	}
+}
+
+// syncDiscordBan applies a Discord guild ban or unban to all portals of the guild. Every logged-in user with
+// the Ban Members permission receives the same event, so users who are already banned are skipped.
+func (br *DiscordBridge) syncDiscordBan(guildID string, target *discordgo.User, reason string, banned bool) {
+	if !br.Config.Bridge.BanSync || target == nil || br.GetGuildByID(guildID, false) == nil {
+		return
+	}
+	for _, portal := range br.GetAllPortalsInGuild(guildID) {
+		if banned {
+			portal.banDiscordUserOnMatrix(target.ID, reason)
+		} else {
+			portal.unbanDiscordUserOnMatrix(target.ID)
+		}
+	}
+}
+
+func (user *User) guildBanAddHandler(evt *discordgo.GuildBanAdd) {
+	if !user.bridge.Config.Bridge.BanSync {
+		return
+	}
+	reason := "Banned on Discord"
+	if ban, err := user.Session.GuildBan(evt.GuildID, evt.User.ID); err == nil && ban.Reason != "" {
+		reason = ban.Reason
+	}
+	user.bridge.syncDiscordBan(evt.GuildID, evt.User, reason, true)
+}
+
+func (user *User) guildBanRemoveHandler(evt *discordgo.GuildBanRemove) {
+	user.bridge.syncDiscordBan(evt.GuildID, evt.User, "", false)
+}
+
+// handleMatrixBan bans or unbans Discord users in the guild when they're banned or unbanned in a guild portal.
+// The ban is made with the Discord account of the Matrix user, so they need the Ban Members permission on Discord.
+func (br *DiscordBridge) handleMatrixBan(evt *event.Event) {
+	if !br.Config.Bridge.BanSync || evt.Sender == br.Bot.UserID || br.IsGhost(evt.Sender) {
+		return
+	}
+	content := evt.Content.AsMember()
+	prevMembership := getPrevMembership(evt)
+	isBan := content.Membership == event.MembershipBan && prevMembership != event.MembershipBan
+	isUnban := content.Membership == event.MembershipLeave && prevMembership == event.MembershipBan
+	if !isBan && !isUnban {
+		return
+	}
+	portal := br.GetPortalByMXID(evt.RoomID)
+	if portal == nil || portal.GuildID == "" {
+		return
+	}
+	discordID := br.discordIDForMatrixUser(id.UserID(evt.GetStateKey()))
+	if discordID == "" {
+		return
+	}
+	log := portal.log.With().
+		Str("action", "sync matrix ban").
+		Str("sender", evt.Sender.String()).
+		Str("target_discord_id", discordID).
+		Bool("unban", isUnban).
+		Logger()
+	sender := br.GetUserByMXID(evt.Sender)
+	if sender == nil || sender.Session == nil {
+		log.Debug().Msg("Not syncing ban from user who isn't logged in")
+		return
+	}
+	var err error
+	if isBan {
+		err = sender.Session.GuildBanCreateWithReason(portal.GuildID, discordID, content.Reason, 0)
+	} else {
+		err = sender.Session.GuildBanDelete(portal.GuildID, discordID)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to sync Matrix ban to Discord")
+	} else {
+		log.Debug().Msg("Synced Matrix ban to Discord")
+	}
+}
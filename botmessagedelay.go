@@ -0,0 +1,101 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// delayBotMessage holds back new messages from bots for the configured delay, so that messages which the bot
+// deletes right away (e.g. command confirmations) never show up on Matrix. Edits and deletions of held messages
+// are applied to the held message. Returns true if the event was consumed.
+func (portal *Portal) delayBotMessage(msg portalDiscordMessage) bool {
+	delay := time.Duration(portal.bridge.Config.Bridge.BotMessageDelay) * time.Second
+	if delay <= 0 || msg.delayed {
+		return false
+	}
+	portal.delayedBotMessagesLock.Lock()
+	defer portal.delayedBotMessagesLock.Unlock()
+	switch evt := msg.msg.(type) {
+	case *discordgo.MessageCreate:
+		if evt.Author == nil || !evt.Author.Bot || msg.receivedAt.IsZero() {
+			return false
+		}
+		if portal.delayedBotMessages == nil {
+			portal.delayedBotMessages = make(map[string]*portalDiscordMessage)
+		}
+		portal.delayedBotMessages[evt.ID] = &msg
+		time.AfterFunc(delay, func() {
+			portal.releaseBotMessage(evt.ID)
+		})
+		return true
+	case *discordgo.MessageUpdate:
+		held, ok := portal.delayedBotMessages[evt.ID]
+		if !ok {
+			return false
+		}
+		heldMsg := held.msg.(*discordgo.MessageCreate).Message
+		// Edits don't always include all fields, so only copy the ones that are present
+		if evt.Author != nil {
+			held.msg = &discordgo.MessageCreate{Message: evt.Message}
+		} else {
+			if evt.Content != "" {
+				heldMsg.Content = evt.Content
+			}
+			if evt.Embeds != nil {
+				heldMsg.Embeds = evt.Embeds
+			}
+			if evt.Components != nil {
+				heldMsg.Components = evt.Components
+			}
+		}
+		return true
+	case *discordgo.MessageDelete:
+		if _, ok := portal.delayedBotMessages[evt.ID]; !ok {
+			return false
+		}
+		portal.log.Debug().Str("message_id", evt.ID).Msg("Dropping bot message that was deleted within the delay")
+		delete(portal.delayedBotMessages, evt.ID)
+		return true
+	case *discordgo.MessageDeleteBulk:
+		remaining := evt.Messages[:0]
+		for _, msgID := range evt.Messages {
+			if _, ok := portal.delayedBotMessages[msgID]; ok {
+				delete(portal.delayedBotMessages, msgID)
+			} else {
+				remaining = append(remaining, msgID)
+			}
+		}
+		evt.Messages = remaining
+		return len(remaining) == 0
+	}
+	return false
+}
+
+// releaseBotMessage passes a held bot message back to the portal's event loop once its delay has passed.
+func (portal *Portal) releaseBotMessage(msgID string) {
+	portal.delayedBotMessagesLock.Lock()
+	held, ok := portal.delayedBotMessages[msgID]
+	delete(portal.delayedBotMessages, msgID)
+	portal.delayedBotMessagesLock.Unlock()
+	if ok {
+		held.delayed = true
+		held.user.sendPortalMessage(portal, *held, "delayed bot message")
+	}
+}
@@ -0,0 +1,53 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/config"
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// newTestBridge creates a bridge with an in-memory SQLite database that has the latest schema.
+func newTestBridge(t *testing.T) *DiscordBridge {
+	baseDB, err := dbutil.NewWithDialect(":memory:", "sqlite3")
+	require.NoError(t, err)
+	// Every connection to :memory: is a separate database
+	baseDB.RawDB.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		_ = baseDB.Close()
+	})
+	br := &DiscordBridge{
+		Config:       &config.Config{},
+		guildsByID:   make(map[string]*Guild),
+		guildsByMXID: make(map[id.RoomID]*Guild),
+	}
+	br.Bridge.DB = baseDB
+	log := zerolog.Nop()
+	br.ZLog = &log
+	br.Log = maulogger.DefaultLogger
+	br.DB = database.New(baseDB, br.Log.Sub("Database"))
+	require.NoError(t, br.DB.Upgrade())
+	return br
+}
@@ -0,0 +1,186 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/random"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+const (
+	cacheInvalidationPortal = "portal"
+	cacheInvalidationPuppet = "puppet"
+)
+
+// cacheInvalidation is sent with NOTIFY when a portal or puppet is updated.
+type cacheInvalidation struct {
+	// Origin is a random ID of the process that sent the notification, used to ignore our own notifications.
+	Origin string `json:"origin"`
+	Type   string `json:"type"`
+
+	ChannelID string `json:"channel_id,omitempty"`
+	Receiver  string `json:"receiver,omitempty"`
+	PuppetID  string `json:"puppet_id,omitempty"`
+}
+
+// startCacheInvalidation uses Postgres LISTEN/NOTIFY to invalidate cached portals and puppets
+// when another bridge process using the same database updates them.
+func (br *DiscordBridge) startCacheInvalidation() {
+	cfg := &br.Config.Bridge.CacheInvalidation
+	if !cfg.Enabled {
+		return
+	} else if br.DB.Dialect != dbutil.Postgres {
+		br.ZLog.Warn().Msg("Cache invalidation is only supported with Postgres")
+		return
+	}
+	log := br.componentLog("cache invalidation")
+	origin := random.String(16)
+	listener := pq.NewListener(br.Config.AppService.Database.URI, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventConnectionAttemptFailed, pq.ListenerEventDisconnected:
+			log.Warn().Err(err).Msg("Cache invalidation listener disconnected")
+		case pq.ListenerEventReconnected:
+			log.Info().Msg("Cache invalidation listener reconnected")
+		}
+	})
+	err := listener.Listen(cfg.Channel)
+	if err != nil {
+		log.Err(err).Str("channel", cfg.Channel).Msg("Failed to listen for cache invalidations")
+		_ = listener.Close()
+		return
+	}
+	notify := func(inv cacheInvalidation) {
+		inv.Origin = origin
+		payload, err := json.Marshal(&inv)
+		if err != nil {
+			return
+		}
+		_, err = br.DB.Exec("SELECT pg_notify($1, $2)", cfg.Channel, string(payload))
+		if err != nil {
+			log.Warn().Err(err).Str("type", inv.Type).Msg("Failed to send cache invalidation")
+		}
+	}
+	br.DB.OnPortalUpdated = func(key database.PortalKey) {
+		notify(cacheInvalidation{Type: cacheInvalidationPortal, ChannelID: key.ChannelID, Receiver: key.Receiver})
+	}
+	br.DB.OnPuppetUpdated = func(id string) {
+		notify(cacheInvalidation{Type: cacheInvalidationPuppet, PuppetID: id})
+	}
+	log.Info().Str("channel", cfg.Channel).Msg("Listening for cache invalidations")
+	go br.handleCacheInvalidations(listener, origin)
+}
+
+func (br *DiscordBridge) handleCacheInvalidations(listener *pq.Listener, origin string) {
+	log := br.componentLog("cache invalidation")
+	for n := range listener.Notify {
+		if n == nil {
+			// The connection was re-established, so notifications may have been missed
+			continue
+		}
+		var inv cacheInvalidation
+		err := json.Unmarshal([]byte(n.Extra), &inv)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to parse cache invalidation")
+			continue
+		} else if inv.Origin == origin {
+			continue
+		}
+		switch inv.Type {
+		case cacheInvalidationPortal:
+			br.reloadCachedPortal(database.NewPortalKey(inv.ChannelID, inv.Receiver))
+		case cacheInvalidationPuppet:
+			br.reloadCachedPuppet(inv.PuppetID)
+		}
+	}
+}
+
+func (br *DiscordBridge) reloadCachedPortal(key database.PortalKey) {
+	br.portalsLock.Lock()
+	portal, ok := br.portalsByID[key]
+	br.portalsLock.Unlock()
+	if !ok {
+		return
+	}
+	// The fields are only replaced in the portal's event loop, so that they don't change while an event is being handled.
+	// If a reload is already queued, it will read the latest state too.
+	select {
+	case portal.cacheReloads <- struct{}{}:
+	default:
+	}
+}
+
+func (portal *Portal) reloadFromDB() {
+	dbPortal := portal.bridge.DB.Portal.GetByID(portal.Key)
+	if dbPortal == nil {
+		return
+	}
+	portal.PlainName = dbPortal.PlainName
+	portal.Name = dbPortal.Name
+	portal.NameSet = dbPortal.NameSet
+	portal.FriendNick = dbPortal.FriendNick
+	portal.Topic = dbPortal.Topic
+	portal.TopicSet = dbPortal.TopicSet
+	portal.Avatar = dbPortal.Avatar
+	portal.AvatarURL = dbPortal.AvatarURL
+	portal.AvatarSet = dbPortal.AvatarSet
+	portal.RelayWebhookID = dbPortal.RelayWebhookID
+	portal.RelayWebhookSecret = dbPortal.RelayWebhookSecret
+	portal.RelayRosterMessageID = dbPortal.RelayRosterMessageID
+	portal.RelayBotMXID = dbPortal.RelayBotMXID
+	portal.LargeVideoPreviews = dbPortal.LargeVideoPreviews
+	portal.RelayApproval = dbPortal.RelayApproval
+	portal.MaxMessageAge = dbPortal.MaxMessageAge
+	portal.SkippedUntil = dbPortal.SkippedUntil
+	portal.RelayMinLevel = dbPortal.RelayMinLevel
+	portal.NameOverride = dbPortal.NameOverride
+	portal.TopicOverride = dbPortal.TopicOverride
+	portal.AvatarOverride = dbPortal.AvatarOverride
+	portal.PausedToMatrix.Store(dbPortal.PausedToMatrix.Load())
+	portal.PausedToDiscord.Store(dbPortal.PausedToDiscord.Load())
+	portal.log.Debug().Msg("Reloaded portal info after cache invalidation")
+}
+
+func (br *DiscordBridge) reloadCachedPuppet(id string) {
+	br.puppetsLock.Lock()
+	puppet, ok := br.puppets[id]
+	br.puppetsLock.Unlock()
+	if !ok {
+		return
+	}
+	dbPuppet := br.DB.Puppet.Get(id)
+	if dbPuppet == nil {
+		return
+	}
+	puppet.syncLock.Lock()
+	defer puppet.syncLock.Unlock()
+	puppet.Name = dbPuppet.Name
+	puppet.NameSet = dbPuppet.NameSet
+	puppet.Avatar = dbPuppet.Avatar
+	puppet.AvatarURL = dbPuppet.AvatarURL
+	puppet.AvatarSet = dbPuppet.AvatarSet
+	puppet.ContactInfoSet = dbPuppet.ContactInfoSet
+	puppet.GlobalName = dbPuppet.GlobalName
+	puppet.Username = dbPuppet.Username
+	puppet.Discriminator = dbPuppet.Discriminator
+	puppet.log.Debug().Msg("Reloaded puppet info after cache invalidation")
+}
@@ -0,0 +1,183 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	capabilityGateway      = "gateway"
+	capabilityCurrentUser  = "current_user"
+	capabilityUserSettings = "user_settings"
+	capabilitySoundboard   = "default_soundboard_sounds"
+
+	adminAlertCapability = "capability_"
+
+	// discordErrorInvalidAPIVersion is the JSON error code Discord returns when the requested API version was removed.
+	discordErrorInvalidAPIVersion = 50041
+)
+
+// errCapabilityUnavailable is returned instead of calling endpoints that the last capability probe found to be gone.
+var errCapabilityUnavailable = errors.New("endpoint is unavailable on Discord")
+
+// capabilityProbe is a cheap request to an endpoint that the bridge depends on,
+// used to notice Discord deprecating or removing it before handlers start failing.
+type capabilityProbe struct {
+	name     string
+	endpoint string
+	// degrades describes what stops working without the endpoint, for the admin alert.
+	degrades string
+	// restore is called when a previously unavailable endpoint works again.
+	restore func(br *DiscordBridge)
+}
+
+var capabilityProbes = []capabilityProbe{{
+	name:     capabilityGateway,
+	endpoint: discordgo.EndpointGateway,
+	degrades: fmt.Sprintf("Discord no longer accepts API v%s, so logins and reconnections will fail until the bridge is updated", discordgo.APIVersion),
+}, {
+	name:     capabilityCurrentUser,
+	endpoint: discordgo.EndpointUser("@me"),
+	degrades: "user info can't be fetched, so logins and profile syncing may fail",
+}, {
+	name:     capabilityUserSettings,
+	endpoint: discordgo.EndpointUserSettings("@me"),
+	degrades: "guild folder spaces and folder room tags are disabled",
+	restore: func(br *DiscordBridge) {
+		for _, user := range br.getAllUsersWithToken() {
+			if user.Connected() {
+				go user.syncGuildFolderSpaces()
+				go user.syncRoomTags()
+			}
+		}
+	},
+}, {
+	name:     capabilitySoundboard,
+	endpoint: discordgo.EndpointAPI + "soundboard-default-sounds",
+	degrades: "default soundboard sounds are bridged without names",
+}}
+
+// discordCapabilities stores which probed endpoints were found to be unavailable.
+type discordCapabilities struct {
+	unavailable  map[string]error
+	lock         sync.RWMutex
+	startupProbe sync.Once
+}
+
+// hasCapability returns false if the last probe found the endpoint behind the capability to be gone.
+// Capabilities that haven't been probed yet are assumed to work.
+func (br *DiscordBridge) hasCapability(name string) bool {
+	br.capabilities.lock.RLock()
+	defer br.capabilities.lock.RUnlock()
+	_, unavailable := br.capabilities.unavailable[name]
+	return !unavailable
+}
+
+// isDeprecationError checks if a probe error means that the endpoint or API version is gone,
+// rather than a temporary failure like a rate limit or a server error.
+func isDeprecationError(err error) bool {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) || restErr.Response == nil {
+		return false
+	}
+	switch restErr.Response.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return true
+	case http.StatusBadRequest:
+		return restErr.Message != nil && restErr.Message.Code == discordErrorInvalidAPIVersion
+	default:
+		return false
+	}
+}
+
+// probeCapabilities requests each probed endpoint with the given user's session and updates the capability state.
+// Newly unavailable endpoints are reported in the admin alert room, and features are restored when they come back.
+func (br *DiscordBridge) probeCapabilities(user *User) {
+	log := br.ZLog.With().Str("action", "probe discord capabilities").Str("user_id", user.MXID.String()).Logger()
+	for _, probe := range capabilityProbes {
+		_, err := user.Session.RequestWithBucketID(http.MethodGet, probe.endpoint, nil, probe.endpoint)
+		if err != nil && !isDeprecationError(err) {
+			// Temporary failures don't tell us anything, so keep the previous state
+			log.Debug().Err(err).Str("capability", probe.name).Msg("Capability probe failed")
+			continue
+		}
+		br.capabilities.lock.Lock()
+		prevErr, wasUnavailable := br.capabilities.unavailable[probe.name]
+		if err != nil {
+			if br.capabilities.unavailable == nil {
+				br.capabilities.unavailable = make(map[string]error)
+			}
+			br.capabilities.unavailable[probe.name] = err
+		} else {
+			delete(br.capabilities.unavailable, probe.name)
+		}
+		br.capabilities.lock.Unlock()
+		if err != nil && !wasUnavailable {
+			log.Warn().Err(err).Str("capability", probe.name).Msg("Discord endpoint is unavailable, degrading features")
+			br.sendAdminAlert(adminAlertCapability+probe.name, fmt.Sprintf(
+				"Discord endpoint %s is unavailable (%v): %s. The bridge may need to be updated.",
+				probe.endpoint, err, probe.degrades,
+			))
+		} else if err == nil && wasUnavailable {
+			log.Info().AnErr("previous_error", prevErr).Str("capability", probe.name).Msg("Discord endpoint is available again")
+			br.sendAdminAlert(adminAlertCapability+probe.name+"_restored", fmt.Sprintf(
+				"Discord endpoint %s works again, re-enabling the features that were degraded.", probe.endpoint,
+			))
+			if probe.restore != nil {
+				probe.restore(br)
+			}
+		}
+	}
+}
+
+// probeCapabilitiesOnStartup runs the first capability probe when a user-token session connects.
+func (user *User) probeCapabilitiesOnStartup() {
+	br := user.bridge
+	if !br.Config.Bridge.CapabilityProbes.Enabled || !user.Session.IsUser {
+		return
+	}
+	br.capabilities.startupProbe.Do(func() {
+		br.probeCapabilities(user)
+	})
+}
+
+// startCapabilityProbes periodically re-probes Discord endpoints, so that degraded features resume
+// once Discord (or a bridge update) makes the endpoints work again.
+func (br *DiscordBridge) startCapabilityProbes() {
+	cfg := &br.Config.Bridge.CapabilityProbes
+	if !cfg.Enabled || cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(cfg.Interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, user := range br.getAllUsersWithToken() {
+			// Bot tokens can't use the user-only endpoints, so only user sessions are used for probing
+			if user.Connected() && user.Session.IsUser {
+				br.probeCapabilities(user)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+func isChannelNameEmojiRune(r rune) bool {
+	switch {
+	case r >= 0x2500 && r <= 0x259F:
+		// Box drawing characters are commonly used as separators rather than as the icon
+		return false
+	case r == 0x200D, r == 0x20E3, r >= 0xFE00 && r <= 0xFE0F, r >= 0xE0020 && r <= 0xE007F:
+		// Zero-width joiners, keycaps, variation selectors and tags are parts of emoji sequences
+		return true
+	default:
+		return unicode.Is(unicode.So, r) || (r >= 0x1F3FB && r <= 0x1F3FF)
+	}
+}
+
+func isChannelNameSeparatorRune(r rune) bool {
+	return unicode.IsSpace(r) || unicode.IsPunct(r) || (r >= 0x2500 && r <= 0x259F) || r == '|' || r == '｜'
+}
+
+// splitChannelNameEmoji splits the emoji that Discord channel names are often prefixed with as an icon
+// (e.g. "📢・announcements") from the rest of the name. The separator after the emoji is removed too.
+// If the name doesn't start with an emoji or is only an emoji, the emoji is empty and the name is returned as-is.
+func splitChannelNameEmoji(name string) (emoji, rest string) {
+	end := strings.IndexFunc(name, func(r rune) bool {
+		return !isChannelNameEmojiRune(r)
+	})
+	if end <= 0 {
+		return "", name
+	}
+	rest = strings.TrimLeftFunc(name[end:], isChannelNameSeparatorRune)
+	if rest == "" {
+		return "", name
+	}
+	return name[:end], rest
+}
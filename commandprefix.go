@@ -0,0 +1,91 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// aliasedCommandProcessor strips command prefix aliases before handling commands. The main prefix is
+// already stripped by mautrix-go, but in management rooms the whole message is passed through as-is.
+type aliasedCommandProcessor struct {
+	*commands.Processor
+	bridge *DiscordBridge
+}
+
+func (proc *aliasedCommandProcessor) Handle(roomID id.RoomID, eventID id.EventID, user bridge.User, message string, replyTo id.EventID) {
+	if trimmed, ok := proc.bridge.trimCommandPrefixAlias(message); ok {
+		message = trimmed
+	}
+	proc.Processor.Handle(roomID, eventID, user, message, replyTo)
+}
+
+// trimCommandPrefixAlias checks if the message starts with one of the configured command prefix aliases.
+// The alias must be followed by whitespace or the end of the message, so that e.g. `!dcx` isn't treated as `!dc x`.
+func (br *DiscordBridge) trimCommandPrefixAlias(message string) (string, bool) {
+	for _, alias := range br.Config.Bridge.CommandPrefixAliases {
+		if alias == "" || !strings.HasPrefix(message, alias) {
+			continue
+		}
+		rest := message[len(alias):]
+		if rest == "" || rest[0] == ' ' || rest[0] == '\n' || rest[0] == '\t' {
+			return strings.TrimLeft(rest, " \n\t"), true
+		}
+	}
+	return message, false
+}
+
+// trimInteractionPrefix checks if the message starts with the inline bot command prefix, and converts it into
+// an exec command. The command name must directly follow the prefix, so that e.g. `// comment` isn't a command.
+func (br *DiscordBridge) trimInteractionPrefix(message string) (string, bool) {
+	prefix := br.Config.Bridge.InteractionPrefix
+	if prefix == "" || !strings.HasPrefix(message, prefix) {
+		return message, false
+	}
+	rest := message[len(prefix):]
+	if rest == "" || rest[0] == ' ' || rest[0] == '\n' || rest[0] == '\t' {
+		return message, false
+	}
+	return "exec " + rest, true
+}
+
+// handleAliasedCommand passes messages in portal rooms that start with a command prefix alias to the command
+// processor instead of bridging them. Returns true if the message was handled as a command.
+func (portal *Portal) handleAliasedCommand(user bridge.User, evt *event.Event) bool {
+	if evt.Type != event.EventMessage || user.GetPermissionLevel() < bridgeconfig.PermissionLevelUser {
+		return false
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok || content.MsgType != event.MsgText || content.GetRelatesTo().GetReplaceID() != "" {
+		return false
+	}
+	command, ok := portal.bridge.trimCommandPrefixAlias(content.Body)
+	if !ok {
+		command, ok = portal.bridge.trimInteractionPrefix(content.Body)
+	}
+	if !ok {
+		return false
+	}
+	go portal.bridge.CommandProcessor.Handle(evt.RoomID, evt.ID, user, command, content.RelatesTo.GetReplyTo())
+	return true
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"html"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -51,23 +52,62 @@ type WrappedCommandEvent struct {
 var HelpSectionPortalManagement = commands.HelpSection{Name: "Portal management", Order: 20}
 
 func (br *DiscordBridge) RegisterCommands() {
-	proc := br.CommandProcessor.(*commands.Processor)
+	proc := br.CommandProcessor.(*aliasedCommandProcessor).Processor
 	proc.AddHandlers(
 		cmdLoginToken,
 		cmdLoginQR,
 		cmdLogout,
+		cmdConfirmAccountSwitch,
+		cmdPurgeMyData,
 		cmdPing,
 		cmdReconnect,
 		cmdDisconnect,
 		cmdBridge,
+		cmdPlumbingRequest,
 		cmdUnbridge,
 		cmdDeletePortal,
 		cmdCreatePortal,
+		cmdCreateChannel,
 		cmdSetRelay,
 		cmdUnsetRelay,
+		cmdRelayApproval,
+		cmdRelayApprove,
+		cmdRelayDeny,
+		cmdRelayLevel,
+		cmdIgnoreBot,
+		cmdUnignoreBot,
+		cmdGuildBans,
+		cmdFillGap,
+		cmdBackfill,
+		cmdVideoPreviews,
+		cmdMaxMessageAge,
+		cmdRenameThread,
+		cmdPostTags,
+		cmdPin,
+		cmdSetTopic,
+		cmdRoomTheme,
+		cmdPause,
+		cmdResume,
+		cmdKeywords,
+		cmdDMInvites,
+		cmdWhois,
+		cmdID,
+		cmdLink,
+		cmdAway,
+		cmdStatus,
+		cmdNowPlaying,
+		cmdTimezone,
+		cmdFolderSpaces,
+		cmdDoublePuppetScope,
+		cmdOwnMessages,
+		cmdUnreads,
 		cmdGuilds,
 		cmdRejoinSpace,
 		cmdDeleteAllPortals,
+		cmdMigrateDirectMedia,
+		cmdSnapshot,
+		cmdRecordEvents,
+		cmdAdmin,
 		cmdExec,
 		cmdCommands,
 	)
@@ -97,6 +137,21 @@ var cmdLoginToken = &commands.FullHandler{
 
 const discordTokenEpoch = 1293840000
 
+// authorizationForToken adds the prefix for the given token type to a token.
+func authorizationForToken(tokenType, token string) (string, bool) {
+	switch strings.ToLower(tokenType) {
+	case "user":
+		// Token is used as-is
+		return token, true
+	case "bot":
+		return "Bot " + token, true
+	case "oauth":
+		return "Bearer " + token, true
+	default:
+		return "", false
+	}
+}
+
 func decodeToken(token string) (userID int64, err error) {
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
@@ -144,14 +199,8 @@ func fnLoginToken(ce *WrappedCommandEvent) {
 		ce.Reply("Invalid token")
 		return
 	}
-	switch strings.ToLower(ce.Args[0]) {
-	case "user":
-		// Token is used as-is
-	case "bot":
-		token = "Bot " + token
-	case "oauth":
-		token = "Bearer " + token
-	default:
+	token, ok := authorizationForToken(ce.Args[0], token)
+	if !ok {
 		ce.Reply("Token type must be `user`, `bot` or `oauth`")
 		return
 	}
@@ -393,8 +442,8 @@ var cmdSetRelay = &commands.FullHandler{
 	Name: "set-relay",
 	Help: commands.HelpMeta{
 		Section:     HelpSectionPortalManagement,
-		Description: "Create or set a relay webhook for a portal",
-		Args:        "[room ID] <​--url URL> OR <​--create [name]>",
+		Description: "Create or set a relay webhook for a portal, or relay through your Discord bot account",
+		Args:        "[room ID] <​--url URL> OR <​--create [name]> OR <​--bot>",
 	},
 	RequiresLogin:      true,
 	RequiresEventLevel: roomModerator,
@@ -402,7 +451,7 @@ var cmdSetRelay = &commands.FullHandler{
 
 const webhookURLFormat = "https://discord.com/api/webhooks/%d/%s"
 
-const selectRelayHelp = "Usage: `$cmdprefix [room ID] <​--url URL> OR <​--create [name]>`"
+const selectRelayHelp = "Usage: `$cmdprefix [room ID] <​--url URL> OR <​--create [name]> OR <​--bot>`"
 
 func fnSetRelay(ce *WrappedCommandEvent) {
 	portal := ce.Portal
@@ -469,14 +518,7 @@ func fnSetRelay(ce *WrappedCommandEvent) {
 			return
 		}
 	case "create":
-		perms, err := ce.User.Session.UserChannelPermissions(ce.User.DiscordID, portal.Key.ChannelID, portal.RefererOptIfUser(ce.User.Session, "")...)
-		if err != nil {
-			log.Warn().Err(err).Msg("Failed to check user permissions")
-			ce.Reply("Failed to check if you have permission to create webhooks")
-			return
-		} else if perms&discordgo.PermissionManageWebhooks == 0 {
-			log.Debug().Int64("perms", perms).Msg("User doesn't have permissions to manage webhooks in channel")
-			ce.Reply("You don't have permission to manage webhooks in that channel")
+		if !replyPermissionCheck(ce, ce.User.checkChannelPermission(portal.Key.ChannelID, discordgo.PermissionManageWebhooks)) {
 			return
 		}
 		name := "mautrix"
@@ -484,12 +526,26 @@ func fnSetRelay(ce *WrappedCommandEvent) {
 			name = strings.Join(ce.Args[1:], " ")
 		}
 		log.Debug().Str("webhook_name", name).Msg("Creating webhook")
+		var err error
 		webhookMeta, err = ce.User.Session.WebhookCreate(portal.Key.ChannelID, name, "", portal.RefererOptIfUser(ce.User.Session, "")...)
 		if err != nil {
 			log.Warn().Err(err).Msg("Failed to create webhook")
 			ce.Reply("Failed to create webhook: %v", err)
 			return
 		}
+	case "bot":
+		// The bot's owner setting it up themselves is what allows the bridge to relay other users' messages through it
+		if ce.User.Session.IsUser {
+			ce.Reply("Only bot accounts can be used for relaying")
+		} else if _, err := ce.User.Session.State.Guild(portal.GuildID); err != nil {
+			ce.Reply("Your bot account isn't in the server of that channel")
+		} else {
+			log.Debug().Msg("Setting portal relay bot")
+			portal.RelayBotMXID = ce.User.MXID
+			portal.Update()
+			ce.Reply("Messages from Matrix users who aren't logged in will now be relayed through your bot account")
+		}
+		return
 	default:
 		ce.Reply(selectRelayHelp)
 		return
@@ -505,8 +561,10 @@ func fnSetRelay(ce *WrappedCommandEvent) {
 	log.Debug().Str("webhook_id", webhookMeta.ID).Msg("Setting portal relay webhook")
 	portal.RelayWebhookID = webhookMeta.ID
 	portal.RelayWebhookSecret = webhookMeta.Token
+	portal.RelayRosterMessageID = ""
 	portal.Update()
 	ce.Reply("Saved webhook %s (%s) as portal relay webhook", webhookMeta.Name, portal.RelayWebhookID)
+	go portal.updateRelayRoster()
 }
 
 var cmdUnsetRelay = &commands.FullHandler{
@@ -514,7 +572,7 @@ var cmdUnsetRelay = &commands.FullHandler{
 	Name: "unset-relay",
 	Help: commands.HelpMeta{
 		Section:     HelpSectionPortalManagement,
-		Description: "Disable the relay webhook and optionally delete it on Discord",
+		Description: "Disable the relay webhook or bot, and optionally delete the webhook on Discord",
 		Args:        "[--delete]",
 	},
 	RequiresPortal:     true,
@@ -522,8 +580,13 @@ var cmdUnsetRelay = &commands.FullHandler{
 }
 
 func fnUnsetRelay(ce *WrappedCommandEvent) {
-	if ce.Portal.RelayWebhookID == "" {
-		ce.Reply("This portal doesn't have a relay webhook")
+	if ce.Portal.RelayWebhookID == "" && ce.Portal.RelayBotMXID == "" {
+		ce.Reply("This portal doesn't have a relay webhook or bot")
+		return
+	} else if ce.Portal.RelayWebhookID == "" {
+		ce.Portal.RelayBotMXID = ""
+		ce.Portal.Update()
+		ce.Reply("Relay bot disabled")
 		return
 	}
 	if len(ce.Args) > 0 && ce.Args[0] == "--delete" {
@@ -531,15 +594,478 @@ func fnUnsetRelay(ce *WrappedCommandEvent) {
 		if err != nil {
 			ce.Reply("Failed to delete webhook: %v", err)
 			return
+		} else if ce.Portal.RelayBotMXID != "" {
+			ce.Reply("Successfully deleted webhook and disabled relay bot")
 		} else {
 			ce.Reply("Successfully deleted webhook")
 		}
+	} else if ce.Portal.RelayBotMXID != "" {
+		ce.Reply("Relay webhook and bot disabled")
 	} else {
 		ce.Reply("Relay webhook disabled")
 	}
 	ce.Portal.RelayWebhookID = ""
 	ce.Portal.RelayWebhookSecret = ""
+	ce.Portal.RelayRosterMessageID = ""
+	// Otherwise messages would silently fall back to the relay bot
+	ce.Portal.RelayBotMXID = ""
+	ce.Portal.Update()
+}
+
+var cmdFillGap = &commands.FullHandler{
+	Func: wrapCommand(fnFillGap),
+	Name: "fill-gap",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Backfill all messages between the newest bridged message and the current Discord history",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnFillGap(ce *WrappedCommandEvent) {
+	if ce.User.Session == nil || !ce.User.Connected() {
+		ce.Reply("You must be connected to Discord to fill gaps")
+		return
+	}
+	ce.Reply("Checking for missed messages...")
+	filled, err := ce.Portal.FillGap(ce.User)
+	if errors.Is(err, errNoBridgedMessages) {
+		ce.Reply("There are no bridged messages in this room, so the gap can't be detected")
+	} else if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to fill gap")
+		ce.Reply("Failed to fill gap: %v", err)
+	} else if !filled {
+		ce.Reply("No missed messages found")
+	} else {
+		ce.Reply("Successfully filled gap")
+	}
+}
+
+var cmdVideoPreviews = &commands.FullHandler{
+	Func: wrapCommand(fnVideoPreviews),
+	Name: "video-previews",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Choose whether videos too large to reupload are bridged as a thumbnail and link in this room.",
+		Args:        "[on|off|default]",
+	},
+	RequiresPortal:     true,
+	RequiresEventLevel: roomModerator,
+}
+
+func fnVideoPreviews(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		enabled := ce.Bridge.Config.Bridge.VideoEmbeds.LargeVideoPreviews
+		source := "bridge default"
+		if ce.Portal.LargeVideoPreviews != nil {
+			enabled = *ce.Portal.LargeVideoPreviews
+			source = "room override"
+		}
+		if enabled {
+			ce.Reply("Large video previews are enabled in this room (%s)", source)
+		} else {
+			ce.Reply("Large video previews are disabled in this room (%s)", source)
+		}
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "on", "true", "yes":
+		enabled := true
+		ce.Portal.LargeVideoPreviews = &enabled
+	case "off", "false", "no":
+		enabled := false
+		ce.Portal.LargeVideoPreviews = &enabled
+	case "default":
+		ce.Portal.LargeVideoPreviews = nil
+	default:
+		ce.Reply("**Usage:** `$cmdprefix video-previews [on|off|default]`")
+		return
+	}
 	ce.Portal.Update()
+	ce.Reply("Updated large video preview setting for this room")
+}
+
+var cmdBackfill = &commands.FullHandler{
+	Func: wrapCommand(fnBackfill),
+	Name: "backfill",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Backfill recent messages newer than the newest bridged message",
+		Args:        "<count>",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+const maxOnDemandBackfill = 1000
+
+func fnBackfill(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `$cmdprefix backfill <count>`")
+		return
+	}
+	count, err := strconv.Atoi(ce.Args[0])
+	if err != nil || count <= 0 || count > maxOnDemandBackfill {
+		ce.Reply("The message count must be a number between 1 and %d", maxOnDemandBackfill)
+		return
+	} else if ce.User.Session == nil || !ce.User.Connected() {
+		ce.Reply("You must be connected to Discord to backfill")
+		return
+	}
+	ce.Reply("Backfilling up to %d messages...", count)
+	ce.Portal.BackfillRecent(ce.User, count)
+	ce.Reply("Backfill finished")
+}
+
+var cmdRenameThread = &commands.FullHandler{
+	Func: wrapCommand(fnRenameThread),
+	Name: "rename-thread",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Rename a Discord thread. Reply to the thread root or a message in the thread when using this command.",
+		Args:        "<_name_>",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+// getReplyThread finds the thread that the message the command replied to is in.
+// If nil is returned, an error has already been sent as a reply.
+func getReplyThread(ce *WrappedCommandEvent) *Thread {
+	if ce.ReplyTo == "" {
+		ce.Reply("You must reply to the thread root or a message in the thread")
+		return nil
+	}
+	var thread *Thread
+	if msg := ce.Bridge.DB.Message.GetByMXID(ce.Portal.Key, ce.ReplyTo); msg != nil && msg.ThreadID != "" {
+		thread = ce.Bridge.GetThreadByID(msg.ThreadID, nil)
+	} else {
+		thread = ce.Bridge.GetThreadByRootOrCreationNoticeMXID(ce.ReplyTo)
+	}
+	if thread == nil {
+		ce.Reply("That message is not in a thread")
+	}
+	return thread
+}
+
+func fnRenameThread(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `$cmdprefix rename-thread <name>`")
+		return
+	}
+	thread := getReplyThread(ce)
+	if thread == nil {
+		return
+	}
+	name := ce.RawArgs
+	if len([]rune(name)) > discordMaxThreadNameLength {
+		ce.Reply("Thread names can be at most %d characters long", discordMaxThreadNameLength)
+		return
+	}
+	// Thread creators can always rename their own threads
+	if threadInfo, err := ce.User.Session.State.Channel(thread.ID); err != nil || threadInfo.OwnerID != ce.User.DiscordID {
+		if !replyPermissionCheck(ce, ce.User.checkChannelPermission(ce.Portal.Key.ChannelID, discordgo.PermissionManageThreads)) {
+			return
+		}
+	}
+	_, err := ce.User.Session.ChannelEditComplex(thread.ID, &discordgo.ChannelEdit{Name: name}, thread.RefererOpt())
+	if err != nil {
+		ce.ZLog.Err(err).Str("thread_id", thread.ID).Msg("Failed to rename thread")
+		ce.Reply("Failed to rename thread: %v", err)
+	} else {
+		ce.Reply("Renamed thread to %s", name)
+	}
+}
+
+var cmdIgnoreBot = &commands.FullHandler{
+	Func: wrapCommand(fnIgnoreBot),
+	Name: "ignore-bot",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Drop messages from a Discord bot, application or webhook in this portal, or list ignored bots",
+		Args:        "[--global] [_bot ID_]",
+	},
+	RequiresPortal:     true,
+	RequiresEventLevel: roomModerator,
+}
+
+var cmdUnignoreBot = &commands.FullHandler{
+	Func: wrapCommand(fnUnignoreBot),
+	Name: "unignore-bot",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Stop dropping messages from a Discord bot, application or webhook",
+		Args:        "[--global] <_bot ID_>",
+	},
+	RequiresPortal:     true,
+	RequiresEventLevel: roomModerator,
+}
+
+// parseIgnoreBotArgs parses the arguments of ignore-bot and unignore-bot, returning the bot ID and
+// the channel ID to apply the rule to. ok is false if a reply has already been sent.
+func parseIgnoreBotArgs(ce *WrappedCommandEvent) (botID, channelID string, ok bool) {
+	channelID = ce.Portal.Key.ChannelID
+	for _, arg := range ce.Args {
+		if arg == "--global" {
+			if ce.User.PermissionLevel < bridgeconfig.PermissionLevelAdmin {
+				ce.Reply("Only bridge admins can ignore bots globally")
+				return
+			}
+			channelID = ""
+		} else if _, err := strconv.ParseUint(arg, 10, 64); err != nil {
+			ce.Reply("%q is not a valid Discord ID", arg)
+			return
+		} else {
+			botID = arg
+		}
+	}
+	ok = true
+	return
+}
+
+func fnIgnoreBot(ce *WrappedCommandEvent) {
+	botID, channelID, ok := parseIgnoreBotArgs(ce)
+	if !ok {
+		return
+	} else if botID == "" {
+		bots := ce.Bridge.GetIgnoredBots(ce.Portal.Key.ChannelID)
+		if len(bots) == 0 {
+			ce.Reply("No bots are ignored in this portal")
+			return
+		}
+		lines := make([]string, len(bots))
+		for i, bot := range bots {
+			if bot.ChannelID == "" {
+				lines[i] = fmt.Sprintf("* `%s` (global)", bot.BotID)
+			} else {
+				lines[i] = fmt.Sprintf("* `%s`", bot.BotID)
+			}
+		}
+		slices.Sort(lines)
+		ce.Reply("Ignored bots in this portal:\n\n%s", strings.Join(lines, "\n"))
+		return
+	}
+	if ce.Bridge.SetBotIgnored(botID, channelID, true) {
+		ce.Reply("Messages from `%s` will now be ignored", botID)
+	} else {
+		ce.Reply("`%s` is already ignored", botID)
+	}
+}
+
+func fnUnignoreBot(ce *WrappedCommandEvent) {
+	botID, channelID, ok := parseIgnoreBotArgs(ce)
+	if !ok {
+		return
+	} else if botID == "" {
+		ce.Reply("**Usage:** `$cmdprefix unignore-bot [--global] <bot ID>`")
+		return
+	}
+	if ce.Bridge.SetBotIgnored(botID, channelID, false) {
+		ce.Reply("Messages from `%s` will no longer be ignored", botID)
+	} else {
+		ce.Reply("`%s` wasn't ignored", botID)
+	}
+}
+
+var cmdKeywords = &commands.FullHandler{
+	Func:    wrapCommand(fnKeywords),
+	Name:    "keywords",
+	Aliases: []string{"keyword", "highlights"},
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Manage keywords that ping you in the management room when they're mentioned in bridged Discord channels",
+		Args:        "[add|remove <_keyword_>]",
+	},
+	RequiresLogin: true,
+}
+
+func fnKeywords(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 || ce.Args[0] == "list" {
+		keywords := ce.User.GetKeywordList()
+		if len(keywords) == 0 {
+			ce.Reply("You don't have any keywords. Add one with `$cmdprefix keywords add <keyword>`")
+			return
+		}
+		slices.Sort(keywords)
+		ce.Reply("Your keywords:\n\n* `%s`", strings.Join(keywords, "`\n* `"))
+		return
+	}
+	keyword := strings.Join(ce.Args[1:], " ")
+	if keyword == "" {
+		ce.Reply("**Usage:** `$cmdprefix keywords [add|remove <keyword>]`")
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "add":
+		if ce.User.ManagementRoom == "" {
+			ce.Reply("You don't have a management room, keyword highlights would have nowhere to go")
+		} else if ce.User.SetKeyword(keyword, true) {
+			ce.Reply("Added keyword `%s`", keyword)
+		} else {
+			ce.Reply("You already have that keyword")
+		}
+	case "remove", "delete":
+		if ce.User.SetKeyword(keyword, false) {
+			ce.Reply("Removed keyword `%s`", keyword)
+		} else {
+			ce.Reply("You don't have that keyword")
+		}
+	default:
+		ce.Reply("**Usage:** `$cmdprefix keywords [add|remove <keyword>]`")
+	}
+}
+
+var cmdAway = &commands.FullHandler{
+	Func: wrapCommand(fnAway),
+	Name: "away",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Pause real-time bridging of guild channels and catch up when you return. DMs and mentions are still bridged.",
+		Args:        "[on|off]",
+	},
+	RequiresLogin: true,
+}
+
+func fnAway(ce *WrappedCommandEvent) {
+	away := !ce.User.Away
+	if len(ce.Args) > 0 {
+		switch strings.ToLower(ce.Args[0]) {
+		case "on", "true", "yes":
+			away = true
+		case "off", "false", "no":
+			away = false
+		default:
+			ce.Reply("**Usage:** `$cmdprefix away [on|off]`")
+			return
+		}
+	}
+	if away == ce.User.Away {
+		if away {
+			ce.Reply("You're already away")
+		} else {
+			ce.Reply("You're not away")
+		}
+		return
+	}
+	caughtUp := ce.User.SetAway(away)
+	if away {
+		ce.Reply("Away mode enabled. Messages in guild channels will be bridged when you return, except ones mentioning you.")
+	} else {
+		ce.Reply("Welcome back! Catching up on messages in %d channels", caughtUp)
+	}
+}
+
+var cmdFolderSpaces = &commands.FullHandler{
+	Func: wrapCommand(fnFolderSpaces),
+	Name: "folder-spaces",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Mirror your Discord guild folders as spaces inside your Discord space.",
+		Args:        "[on|off]",
+	},
+	RequiresLogin: true,
+}
+
+func fnFolderSpaces(ce *WrappedCommandEvent) {
+	if ce.User.Session == nil || !ce.User.Session.IsUser {
+		ce.Reply("Guild folders are only available when logged in as a user account")
+		return
+	}
+	enabled := !ce.User.FolderSpaces
+	if len(ce.Args) > 0 {
+		switch strings.ToLower(ce.Args[0]) {
+		case "on", "true", "yes":
+			enabled = true
+		case "off", "false", "no":
+			enabled = false
+		default:
+			ce.Reply("**Usage:** `$cmdprefix folder-spaces [on|off]`")
+			return
+		}
+	}
+	ce.User.SetFolderSpaces(enabled)
+	if enabled {
+		ce.Reply("Guild folders will now be mirrored as spaces")
+	} else {
+		ce.Reply("Guild folder spaces disabled, guild spaces will be moved back to your Discord space")
+	}
+}
+
+var cmdDoublePuppetScope = &commands.FullHandler{
+	Func: wrapCommand(fnDoublePuppetScope),
+	Name: "double-puppet-scope",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Choose whether your messages are sent with your Matrix account everywhere or only in DMs.",
+		Args:        "[dms|everywhere]",
+	},
+	RequiresLogin: true,
+}
+
+func fnDoublePuppetScope(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		if ce.User.DMOnlyDoublePuppet {
+			ce.Reply("Double puppeting is only used in DMs")
+		} else {
+			ce.Reply("Double puppeting is used everywhere")
+		}
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "dms", "dm":
+		ce.User.DMOnlyDoublePuppet = true
+	case "everywhere", "all":
+		ce.User.DMOnlyDoublePuppet = false
+	default:
+		ce.Reply("**Usage:** `$cmdprefix double-puppet-scope [dms|everywhere]`")
+		return
+	}
+	ce.User.Update()
+	if ce.User.DMOnlyDoublePuppet {
+		ce.Reply("Your messages in guild channels will now be sent by your Discord ghost user")
+	} else {
+		ce.Reply("Your messages will now be sent with your Matrix account everywhere")
+	}
+}
+
+var cmdUnreads = &commands.FullHandler{
+	Func: wrapCommand(fnUnreads),
+	Name: "unreads",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "List portals with messages you haven't read on Discord",
+	},
+	RequiresLogin: true,
+}
+
+const maxListedUnreads = 50
+
+func fnUnreads(ce *WrappedCommandEvent) {
+	unreads := ce.User.GetUnreadPortals()
+	if len(unreads) == 0 {
+		ce.Reply("No unread portals found")
+		return
+	}
+	serverName := ce.Bridge.Config.Homeserver.Domain
+	items := make([]string, 0, min(len(unreads), maxListedUnreads))
+	for _, unread := range unreads[:min(len(unreads), maxListedUnreads)] {
+		// Link to the last read message if it was bridged, so that the client jumps to the first unread message
+		link := unread.portal.MXID.URI(serverName).MatrixToURL()
+		if unread.lastRead != nil {
+			link = unread.portal.MXID.EventURI(unread.lastRead.MXID, serverName).MatrixToURL()
+		}
+		name := unread.portal.Name
+		if name == "" {
+			name = unread.portal.Key.ChannelID
+		}
+		items = append(items, fmt.Sprintf(`<li><a href="%s">%s</a></li>`, link, html.EscapeString(name)))
+	}
+	reply := fmt.Sprintf("<p>Portals with unread messages:</p><ul>%s</ul>", strings.Join(items, ""))
+	if len(unreads) > maxListedUnreads {
+		reply += fmt.Sprintf("<p>...and %d more</p>", len(unreads)-maxListedUnreads)
+	}
+	ce.ReplyAdvanced(reply, false, true)
 }
 
 var cmdGuilds = &commands.FullHandler{
@@ -549,7 +1075,7 @@ var cmdGuilds = &commands.FullHandler{
 	Help: commands.HelpMeta{
 		Section:     HelpSectionPortalManagement,
 		Description: "Guild bridging management",
-		Args:        "<status/bridge/unbridge/bridging-mode> [_guild ID_] [...]",
+		Args:        "<status/bridge/unbridge/bridging-mode/notices> [_guild ID_] [...]",
 	},
 	RequiresLogin: true,
 }
@@ -560,9 +1086,10 @@ const fullGuildsHelp = smallGuildsHelp + `
 
 * **help** - View this help message.
 * **status** - View the list of guilds and their bridging status.
-* **bridge <_guild ID_> [--entire]** - Enable bridging for a guild. The --entire flag auto-creates portals for all channels.
+* **bridge <_guild ID_> [--entire | --mode <_mode_>]** - Enable bridging for a guild. The --entire flag auto-creates portals for all channels, and is the same as ` + "`--mode everything`" + `.
 * **bridging-mode <_guild ID_> <_mode_>** - Set the mode for bridging messages and new channels in a guild.
-* **unbridge <_guild ID_>** - Unbridge a guild and delete all channel portal rooms.`
+* **unbridge <_guild ID_>** - Unbridge a guild and delete all channel portal rooms.
+* **notices <_guild ID_> [here/off]** - Report role, channel and emoji changes in a guild to the current room.`
 
 func fnGuilds(ce *WrappedCommandEvent) {
 	if len(ce.Args) == 0 {
@@ -580,6 +1107,8 @@ func fnGuilds(ce *WrappedCommandEvent) {
 		fnUnbridgeGuild(ce)
 	case "bridging-mode", "mode":
 		fnGuildBridgingMode(ce)
+	case "notices":
+		fnGuildNotices(ce)
 	case "help":
 		ce.Reply(fullGuildsHelp)
 	default:
@@ -607,13 +1136,42 @@ func fnListGuilds(ce *WrappedCommandEvent) {
 	}
 }
 
+const bridgeGuildUsage = "**Usage**: `$cmdprefix guilds bridge <guild ID> [--entire | --mode <mode>]`"
+
+// parseBridgeGuildFlags parses the flags of the bridge subcommand, defaulting to create-on-message.
+func parseBridgeGuildFlags(args []string) (database.GuildBridgingMode, bool) {
+	mode := database.GuildBridgeCreateOnMessage
+	for i := 0; i < len(args); i++ {
+		arg := strings.ToLower(args[i])
+		switch {
+		case arg == "--entire":
+			mode = database.GuildBridgeEverything
+		case arg == "--mode" && i+1 < len(args):
+			i++
+			mode = database.ParseGuildBridgingMode(args[i])
+		case strings.HasPrefix(arg, "--mode="):
+			mode = database.ParseGuildBridgingMode(strings.TrimPrefix(arg, "--mode="))
+		default:
+			return database.GuildBridgeInvalid, false
+		}
+	}
+	return mode, mode > database.GuildBridgeNothing
+}
+
 func fnBridgeGuild(ce *WrappedCommandEvent) {
-	if len(ce.Args) == 0 || len(ce.Args) > 2 {
-		ce.Reply("**Usage**: `$cmdprefix guilds bridge <guild ID> [--entire]")
-	} else if err := ce.User.bridgeGuild(ce.Args[0], len(ce.Args) == 2 && strings.ToLower(ce.Args[1]) == "--entire"); err != nil {
+	if len(ce.Args) == 0 {
+		ce.Reply(bridgeGuildUsage + "\n\n" + availableModes)
+		return
+	}
+	mode, ok := parseBridgeGuildFlags(ce.Args[1:])
+	if !ok {
+		ce.Reply(bridgeGuildUsage + "\n\n" + availableModes)
+	} else if err := ce.User.bridgeGuild(ce.Args[0], mode); errors.As(err, new(*DiscordPermissionError)) {
+		replyPermissionCheck(ce, err)
+	} else if err != nil {
 		ce.Reply("Error bridging guild: %v", err)
 	} else {
-		ce.Reply("Successfully bridged guild")
+		ce.Reply("Successfully bridged guild with mode %s", mode.Description())
 	}
 }
 
@@ -629,7 +1187,7 @@ func fnUnbridgeGuild(ce *WrappedCommandEvent) {
 
 const availableModes = "Available modes:\n" +
 	"* `nothing` to never bridge any messages (default when unbridged)\n" +
-	"* `if-portal-exists` to bridge messages in existing portals, but drop messages in unbridged channels\n" +
+	"* `if-portal-exists` (or `manual-only`) to bridge messages in existing portals, but drop messages in unbridged channels\n" +
 	"* `create-on-message` to bridge all messages and create portals if necessary on incoming messages (default after bridging)\n" +
 	"* `everything` to bridge all messages and create portals proactively on bridge startup (default if bridged with `--entire`)\n"
 
@@ -651,19 +1209,55 @@ func fnGuildBridgingMode(ce *WrappedCommandEvent) {
 	if mode == database.GuildBridgeInvalid {
 		ce.Reply("Invalid guild bridging mode `%s`", ce.Args[1])
 		return
+	} else if !replyPermissionCheck(ce, ce.User.checkGuildSettingPermission(guild.ID, discordgo.PermissionManageChannels)) {
+		return
 	}
 	guild.BridgingMode = mode
 	guild.Update()
 	ce.Reply("Set guild bridging mode to %s", mode.Description())
 }
 
+func fnGuildNotices(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 || len(ce.Args) > 2 {
+		ce.Reply("**Usage**: `$cmdprefix guilds notices <guild ID> [here/off]`")
+		return
+	}
+	guild := ce.Bridge.GetGuildByID(ce.Args[0], false)
+	if guild == nil || !ce.User.IsInPortal(guild.ID) {
+		ce.Reply("Guild not found")
+		return
+	}
+	if len(ce.Args) == 1 {
+		if guild.NoticeRoom == "" {
+			ce.Reply("%s (%s) doesn't have an admin notice room", guild.PlainName, guild.ID)
+		} else {
+			ce.Reply("Admin notices for %s (%s) are sent to %s", guild.PlainName, guild.ID, guild.NoticeRoom)
+		}
+		return
+	} else if !replyPermissionCheck(ce, ce.User.checkGuildSettingPermission(guild.ID, discordgo.PermissionManageServer)) {
+		return
+	}
+	switch strings.ToLower(ce.Args[1]) {
+	case "here":
+		guild.NoticeRoom = ce.RoomID
+		guild.Update()
+		ce.Reply("Role, channel and emoji changes in %s will now be reported in this room", guild.PlainName)
+	case "off":
+		guild.NoticeRoom = ""
+		guild.Update()
+		ce.Reply("Disabled admin notices for %s", guild.PlainName)
+	default:
+		ce.Reply("**Usage**: `$cmdprefix guilds notices <guild ID> [here/off]`")
+	}
+}
+
 var cmdBridge = &commands.FullHandler{
 	Func: wrapCommand(fnBridge),
 	Name: "bridge",
 	Help: commands.HelpMeta{
 		Section:     HelpSectionPortalManagement,
 		Description: "Bridge this room to a specific Discord channel",
-		Args:        "[--replace[=delete]] <_channel ID_>",
+		Args:        "[--replace[=delete]] [--plumb] <_channel ID_>",
 	},
 	RequiresEventLevel: roomModerator,
 }
@@ -683,11 +1277,13 @@ func fnBridge(ce *WrappedCommandEvent) {
 		return
 	}
 	var channelID string
-	var unbridgeOld, deleteOld bool
+	var unbridgeOld, deleteOld, plumb bool
 	fail := true
 	for _, arg := range ce.Args {
 		arg = strings.ToLower(arg)
-		if arg == "--replace" {
+		if arg == "--plumb" {
+			plumb = true
+		} else if arg == "--replace" {
 			unbridgeOld = true
 		} else if arg == "--replace=delete" {
 			unbridgeOld = true
@@ -701,7 +1297,9 @@ func fnBridge(ce *WrappedCommandEvent) {
 		}
 	}
 	if fail {
-		ce.Reply("**Usage**: `$cmdprefix bridge [--replace[=delete]] <channel ID>`")
+		ce.Reply("**Usage**: `$cmdprefix bridge [--replace[=delete]] [--plumb] <channel ID>`\n\n" +
+			"The `--plumb` flag bridges the room as a shared community room: the bridge won't change its name, avatar, " +
+			"topic or power levels, and messages from Matrix users who aren't logged in are relayed.")
 		return
 	}
 	portal := ce.User.GetExistingPortalByID(channelID)
@@ -746,34 +1344,21 @@ func fnBridge(ce *WrappedCommandEvent) {
 			Bool("delete", deleteOld).
 			Msg("Unbridged old room to make space for new bridge")
 	}
-	if portal.Guild != nil && portal.Guild.BridgingMode < database.GuildBridgeIfPortalExists {
-		ce.ZLog.Debug().Str("guild_id", portal.Guild.ID).Msg("Bumping bridging mode of portal guild to if-portal-exists")
-		portal.Guild.BridgingMode = database.GuildBridgeIfPortalExists
-		portal.Guild.Update()
-	}
-	ce.ZLog.Debug().Str("channel_id", portal.Key.ChannelID).Msg("Bridging room")
-	portal.MXID = ce.RoomID
-	portal.bridge.portalsLock.Lock()
-	portal.bridge.portalsByMXID[portal.MXID] = portal
-	portal.bridge.portalsLock.Unlock()
-	portal.updateRoomName()
-	portal.updateRoomAvatar()
-	portal.updateRoomTopic()
-	portal.updateSpace(ce.User)
-	portal.UpdateBridgeInfo()
-	state, err := portal.MainIntent().State(portal.MXID)
-	if err != nil {
-		ce.ZLog.Error().Err(err).Msg("Failed to update state cache for room")
+	bindPortalToRoom(ce, portal, plumb)
+}
+
+// bindPortalToRoom links an unbridged portal to the room the command was sent in.
+// The caller must hold the portal's roomCreateLock.
+func bindPortalToRoom(ce *WrappedCommandEvent, portal *Portal, plumbed bool) {
+	portal.BindRoom(ce.User, ce.RoomID, plumbed)
+	if !plumbed {
+		ce.Reply("Room successfully bridged")
+	} else if portal.RelayWebhookID == "" && portal.getRelayBot() == nil {
+		ce.Reply("Room successfully bridged as a shared room, but there's no relay webhook or bot to send messages " +
+			"from Matrix users who aren't logged in. Set one up with `$cmdprefix set-relay`.")
 	} else {
-		encryptionEvent, isEncrypted := state[event.StateEncryption][""]
-		portal.Encrypted = isEncrypted && encryptionEvent.Content.AsEncryption().Algorithm == id.AlgorithmMegolmV1
+		ce.Reply("Room successfully bridged as a shared room")
 	}
-	portal.Update()
-	ce.Reply("Room successfully bridged")
-	ce.ZLog.Info().
-		Str("channel_id", portal.Key.ChannelID).
-		Bool("encrypted", portal.Encrypted).
-		Msg("Manual bridging complete")
 }
 
 var cmdUnbridge = &commands.FullHandler{
@@ -826,6 +1411,73 @@ func fnCreatePortal(ce *WrappedCommandEvent) {
 	}
 }
 
+var cmdCreateChannel = &commands.FullHandler{
+	Func: wrapCommand(fnCreateChannel),
+	Name: "create-channel",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Create a new Discord channel and bridge it to this room, or to a new room if used in the management room",
+		Args:        "<_guild ID_> [name]",
+	},
+	RequiresLogin:      true,
+	RequiresEventLevel: roomModerator,
+}
+
+func fnCreateChannel(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 || !isNumber(ce.Args[0]) {
+		ce.Reply("**Usage**: `$cmdprefix create-channel <guild ID> [name]`")
+		return
+	} else if ce.Portal != nil {
+		ce.Reply("This is already a portal room")
+		return
+	}
+	guild := ce.Bridge.GetGuildByID(ce.Args[0], false)
+	if guild == nil {
+		ce.Reply("Guild not found")
+		return
+	} else if !replyPermissionCheck(ce, ce.User.checkGuildPermission(guild.ID, discordgo.PermissionManageChannels)) {
+		return
+	}
+	inManagementRoom := ce.RoomID == ce.User.GetManagementRoomID()
+	name := strings.Join(ce.Args[1:], " ")
+	if name == "" && !inManagementRoom {
+		var nameContent event.RoomNameEventContent
+		err := ce.Bot.StateEvent(ce.RoomID, event.StateRoomName, "", &nameContent)
+		if err != nil {
+			ce.ZLog.Debug().Err(err).Msg("Failed to get room name for new channel")
+		}
+		name = nameContent.Name
+	}
+	if name == "" {
+		ce.Reply("Please specify a name for the new channel")
+		return
+	}
+	ch, err := ce.User.Session.GuildChannelCreate(guild.ID, name, discordgo.ChannelTypeGuildText)
+	if err != nil {
+		ce.ZLog.Warn().Err(err).Str("guild_id", guild.ID).Msg("Failed to create channel")
+		ce.Reply("Failed to create channel: %v", err)
+		return
+	}
+	ce.ZLog.Info().Str("guild_id", guild.ID).Str("channel_id", ch.ID).Msg("Created Discord channel from Matrix")
+	portal := ce.User.GetPortalByMeta(ch)
+	if inManagementRoom {
+		if guild.BridgingMode < database.GuildBridgeIfPortalExists {
+			guild.BridgingMode = database.GuildBridgeIfPortalExists
+			guild.Update()
+		}
+		err = portal.CreateMatrixRoom(ce.User, ch)
+		if err != nil {
+			ce.Reply("Created channel `%s`, but failed to create portal: %v", ch.ID, err)
+		} else {
+			ce.Reply("Created channel and portal: [%s](%s)", portal.Name, portal.MXID.URI(portal.bridge.Config.Homeserver.Domain).MatrixToURL())
+		}
+		return
+	}
+	portal.roomCreateLock.Lock()
+	defer portal.roomCreateLock.Unlock()
+	bindPortalToRoom(ce, portal, false)
+}
+
 var cmdDeletePortal = &commands.FullHandler{
 	Func: wrapCommand(fnUnbridge),
 	Name: "delete-portal",
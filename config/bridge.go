@@ -19,48 +19,267 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net/url"
+	"slices"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 type BridgeConfig struct {
-	UsernameTemplate          string `yaml:"username_template"`
-	DisplaynameTemplate       string `yaml:"displayname_template"`
-	ChannelNameTemplate       string `yaml:"channel_name_template"`
-	GuildNameTemplate         string `yaml:"guild_name_template"`
-	PrivateChatPortalMeta     string `yaml:"private_chat_portal_meta"`
-	PrivateChannelCreateLimit int    `yaml:"startup_private_channel_create_limit"`
-
-	PortalMessageBuffer int `yaml:"portal_message_buffer"`
+	UsernameTemplate          string               `yaml:"username_template"`
+	DisplaynameTemplate       string               `yaml:"displayname_template"`
+	ServerDisplaynameTemplate string               `yaml:"server_displayname_template"`
+	PerGuildProfiles          bool                 `yaml:"per_guild_profiles"`
+	FriendNickDisplaynames    bool                 `yaml:"friend_nick_displaynames"`
+	ChannelNameTemplate       string               `yaml:"channel_name_template"`
+	ChannelNameEmoji          ChannelNameEmojiMode `yaml:"channel_name_emoji"`
+	GuildNameTemplate         string               `yaml:"guild_name_template"`
+	ThreadNameTemplate        string               `yaml:"thread_name_template"`
+	RelayDisplaynameTemplate  string               `yaml:"relay_displayname_template"`
+	PrivateChatPortalMeta     string               `yaml:"private_chat_portal_meta"`
+	PrivateChannelCreateLimit int                  `yaml:"startup_private_channel_create_limit"`
+	ChannelDeleteAction       string               `yaml:"channel_delete_action"`
+	EphemeralMessages         string               `yaml:"ephemeral_messages"`
+	BotMessageDelay           int                  `yaml:"bot_message_delay"`
+	MaxMessageAge             int                  `yaml:"max_message_age"`
+	MaxPortalsPerUser         int                  `yaml:"max_portals_per_user"`
+	TrimGuildSubscriptions    bool                 `yaml:"trim_guild_subscriptions"`
+
+	PortalMessageBuffer         int                  `yaml:"portal_message_buffer"`
+	PortalMessageBufferOverflow BufferOverflowPolicy `yaml:"portal_message_buffer_overflow"`
 
 	PublicAddress  string `yaml:"public_address"`
 	AvatarProxyKey string `yaml:"avatar_proxy_key"`
 
-	DeliveryReceipts            bool `yaml:"delivery_receipts"`
-	MessageStatusEvents         bool `yaml:"message_status_events"`
-	MessageErrorNotices         bool `yaml:"message_error_notices"`
-	RestrictedRooms             bool `yaml:"restricted_rooms"`
-	AutojoinThreadOnOpen        bool `yaml:"autojoin_thread_on_open"`
-	EmbedFieldsAsTables         bool `yaml:"embed_fields_as_tables"`
-	MuteChannelsOnCreate        bool `yaml:"mute_channels_on_create"`
-	SyncDirectChatList          bool `yaml:"sync_direct_chat_list"`
-	ResendBridgeInfo            bool `yaml:"resend_bridge_info"`
-	CustomEmojiReactions        bool `yaml:"custom_emoji_reactions"`
-	DeletePortalOnChannelDelete bool `yaml:"delete_portal_on_channel_delete"`
-	DeleteGuildOnLeave          bool `yaml:"delete_guild_on_leave"`
-	FederateRooms               bool `yaml:"federate_rooms"`
-	PrefixWebhookMessages       bool `yaml:"prefix_webhook_messages"`
-	EnableWebhookAvatars        bool `yaml:"enable_webhook_avatars"`
-	UseDiscordCDNUpload         bool `yaml:"use_discord_cdn_upload"`
-
-	Proxy string `yaml:"proxy"`
-
-	CacheMedia  string      `yaml:"cache_media"`
-	DirectMedia DirectMedia `yaml:"direct_media"`
+	DeliveryReceipts       bool `yaml:"delivery_receipts"`
+	MessageStatusEvents    bool `yaml:"message_status_events"`
+	MessageErrorNotices    bool `yaml:"message_error_notices"`
+	RestrictedRooms        bool `yaml:"restricted_rooms"`
+	AutojoinThreadOnOpen   bool `yaml:"autojoin_thread_on_open"`
+	EmbedFieldsAsTables    bool `yaml:"embed_fields_as_tables"`
+	MuteChannelsOnCreate   bool `yaml:"mute_channels_on_create"`
+	SyncDirectChatList     bool `yaml:"sync_direct_chat_list"`
+	ResendBridgeInfo       bool `yaml:"resend_bridge_info"`
+	CustomEmojiReactions   bool `yaml:"custom_emoji_reactions"`
+	DeleteGuildOnLeave     bool `yaml:"delete_guild_on_leave"`
+	FederateRooms          bool `yaml:"federate_rooms"`
+	PrefixWebhookMessages  bool `yaml:"prefix_webhook_messages"`
+	EnableWebhookAvatars   bool `yaml:"enable_webhook_avatars"`
+	UseDiscordCDNUpload    bool `yaml:"use_discord_cdn_upload"`
+	RelayMembershipNotices bool `yaml:"relay_membership_notices"`
+	RelayRoster            bool `yaml:"relay_roster"`
+	SoundboardNotices      bool `yaml:"soundboard_notices"`
+	ActivityNotices        bool `yaml:"activity_notices"`
+	ReplyContextQuotes     bool `yaml:"reply_context_quotes"`
+	RoleColoredNames       bool `yaml:"role_colored_names"`
+	LoopDetectionWindow    int  `yaml:"loop_detection_window"`
+
+	EmojiShortcodes map[string]string `yaml:"emoji_shortcodes"`
+
+	VideoEmbeds struct {
+		PlayerCards   bool  `yaml:"player_cards"`
+		MaxInlineSize int64 `yaml:"max_inline_size"`
+
+		LargeVideoPreviews bool `yaml:"large_video_previews"`
+	} `yaml:"video_embeds"`
+
+	LinkPolicies map[string]LinkPolicy `yaml:"link_policies"`
+
+	PromotionalContent PromotionalPolicy `yaml:"promotional_content"`
+
+	MessageLinks MessageLinkMode `yaml:"message_links"`
+
+	MessageEffects MessageEffectMode `yaml:"message_effects"`
+
+	Timestamps struct {
+		Timezone   string `yaml:"timezone"`
+		TwelveHour bool   `yaml:"twelve_hour"`
+	} `yaml:"timestamps"`
+
+	UnsupportedEventNotices bool `yaml:"unsupported_event_notices"`
+
+	LinkCommandInvites bool `yaml:"link_command_invites"`
+
+	PublicInstance struct {
+		Enabled                bool  `yaml:"enabled"`
+		MessagesPerDay         int   `yaml:"messages_per_day"`
+		MediaMBPerDay          int64 `yaml:"media_mb_per_day"`
+		MaxGuilds              int   `yaml:"max_guilds"`
+		SignupsPerHour         int   `yaml:"signups_per_hour"`
+		NewUserPeriod          int   `yaml:"new_user_period"`
+		NewUserMessageInterval int   `yaml:"new_user_message_interval"`
+	} `yaml:"public_instance"`
+
+	PolicyLists struct {
+		Rooms           []string `yaml:"rooms"`
+		DiscordTimeouts bool     `yaml:"discord_timeouts"`
+	} `yaml:"policy_lists"`
+
+	MessageScript struct {
+		Path     string `yaml:"path"`
+		MaxSteps uint64 `yaml:"max_steps"`
+	} `yaml:"message_script"`
+
+	Hooks struct {
+		Webhooks []HookWebhook `yaml:"webhooks"`
+	} `yaml:"hooks"`
+
+	NowPlayingNotices struct {
+		Enabled     bool `yaml:"enabled"`
+		MinInterval int  `yaml:"min_interval"`
+	} `yaml:"now_playing_notices"`
+
+	MatrixPresence struct {
+		Enabled              bool `yaml:"enabled"`
+		IdleAfter            int  `yaml:"idle_after"`
+		InvisibleWhenOffline bool `yaml:"invisible_when_offline"`
+	} `yaml:"matrix_presence"`
+
+	RoomPolicies struct {
+		DM      RoomPolicy `yaml:"dm"`
+		GroupDM RoomPolicy `yaml:"group_dm"`
+		Guild   RoomPolicy `yaml:"guild"`
+	} `yaml:"room_policies"`
+
+	HistoryVisibilitySync struct {
+		Enabled    bool                    `yaml:"enabled"`
+		Public     event.HistoryVisibility `yaml:"public"`
+		Restricted event.HistoryVisibility `yaml:"restricted"`
+	} `yaml:"history_visibility_sync"`
+
+	BotNotices struct {
+		Default bool     `yaml:"default"`
+		Allow   []string `yaml:"allow"`
+		Deny    []string `yaml:"deny"`
+	} `yaml:"bot_notices"`
+
+	RelayMentionEscaping struct {
+		Enabled   bool     `yaml:"enabled"`
+		Allowlist []string `yaml:"allowlist"`
+	} `yaml:"relay_mention_escaping"`
+
+	LatencyAlerts struct {
+		WebhookURL   string  `yaml:"webhook_url"`
+		MaxP95       int64   `yaml:"max_p95"`
+		MaxErrorRate float64 `yaml:"max_error_rate"`
+		Cooldown     int     `yaml:"cooldown"`
+	} `yaml:"latency_alerts"`
+
+	AdminAlerts struct {
+		Room     id.RoomID `yaml:"room"`
+		Cooldown int       `yaml:"cooldown"`
+	} `yaml:"admin_alerts"`
+
+	CapabilityProbes struct {
+		Enabled  bool `yaml:"enabled"`
+		Interval int  `yaml:"interval"`
+	} `yaml:"capability_probes"`
+
+	Sentry struct {
+		DSN         string `yaml:"dsn"`
+		Environment string `yaml:"environment"`
+	} `yaml:"sentry"`
+
+	Snapshots struct {
+		Interval  int      `yaml:"interval"`
+		Directory string   `yaml:"directory"`
+		Keep      int      `yaml:"keep"`
+		S3        S3Config `yaml:"s3"`
+	} `yaml:"snapshots"`
+
+	EventRecording struct {
+		Enabled     bool   `yaml:"enabled"`
+		Directory   string `yaml:"directory"`
+		MaxDuration int    `yaml:"max_duration"`
+	} `yaml:"event_recording"`
+
+	RoomTags struct {
+		Enabled          bool `yaml:"enabled"`
+		MutedLowPriority bool `yaml:"muted_low_priority"`
+		FolderTags       bool `yaml:"folder_tags"`
+		ResyncInterval   int  `yaml:"resync_interval"`
+	} `yaml:"room_tags"`
+
+	APICache struct {
+		ChannelTTL int `yaml:"channel_ttl"`
+		UserTTL    int `yaml:"user_ttl"`
+		MemberTTL  int `yaml:"member_ttl"`
+	} `yaml:"api_cache"`
+
+	StateCache struct {
+		TrackPresences        bool `yaml:"track_presences"`
+		UnbridgedGuildMembers bool `yaml:"unbridged_guild_members"`
+		MaxMembersPerGuild    int  `yaml:"max_members_per_guild"`
+		TrimInterval          int  `yaml:"trim_interval"`
+		FetchMissingMembers   bool `yaml:"fetch_missing_members"`
+	} `yaml:"state_cache"`
+
+	BanSync bool `yaml:"ban_sync"`
+
+	PlumbingRequests struct {
+		Enabled        bool     `yaml:"enabled"`
+		Timeout        int      `yaml:"timeout"`
+		AllowedServers []string `yaml:"allowed_servers"`
+	} `yaml:"plumbing_requests"`
+
+	Deactivation struct {
+		Cleanup    DeactivationCleanup `yaml:"cleanup"`
+		AdminToken string              `yaml:"admin_token"`
+	} `yaml:"deactivation"`
+
+	GhostCleanup struct {
+		Enabled     bool `yaml:"enabled"`
+		GracePeriod int  `yaml:"grace_period"`
+	} `yaml:"ghost_cleanup"`
+
+	ReinviteOnLeave struct {
+		Enabled  bool `yaml:"enabled"`
+		Backfill bool `yaml:"backfill"`
+	} `yaml:"reinvite_on_leave"`
+
+	EmotePacks struct {
+		Enabled     bool `yaml:"enabled"`
+		PortalRooms bool `yaml:"portal_rooms"`
+	} `yaml:"emote_packs"`
+
+	PermissionSync PermissionSyncConfig `yaml:"permission_sync"`
+
+	Proxy                 string `yaml:"proxy"`
+	GatewayLargeThreshold int    `yaml:"gateway_large_threshold"`
+
+	CacheMedia                string      `yaml:"cache_media"`
+	AttachmentMemoryThreshold int64       `yaml:"attachment_memory_threshold"`
+	DirectMedia               DirectMedia `yaml:"direct_media"`
+
+	MediaStorage struct {
+		Enabled   bool     `yaml:"enabled"`
+		S3        S3Config `yaml:"s3"`
+		PublicURL string   `yaml:"public_url"`
+		URLExpiry int      `yaml:"url_expiry"`
+	} `yaml:"media_storage"`
+
+	CacheInvalidation struct {
+		Enabled bool   `yaml:"enabled"`
+		Channel string `yaml:"channel"`
+	} `yaml:"cache_invalidation"`
+
+	HighAvailability struct {
+		Enabled       bool  `yaml:"enabled"`
+		LockID        int64 `yaml:"lock_id"`
+		CheckInterval int   `yaml:"check_interval"`
+	} `yaml:"high_availability"`
+
+	Sharding struct {
+		Count int `yaml:"count"`
+		Index int `yaml:"index"`
+	} `yaml:"sharding"`
 
 	AnimatedSticker struct {
 		Target string `yaml:"target"`
@@ -73,31 +292,47 @@ type BridgeConfig struct {
 
 	DoublePuppetConfig bridgeconfig.DoublePuppetConfig `yaml:",inline"`
 
-	CommandPrefix      string                           `yaml:"command_prefix"`
-	ManagementRoomText bridgeconfig.ManagementRoomTexts `yaml:"management_room_text"`
+	CommandPrefix        string                           `yaml:"command_prefix"`
+	CommandPrefixAliases []string                         `yaml:"command_prefix_aliases"`
+	InteractionPrefix    string                           `yaml:"interaction_prefix"`
+	ManagementRoomText   bridgeconfig.ManagementRoomTexts `yaml:"management_room_text"`
+	PortalWelcomeMessage string                           `yaml:"portal_welcome_message"`
 
 	Backfill struct {
 		Limits struct {
 			Initial BackfillLimitPart `yaml:"initial"`
 			Missed  BackfillLimitPart `yaml:"missed"`
 		} `yaml:"forward_limits"`
-		MaxGuildMembers int `yaml:"max_guild_members"`
+		MaxGuildMembers       int  `yaml:"max_guild_members"`
+		MaxAge                int  `yaml:"max_age"`
+		SuppressNotifications bool `yaml:"suppress_notifications"`
+		MarkUnread            bool `yaml:"mark_unread"`
+		Scrollback            struct {
+			Enabled  bool `yaml:"enabled"`
+			MaxBatch int  `yaml:"max_batch"`
+		} `yaml:"scrollback"`
 	} `yaml:"backfill"`
 
 	Encryption bridgeconfig.EncryptionConfig `yaml:"encryption"`
 
 	Provisioning struct {
-		Prefix         string `yaml:"prefix"`
-		SharedSecret   string `yaml:"shared_secret"`
-		DebugEndpoints bool   `yaml:"debug_endpoints"`
+		Prefix             string `yaml:"prefix"`
+		SharedSecret       string `yaml:"shared_secret"`
+		DebugEndpoints     bool   `yaml:"debug_endpoints"`
+		DebugListenAddress string `yaml:"debug_listen_address"`
 	} `yaml:"provisioning"`
 
 	Permissions bridgeconfig.PermissionConfig `yaml:"permissions"`
 
 	usernameTemplate    *template.Template `yaml:"-"`
 	displaynameTemplate *template.Template `yaml:"-"`
+	serverNameTemplate  *template.Template `yaml:"-"`
 	channelNameTemplate *template.Template `yaml:"-"`
 	guildNameTemplate   *template.Template `yaml:"-"`
+	threadNameTemplate  *template.Template `yaml:"-"`
+	relayNameTemplate   *template.Template `yaml:"-"`
+	portalWelcomeTmpl   *template.Template `yaml:"-"`
+	timestampLocation   *time.Location     `yaml:"-"`
 }
 
 type DirectMedia struct {
@@ -106,6 +341,19 @@ type DirectMedia struct {
 	WellKnownResponse string `yaml:"well_known_response"`
 	AllowProxy        bool   `yaml:"allow_proxy"`
 	ServerKey         string `yaml:"server_key"`
+
+	Prefetch struct {
+		Interval int `yaml:"interval"`
+		MinHits  int `yaml:"min_hits"`
+		Window   int `yaml:"window"`
+	} `yaml:"prefetch"`
+}
+
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
 }
 
 type BackfillLimitPart struct {
@@ -114,6 +362,58 @@ type BackfillLimitPart struct {
 	Thread  int `yaml:"thread"`
 }
 
+// ShouldBridgeAsNotice checks if messages from a Discord bot or application should be sent as m.notice.
+// The IDs are the bot user ID and the application ID, deny list matches take precedence over allow list matches.
+func (bc *BridgeConfig) ShouldBridgeAsNotice(ids ...string) bool {
+	for _, id := range ids {
+		if id != "" && slices.Contains(bc.BotNotices.Deny, id) {
+			return false
+		}
+	}
+	for _, id := range ids {
+		if id != "" && slices.Contains(bc.BotNotices.Allow, id) {
+			return true
+		}
+	}
+	return bc.BotNotices.Default
+}
+
+type PermissionSyncConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Levels  struct {
+		Administrator  int `yaml:"administrator"`
+		ManageMessages int `yaml:"manage_messages"`
+		Muted          int `yaml:"muted"`
+	} `yaml:"levels"`
+	RoleLevels     map[string]int `yaml:"role_levels"`
+	DisabledGuilds []string       `yaml:"disabled_guilds"`
+}
+
+// IsEnabledIn checks if power levels should be synced in portals of the given guild.
+func (psc *PermissionSyncConfig) IsEnabledIn(guildID string) bool {
+	return psc.Enabled && guildID != "" && !slices.Contains(psc.DisabledGuilds, guildID)
+}
+
+// GetLevel maps a Discord member's computed channel permissions and roles to a Matrix power level.
+// Users who can't send messages get the muted level, otherwise the highest applicable level is used.
+func (psc *PermissionSyncConfig) GetLevel(permissions int64, roles []string, timedOut bool) int {
+	if permissions&discordgo.PermissionAdministrator != 0 {
+		return psc.Levels.Administrator
+	} else if timedOut || permissions&discordgo.PermissionSendMessages == 0 {
+		return psc.Levels.Muted
+	}
+	var level int
+	if permissions&discordgo.PermissionManageMessages != 0 {
+		level = psc.Levels.ManageMessages
+	}
+	for _, roleID := range roles {
+		if roleLevel, ok := psc.RoleLevels[roleID]; ok && roleLevel > level {
+			level = roleLevel
+		}
+	}
+	return level
+}
+
 func (bc *BridgeConfig) GetResendBridgeInfo() bool {
 	return bc.ResendBridgeInfo
 }
@@ -141,6 +441,12 @@ func (bc *BridgeConfig) Validate() error {
 	if len(bc.Permissions) <= exampleLen {
 		return errors.New("bridge.permissions not configured")
 	}
+	if bc.GatewayLargeThreshold != 0 && (bc.GatewayLargeThreshold < 50 || bc.GatewayLargeThreshold > 250) {
+		return errors.New("bridge.gateway_large_threshold must be between 50 and 250")
+	}
+	if bc.Sharding.Count > 1 && (bc.Sharding.Index < 0 || bc.Sharding.Index >= bc.Sharding.Count) {
+		return errors.New("bridge.sharding.index must be between 0 and bridge.sharding.count - 1")
+	}
 	return nil
 }
 
@@ -162,6 +468,10 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
+	bc.serverNameTemplate, err = template.New("server_displayname").Parse(bc.ServerDisplaynameTemplate)
+	if err != nil {
+		return err
+	}
 	bc.channelNameTemplate, err = template.New("channel_name").Parse(bc.ChannelNameTemplate)
 	if err != nil {
 		return err
@@ -170,12 +480,97 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
+	bc.threadNameTemplate, err = template.New("thread_name").Parse(bc.ThreadNameTemplate)
+	if err != nil {
+		return err
+	}
+	bc.relayNameTemplate, err = template.New("relay_displayname").Parse(bc.RelayDisplaynameTemplate)
+	if err != nil {
+		return err
+	}
+	bc.portalWelcomeTmpl, err = template.New("portal_welcome_message").Parse(bc.PortalWelcomeMessage)
+	if err != nil {
+		return err
+	}
+
+	switch bc.PromotionalContent {
+	case PromotionalPolicyKeep, PromotionalPolicySimplify, PromotionalPolicyDrop:
+	default:
+		return fmt.Errorf("invalid promotional content policy %q", bc.PromotionalContent)
+	}
+
+	for name, policy := range map[string]RoomPolicy{"dm": bc.RoomPolicies.DM, "group_dm": bc.RoomPolicies.GroupDM, "guild": bc.RoomPolicies.Guild} {
+		if err = policy.validate(); err != nil {
+			return fmt.Errorf("invalid room policy for %s: %w", name, err)
+		}
+	}
+
+	if hvs := bc.HistoryVisibilitySync; hvs.Enabled {
+		if hvs.Public != event.HistoryVisibilityShared && hvs.Public != event.HistoryVisibilityWorldReadable {
+			return fmt.Errorf("invalid public history visibility %q, must be shared or world_readable", hvs.Public)
+		} else if hvs.Restricted != event.HistoryVisibilityInvited && hvs.Restricted != event.HistoryVisibilityJoined {
+			return fmt.Errorf("invalid restricted history visibility %q, must be invited or joined", hvs.Restricted)
+		}
+	}
+
+	switch bc.MessageLinks {
+	case MessageLinkKeep, MessageLinkRewrite, MessageLinkAppend:
+	default:
+		return fmt.Errorf("invalid message link mode %q", bc.MessageLinks)
+	}
+	switch bc.MessageEffects {
+	case MessageEffectMarker, MessageEffectStrip:
+	default:
+		return fmt.Errorf("invalid message effect mode %q", bc.MessageEffects)
+	}
+	switch bc.PortalMessageBufferOverflow {
+	case BufferOverflowBlock, BufferOverflowDropOldest, BufferOverflowSpill:
+	default:
+		return fmt.Errorf("invalid portal message buffer overflow policy %q", bc.PortalMessageBufferOverflow)
+	}
+	switch bc.ChannelNameEmoji {
+	case ChannelNameEmojiKeep, ChannelNameEmojiStrip:
+	default:
+		return fmt.Errorf("invalid channel name emoji mode %q", bc.ChannelNameEmoji)
+	}
+	bc.timestampLocation, err = time.LoadLocation(bc.Timestamps.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp timezone %q: %w", bc.Timestamps.Timezone, err)
+	}
+
+	switch bc.Deactivation.Cleanup {
+	case DeactivationLogout, DeactivationDeletePortals, DeactivationPurge:
+	default:
+		return fmt.Errorf("invalid deactivation cleanup mode %q", bc.Deactivation.Cleanup)
+	}
+
+	for i, webhook := range bc.Hooks.Webhooks {
+		if err = webhook.validate(); err != nil {
+			return fmt.Errorf("invalid hook webhook #%d: %w", i+1, err)
+		}
+	}
+
+	for domain, policy := range bc.LinkPolicies {
+		switch policy {
+		case LinkPolicyInline, LinkPolicyLink, LinkPolicyStrip:
+		default:
+			return fmt.Errorf("invalid link policy %q for %s", policy, domain)
+		}
+	}
 
 	return nil
 }
 
 var _ bridgeconfig.BridgeConfig = (*BridgeConfig)(nil)
 
+// TimestampLocation returns the default timezone for rendering timestamps in Matrix messages.
+func (bc *BridgeConfig) TimestampLocation() *time.Location {
+	if bc.timestampLocation == nil {
+		return time.UTC
+	}
+	return bc.timestampLocation
+}
+
 func (bc BridgeConfig) GetDoublePuppetConfig() bridgeconfig.DoublePuppetConfig {
 	return bc.DoublePuppetConfig
 }
@@ -214,8 +609,23 @@ func (bc BridgeConfig) FormatDisplayname(user *discordgo.User, webhook, applicat
 	return buffer.String()
 }
 
+type ServerDisplaynameParams struct {
+	*discordgo.User
+	// Nick is the user's nickname in the guild, or an empty string if they don't have one.
+	Nick string
+	// Displayname is the user's global displayname, pre-formatted with displayname_template.
+	Displayname string
+}
+
+func (bc BridgeConfig) FormatServerDisplayname(params ServerDisplaynameParams) string {
+	var buffer strings.Builder
+	_ = bc.serverNameTemplate.Execute(&buffer, params)
+	return buffer.String()
+}
+
 type ChannelNameParams struct {
 	Name       string
+	Emoji      string
 	ParentName string
 	GuildName  string
 	NSFW       bool
@@ -237,3 +647,195 @@ func (bc BridgeConfig) FormatGuildName(params GuildNameParams) string {
 	_ = bc.guildNameTemplate.Execute(&buffer, params)
 	return buffer.String()
 }
+
+type ThreadNameParams struct {
+	Root    string
+	Message string
+	Sender  string
+}
+
+func (bc BridgeConfig) FormatThreadName(params ThreadNameParams) string {
+	var buffer strings.Builder
+	_ = bc.threadNameTemplate.Execute(&buffer, params)
+	return buffer.String()
+}
+
+type PortalWelcomeParams struct {
+	Name          string
+	GuildName     string
+	IsDM          bool
+	Account       string
+	Relay         bool
+	CommandPrefix string
+}
+
+// FormatPortalWelcome renders the welcome notice for new portal rooms. An empty string means it's disabled.
+func (bc BridgeConfig) FormatPortalWelcome(params PortalWelcomeParams) string {
+	if bc.PortalWelcomeMessage == "" {
+		return ""
+	}
+	var buffer strings.Builder
+	_ = bc.portalWelcomeTmpl.Execute(&buffer, params)
+	return strings.TrimSpace(buffer.String())
+}
+
+type RelayDisplaynameParams struct {
+	Displayname string
+	UserID      id.UserID
+}
+
+func (bc BridgeConfig) FormatRelayDisplayname(params RelayDisplaynameParams) string {
+	var buffer strings.Builder
+	_ = bc.relayNameTemplate.Execute(&buffer, params)
+	return buffer.String()
+}
+
+type LinkPolicy string
+
+const (
+	LinkPolicyDefault LinkPolicy = ""
+	LinkPolicyInline  LinkPolicy = "inline"
+	LinkPolicyLink    LinkPolicy = "link"
+	LinkPolicyStrip   LinkPolicy = "strip"
+)
+
+type PromotionalPolicy string
+
+const (
+	PromotionalPolicyKeep     PromotionalPolicy = "keep"
+	PromotionalPolicySimplify PromotionalPolicy = "simplify"
+	PromotionalPolicyDrop     PromotionalPolicy = "drop"
+)
+
+type MessageLinkMode string
+
+const (
+	MessageLinkKeep    MessageLinkMode = "keep"
+	MessageLinkRewrite MessageLinkMode = "rewrite"
+	MessageLinkAppend  MessageLinkMode = "append"
+)
+
+type MessageEffectMode string
+
+const (
+	MessageEffectMarker MessageEffectMode = "marker"
+	MessageEffectStrip  MessageEffectMode = "strip"
+)
+
+type BufferOverflowPolicy string
+
+const (
+	BufferOverflowBlock      BufferOverflowPolicy = "block"
+	BufferOverflowDropOldest BufferOverflowPolicy = "drop_oldest"
+	BufferOverflowSpill      BufferOverflowPolicy = "spill"
+)
+
+type ChannelNameEmojiMode string
+
+const (
+	ChannelNameEmojiKeep  ChannelNameEmojiMode = "keep"
+	ChannelNameEmojiStrip ChannelNameEmojiMode = "strip"
+)
+
+type DeactivationCleanup string
+
+const (
+	DeactivationLogout        DeactivationCleanup = "logout"
+	DeactivationDeletePortals DeactivationCleanup = "delete_portals"
+	DeactivationPurge         DeactivationCleanup = "purge"
+)
+
+type HookEventType string
+
+const (
+	HookPortalCreated      HookEventType = "portal_created"
+	HookMessageFromDiscord HookEventType = "message_from_discord"
+	HookMessageToDiscord   HookEventType = "message_to_discord"
+	HookLogin              HookEventType = "login"
+	HookError              HookEventType = "error"
+)
+
+// HookWebhook is an HTTP endpoint that hook events are posted to. An empty event list means all events.
+type HookWebhook struct {
+	URL    string          `yaml:"url"`
+	Secret string          `yaml:"secret"`
+	Events []HookEventType `yaml:"events"`
+}
+
+func (hw HookWebhook) validate() error {
+	if hw.URL == "" {
+		return errors.New("missing URL")
+	}
+	for _, evtType := range hw.Events {
+		switch evtType {
+		case HookPortalCreated, HookMessageFromDiscord, HookMessageToDiscord, HookLogin, HookError:
+		default:
+			return fmt.Errorf("unknown event type %q", evtType)
+		}
+	}
+	return nil
+}
+
+// Wants returns true if the given event type should be posted to the webhook.
+func (hw HookWebhook) Wants(evtType HookEventType) bool {
+	return len(hw.Events) == 0 || slices.Contains(hw.Events, evtType)
+}
+
+// RoomPolicy contains the directory visibility, history visibility and guest access of new portal rooms.
+// Empty values use the defaults of the private_chat room preset.
+type RoomPolicy struct {
+	Directory         string                  `yaml:"directory"`
+	HistoryVisibility event.HistoryVisibility `yaml:"history_visibility"`
+	GuestAccess       event.GuestAccess       `yaml:"guest_access"`
+}
+
+func (rp RoomPolicy) validate() error {
+	switch rp.Directory {
+	case "", "public", "private":
+	default:
+		return fmt.Errorf("invalid directory visibility %q", rp.Directory)
+	}
+	switch rp.HistoryVisibility {
+	case "", event.HistoryVisibilityShared, event.HistoryVisibilityInvited, event.HistoryVisibilityJoined, event.HistoryVisibilityWorldReadable:
+	default:
+		return fmt.Errorf("invalid history visibility %q", rp.HistoryVisibility)
+	}
+	switch rp.GuestAccess {
+	case "", event.GuestAccessCanJoin, event.GuestAccessForbidden:
+	default:
+		return fmt.Errorf("invalid guest access %q", rp.GuestAccess)
+	}
+	return nil
+}
+
+// GetRoomPolicy returns the room policy for portals of the given Discord channel type.
+func (bc BridgeConfig) GetRoomPolicy(chanType discordgo.ChannelType) RoomPolicy {
+	switch chanType {
+	case discordgo.ChannelTypeDM:
+		return bc.RoomPolicies.DM
+	case discordgo.ChannelTypeGroupDM:
+		return bc.RoomPolicies.GroupDM
+	default:
+		return bc.RoomPolicies.Guild
+	}
+}
+
+// GetLinkPolicy finds the link policy for the domain of the given URL.
+// Policies for a domain also apply to all of its subdomains, the most specific match wins.
+func (bc BridgeConfig) GetLinkPolicy(rawURL string) LinkPolicy {
+	if len(bc.LinkPolicies) == 0 || rawURL == "" {
+		return LinkPolicyDefault
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return LinkPolicyDefault
+	}
+	domain := strings.ToLower(parsed.Hostname())
+	for domain != "" {
+		if policy, ok := bc.LinkPolicies[domain]; ok {
+			return policy
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return LinkPolicyDefault
+}
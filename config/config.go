@@ -17,6 +17,8 @@
 package config
 
 import (
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/id"
 )
@@ -25,6 +27,66 @@ type Config struct {
 	*bridgeconfig.BaseConfig `yaml:",inline"`
 
 	Bridge BridgeConfig `yaml:"bridge"`
+
+	Metrics struct {
+		Enabled bool   `yaml:"enabled"`
+		Listen  string `yaml:"listen"`
+	} `yaml:"metrics"`
+
+	// DatabaseExtras contains the bridge-specific options in the appservice.database section.
+	DatabaseExtras DatabaseExtras `yaml:"-"`
+	// LoggingExtras contains the bridge-specific options in the logging section.
+	LoggingExtras LoggingExtras `yaml:"-"`
+}
+
+type DatabaseExtras struct {
+	// The example config uses these names, but dbutil expects conn_max_*, so they're copied over manually.
+	MaxConnIdleTime string `yaml:"max_conn_idle_time"`
+	MaxConnLifetime string `yaml:"max_conn_lifetime"`
+
+	HealthCheck struct {
+		Interval int `yaml:"interval"`
+		Timeout  int `yaml:"timeout"`
+	} `yaml:"health_check"`
+	SaturationWarningInterval int `yaml:"saturation_warning_interval"`
+}
+
+type LoggingExtras struct {
+	// Minimum log levels for individual modules, overriding the global min_level.
+	ModuleLevels map[string]zerolog.Level `yaml:"module_levels"`
+	// How often file writers should rotate regardless of size, in seconds. 0 means only size-based rotation.
+	RotateInterval int `yaml:"rotate_interval"`
+}
+
+type rawConfig Config
+
+func (config *Config) UnmarshalYAML(node *yaml.Node) error {
+	err := node.Decode((*rawConfig)(config))
+	if err != nil {
+		return err
+	}
+	var extras struct {
+		AppService struct {
+			Database DatabaseExtras `yaml:"database"`
+		} `yaml:"appservice"`
+		Logging LoggingExtras `yaml:"logging"`
+	}
+	extras.AppService.Database = config.DatabaseExtras
+	extras.Logging = config.LoggingExtras
+	err = node.Decode(&extras)
+	if err != nil {
+		return err
+	}
+	config.DatabaseExtras = extras.AppService.Database
+	config.LoggingExtras = extras.Logging
+	dbConfig := &config.AppService.Database
+	if dbConfig.ConnMaxIdleTime == "" {
+		dbConfig.ConnMaxIdleTime = config.DatabaseExtras.MaxConnIdleTime
+	}
+	if dbConfig.ConnMaxLifetime == "" {
+		dbConfig.ConnMaxLifetime = config.DatabaseExtras.MaxConnLifetime
+	}
+	return nil
 }
 
 func (config *Config) CanAutoDoublePuppet(userID id.UserID) bool {
@@ -25,11 +25,20 @@ import (
 
 func DoUpgrade(helper *up.Helper) {
 	bridgeconfig.Upgrader.DoUpgrade(helper)
+	helper.Copy(up.Int, "appservice", "database", "health_check", "interval")
+	helper.Copy(up.Int, "appservice", "database", "health_check", "timeout")
+	helper.Copy(up.Int, "appservice", "database", "saturation_warning_interval")
 
 	helper.Copy(up.Str, "bridge", "username_template")
 	helper.Copy(up.Str, "bridge", "displayname_template")
+	helper.Copy(up.Str, "bridge", "server_displayname_template")
+	helper.Copy(up.Bool, "bridge", "per_guild_profiles")
+	helper.Copy(up.Bool, "bridge", "friend_nick_displaynames")
 	helper.Copy(up.Str, "bridge", "channel_name_template")
+	helper.Copy(up.Str, "bridge", "channel_name_emoji")
 	helper.Copy(up.Str, "bridge", "guild_name_template")
+	helper.Copy(up.Str, "bridge", "thread_name_template")
+	helper.Copy(up.Str, "bridge", "relay_displayname_template")
 	if legacyPrivateChatPortalMeta, ok := helper.Get(up.Bool, "bridge", "private_chat_portal_meta"); ok {
 		updatedPrivateChatPortalMeta := "default"
 		if legacyPrivateChatPortalMeta == "true" {
@@ -47,6 +56,7 @@ func DoUpgrade(helper *up.Helper) {
 		helper.Copy(up.Str, "bridge", "avatar_proxy_key")
 	}
 	helper.Copy(up.Int, "bridge", "portal_message_buffer")
+	helper.Copy(up.Str, "bridge", "portal_message_buffer_overflow")
 	helper.Copy(up.Bool, "bridge", "delivery_receipts")
 	helper.Copy(up.Bool, "bridge", "message_status_events")
 	helper.Copy(up.Bool, "bridge", "message_error_notices")
@@ -57,14 +67,139 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "bridge", "sync_direct_chat_list")
 	helper.Copy(up.Bool, "bridge", "resend_bridge_info")
 	helper.Copy(up.Bool, "bridge", "custom_emoji_reactions")
-	helper.Copy(up.Bool, "bridge", "delete_portal_on_channel_delete")
+	if legacyDeletePortal, ok := helper.Get(up.Bool, "bridge", "delete_portal_on_channel_delete"); ok {
+		updatedChannelDeleteAction := "leave"
+		if legacyDeletePortal == "true" {
+			updatedChannelDeleteAction = "delete"
+		}
+		helper.Set(up.Str, updatedChannelDeleteAction, "bridge", "channel_delete_action")
+	} else {
+		helper.Copy(up.Str, "bridge", "channel_delete_action")
+	}
+	helper.Copy(up.Str, "bridge", "ephemeral_messages")
+	helper.Copy(up.Int, "bridge", "bot_message_delay")
+	helper.Copy(up.Int, "bridge", "max_message_age")
+	helper.Copy(up.Int, "bridge", "max_portals_per_user")
+	helper.Copy(up.Bool, "bridge", "trim_guild_subscriptions")
 	helper.Copy(up.Bool, "bridge", "delete_guild_on_leave")
 	helper.Copy(up.Bool, "bridge", "federate_rooms")
 	helper.Copy(up.Bool, "bridge", "prefix_webhook_messages")
 	helper.Copy(up.Bool, "bridge", "enable_webhook_avatars")
 	helper.Copy(up.Bool, "bridge", "use_discord_cdn_upload")
+	helper.Copy(up.Bool, "bridge", "relay_membership_notices")
+	helper.Copy(up.Bool, "bridge", "relay_roster")
+	helper.Copy(up.Bool, "bridge", "relay_mention_escaping", "enabled")
+	helper.Copy(up.List, "bridge", "relay_mention_escaping", "allowlist")
+	helper.Copy(up.Bool, "bridge", "soundboard_notices")
+	helper.Copy(up.Bool, "bridge", "activity_notices")
+	helper.Copy(up.Bool, "bridge", "reply_context_quotes")
+	helper.Copy(up.Bool, "bridge", "role_colored_names")
+	helper.Copy(up.Int, "bridge", "loop_detection_window")
+	helper.Copy(up.Map, "bridge", "emoji_shortcodes")
+	helper.Copy(up.Bool, "bridge", "video_embeds", "player_cards")
+	helper.Copy(up.Int, "bridge", "video_embeds", "max_inline_size")
+	helper.Copy(up.Bool, "bridge", "video_embeds", "large_video_previews")
+	helper.Copy(up.Map, "bridge", "link_policies")
+	helper.Copy(up.Str, "bridge", "promotional_content")
+	helper.Copy(up.Str, "bridge", "message_links")
+	helper.Copy(up.Str, "bridge", "message_effects")
+	helper.Copy(up.Str, "bridge", "timestamps", "timezone")
+	helper.Copy(up.Bool, "bridge", "timestamps", "twelve_hour")
+	helper.Copy(up.Bool, "bridge", "unsupported_event_notices")
+	helper.Copy(up.Bool, "bridge", "link_command_invites")
+	helper.Copy(up.Bool, "bridge", "public_instance", "enabled")
+	helper.Copy(up.Int, "bridge", "public_instance", "messages_per_day")
+	helper.Copy(up.Int, "bridge", "public_instance", "media_mb_per_day")
+	helper.Copy(up.Int, "bridge", "public_instance", "max_guilds")
+	helper.Copy(up.Int, "bridge", "public_instance", "signups_per_hour")
+	helper.Copy(up.Int, "bridge", "public_instance", "new_user_period")
+	helper.Copy(up.Int, "bridge", "public_instance", "new_user_message_interval")
+	helper.Copy(up.List, "bridge", "policy_lists", "rooms")
+	helper.Copy(up.Str|up.Null, "bridge", "message_script", "path")
+	helper.Copy(up.Int, "bridge", "message_script", "max_steps")
+	helper.Copy(up.List, "bridge", "hooks", "webhooks")
+	helper.Copy(up.Bool, "bridge", "policy_lists", "discord_timeouts")
+	helper.Copy(up.Bool, "bridge", "now_playing_notices", "enabled")
+	helper.Copy(up.Int, "bridge", "now_playing_notices", "min_interval")
+	helper.Copy(up.Bool, "bridge", "matrix_presence", "enabled")
+	helper.Copy(up.Int, "bridge", "matrix_presence", "idle_after")
+	helper.Copy(up.Bool, "bridge", "matrix_presence", "invisible_when_offline")
+	helper.Copy(up.Str|up.Null, "bridge", "room_policies", "dm", "directory")
+	helper.Copy(up.Str|up.Null, "bridge", "room_policies", "dm", "history_visibility")
+	helper.Copy(up.Str|up.Null, "bridge", "room_policies", "dm", "guest_access")
+	helper.Copy(up.Str|up.Null, "bridge", "room_policies", "group_dm", "directory")
+	helper.Copy(up.Str|up.Null, "bridge", "room_policies", "group_dm", "history_visibility")
+	helper.Copy(up.Str|up.Null, "bridge", "room_policies", "group_dm", "guest_access")
+	helper.Copy(up.Str|up.Null, "bridge", "room_policies", "guild", "directory")
+	helper.Copy(up.Str|up.Null, "bridge", "room_policies", "guild", "history_visibility")
+	helper.Copy(up.Str|up.Null, "bridge", "room_policies", "guild", "guest_access")
+	helper.Copy(up.Bool, "bridge", "history_visibility_sync", "enabled")
+	helper.Copy(up.Str, "bridge", "history_visibility_sync", "public")
+	helper.Copy(up.Str, "bridge", "history_visibility_sync", "restricted")
+	helper.Copy(up.Str|up.Null, "bridge", "latency_alerts", "webhook_url")
+	helper.Copy(up.Int, "bridge", "latency_alerts", "max_p95")
+	helper.Copy(up.Float, "bridge", "latency_alerts", "max_error_rate")
+	helper.Copy(up.Int, "bridge", "latency_alerts", "cooldown")
+	helper.Copy(up.Str|up.Null, "bridge", "admin_alerts", "room")
+	helper.Copy(up.Int, "bridge", "admin_alerts", "cooldown")
+	helper.Copy(up.Bool, "bridge", "capability_probes", "enabled")
+	helper.Copy(up.Int, "bridge", "capability_probes", "interval")
+	helper.Copy(up.Str|up.Null, "bridge", "sentry", "dsn")
+	helper.Copy(up.Str|up.Null, "bridge", "sentry", "environment")
+	helper.Copy(up.Int, "bridge", "snapshots", "interval")
+	helper.Copy(up.Str, "bridge", "snapshots", "directory")
+	helper.Copy(up.Int, "bridge", "snapshots", "keep")
+	helper.Copy(up.Str|up.Null, "bridge", "snapshots", "s3", "endpoint")
+	helper.Copy(up.Str, "bridge", "snapshots", "s3", "region")
+	helper.Copy(up.Str|up.Null, "bridge", "snapshots", "s3", "access_key")
+	helper.Copy(up.Str|up.Null, "bridge", "snapshots", "s3", "secret_key")
+	helper.Copy(up.Bool, "bridge", "event_recording", "enabled")
+	helper.Copy(up.Str, "bridge", "event_recording", "directory")
+	helper.Copy(up.Int, "bridge", "event_recording", "max_duration")
+	helper.Copy(up.Bool, "bridge", "room_tags", "enabled")
+	helper.Copy(up.Bool, "bridge", "room_tags", "muted_low_priority")
+	helper.Copy(up.Bool, "bridge", "room_tags", "folder_tags")
+	helper.Copy(up.Int, "bridge", "room_tags", "resync_interval")
+	helper.Copy(up.Int, "bridge", "api_cache", "channel_ttl")
+	helper.Copy(up.Int, "bridge", "api_cache", "user_ttl")
+	helper.Copy(up.Int, "bridge", "api_cache", "member_ttl")
+	helper.Copy(up.Bool, "bridge", "state_cache", "track_presences")
+	helper.Copy(up.Bool, "bridge", "state_cache", "unbridged_guild_members")
+	helper.Copy(up.Int, "bridge", "state_cache", "max_members_per_guild")
+	helper.Copy(up.Int, "bridge", "state_cache", "trim_interval")
+	helper.Copy(up.Bool, "bridge", "state_cache", "fetch_missing_members")
+	helper.Copy(up.Bool, "bridge", "ban_sync")
+	helper.Copy(up.Bool, "bridge", "plumbing_requests", "enabled")
+	helper.Copy(up.Int, "bridge", "plumbing_requests", "timeout")
+	helper.Copy(up.List, "bridge", "plumbing_requests", "allowed_servers")
+	helper.Copy(up.Str, "bridge", "deactivation", "cleanup")
+	helper.Copy(up.Str|up.Null, "bridge", "deactivation", "admin_token")
+	helper.Copy(up.Bool, "bridge", "ghost_cleanup", "enabled")
+	helper.Copy(up.Int, "bridge", "ghost_cleanup", "grace_period")
+	helper.Copy(up.Bool, "bridge", "reinvite_on_leave", "enabled")
+	helper.Copy(up.Bool, "bridge", "reinvite_on_leave", "backfill")
+	helper.Copy(up.Bool, "bridge", "emote_packs", "enabled")
+	helper.Copy(up.Bool, "bridge", "emote_packs", "portal_rooms")
+	helper.Copy(up.Bool, "bridge", "permission_sync", "enabled")
+	helper.Copy(up.Int, "bridge", "permission_sync", "levels", "administrator")
+	helper.Copy(up.Int, "bridge", "permission_sync", "levels", "manage_messages")
+	helper.Copy(up.Int, "bridge", "permission_sync", "levels", "muted")
+	helper.Copy(up.Map, "bridge", "permission_sync", "role_levels")
+	helper.Copy(up.List, "bridge", "permission_sync", "disabled_guilds")
+	helper.Copy(up.Bool, "bridge", "bot_notices", "default")
+	helper.Copy(up.List, "bridge", "bot_notices", "allow")
+	helper.Copy(up.List, "bridge", "bot_notices", "deny")
 	helper.Copy(up.Str|up.Null, "bridge", "proxy")
+	helper.Copy(up.Int, "bridge", "gateway_large_threshold")
 	helper.Copy(up.Str, "bridge", "cache_media")
+	helper.Copy(up.Int, "bridge", "attachment_memory_threshold")
+	helper.Copy(up.Bool, "bridge", "cache_invalidation", "enabled")
+	helper.Copy(up.Str, "bridge", "cache_invalidation", "channel")
+	helper.Copy(up.Bool, "bridge", "high_availability", "enabled")
+	helper.Copy(up.Int, "bridge", "high_availability", "lock_id")
+	helper.Copy(up.Int, "bridge", "high_availability", "check_interval")
+	helper.Copy(up.Int, "bridge", "sharding", "count")
+	helper.Copy(up.Int, "bridge", "sharding", "index")
 	helper.Copy(up.Bool, "bridge", "direct_media", "enabled")
 	helper.Copy(up.Str, "bridge", "direct_media", "server_name")
 	helper.Copy(up.Str|up.Null, "bridge", "direct_media", "well_known_response")
@@ -75,6 +210,16 @@ func DoUpgrade(helper *up.Helper) {
 	} else {
 		helper.Copy(up.Str, "bridge", "direct_media", "server_key")
 	}
+	helper.Copy(up.Int, "bridge", "direct_media", "prefetch", "interval")
+	helper.Copy(up.Int, "bridge", "direct_media", "prefetch", "min_hits")
+	helper.Copy(up.Int, "bridge", "direct_media", "prefetch", "window")
+	helper.Copy(up.Bool, "bridge", "media_storage", "enabled")
+	helper.Copy(up.Str|up.Null, "bridge", "media_storage", "s3", "endpoint")
+	helper.Copy(up.Str, "bridge", "media_storage", "s3", "region")
+	helper.Copy(up.Str|up.Null, "bridge", "media_storage", "s3", "access_key")
+	helper.Copy(up.Str|up.Null, "bridge", "media_storage", "s3", "secret_key")
+	helper.Copy(up.Str|up.Null, "bridge", "media_storage", "public_url")
+	helper.Copy(up.Int, "bridge", "media_storage", "url_expiry")
 	helper.Copy(up.Str, "bridge", "animated_sticker", "target")
 	helper.Copy(up.Int, "bridge", "animated_sticker", "args", "width")
 	helper.Copy(up.Int, "bridge", "animated_sticker", "args", "height")
@@ -83,7 +228,10 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "bridge", "double_puppet_allow_discovery")
 	helper.Copy(up.Map, "bridge", "login_shared_secret_map")
 	helper.Copy(up.Str, "bridge", "command_prefix")
+	helper.Copy(up.List, "bridge", "command_prefix_aliases")
+	helper.Copy(up.Str, "bridge", "interaction_prefix")
 	helper.Copy(up.Str, "bridge", "management_room_text", "welcome")
+	helper.Copy(up.Str, "bridge", "portal_welcome_message")
 	helper.Copy(up.Str, "bridge", "management_room_text", "welcome_connected")
 	helper.Copy(up.Str, "bridge", "management_room_text", "welcome_unconnected")
 	helper.Copy(up.Str|up.Null, "bridge", "management_room_text", "additional_help")
@@ -95,6 +243,11 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Int, "bridge", "backfill", "forward_limits", "missed", "channel")
 	helper.Copy(up.Int, "bridge", "backfill", "forward_limits", "missed", "thread")
 	helper.Copy(up.Int, "bridge", "backfill", "max_guild_members")
+	helper.Copy(up.Int, "bridge", "backfill", "max_age")
+	helper.Copy(up.Bool, "bridge", "backfill", "suppress_notifications")
+	helper.Copy(up.Bool, "bridge", "backfill", "mark_unread")
+	helper.Copy(up.Bool, "bridge", "backfill", "scrollback", "enabled")
+	helper.Copy(up.Int, "bridge", "backfill", "scrollback", "max_batch")
 	helper.Copy(up.Bool, "bridge", "encryption", "allow")
 	helper.Copy(up.Bool, "bridge", "encryption", "default")
 	helper.Copy(up.Bool, "bridge", "encryption", "require")
@@ -125,8 +278,12 @@ func DoUpgrade(helper *up.Helper) {
 		helper.Copy(up.Str, "bridge", "provisioning", "shared_secret")
 	}
 	helper.Copy(up.Bool, "bridge", "provisioning", "debug_endpoints")
+	helper.Copy(up.Str|up.Null, "bridge", "provisioning", "debug_listen_address")
 
 	helper.Copy(up.Map, "bridge", "permissions")
+
+	helper.Copy(up.Bool, "metrics", "enabled")
+	helper.Copy(up.Str, "metrics", "listen")
 	//helper.Copy(up.Bool, "bridge", "relay", "enabled")
 	//helper.Copy(up.Bool, "bridge", "relay", "admin_only")
 	//helper.Copy(up.Map, "bridge", "relay", "message_formats")
@@ -146,5 +303,6 @@ var SpacedBlocks = [][]string{
 	{"bridge", "provisioning"},
 	{"bridge", "permissions"},
 	//{"bridge", "relay"},
+	{"metrics"},
 	{"logging"},
 }
@@ -47,6 +47,7 @@ func (puppet *Puppet) StartCustomMXID(reloginOnFail bool) error {
 	}
 	puppet.customIntent = newIntent
 	puppet.customUser = puppet.bridge.GetUserByMXID(puppet.CustomMXID)
+	go puppet.ensureBackfillPushRule()
 	return nil
 }
 
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const BackfillDirectionForward = "forward"
+
+type BackfillCheckpointQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+// BackfillCheckpoint is the progress of an in-progress backfill, which is used to resume it after a restart.
+type BackfillCheckpoint struct {
+	db  *Database
+	log log.Logger
+
+	Channel   PortalKey
+	ThreadID  string
+	Direction string
+	AfterID   string
+	UntilID   string
+	Batch     int
+}
+
+func (bcq *BackfillCheckpointQuery) New() *BackfillCheckpoint {
+	return &BackfillCheckpoint{
+		db:  bcq.db,
+		log: bcq.log,
+	}
+}
+
+func (bcq *BackfillCheckpointQuery) Get(key PortalKey, threadID string) *BackfillCheckpoint {
+	query := `
+		SELECT dc_chan_id, dc_chan_receiver, dc_thread_id, direction, after_id, until_id, batch
+		FROM backfill_checkpoint WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND dc_thread_id=$3
+	`
+	bc := bcq.New()
+	err := bcq.db.QueryRow(query, key.ChannelID, key.Receiver, threadID).
+		Scan(&bc.Channel.ChannelID, &bc.Channel.Receiver, &bc.ThreadID, &bc.Direction, &bc.AfterID, &bc.UntilID, &bc.Batch)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		bcq.log.Errorfln("Failed to get backfill checkpoint of %s/%s: %v", key, threadID, err)
+		panic(err)
+	}
+	return bc
+}
+
+func (bc *BackfillCheckpoint) Upsert() {
+	query := `
+		INSERT INTO backfill_checkpoint (dc_chan_id, dc_chan_receiver, dc_thread_id, direction, after_id, until_id, batch)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (dc_chan_id, dc_chan_receiver, dc_thread_id)
+			DO UPDATE SET direction=excluded.direction, after_id=excluded.after_id, until_id=excluded.until_id, batch=excluded.batch
+	`
+	_, err := bc.db.Exec(query, bc.Channel.ChannelID, bc.Channel.Receiver, bc.ThreadID, bc.Direction, bc.AfterID, bc.UntilID, bc.Batch)
+	if err != nil {
+		bc.log.Warnfln("Failed to upsert backfill checkpoint of %s/%s: %v", bc.Channel, bc.ThreadID, err)
+		panic(err)
+	}
+}
+
+func (bc *BackfillCheckpoint) Delete() {
+	query := "DELETE FROM backfill_checkpoint WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND dc_thread_id=$3"
+	_, err := bc.db.Exec(query, bc.Channel.ChannelID, bc.Channel.Receiver, bc.ThreadID)
+	if err != nil {
+		bc.log.Warnfln("Failed to delete backfill checkpoint of %s/%s: %v", bc.Channel, bc.ThreadID, err)
+		panic(err)
+	}
+}
@@ -23,6 +23,15 @@ type Database struct {
 	Guild    *GuildQuery
 	Role     *RoleQuery
 	File     *FileQuery
+
+	IgnoredBot         *IgnoredBotQuery
+	BackfillCheckpoint *BackfillCheckpointQuery
+	SpilledMessage     *SpilledMessageQuery
+
+	// OnPortalUpdated and OnPuppetUpdated are called after portals and puppets are updated,
+	// so that other bridge processes using the same database can invalidate their caches.
+	OnPortalUpdated func(key PortalKey)
+	OnPuppetUpdated func(id string)
 }
 
 func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
@@ -64,6 +73,18 @@ func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
 		db:  db,
 		log: log.Sub("File"),
 	}
+	db.IgnoredBot = &IgnoredBotQuery{
+		db:  db,
+		log: log.Sub("IgnoredBot"),
+	}
+	db.BackfillCheckpoint = &BackfillCheckpointQuery{
+		db:  db,
+		log: log.Sub("BackfillCheckpoint"),
+	}
+	db.SpilledMessage = &SpilledMessageQuery{
+		db:  db,
+		log: log.Sub("SpilledMessage"),
+	}
 	return db
 }
 
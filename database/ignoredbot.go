@@ -0,0 +1,54 @@
+package database
+
+import (
+	log "maunium.net/go/maulogger/v2"
+)
+
+type IgnoredBotQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+// IgnoredBot is a Discord bot, application or webhook whose messages are dropped.
+// An empty ChannelID means the bot is ignored in all channels.
+type IgnoredBot struct {
+	BotID     string
+	ChannelID string
+}
+
+func (ibq *IgnoredBotQuery) GetAll() []IgnoredBot {
+	rows, err := ibq.db.Query("SELECT bot_id, channel_id FROM ignored_bot")
+	if err != nil {
+		ibq.log.Errorln("Failed to get ignored bots:", err)
+		panic(err)
+	}
+	defer rows.Close()
+	var bots []IgnoredBot
+	for rows.Next() {
+		var bot IgnoredBot
+		err = rows.Scan(&bot.BotID, &bot.ChannelID)
+		if err != nil {
+			ibq.log.Errorln("Failed to scan ignored bot:", err)
+			panic(err)
+		}
+		bots = append(bots, bot)
+	}
+	return bots
+}
+
+func (ibq *IgnoredBotQuery) Add(bot IgnoredBot) {
+	query := "INSERT INTO ignored_bot (bot_id, channel_id) VALUES ($1, $2) ON CONFLICT (bot_id, channel_id) DO NOTHING"
+	_, err := ibq.db.Exec(query, bot.BotID, bot.ChannelID)
+	if err != nil {
+		ibq.log.Warnfln("Failed to insert ignored bot %s in %q: %v", bot.BotID, bot.ChannelID, err)
+		panic(err)
+	}
+}
+
+func (ibq *IgnoredBotQuery) Remove(bot IgnoredBot) {
+	_, err := ibq.db.Exec("DELETE FROM ignored_bot WHERE bot_id=$1 AND channel_id=$2", bot.BotID, bot.ChannelID)
+	if err != nil {
+		ibq.log.Warnfln("Failed to delete ignored bot %s in %q: %v", bot.BotID, bot.ChannelID, err)
+		panic(err)
+	}
+}
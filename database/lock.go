@@ -0,0 +1,43 @@
+package database
+
+import (
+	"context"
+	"hash/fnv"
+
+	"go.mau.fi/util/dbutil"
+)
+
+// advisoryLockNamespace is mixed into advisory lock keys so they don't collide with other
+// applications sharing the same Postgres database.
+const advisoryLockNamespace = "mautrix-discord/portal-create/"
+
+// LockPortalCreation acquires a Postgres session-level advisory lock for creating the room of the
+// given portal, so that multiple bridge processes can't create duplicate rooms for one channel.
+// On SQLite, only one process can use the database anyway, so this is a no-op.
+//
+// The returned function must be called to release the lock.
+func (pq *PortalQuery) LockPortalCreation(ctx context.Context, key PortalKey) (func(), error) {
+	if pq.db.Dialect != dbutil.Postgres {
+		return func() {}, nil
+	}
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(advisoryLockNamespace + key.String()))
+	lockID := int64(hash.Sum64())
+	// Advisory locks are bound to the connection, so a dedicated connection is needed
+	conn, err := pq.db.RawDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockID)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return func() {
+		_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockID)
+		if err != nil {
+			pq.log.Warnfln("Failed to release portal creation lock for %s: %v", key, err)
+		}
+		_ = conn.Close()
+	}, nil
+}
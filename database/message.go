@@ -69,6 +69,12 @@ func (mq *MessageQuery) GetLastInThread(key PortalKey, threadID string) *Message
 	return mq.New().Scan(mq.db.QueryRow(query, key.ChannelID, key.Receiver, threadID))
 }
 
+// GetFirst returns the oldest bridged message in the main channel (i.e. not in a thread) of the given portal.
+func (mq *MessageQuery) GetFirst(key PortalKey) *Message {
+	query := messageSelect + " WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND dc_thread_id='' ORDER BY timestamp ASC LIMIT 1"
+	return mq.New().Scan(mq.db.QueryRow(query, key.ChannelID, key.Receiver))
+}
+
 func (mq *MessageQuery) GetLast(key PortalKey) *Message {
 	query := messageSelect + " WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 ORDER BY timestamp DESC LIMIT 1"
 	return mq.New().Scan(mq.db.QueryRow(query, key.ChannelID, key.Receiver))
@@ -83,6 +89,21 @@ func (mq *MessageQuery) DeleteAll(key PortalKey) {
 	}
 }
 
+// GetAllBySenderMXID returns all messages that the given Matrix user sent through the bridge.
+func (mq *MessageQuery) GetAllBySenderMXID(senderMXID id.UserID) []*Message {
+	query := messageSelect + " WHERE sender_mxid=$1"
+	return mq.scanAll(mq.db.Query(query, senderMXID))
+}
+
+func (mq *MessageQuery) DeleteAllBySenderMXID(senderMXID id.UserID) {
+	query := "DELETE FROM message WHERE sender_mxid=$1"
+	_, err := mq.db.Exec(query, senderMXID)
+	if err != nil {
+		mq.log.Warnfln("Failed to delete messages sent by %s: %v", senderMXID, err)
+		panic(err)
+	}
+}
+
 func (mq *MessageQuery) GetByMXID(key PortalKey, mxid id.EventID) *Message {
 	query := messageSelect + " WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND mxid=$3"
 
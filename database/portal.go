@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"sync/atomic"
 
 	"github.com/bwmarrin/discordgo"
 	"go.mau.fi/util/dbutil"
@@ -14,7 +15,10 @@ const (
 	portalSelect = `
 		SELECT dcid, receiver, type, other_user_id, dc_guild_id, dc_parent_id, mxid,
 		       plain_name, name, name_set, friend_nick, topic, topic_set, avatar, avatar_url, avatar_set,
-		       encrypted, in_space, first_event_id, relay_webhook_id, relay_webhook_secret
+		       encrypted, in_space, first_event_id, relay_webhook_id, relay_webhook_secret,
+		       relay_roster_message_id, large_video_previews, plumbed, relay_approval, max_message_age, skipped_until,
+		       relay_min_level, name_override, topic_override, avatar_override, paused_to_matrix, paused_to_discord,
+		       features_hash, relay_bot_mxid
 		FROM portal
 	`
 )
@@ -62,6 +66,10 @@ func (pq *PortalQuery) GetByID(key PortalKey) *Portal {
 	return pq.get(portalSelect+" WHERE dcid=$1 AND (receiver=$2 OR receiver='')", key.ChannelID, key.Receiver)
 }
 
+func (pq *PortalQuery) GetAllByChannelID(channelID string) []*Portal {
+	return pq.getAll(portalSelect+" WHERE dcid=$1", channelID)
+}
+
 func (pq *PortalQuery) GetByMXID(mxid id.RoomID) *Portal {
 	return pq.get(portalSelect+" WHERE mxid=$1", mxid)
 }
@@ -125,18 +133,53 @@ type Portal struct {
 
 	FirstEventID id.EventID
 
-	RelayWebhookID     string
-	RelayWebhookSecret string
+	RelayWebhookID       string
+	RelayWebhookSecret   string
+	RelayRosterMessageID string
+
+	// LargeVideoPreviews overrides the bridge-wide large video preview setting if set.
+	LargeVideoPreviews *bool
+	// Plumbed is set for portals bridged to an existing room, which is managed by its community rather than the bridge.
+	Plumbed bool
+	// RelayApproval makes relayed Matrix users wait for a moderator's approval before their messages are sent to Discord.
+	RelayApproval bool
+	// MaxMessageAge overrides the bridge-wide maximum age (in minutes) of live Discord messages if set.
+	MaxMessageAge *int
+	// SkippedUntil is the newest message ID that was dropped for being too old, so that it isn't backfilled later.
+	SkippedUntil string
+	// RelayMinLevel is the power level that Matrix users need for their messages to be relayed to Discord if set.
+	RelayMinLevel *int
+	// NameOverride, TopicOverride and AvatarOverride are set by Matrix users and take precedence over Discord's info.
+	NameOverride   string
+	TopicOverride  string
+	AvatarOverride id.ContentURI
+	// PausedToMatrix and PausedToDiscord temporarily stop bridging messages in that direction.
+	// They're atomic, as they're changed by commands while the portal's event loops are reading them.
+	PausedToMatrix  atomic.Bool
+	PausedToDiscord atomic.Bool
+	// FeaturesHash is the hash of the last feature state event sent to the room, so that it's only resent when it changes.
+	FeaturesHash string
+	// RelayBotMXID is the bridge user whose logged-in Discord bot relays messages from Matrix users in the portal.
+	RelayBotMXID id.UserID
 }
 
 func (p *Portal) Scan(row dbutil.Scannable) *Portal {
-	var otherUserID, guildID, parentID, mxid, firstEventID, relayWebhookID, relayWebhookSecret sql.NullString
+	var otherUserID, guildID, parentID, mxid, firstEventID, relayWebhookID, relayWebhookSecret, relayRosterMessageID sql.NullString
 	var chanType int32
 	var avatarURL string
+	var largeVideoPreviews sql.NullBool
+	var maxMessageAge sql.NullInt32
+	var skippedUntil sql.NullString
+	var relayMinLevel sql.NullInt32
+	var nameOverride, topicOverride, avatarOverride sql.NullString
+	var relayBotMXID sql.NullString
+	var pausedToMatrix, pausedToDiscord bool
 
 	err := row.Scan(&p.Key.ChannelID, &p.Key.Receiver, &chanType, &otherUserID, &guildID, &parentID,
 		&mxid, &p.PlainName, &p.Name, &p.NameSet, &p.FriendNick, &p.Topic, &p.TopicSet, &p.Avatar, &avatarURL, &p.AvatarSet,
-		&p.Encrypted, &p.InSpace, &firstEventID, &relayWebhookID, &relayWebhookSecret)
+		&p.Encrypted, &p.InSpace, &firstEventID, &relayWebhookID, &relayWebhookSecret, &relayRosterMessageID, &largeVideoPreviews, &p.Plumbed, &p.RelayApproval,
+		&maxMessageAge, &skippedUntil, &relayMinLevel, &nameOverride, &topicOverride, &avatarOverride,
+		&pausedToMatrix, &pausedToDiscord, &p.FeaturesHash, &relayBotMXID)
 
 	if err != nil {
 		if err != sql.ErrNoRows {
@@ -156,6 +199,25 @@ func (p *Portal) Scan(row dbutil.Scannable) *Portal {
 	p.AvatarURL, _ = id.ParseContentURI(avatarURL)
 	p.RelayWebhookID = relayWebhookID.String
 	p.RelayWebhookSecret = relayWebhookSecret.String
+	p.RelayRosterMessageID = relayRosterMessageID.String
+	if largeVideoPreviews.Valid {
+		p.LargeVideoPreviews = &largeVideoPreviews.Bool
+	}
+	if maxMessageAge.Valid {
+		age := int(maxMessageAge.Int32)
+		p.MaxMessageAge = &age
+	}
+	p.SkippedUntil = skippedUntil.String
+	if relayMinLevel.Valid {
+		level := int(relayMinLevel.Int32)
+		p.RelayMinLevel = &level
+	}
+	p.NameOverride = nameOverride.String
+	p.TopicOverride = topicOverride.String
+	p.AvatarOverride, _ = id.ParseContentURI(avatarOverride.String)
+	p.RelayBotMXID = id.UserID(relayBotMXID.String)
+	p.PausedToMatrix.Store(pausedToMatrix)
+	p.PausedToDiscord.Store(pausedToDiscord)
 
 	return p
 }
@@ -164,13 +226,20 @@ func (p *Portal) Insert() {
 	query := `
 		INSERT INTO portal (dcid, receiver, type, other_user_id, dc_guild_id, dc_parent_id, mxid,
 		                    plain_name, name, name_set, friend_nick, topic, topic_set, avatar, avatar_url, avatar_set,
-		                    encrypted, in_space, first_event_id, relay_webhook_id, relay_webhook_secret)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+		                    encrypted, in_space, first_event_id, relay_webhook_id, relay_webhook_secret,
+		                    relay_roster_message_id, large_video_previews, plumbed, relay_approval,
+		                    max_message_age, skipped_until, relay_min_level, name_override, topic_override, avatar_override,
+		                    paused_to_matrix, paused_to_discord, features_hash, relay_bot_mxid)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28,
+		        $29, $30, $31, $32, $33, $34, $35)
 	`
 	_, err := p.db.Exec(query, p.Key.ChannelID, p.Key.Receiver, p.Type,
 		strPtr(p.OtherUserID), strPtr(p.GuildID), strPtr(p.ParentID), strPtr(string(p.MXID)),
 		p.PlainName, p.Name, p.NameSet, p.FriendNick, p.Topic, p.TopicSet, p.Avatar, p.AvatarURL.String(), p.AvatarSet,
-		p.Encrypted, p.InSpace, p.FirstEventID.String(), strPtr(p.RelayWebhookID), strPtr(p.RelayWebhookSecret))
+		p.Encrypted, p.InSpace, p.FirstEventID.String(), strPtr(p.RelayWebhookID), strPtr(p.RelayWebhookSecret),
+		strPtr(p.RelayRosterMessageID), p.LargeVideoPreviews, p.Plumbed, p.RelayApproval,
+		p.MaxMessageAge, strPtr(p.SkippedUntil), p.RelayMinLevel, strPtr(p.NameOverride), strPtr(p.TopicOverride),
+		strPtr(p.AvatarOverride.String()), p.PausedToMatrix.Load(), p.PausedToDiscord.Load(), p.FeaturesHash, strPtr(string(p.RelayBotMXID)))
 
 	if err != nil {
 		p.log.Warnfln("Failed to insert %s: %v", p.Key, err)
@@ -184,20 +253,28 @@ func (p *Portal) Update() {
 		SET type=$1, other_user_id=$2, dc_guild_id=$3, dc_parent_id=$4, mxid=$5,
 			plain_name=$6, name=$7, name_set=$8, friend_nick=$9, topic=$10, topic_set=$11,
 			avatar=$12, avatar_url=$13, avatar_set=$14, encrypted=$15, in_space=$16, first_event_id=$17,
-			relay_webhook_id=$18, relay_webhook_secret=$19
-		WHERE dcid=$20 AND receiver=$21
+			relay_webhook_id=$18, relay_webhook_secret=$19, relay_roster_message_id=$20, large_video_previews=$21,
+			plumbed=$22, relay_approval=$23, max_message_age=$24, skipped_until=$25,
+			relay_min_level=$26, name_override=$27, topic_override=$28, avatar_override=$29,
+			paused_to_matrix=$30, paused_to_discord=$31, features_hash=$32, relay_bot_mxid=$33
+		WHERE dcid=$34 AND receiver=$35
 	`
 	_, err := p.db.Exec(query,
 		p.Type, strPtr(p.OtherUserID), strPtr(p.GuildID), strPtr(p.ParentID), strPtr(string(p.MXID)),
 		p.PlainName, p.Name, p.NameSet, p.FriendNick, p.Topic, p.TopicSet,
 		p.Avatar, p.AvatarURL.String(), p.AvatarSet, p.Encrypted, p.InSpace, p.FirstEventID.String(),
-		strPtr(p.RelayWebhookID), strPtr(p.RelayWebhookSecret),
-		p.Key.ChannelID, p.Key.Receiver)
+		strPtr(p.RelayWebhookID), strPtr(p.RelayWebhookSecret), strPtr(p.RelayRosterMessageID), p.LargeVideoPreviews,
+		p.Plumbed, p.RelayApproval, p.MaxMessageAge, strPtr(p.SkippedUntil), p.RelayMinLevel,
+		strPtr(p.NameOverride), strPtr(p.TopicOverride), strPtr(p.AvatarOverride.String()),
+		p.PausedToMatrix.Load(), p.PausedToDiscord.Load(), p.FeaturesHash, strPtr(string(p.RelayBotMXID)), p.Key.ChannelID, p.Key.Receiver)
 
 	if err != nil {
 		p.log.Warnfln("Failed to update %s: %v", p.Key, err)
 		panic(err)
 	}
+	if p.db.OnPortalUpdated != nil {
+		p.db.OnPortalUpdated(p.Key)
+	}
 }
 
 func (p *Portal) Delete() {
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// GetRelayApproval returns whether the user has been approved, and whether they're in the approval queue at all.
+func (p *Portal) GetRelayApproval(userID id.UserID) (approved, found bool) {
+	query := "SELECT approved FROM portal_relay_approval WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND user_mxid=$3"
+	err := p.db.QueryRow(query, p.Key.ChannelID, p.Key.Receiver, userID).Scan(&approved)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, false
+	} else if err != nil {
+		p.log.Errorfln("Failed to get relay approval of %s in %s: %v", userID, p.Key, err)
+		panic(err)
+	}
+	return approved, true
+}
+
+// GetPendingRelayApprovalByNotice finds the pending user whose approval notice has the given event ID.
+func (p *Portal) GetPendingRelayApprovalByNotice(noticeMXID id.EventID) id.UserID {
+	query := "SELECT user_mxid FROM portal_relay_approval WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND notice_mxid=$3 AND approved=false"
+	var userID id.UserID
+	err := p.db.QueryRow(query, p.Key.ChannelID, p.Key.Receiver, noticeMXID).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ""
+	} else if err != nil {
+		p.log.Errorfln("Failed to get relay approval by notice %s in %s: %v", noticeMXID, p.Key, err)
+		panic(err)
+	}
+	return userID
+}
+
+func (p *Portal) GetPendingRelayApprovals() []id.UserID {
+	query := "SELECT user_mxid FROM portal_relay_approval WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND approved=false"
+	rows, err := p.db.Query(query, p.Key.ChannelID, p.Key.Receiver)
+	if err != nil {
+		p.log.Errorfln("Failed to get pending relay approvals in %s: %v", p.Key, err)
+		panic(err)
+	}
+	defer rows.Close()
+	var users []id.UserID
+	for rows.Next() {
+		var userID id.UserID
+		err = rows.Scan(&userID)
+		if err != nil {
+			p.log.Errorln("Failed to scan pending relay approval:", err)
+			panic(err)
+		}
+		users = append(users, userID)
+	}
+	return users
+}
+
+func (p *Portal) SetRelayApproval(userID id.UserID, approved bool, noticeMXID id.EventID) {
+	query := `
+		INSERT INTO portal_relay_approval (dc_chan_id, dc_chan_receiver, user_mxid, approved, notice_mxid)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (dc_chan_id, dc_chan_receiver, user_mxid) DO UPDATE
+			SET approved=excluded.approved, notice_mxid=excluded.notice_mxid
+	`
+	_, err := p.db.Exec(query, p.Key.ChannelID, p.Key.Receiver, userID, approved, noticeMXID)
+	if err != nil {
+		p.log.Warnfln("Failed to set relay approval of %s in %s: %v", userID, p.Key, err)
+		panic(err)
+	}
+}
+
+func (p *Portal) DeleteRelayApproval(userID id.UserID) {
+	query := "DELETE FROM portal_relay_approval WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND user_mxid=$3"
+	_, err := p.db.Exec(query, p.Key.ChannelID, p.Key.Receiver, userID)
+	if err != nil {
+		p.log.Warnfln("Failed to delete relay approval of %s in %s: %v", userID, p.Key, err)
+		panic(err)
+	}
+}
@@ -148,4 +148,7 @@ func (p *Puppet) Update() {
 		p.log.Warnfln("Failed to update %s: %v", p.ID, err)
 		panic(err)
 	}
+	if p.db.OnPuppetUpdated != nil {
+		p.db.OnPuppetUpdated(p.ID)
+	}
 }
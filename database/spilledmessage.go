@@ -0,0 +1,108 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+)
+
+type SpilledMessageQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+// SpilledMessage is a Discord event that didn't fit in the message buffer of a portal,
+// and is waiting to be handled after the events before it.
+type SpilledMessage struct {
+	db  *Database
+	log log.Logger
+
+	Channel    PortalKey
+	Seq        int64
+	UserMXID   string
+	ThreadID   string
+	EventType  string
+	Data       string
+	ReceivedAt int64
+	Delayed    bool
+}
+
+const spilledMessageSelect = `
+	SELECT dc_chan_id, dc_chan_receiver, seq, user_mxid, dc_thread_id, event_type, data, received_at, delayed
+	FROM spilled_message
+`
+
+func (smq *SpilledMessageQuery) New() *SpilledMessage {
+	return &SpilledMessage{
+		db:  smq.db,
+		log: smq.log,
+	}
+}
+
+// GetOldest returns the first spilled event of the portal, or nil if there are none.
+func (smq *SpilledMessageQuery) GetOldest(key PortalKey) *SpilledMessage {
+	query := spilledMessageSelect + " WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 ORDER BY seq ASC LIMIT 1"
+	sm := smq.New()
+	err := smq.db.QueryRow(query, key.ChannelID, key.Receiver).
+		Scan(&sm.Channel.ChannelID, &sm.Channel.Receiver, &sm.Seq, &sm.UserMXID, &sm.ThreadID, &sm.EventType, &sm.Data, &sm.ReceivedAt, &sm.Delayed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		smq.log.Errorfln("Failed to get oldest spilled message of %s: %v", key, err)
+		panic(err)
+	}
+	return sm
+}
+
+// GetPortals returns the keys of all portals that have spilled events.
+func (smq *SpilledMessageQuery) GetPortals() []PortalKey {
+	rows, err := smq.db.Query("SELECT DISTINCT dc_chan_id, dc_chan_receiver FROM spilled_message")
+	if err != nil {
+		smq.log.Errorln("Failed to get portals with spilled messages:", err)
+		panic(err)
+	}
+	defer rows.Close()
+	var keys []PortalKey
+	for rows.Next() {
+		var key PortalKey
+		err = rows.Scan(&key.ChannelID, &key.Receiver)
+		if err != nil {
+			smq.log.Errorln("Failed to scan portal with spilled messages:", err)
+			panic(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (sm *SpilledMessage) Insert() {
+	query := `
+		INSERT INTO spilled_message (dc_chan_id, dc_chan_receiver, seq, user_mxid, dc_thread_id, event_type, data, received_at, delayed)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+	_, err := sm.db.Exec(query, sm.Channel.ChannelID, sm.Channel.Receiver, sm.Seq, sm.UserMXID, sm.ThreadID, sm.EventType, sm.Data, sm.ReceivedAt, sm.Delayed)
+	if err != nil {
+		sm.log.Warnfln("Failed to insert spilled message %s/%d: %v", sm.Channel, sm.Seq, err)
+		panic(err)
+	}
+}
+
+func (sm *SpilledMessage) Delete() {
+	query := "DELETE FROM spilled_message WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND seq=$3"
+	_, err := sm.db.Exec(query, sm.Channel.ChannelID, sm.Channel.Receiver, sm.Seq)
+	if err != nil {
+		sm.log.Warnfln("Failed to delete spilled message %s/%d: %v", sm.Channel, sm.Seq, err)
+		panic(err)
+	}
+}
+
+// DeleteAllByUser deletes the spilled events that were queued for the given Matrix user.
+func (smq *SpilledMessageQuery) DeleteAllByUser(userID id.UserID) {
+	_, err := smq.db.Exec("DELETE FROM spilled_message WHERE user_mxid=$1", userID)
+	if err != nil {
+		smq.log.Warnfln("Failed to delete spilled messages of %s: %v", userID, err)
+		panic(err)
+	}
+}
@@ -15,7 +15,7 @@ type ThreadQuery struct {
 }
 
 const (
-	threadSelect = "SELECT dcid, parent_chan_id, root_msg_dcid, root_msg_mxid, creation_notice_mxid FROM thread"
+	threadSelect = "SELECT dcid, parent_chan_id, root_msg_dcid, root_msg_mxid, creation_notice_mxid, archived, locked FROM thread"
 )
 
 func (tq *ThreadQuery) New() *Thread {
@@ -69,10 +69,13 @@ type Thread struct {
 	RootMXID      id.EventID
 
 	CreationNoticeMXID id.EventID
+
+	Archived bool
+	Locked   bool
 }
 
 func (t *Thread) Scan(row dbutil.Scannable) *Thread {
-	err := row.Scan(&t.ID, &t.ParentID, &t.RootDiscordID, &t.RootMXID, &t.CreationNoticeMXID)
+	err := row.Scan(&t.ID, &t.ParentID, &t.RootDiscordID, &t.RootMXID, &t.CreationNoticeMXID, &t.Archived, &t.Locked)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			t.log.Errorln("Database scan failed:", err)
@@ -84,8 +87,8 @@ func (t *Thread) Scan(row dbutil.Scannable) *Thread {
 }
 
 func (t *Thread) Insert() {
-	query := "INSERT INTO thread (dcid, parent_chan_id, root_msg_dcid, root_msg_mxid, creation_notice_mxid) VALUES ($1, $2, $3, $4, $5)"
-	_, err := t.db.Exec(query, t.ID, t.ParentID, t.RootDiscordID, t.RootMXID, t.CreationNoticeMXID)
+	query := "INSERT INTO thread (dcid, parent_chan_id, root_msg_dcid, root_msg_mxid, creation_notice_mxid, archived, locked) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	_, err := t.db.Exec(query, t.ID, t.ParentID, t.RootDiscordID, t.RootMXID, t.CreationNoticeMXID, t.Archived, t.Locked)
 	if err != nil {
 		t.log.Warnfln("Failed to insert %s@%s: %v", t.ID, t.ParentID, err)
 		panic(err)
@@ -93,8 +96,8 @@ func (t *Thread) Insert() {
 }
 
 func (t *Thread) Update() {
-	query := "UPDATE thread SET creation_notice_mxid=$2 WHERE dcid=$1"
-	_, err := t.db.Exec(query, t.ID, t.CreationNoticeMXID)
+	query := "UPDATE thread SET creation_notice_mxid=$2, archived=$3, locked=$4 WHERE dcid=$1"
+	_, err := t.db.Exec(query, t.ID, t.CreationNoticeMXID, t.Archived, t.Locked)
 	if err != nil {
 		t.log.Warnfln("Failed to update %s@%s: %v", t.ID, t.ParentID, err)
 		panic(err)
@@ -1,4 +1,4 @@
--- v0 -> v23 (compatible with v19+): Latest revision
+-- v0 -> v47 (compatible with v19+): Latest revision
 
 CREATE TABLE guild (
     dcid       TEXT PRIMARY KEY,
@@ -10,7 +10,8 @@ CREATE TABLE guild (
     avatar_url TEXT NOT NULL,
     avatar_set BOOLEAN NOT NULL,
 
-    bridging_mode INTEGER NOT NULL
+    bridging_mode INTEGER NOT NULL,
+    notice_room   TEXT NOT NULL DEFAULT ''
 );
 
 CREATE TABLE portal (
@@ -40,20 +41,47 @@ CREATE TABLE portal (
 
     first_event_id TEXT NOT NULL,
 
-    relay_webhook_id     TEXT,
-    relay_webhook_secret TEXT,
+    relay_webhook_id        TEXT,
+    relay_webhook_secret    TEXT,
+    relay_roster_message_id TEXT,
+    relay_bot_mxid          TEXT,
+    large_video_previews    BOOLEAN,
+    plumbed                 BOOLEAN NOT NULL DEFAULT false,
+    relay_approval          BOOLEAN NOT NULL DEFAULT false,
+    max_message_age         INTEGER,
+    skipped_until           TEXT,
+    relay_min_level         INTEGER,
+    name_override           TEXT,
+    topic_override          TEXT,
+    avatar_override         TEXT,
+    paused_to_matrix        BOOLEAN NOT NULL DEFAULT false,
+    paused_to_discord       BOOLEAN NOT NULL DEFAULT false,
+    features_hash           TEXT NOT NULL DEFAULT '',
 
     PRIMARY KEY (dcid, receiver),
     CONSTRAINT portal_parent_fkey FOREIGN KEY (dc_parent_id, dc_parent_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE,
     CONSTRAINT portal_guild_fkey  FOREIGN KEY (dc_guild_id) REFERENCES guild(dcid) ON DELETE CASCADE
 );
 
+CREATE TABLE portal_relay_approval (
+    dc_chan_id       TEXT,
+    dc_chan_receiver TEXT,
+    user_mxid        TEXT,
+    approved         BOOLEAN NOT NULL,
+    notice_mxid      TEXT NOT NULL,
+
+    PRIMARY KEY (dc_chan_id, dc_chan_receiver, user_mxid),
+    CONSTRAINT portal_relay_approval_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
 CREATE TABLE thread (
     dcid           TEXT PRIMARY KEY,
     parent_chan_id TEXT NOT NULL,
     root_msg_dcid  TEXT NOT NULL,
     root_msg_mxid  TEXT NOT NULL,
     creation_notice_mxid TEXT NOT NULL,
+    archived       BOOLEAN NOT NULL DEFAULT false,
+    locked         BOOLEAN NOT NULL DEFAULT false,
     -- This is also not accessed by the bridge.
     receiver   TEXT NOT NULL DEFAULT '',
 
@@ -92,7 +120,14 @@ CREATE TABLE "user" (
     space_room      TEXT,
     dm_space_room   TEXT,
 
-    read_state_version INTEGER NOT NULL DEFAULT 0
+    read_state_version    INTEGER NOT NULL DEFAULT 0,
+    away                  BOOLEAN NOT NULL DEFAULT false,
+    folder_spaces         BOOLEAN NOT NULL DEFAULT false,
+    dm_only_double_puppet BOOLEAN NOT NULL DEFAULT false,
+    presence_status       TEXT NOT NULL DEFAULT '',
+    custom_status         TEXT NOT NULL DEFAULT '',
+    signup_ts             BIGINT NOT NULL DEFAULT 0,
+    timezone              TEXT NOT NULL DEFAULT ''
 );
 
 CREATE TABLE user_portal (
@@ -106,6 +141,40 @@ CREATE TABLE user_portal (
     CONSTRAINT up_user_fkey FOREIGN KEY (user_mxid) REFERENCES "user" (mxid) ON DELETE CASCADE
 );
 
+CREATE TABLE user_keyword (
+    user_mxid TEXT,
+    keyword   TEXT,
+
+    PRIMARY KEY (user_mxid, keyword),
+    CONSTRAINT user_keyword_user_fkey FOREIGN KEY (user_mxid) REFERENCES "user" (mxid) ON DELETE CASCADE
+);
+
+CREATE TABLE user_dm_invite (
+    user_mxid   TEXT,
+    invite_mxid TEXT,
+
+    PRIMARY KEY (user_mxid, invite_mxid),
+    CONSTRAINT user_dm_invite_user_fkey FOREIGN KEY (user_mxid) REFERENCES "user" (mxid) ON DELETE CASCADE
+);
+
+CREATE TABLE user_own_message_mode (
+    user_mxid  TEXT,
+    channel_id TEXT,
+    mode       TEXT NOT NULL,
+
+    PRIMARY KEY (user_mxid, channel_id),
+    CONSTRAINT user_own_message_mode_user_fkey FOREIGN KEY (user_mxid) REFERENCES "user" (mxid) ON DELETE CASCADE
+);
+
+CREATE TABLE user_guild_folder (
+    user_mxid TEXT,
+    folder_id TEXT,
+    mxid      TEXT NOT NULL,
+
+    PRIMARY KEY (user_mxid, folder_id),
+    CONSTRAINT user_guild_folder_user_fkey FOREIGN KEY (user_mxid) REFERENCES "user" (mxid) ON DELETE CASCADE
+);
+
 CREATE TABLE message (
     dcid              TEXT,
     dc_attachment_id  TEXT,
@@ -123,6 +192,38 @@ CREATE TABLE message (
     CONSTRAINT message_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE
 );
 
+CREATE TABLE backfill_checkpoint (
+    dc_chan_id       TEXT,
+    dc_chan_receiver TEXT,
+    -- Empty string for the main channel
+    dc_thread_id     TEXT,
+    direction        TEXT    NOT NULL,
+    -- The last message that was bridged (exclusive lower bound for resuming)
+    after_id         TEXT    NOT NULL,
+    -- The newest message that the backfill should reach (inclusive)
+    until_id         TEXT    NOT NULL,
+    batch            INTEGER NOT NULL,
+
+    PRIMARY KEY (dc_chan_id, dc_chan_receiver, dc_thread_id),
+    CONSTRAINT backfill_checkpoint_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE
+);
+
+CREATE TABLE spilled_message (
+    dc_chan_id       TEXT,
+    dc_chan_receiver TEXT,
+    seq              BIGINT  NOT NULL,
+    user_mxid        TEXT    NOT NULL,
+    -- Empty string for events that aren't in a thread
+    dc_thread_id     TEXT    NOT NULL,
+    event_type       TEXT    NOT NULL,
+    data             TEXT    NOT NULL,
+    received_at      BIGINT  NOT NULL,
+    delayed          BOOLEAN NOT NULL,
+
+    PRIMARY KEY (dc_chan_id, dc_chan_receiver, seq),
+    CONSTRAINT spilled_message_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE
+);
+
 CREATE TABLE reaction (
     dc_chan_id       TEXT,
     dc_chan_receiver TEXT,
@@ -177,3 +278,11 @@ CREATE TABLE discord_file (
 );
 
 CREATE INDEX discord_file_mxc_idx ON discord_file (mxc);
+
+CREATE TABLE ignored_bot (
+    bot_id     TEXT NOT NULL,
+    -- Empty string for bots that are ignored in all channels
+    channel_id TEXT NOT NULL,
+
+    PRIMARY KEY (bot_id, channel_id)
+);
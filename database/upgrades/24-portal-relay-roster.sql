@@ -0,0 +1,2 @@
+-- v24 (compatible with v19+): Store relay roster message ID for portals
+ALTER TABLE portal ADD COLUMN relay_roster_message_id TEXT;
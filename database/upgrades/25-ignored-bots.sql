@@ -0,0 +1,8 @@
+-- v25 (compatible with v19+): Store ignored Discord bots
+CREATE TABLE ignored_bot (
+    bot_id     TEXT NOT NULL,
+    -- Empty string for bots that are ignored in all channels
+    channel_id TEXT NOT NULL,
+
+    PRIMARY KEY (bot_id, channel_id)
+);
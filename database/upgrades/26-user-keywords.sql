@@ -0,0 +1,8 @@
+-- v26 (compatible with v19+): Store keyword highlights for users
+CREATE TABLE user_keyword (
+    user_mxid TEXT,
+    keyword   TEXT,
+
+    PRIMARY KEY (user_mxid, keyword),
+    CONSTRAINT user_keyword_user_fkey FOREIGN KEY (user_mxid) REFERENCES "user" (mxid) ON DELETE CASCADE
+);
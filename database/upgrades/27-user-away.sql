@@ -0,0 +1,2 @@
+-- v27 (compatible with v19+): Store away mode for users
+ALTER TABLE "user" ADD COLUMN away BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,16 @@
+-- v28 (compatible with v19+): Store backfill progress so interrupted backfills can be resumed
+CREATE TABLE backfill_checkpoint (
+    dc_chan_id       TEXT,
+    dc_chan_receiver TEXT,
+    -- Empty string for the main channel
+    dc_thread_id     TEXT,
+    direction        TEXT    NOT NULL,
+    -- The last message that was bridged (exclusive lower bound for resuming)
+    after_id         TEXT    NOT NULL,
+    -- The newest message that the backfill should reach (inclusive)
+    until_id         TEXT    NOT NULL,
+    batch            INTEGER NOT NULL,
+
+    PRIMARY KEY (dc_chan_id, dc_chan_receiver, dc_thread_id),
+    CONSTRAINT backfill_checkpoint_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE
+);
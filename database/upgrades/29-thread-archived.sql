@@ -0,0 +1,3 @@
+-- v29 (compatible with v19+): Store thread archive state
+ALTER TABLE thread ADD COLUMN archived BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE thread ADD COLUMN locked BOOLEAN NOT NULL DEFAULT false;
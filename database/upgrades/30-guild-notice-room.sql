@@ -0,0 +1,2 @@
+-- v30 (compatible with v19+): Add admin notice rooms for guilds
+ALTER TABLE guild ADD COLUMN notice_room TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,10 @@
+-- v31 (compatible with v19+): Store spaces for Discord guild folders
+ALTER TABLE "user" ADD COLUMN folder_spaces BOOLEAN NOT NULL DEFAULT false;
+CREATE TABLE user_guild_folder (
+    user_mxid TEXT,
+    folder_id TEXT,
+    mxid      TEXT NOT NULL,
+
+    PRIMARY KEY (user_mxid, folder_id),
+    CONSTRAINT user_guild_folder_user_fkey FOREIGN KEY (user_mxid) REFERENCES "user" (mxid) ON DELETE CASCADE
+);
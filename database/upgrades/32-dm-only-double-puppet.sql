@@ -0,0 +1,2 @@
+-- v32 (compatible with v19+): Allow limiting double puppeting to DMs
+ALTER TABLE "user" ADD COLUMN dm_only_double_puppet BOOLEAN NOT NULL DEFAULT false;
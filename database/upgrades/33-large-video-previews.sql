@@ -0,0 +1,2 @@
+-- v33 (compatible with v19+): Add per-portal override for large video previews
+ALTER TABLE portal ADD COLUMN large_video_previews BOOLEAN;
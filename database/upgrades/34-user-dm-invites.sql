@@ -0,0 +1,8 @@
+-- v34 (compatible with v19+): Store extra users to invite to new DM portals
+CREATE TABLE user_dm_invite (
+    user_mxid   TEXT,
+    invite_mxid TEXT,
+
+    PRIMARY KEY (user_mxid, invite_mxid),
+    CONSTRAINT user_dm_invite_user_fkey FOREIGN KEY (user_mxid) REFERENCES "user" (mxid) ON DELETE CASCADE
+);
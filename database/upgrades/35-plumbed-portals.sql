@@ -0,0 +1,2 @@
+-- v35 (compatible with v19+): Mark portals bridged to existing community-managed rooms
+ALTER TABLE portal ADD COLUMN plumbed BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,9 @@
+-- v36 (compatible with v19+): Store per-portal handling of messages sent from the user's other Discord clients
+CREATE TABLE user_own_message_mode (
+    user_mxid  TEXT,
+    channel_id TEXT,
+    mode       TEXT NOT NULL,
+
+    PRIMARY KEY (user_mxid, channel_id),
+    CONSTRAINT user_own_message_mode_user_fkey FOREIGN KEY (user_mxid) REFERENCES "user" (mxid) ON DELETE CASCADE
+);
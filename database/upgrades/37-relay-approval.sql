@@ -0,0 +1,13 @@
+-- v37 (compatible with v19+): Store approvals of Matrix users in relayed portals
+ALTER TABLE portal ADD COLUMN relay_approval BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE portal_relay_approval (
+    dc_chan_id       TEXT,
+    dc_chan_receiver TEXT,
+    user_mxid        TEXT,
+    approved         BOOLEAN NOT NULL,
+    notice_mxid      TEXT NOT NULL,
+
+    PRIMARY KEY (dc_chan_id, dc_chan_receiver, user_mxid),
+    CONSTRAINT portal_relay_approval_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE ON UPDATE CASCADE
+);
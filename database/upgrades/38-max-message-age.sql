@@ -0,0 +1,3 @@
+-- v38 (compatible with v19+): Store per-portal maximum age of bridged Discord messages
+ALTER TABLE portal ADD COLUMN max_message_age INTEGER;
+ALTER TABLE portal ADD COLUMN skipped_until TEXT;
@@ -0,0 +1,2 @@
+-- v39 (compatible with v19+): Store per-portal minimum power level for relaying messages
+ALTER TABLE portal ADD COLUMN relay_min_level INTEGER;
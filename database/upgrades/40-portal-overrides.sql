@@ -0,0 +1,4 @@
+-- v40 (compatible with v19+): Store Matrix-side room name, topic and avatar overrides for portals
+ALTER TABLE portal ADD COLUMN name_override TEXT;
+ALTER TABLE portal ADD COLUMN topic_override TEXT;
+ALTER TABLE portal ADD COLUMN avatar_override TEXT;
@@ -0,0 +1,3 @@
+-- v41 (compatible with v19+): Store whether bridging is paused in portals
+ALTER TABLE portal ADD COLUMN paused_to_matrix BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE portal ADD COLUMN paused_to_discord BOOLEAN NOT NULL DEFAULT false;
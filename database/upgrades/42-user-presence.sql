@@ -0,0 +1,3 @@
+-- v42 (compatible with v19+): Store Discord presence set with the status command
+ALTER TABLE "user" ADD COLUMN presence_status TEXT NOT NULL DEFAULT '';
+ALTER TABLE "user" ADD COLUMN custom_status TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+-- v43 (compatible with v19+): Store when users first logged in for new user throttling
+ALTER TABLE "user" ADD COLUMN signup_ts BIGINT NOT NULL DEFAULT 0;
+-- Users who were already logged in aren't new users
+UPDATE "user" SET signup_ts=1 WHERE discord_token IS NOT NULL;
@@ -0,0 +1,2 @@
+-- v44 (compatible with v19+): Store user timezone for rendering timestamps
+ALTER TABLE "user" ADD COLUMN timezone TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- v45 (compatible with v19+): Store hash of portal feature state events
+ALTER TABLE portal ADD COLUMN features_hash TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,16 @@
+-- v46 (compatible with v19+): Store Discord events that overflowed portal message buffers
+CREATE TABLE spilled_message (
+    dc_chan_id       TEXT,
+    dc_chan_receiver TEXT,
+    seq              BIGINT  NOT NULL,
+    user_mxid        TEXT    NOT NULL,
+    -- Empty string for events that aren't in a thread
+    dc_thread_id     TEXT    NOT NULL,
+    event_type       TEXT    NOT NULL,
+    data             TEXT    NOT NULL,
+    received_at      BIGINT  NOT NULL,
+    delayed          BOOLEAN NOT NULL,
+
+    PRIMARY KEY (dc_chan_id, dc_chan_receiver, seq),
+    CONSTRAINT spilled_message_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+-- v47 (compatible with v19+): Store the bridge user whose Discord bot relays messages in a portal
+ALTER TABLE portal ADD COLUMN relay_bot_mxid TEXT;
@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"time"
 
 	"go.mau.fi/util/dbutil"
 	log "maunium.net/go/maulogger/v2"
@@ -21,18 +22,27 @@ func (uq *UserQuery) New() *User {
 }
 
 func (uq *UserQuery) GetByMXID(userID id.UserID) *User {
-	query := `SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version FROM "user" WHERE mxid=$1`
+	query := `SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, away, folder_spaces, dm_only_double_puppet, presence_status, custom_status, signup_ts, timezone FROM "user" WHERE mxid=$1`
 	return uq.New().Scan(uq.db.QueryRow(query, userID))
 }
 
 func (uq *UserQuery) GetByID(id string) *User {
-	query := `SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version FROM "user" WHERE dcid=$1`
+	query := `SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, away, folder_spaces, dm_only_double_puppet, presence_status, custom_status, signup_ts, timezone FROM "user" WHERE dcid=$1`
 	return uq.New().Scan(uq.db.QueryRow(query, id))
 }
 
+// CountSignupsSince returns the number of users who logged in for the first time after the given time.
+func (uq *UserQuery) CountSignupsSince(since time.Time) (count int) {
+	err := uq.db.QueryRow(`SELECT COUNT(*) FROM "user" WHERE signup_ts>$1`, since.UnixMilli()).Scan(&count)
+	if err != nil {
+		uq.log.Warnln("Failed to count recent signups:", err)
+	}
+	return
+}
+
 func (uq *UserQuery) GetAllWithToken() []*User {
 	query := `
-		SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version
+		SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, away, folder_spaces, dm_only_double_puppet, presence_status, custom_status, signup_ts, timezone
 		FROM "user" WHERE discord_token IS NOT NULL
 	`
 	rows, err := uq.db.Query(query)
@@ -61,12 +71,20 @@ type User struct {
 	SpaceRoom      id.RoomID
 	DMSpaceRoom    id.RoomID
 
-	ReadStateVersion int
+	ReadStateVersion   int
+	Away               bool
+	FolderSpaces       bool
+	DMOnlyDoublePuppet bool
+	PresenceStatus     string
+	CustomStatus       string
+	SignupTS           time.Time
+	Timezone           string
 }
 
 func (u *User) Scan(row dbutil.Scannable) *User {
 	var discordID, managementRoom, spaceRoom, dmSpaceRoom, discordToken sql.NullString
-	err := row.Scan(&u.MXID, &discordID, &discordToken, &managementRoom, &spaceRoom, &dmSpaceRoom, &u.ReadStateVersion)
+	var signupTS int64
+	err := row.Scan(&u.MXID, &discordID, &discordToken, &managementRoom, &spaceRoom, &dmSpaceRoom, &u.ReadStateVersion, &u.Away, &u.FolderSpaces, &u.DMOnlyDoublePuppet, &u.PresenceStatus, &u.CustomStatus, &signupTS, &u.Timezone)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			u.log.Errorln("Database scan failed:", err)
@@ -79,12 +97,22 @@ func (u *User) Scan(row dbutil.Scannable) *User {
 	u.ManagementRoom = id.RoomID(managementRoom.String)
 	u.SpaceRoom = id.RoomID(spaceRoom.String)
 	u.DMSpaceRoom = id.RoomID(dmSpaceRoom.String)
+	if signupTS != 0 {
+		u.SignupTS = time.UnixMilli(signupTS).UTC()
+	}
 	return u
 }
 
+func (u *User) signupTSVal() int64 {
+	if u.SignupTS.IsZero() {
+		return 0
+	}
+	return u.SignupTS.UnixMilli()
+}
+
 func (u *User) Insert() {
-	query := `INSERT INTO "user" (mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version) VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	_, err := u.db.Exec(query, u.MXID, strPtr(u.DiscordID), strPtr(u.DiscordToken), strPtr(string(u.ManagementRoom)), strPtr(string(u.SpaceRoom)), strPtr(string(u.DMSpaceRoom)), u.ReadStateVersion)
+	query := `INSERT INTO "user" (mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, away, folder_spaces, dm_only_double_puppet, presence_status, custom_status, signup_ts, timezone) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`
+	_, err := u.db.Exec(query, u.MXID, strPtr(u.DiscordID), strPtr(u.DiscordToken), strPtr(string(u.ManagementRoom)), strPtr(string(u.SpaceRoom)), strPtr(string(u.DMSpaceRoom)), u.ReadStateVersion, u.Away, u.FolderSpaces, u.DMOnlyDoublePuppet, u.PresenceStatus, u.CustomStatus, u.signupTSVal(), u.Timezone)
 	if err != nil {
 		u.log.Warnfln("Failed to insert %s: %v", u.MXID, err)
 		panic(err)
@@ -92,10 +120,19 @@ func (u *User) Insert() {
 }
 
 func (u *User) Update() {
-	query := `UPDATE "user" SET dcid=$1, discord_token=$2, management_room=$3, space_room=$4, dm_space_room=$5, read_state_version=$6 WHERE mxid=$7`
-	_, err := u.db.Exec(query, strPtr(u.DiscordID), strPtr(u.DiscordToken), strPtr(string(u.ManagementRoom)), strPtr(string(u.SpaceRoom)), strPtr(string(u.DMSpaceRoom)), u.ReadStateVersion, u.MXID)
+	query := `UPDATE "user" SET dcid=$1, discord_token=$2, management_room=$3, space_room=$4, dm_space_room=$5, read_state_version=$6, away=$7, folder_spaces=$8, dm_only_double_puppet=$9, presence_status=$10, custom_status=$11, signup_ts=$12, timezone=$13 WHERE mxid=$14`
+	_, err := u.db.Exec(query, strPtr(u.DiscordID), strPtr(u.DiscordToken), strPtr(string(u.ManagementRoom)), strPtr(string(u.SpaceRoom)), strPtr(string(u.DMSpaceRoom)), u.ReadStateVersion, u.Away, u.FolderSpaces, u.DMOnlyDoublePuppet, u.PresenceStatus, u.CustomStatus, u.signupTSVal(), u.Timezone, u.MXID)
 	if err != nil {
 		u.log.Warnfln("Failed to update %q: %v", u.MXID, err)
 		panic(err)
 	}
 }
+
+// Delete removes the user and all their per-user data, like portal membership, keywords, DM invites, own message modes and guild folders.
+func (u *User) Delete() {
+	_, err := u.db.Exec(`DELETE FROM "user" WHERE mxid=$1`, u.MXID)
+	if err != nil {
+		u.log.Warnfln("Failed to delete %q: %v", u.MXID, err)
+		panic(err)
+	}
+}
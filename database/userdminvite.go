@@ -0,0 +1,42 @@
+package database
+
+import (
+	"maunium.net/go/mautrix/id"
+)
+
+func (u *User) GetDMInvites() []id.UserID {
+	rows, err := u.db.Query("SELECT invite_mxid FROM user_dm_invite WHERE user_mxid=$1", u.MXID)
+	if err != nil {
+		u.log.Errorln("Failed to get DM invites:", err)
+		panic(err)
+	}
+	defer rows.Close()
+	var invites []id.UserID
+	for rows.Next() {
+		var userID id.UserID
+		err = rows.Scan(&userID)
+		if err != nil {
+			u.log.Errorln("Failed to scan DM invite:", err)
+			panic(err)
+		}
+		invites = append(invites, userID)
+	}
+	return invites
+}
+
+func (u *User) AddDMInvite(userID id.UserID) {
+	query := "INSERT INTO user_dm_invite (user_mxid, invite_mxid) VALUES ($1, $2) ON CONFLICT (user_mxid, invite_mxid) DO NOTHING"
+	_, err := u.db.Exec(query, u.MXID, userID)
+	if err != nil {
+		u.log.Warnfln("Failed to insert DM invite %s for %s: %v", userID, u.MXID, err)
+		panic(err)
+	}
+}
+
+func (u *User) RemoveDMInvite(userID id.UserID) {
+	_, err := u.db.Exec("DELETE FROM user_dm_invite WHERE user_mxid=$1 AND invite_mxid=$2", u.MXID, userID)
+	if err != nil {
+		u.log.Warnfln("Failed to delete DM invite %s for %s: %v", userID, u.MXID, err)
+		panic(err)
+	}
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"maunium.net/go/mautrix/id"
+)
+
+func (u *User) GetGuildFolderSpaces() map[string]id.RoomID {
+	rows, err := u.db.Query("SELECT folder_id, mxid FROM user_guild_folder WHERE user_mxid=$1", u.MXID)
+	if err != nil {
+		u.log.Errorln("Failed to get guild folder spaces:", err)
+		panic(err)
+	}
+	defer rows.Close()
+	spaces := make(map[string]id.RoomID)
+	for rows.Next() {
+		var folderID string
+		var mxid id.RoomID
+		err = rows.Scan(&folderID, &mxid)
+		if err != nil {
+			u.log.Errorln("Failed to scan guild folder space:", err)
+			panic(err)
+		}
+		spaces[folderID] = mxid
+	}
+	return spaces
+}
+
+func (u *User) SetGuildFolderSpace(folderID string, mxid id.RoomID) {
+	query := `
+		INSERT INTO user_guild_folder (user_mxid, folder_id, mxid) VALUES ($1, $2, $3)
+		ON CONFLICT (user_mxid, folder_id) DO UPDATE SET mxid=excluded.mxid
+	`
+	_, err := u.db.Exec(query, u.MXID, folderID, mxid)
+	if err != nil {
+		u.log.Warnfln("Failed to insert guild folder space %s for %s: %v", folderID, u.MXID, err)
+		panic(err)
+	}
+}
+
+func (u *User) RemoveGuildFolderSpace(folderID string) {
+	_, err := u.db.Exec("DELETE FROM user_guild_folder WHERE user_mxid=$1 AND folder_id=$2", u.MXID, folderID)
+	if err != nil {
+		u.log.Warnfln("Failed to delete guild folder space %s for %s: %v", folderID, u.MXID, err)
+		panic(err)
+	}
+}
@@ -0,0 +1,38 @@
+package database
+
+func (u *User) GetKeywords() []string {
+	rows, err := u.db.Query("SELECT keyword FROM user_keyword WHERE user_mxid=$1", u.MXID)
+	if err != nil {
+		u.log.Errorln("Failed to get keywords:", err)
+		panic(err)
+	}
+	defer rows.Close()
+	var keywords []string
+	for rows.Next() {
+		var keyword string
+		err = rows.Scan(&keyword)
+		if err != nil {
+			u.log.Errorln("Failed to scan keyword:", err)
+			panic(err)
+		}
+		keywords = append(keywords, keyword)
+	}
+	return keywords
+}
+
+func (u *User) AddKeyword(keyword string) {
+	query := "INSERT INTO user_keyword (user_mxid, keyword) VALUES ($1, $2) ON CONFLICT (user_mxid, keyword) DO NOTHING"
+	_, err := u.db.Exec(query, u.MXID, keyword)
+	if err != nil {
+		u.log.Warnfln("Failed to insert keyword %q for %s: %v", keyword, u.MXID, err)
+		panic(err)
+	}
+}
+
+func (u *User) RemoveKeyword(keyword string) {
+	_, err := u.db.Exec("DELETE FROM user_keyword WHERE user_mxid=$1 AND keyword=$2", u.MXID, keyword)
+	if err != nil {
+		u.log.Warnfln("Failed to delete keyword %q for %s: %v", keyword, u.MXID, err)
+		panic(err)
+	}
+}
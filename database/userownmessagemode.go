@@ -0,0 +1,41 @@
+package database
+
+func (u *User) GetOwnMessageModes() map[string]string {
+	rows, err := u.db.Query("SELECT channel_id, mode FROM user_own_message_mode WHERE user_mxid=$1", u.MXID)
+	if err != nil {
+		u.log.Errorln("Failed to get own message modes:", err)
+		panic(err)
+	}
+	defer rows.Close()
+	modes := make(map[string]string)
+	for rows.Next() {
+		var channelID, mode string
+		err = rows.Scan(&channelID, &mode)
+		if err != nil {
+			u.log.Errorln("Failed to scan own message mode:", err)
+			panic(err)
+		}
+		modes[channelID] = mode
+	}
+	return modes
+}
+
+func (u *User) SetOwnMessageMode(channelID, mode string) {
+	query := `
+		INSERT INTO user_own_message_mode (user_mxid, channel_id, mode) VALUES ($1, $2, $3)
+		ON CONFLICT (user_mxid, channel_id) DO UPDATE SET mode=excluded.mode
+	`
+	_, err := u.db.Exec(query, u.MXID, channelID, mode)
+	if err != nil {
+		u.log.Warnfln("Failed to set own message mode in %s for %s: %v", channelID, u.MXID, err)
+		panic(err)
+	}
+}
+
+func (u *User) DeleteOwnMessageMode(channelID string) {
+	_, err := u.db.Exec("DELETE FROM user_own_message_mode WHERE user_mxid=$1 AND channel_id=$2", u.MXID, channelID)
+	if err != nil {
+		u.log.Warnfln("Failed to delete own message mode in %s for %s: %v", channelID, u.MXID, err)
+		panic(err)
+	}
+}
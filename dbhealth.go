@@ -0,0 +1,146 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"maunium.net/go/mautrix/bridge/status"
+)
+
+type respDebugDatabase struct {
+	Healthy            bool       `json:"healthy"`
+	LastCheck          *time.Time `json:"last_check,omitempty"`
+	MaxOpenConnections int        `json:"max_open_connections"`
+	OpenConnections    int        `json:"open_connections"`
+	InUse              int        `json:"in_use"`
+	Idle               int        `json:"idle"`
+	WaitCount          int64      `json:"wait_count"`
+	WaitDurationMS     int64      `json:"wait_duration_ms"`
+	MaxIdleClosed      int64      `json:"max_idle_closed"`
+	MaxIdleTimeClosed  int64      `json:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64      `json:"max_lifetime_closed"`
+}
+
+// dbHealth keeps track of the database health check state.
+type dbHealth struct {
+	unhealthy     bool
+	lastCheck     time.Time
+	lastWaitCount int64
+	lastWarning   time.Time
+}
+
+// startDatabaseHealthCheck periodically pings the database and watches the connection pool for saturation.
+func (br *DiscordBridge) startDatabaseHealthCheck() {
+	cfg := &br.Config.DatabaseExtras
+	if cfg.HealthCheck.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(cfg.HealthCheck.Interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		br.checkDatabaseHealth()
+		br.checkDatabasePoolSaturation()
+	}
+}
+
+func (br *DiscordBridge) pingDatabase() error {
+	timeout := time.Duration(br.Config.DatabaseExtras.HealthCheck.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return br.Bridge.DB.RawDB.PingContext(ctx)
+}
+
+func (br *DiscordBridge) checkDatabaseHealth() {
+	log := br.ZLog.With().Str("action", "database health check").Logger()
+	err := br.pingDatabase()
+	if err != nil {
+		log.Warn().Err(err).Msg("Database health check failed, dropping idle connections")
+		// Idle connections may be broken (e.g. after a database restart), so close them to force new ones to be opened.
+		rawDB := br.Bridge.DB.RawDB
+		rawDB.SetMaxIdleConns(0)
+		rawDB.SetMaxIdleConns(br.Config.AppService.Database.MaxIdleConns)
+		err = br.pingDatabase()
+	}
+	br.dbHealthLock.Lock()
+	defer br.dbHealthLock.Unlock()
+	br.dbHealth.lastCheck = time.Now()
+	if err != nil {
+		if !br.dbHealth.unhealthy {
+			log.Error().Err(err).Msg("Database is unreachable")
+			br.sendAdminAlert(adminAlertDatabase, fmt.Sprintf("The bridge can't reach its database: %v", err))
+			br.SendGlobalBridgeState(status.BridgeState{
+				StateEvent: status.StateBridgeUnreachable,
+				Error:      "dc-database-unreachable",
+				Message:    "The bridge can't reach its database",
+			}.Fill(nil))
+		}
+		br.dbHealth.unhealthy = true
+	} else if br.dbHealth.unhealthy {
+		log.Info().Msg("Database connection recovered")
+		br.dbHealth.unhealthy = false
+		br.SendGlobalBridgeState(status.BridgeState{StateEvent: status.StateRunning}.Fill(nil))
+	}
+}
+
+func (br *DiscordBridge) checkDatabasePoolSaturation() {
+	warnInterval := time.Duration(br.Config.DatabaseExtras.SaturationWarningInterval) * time.Second
+	stats := br.Bridge.DB.RawDB.Stats()
+	br.dbHealthLock.Lock()
+	defer br.dbHealthLock.Unlock()
+	newWaits := stats.WaitCount - br.dbHealth.lastWaitCount
+	br.dbHealth.lastWaitCount = stats.WaitCount
+	if warnInterval <= 0 || newWaits <= 0 || time.Since(br.dbHealth.lastWarning) < warnInterval {
+		return
+	}
+	br.dbHealth.lastWarning = time.Now()
+	br.ZLog.Warn().
+		Int64("new_waits", newWaits).
+		Int("in_use", stats.InUse).
+		Int("max_open_connections", stats.MaxOpenConnections).
+		Dur("total_wait_duration", stats.WaitDuration).
+		Msg("Database connection pool is saturated, queries had to wait for a free connection")
+}
+
+func (br *DiscordBridge) getDatabaseStats() respDebugDatabase {
+	stats := br.Bridge.DB.RawDB.Stats()
+	br.dbHealthLock.Lock()
+	defer br.dbHealthLock.Unlock()
+	return respDebugDatabase{
+		Healthy:            !br.dbHealth.unhealthy,
+		LastCheck:          timePtrIfSet(br.dbHealth.lastCheck),
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDurationMS:     stats.WaitDuration.Milliseconds(),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	}
+}
+
+func (p *ProvisioningAPI) debugDatabase(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, http.StatusOK, p.bridge.getDatabaseStats())
+}
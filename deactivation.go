@@ -0,0 +1,114 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/config"
+)
+
+// handleDeactivationCheckMembership checks whether a logged-in user who left a room has been deactivated.
+// Synapse makes deactivated users leave every room, so only one check per user runs at a time.
+func (br *DiscordBridge) handleDeactivationCheckMembership(evt *event.Event) {
+	if br.Config.Bridge.Deactivation.AdminToken == "" || evt.Sender != id.UserID(evt.GetStateKey()) ||
+		evt.Content.AsMember().Membership != event.MembershipLeave {
+		return
+	}
+	_, server, err := evt.Sender.Parse()
+	if err != nil || server != br.Config.Homeserver.Domain {
+		return
+	}
+	user := br.GetCachedUserByMXID(evt.Sender)
+	if user == nil || user.DiscordToken == "" || !br.deactivationChecks.Add(user.MXID) {
+		return
+	}
+	go func() {
+		defer br.deactivationChecks.Remove(user.MXID)
+		deactivated, err := br.isUserDeactivated(user.MXID)
+		if err != nil {
+			user.log.Warn().Err(err).Msg("Failed to check if user was deactivated")
+		} else if deactivated {
+			br.handleUserDeactivated(user)
+		}
+	}()
+}
+
+type synapseAdminUser struct {
+	Deactivated bool `json:"deactivated"`
+}
+
+func (br *DiscordBridge) isUserDeactivated(userID id.UserID) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	url := br.Bot.BuildURL(mautrix.SynapseAdminURLPath{"v2", "users", userID})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+br.Config.Bridge.Deactivation.AdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	var adminUser synapseAdminUser
+	if err = json.NewDecoder(resp.Body).Decode(&adminUser); err != nil {
+		return false, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return adminUser.Deactivated, nil
+}
+
+// handleUserDeactivated logs out a deactivated user and cleans up their data according to the config,
+// so that their Discord connection doesn't keep running without a Matrix account.
+func (br *DiscordBridge) handleUserDeactivated(user *User) {
+	cleanup := br.Config.Bridge.Deactivation.Cleanup
+	user.log.Info().Str("cleanup", string(cleanup)).Msg("User was deactivated on the homeserver, cleaning up")
+	if puppet := br.GetPuppetByCustomMXID(user.MXID); puppet != nil {
+		puppet.ClearCustomMXID()
+	}
+	if cleanup == config.DeactivationPurge {
+		br.purgeUserData(user, false)
+		return
+	}
+	discordID := user.DiscordID
+	user.Logout(false)
+	if cleanup != config.DeactivationDeletePortals {
+		return
+	}
+	// The user may have logged out before being deactivated, so the portals are found through user_portal too
+	portalsToClean := br.findUserDMPortals(user, discordID)
+	for _, portal := range portalsToClean {
+		portal.Delete()
+	}
+	go func() {
+		for _, portal := range portalsToClean {
+			portal.cleanup(false)
+		}
+	}()
+}
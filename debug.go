@@ -0,0 +1,192 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/gorilla/mux"
+	"maunium.net/go/mautrix/id"
+)
+
+func (p *ProvisioningAPI) registerDebugEndpoints(r *mux.Router) {
+	r.Use(p.authMiddleware)
+	r.PathPrefix("/pprof").Handler(http.DefaultServeMux)
+	r.HandleFunc("/runtime", p.debugRuntime).Methods(http.MethodGet)
+	r.HandleFunc("/sessions", p.debugSessions).Methods(http.MethodGet)
+	r.HandleFunc("/cache", p.debugCache).Methods(http.MethodGet)
+	r.HandleFunc("/database", p.debugDatabase).Methods(http.MethodGet)
+}
+
+// startDebugListener serves the debug endpoints on a separate address, so that they don't need to be
+// exposed on the same port as the appservice API.
+func (p *ProvisioningAPI) startDebugListener(addr string) {
+	r := mux.NewRouter()
+	p.registerDebugEndpoints(r.PathPrefix("/debug").Subrouter())
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           r,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	p.log.Infoln("Starting debug listener at", addr)
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		p.log.Errorln("Debug listener failed:", err)
+	}
+}
+
+type respDebugRuntime struct {
+	Goroutines   int    `json:"goroutines"`
+	HeapAlloc    uint64 `json:"heap_alloc"`
+	HeapInuse    uint64 `json:"heap_inuse"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	Sys          uint64 `json:"sys"`
+	NumGC        uint32 `json:"num_gc"`
+	PauseTotalNs uint64 `json:"pause_total_ns"`
+	GoVersion    string `json:"go_version"`
+}
+
+func (p *ProvisioningAPI) debugRuntime(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	jsonResponse(w, http.StatusOK, respDebugRuntime{
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapInuse:    mem.HeapInuse,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		NumGC:        mem.NumGC,
+		PauseTotalNs: mem.PauseTotalNs,
+		GoVersion:    runtime.Version(),
+	})
+}
+
+type respDebugSession struct {
+	MXID              id.UserID  `json:"mxid"`
+	DiscordID         string     `json:"discord_id"`
+	IsBot             bool       `json:"is_bot"`
+	Connected         bool       `json:"connected"`
+	DataReady         bool       `json:"data_ready"`
+	LastHeartbeatSent *time.Time `json:"last_heartbeat_sent,omitempty"`
+	LastHeartbeatAck  *time.Time `json:"last_heartbeat_ack,omitempty"`
+	Guilds            int        `json:"guilds"`
+	PrivateChannels   int        `json:"private_channels"`
+}
+
+func timePtrIfSet(ts time.Time) *time.Time {
+	if ts.IsZero() {
+		return nil
+	}
+	return &ts
+}
+
+func (p *ProvisioningAPI) debugSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := make([]respDebugSession, 0)
+	for _, user := range p.bridge.getAllUsersWithToken() {
+		sess := user.Session
+		info := respDebugSession{
+			MXID:      user.MXID,
+			DiscordID: user.DiscordID,
+			Connected: user.Connected(),
+		}
+		if sess != nil {
+			sess.RLock()
+			info.IsBot = !sess.IsUser
+			info.DataReady = sess.DataReady
+			info.LastHeartbeatSent = timePtrIfSet(sess.LastHeartbeatSent)
+			info.LastHeartbeatAck = timePtrIfSet(sess.LastHeartbeatAck)
+			sess.RUnlock()
+			sess.State.RLock()
+			info.Guilds = len(sess.State.Guilds)
+			info.PrivateChannels = len(sess.State.PrivateChannels)
+			sess.State.RUnlock()
+		}
+		sessions = append(sessions, info)
+	}
+	jsonResponse(w, http.StatusOK, sessions)
+}
+
+type respDebugStateCache struct {
+	MXID     id.UserID `json:"mxid"`
+	Guilds   int       `json:"guilds"`
+	Channels int       `json:"channels"`
+	Threads  int       `json:"threads"`
+	Members  int       `json:"members"`
+	Roles    int       `json:"roles"`
+	Emojis   int       `json:"emojis"`
+}
+
+type respDebugCache struct {
+	Users               int                   `json:"users"`
+	Portals             int                   `json:"portals"`
+	Puppets             int                   `json:"puppets"`
+	Threads             int                   `json:"threads"`
+	Guilds              int                   `json:"guilds"`
+	AttachmentTransfers int                   `json:"attachment_transfers"`
+	APICacheChannels    int                   `json:"api_cache_channels"`
+	APICacheUsers       int                   `json:"api_cache_users"`
+	APICacheMembers     int                   `json:"api_cache_members"`
+	DiscordState        []respDebugStateCache `json:"discord_state"`
+}
+
+func (p *ProvisioningAPI) debugCache(w http.ResponseWriter, r *http.Request) {
+	br := p.bridge
+	var resp respDebugCache
+	br.usersLock.Lock()
+	resp.Users = len(br.usersByMXID)
+	br.usersLock.Unlock()
+	br.portalsLock.Lock()
+	resp.Portals = len(br.portalsByID)
+	br.portalsLock.Unlock()
+	br.puppetsLock.Lock()
+	resp.Puppets = len(br.puppets)
+	br.puppetsLock.Unlock()
+	br.threadsLock.Lock()
+	resp.Threads = len(br.threadsByID)
+	br.threadsLock.Unlock()
+	br.guildsLock.Lock()
+	resp.Guilds = len(br.guildsByID)
+	br.guildsLock.Unlock()
+	resp.AttachmentTransfers = len(br.attachmentTransfers.CopyData())
+	resp.APICacheChannels = br.apiCache.channels.Len()
+	resp.APICacheUsers = br.apiCache.users.Len()
+	resp.APICacheMembers = br.apiCache.members.Len()
+	resp.DiscordState = make([]respDebugStateCache, 0)
+	for _, user := range br.getAllUsersWithToken() {
+		if user.Session == nil {
+			continue
+		}
+		state := user.Session.State
+		stats := respDebugStateCache{MXID: user.MXID}
+		state.RLock()
+		stats.Guilds = len(state.Guilds)
+		stats.Channels = len(state.PrivateChannels)
+		for _, guild := range state.Guilds {
+			stats.Channels += len(guild.Channels)
+			stats.Threads += len(guild.Threads)
+			stats.Members += len(guild.Members)
+			stats.Roles += len(guild.Roles)
+			stats.Emojis += len(guild.Emojis)
+		}
+		state.RUnlock()
+		resp.DiscordState = append(resp.DiscordState, stats)
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
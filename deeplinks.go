@@ -0,0 +1,87 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+var cmdLink = &commands.FullHandler{
+	Func: wrapCommand(fnLink),
+	Name: "link",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Get links to open the current portal's Discord channel in the browser or the Discord app.",
+	},
+	RequiresPortal: true,
+}
+
+// discordChannelLinks returns the web and app deep links to a Discord channel.
+func discordChannelLinks(guildID, channelID string) (web, app string) {
+	if guildID == "" {
+		guildID = "@me"
+	}
+	return fmt.Sprintf("https://discord.com/channels/%s/%s", guildID, channelID),
+		fmt.Sprintf("discord://-/channels/%s/%s", guildID, channelID)
+}
+
+// guildInviteLink returns the vanity invite of the portal's guild, or a permanent invite to the channel if
+// link_command_invites is enabled. An existing invite is reused if the user can see the channel's invites.
+func (portal *Portal) guildInviteLink(user *User) (string, error) {
+	if portal.GuildID == "" || user.Session == nil {
+		return "", nil
+	}
+	if guild, err := user.Session.State.Guild(portal.GuildID); err == nil && guild.VanityURLCode != "" {
+		return "https://discord.gg/" + guild.VanityURLCode, nil
+	} else if !portal.bridge.Config.Bridge.LinkCommandInvites {
+		return "", nil
+	}
+	refererOpts := portal.RefererOptIfUser(user.Session, "")
+	invites, err := user.Session.ChannelInvites(portal.Key.ChannelID, refererOpts...)
+	if err == nil {
+		for _, invite := range invites {
+			if invite.MaxAge == 0 && invite.MaxUses == 0 && !invite.Temporary {
+				return "https://discord.gg/" + invite.Code, nil
+			}
+		}
+	}
+	invite, err := user.Session.ChannelInviteCreate(portal.Key.ChannelID, discordgo.Invite{}, refererOpts...)
+	if err != nil {
+		return "", err
+	}
+	return "https://discord.gg/" + invite.Code, nil
+}
+
+func fnLink(ce *WrappedCommandEvent) {
+	web, app := discordChannelLinks(ce.Portal.GuildID, ce.Portal.Key.ChannelID)
+	lines := []string{
+		fmt.Sprintf("* Web: %s", web),
+		fmt.Sprintf("* Discord app: `%s`", app),
+	}
+	invite, err := ce.Portal.guildInviteLink(ce.User)
+	if err != nil {
+		ce.ZLog.Warn().Err(err).Msg("Failed to get invite link")
+		lines = append(lines, fmt.Sprintf("* Failed to create invite: %v", err))
+	} else if invite != "" {
+		lines = append(lines, fmt.Sprintf("* Invite: %s", invite))
+	}
+	ce.Reply(strings.Join(lines, "\n"))
+}
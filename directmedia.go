@@ -57,7 +57,11 @@ type DirectMediaAPI struct {
 
 	signatureKey [32]byte
 
+	// storage is the S3-compatible bucket that reuploaded media is stored in, if enabled.
+	storage *s3Client
+
 	attachmentCache     map[AttachmentCacheKey]AttachmentCacheValue
+	attachmentAccess    map[AttachmentCacheKey]*attachmentAccess
 	attachmentCacheLock sync.Mutex
 }
 
@@ -73,12 +77,15 @@ type AttachmentCacheValue struct {
 
 func newDirectMediaAPI(br *DiscordBridge) *DirectMediaAPI {
 	if !br.Config.Bridge.DirectMedia.Enabled {
+		if br.Config.Bridge.MediaStorage.Enabled {
+			br.ZLog.Warn().Msg("External media storage requires direct media to be enabled, media will be uploaded to the homeserver")
+		}
 		return nil
 	}
 	dma := &DirectMediaAPI{
 		bridge: br,
 		cfg:    br.Config.Bridge.DirectMedia,
-		log:    br.ZLog.With().Str("component", "direct media").Logger(),
+		log:    br.componentLog("direct media"),
 		proxy: http.Client{
 			Transport: &http.Transport{
 				DialContext:         (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
@@ -87,7 +94,8 @@ func newDirectMediaAPI(br *DiscordBridge) *DirectMediaAPI {
 			},
 			Timeout: 60 * time.Second,
 		},
-		attachmentCache: make(map[AttachmentCacheKey]AttachmentCacheValue),
+		attachmentCache:  make(map[AttachmentCacheKey]AttachmentCacheValue),
+		attachmentAccess: make(map[AttachmentCacheKey]*attachmentAccess),
 	}
 	r := br.AS.Router
 
@@ -98,6 +106,9 @@ func newDirectMediaAPI(br *DiscordBridge) *DirectMediaAPI {
 		return nil
 	}
 	dma.signatureKey = sha256.Sum256(parsed.Priv.Seed())
+	if br.Config.Bridge.MediaStorage.Enabled {
+		dma.storage = newS3Client(br.Config.Bridge.MediaStorage.S3)
+	}
 	dma.ks = &federation.KeyServer{
 		KeyProvider: &federation.StaticServerKey{
 			ServerName: dma.cfg.ServerName,
@@ -419,6 +430,7 @@ func (dma *DirectMediaAPI) getMediaURL(ctx context.Context, encodedMediaID strin
 	case *AttachmentMediaData:
 		dma.attachmentCacheLock.Lock()
 		defer dma.attachmentCacheLock.Unlock()
+		dma.recordAttachmentAccess(mediaData)
 		cached, ok := dma.attachmentCache[mediaData.CacheKey()]
 		if ok && time.Until(cached.Expiry) > 5*time.Minute {
 			return cached.URL, cached.Expiry, nil
@@ -482,6 +494,16 @@ func (dma *DirectMediaAPI) getMediaURL(ctx context.Context, encodedMediaID strin
 				fmt.Sprintf("%x", mediaData.AvatarID),
 			)
 		}
+	case *StoredFileMediaData:
+		url, expiry, err = dma.getStoredMediaURL(mediaData)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to get stored media URL")
+			err = &RespError{
+				Code:    mautrix.MNotFound.ErrCode,
+				Message: "Media storage is not available",
+				Status:  http.StatusNotFound,
+			}
+		}
 	default:
 		zerolog.Ctx(ctx).Error().Type("media_data_type", mediaData).Msg("Unrecognized media data struct")
 		err = &RespError{
@@ -22,6 +22,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -38,6 +39,7 @@ const (
 	MediaIDClassSticker           MediaIDClass = 3
 	MediaIDClassUserAvatar        MediaIDClass = 4
 	MediaIDClassGuildMemberAvatar MediaIDClass = 5
+	MediaIDClassStoredFile        MediaIDClass = 6
 )
 
 type MediaIDData interface {
@@ -125,6 +127,8 @@ func (mid *MediaID) Read(from io.Reader) error {
 		mid.Data = &UserAvatarMediaData{}
 	case MediaIDClassGuildMemberAvatar:
 		mid.Data = &GuildMemberAvatarMediaData{}
+	case MediaIDClassStoredFile:
+		mid.Data = &StoredFileMediaData{}
 	default:
 		return fmt.Errorf("%w: unrecognized type class %d", ErrUnsupportedMediaID, versionAndClass[1])
 	}
@@ -285,3 +289,31 @@ func (guamd *GuildMemberAvatarMediaData) Wrap() *MediaID {
 		Data:      guamd,
 	}
 }
+
+type StoredFileMediaData struct {
+	ObjectID [16]byte
+}
+
+func (sfmd *StoredFileMediaData) Write(to io.Writer) {
+	_ = binary.Write(to, binary.BigEndian, sfmd)
+}
+
+func (sfmd *StoredFileMediaData) Read(from io.Reader) error {
+	return binary.Read(from, binary.BigEndian, sfmd)
+}
+
+func (sfmd *StoredFileMediaData) Size() int {
+	return binary.Size(sfmd)
+}
+
+func (sfmd *StoredFileMediaData) Wrap() *MediaID {
+	return &MediaID{
+		Version:   MediaIDVersion,
+		TypeClass: MediaIDClassStoredFile,
+		Data:      sfmd,
+	}
+}
+
+func (sfmd *StoredFileMediaData) ObjectName() string {
+	return hex.EncodeToString(sfmd.ObjectID[:])
+}
@@ -0,0 +1,107 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+var cmdMigrateDirectMedia = &commands.FullHandler{
+	Func: wrapCommand(fnMigrateDirectMedia),
+	Name: "migrate-direct-media",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "Switch reuploaded ghost avatars, emojis and stickers in emote packs to direct media mxc:// URIs.",
+	},
+	RequiresAdmin: true,
+}
+
+func fnMigrateDirectMedia(ce *WrappedCommandEvent) {
+	if ce.Bridge.DMA == nil {
+		ce.Reply("Direct media is not enabled")
+		return
+	}
+	puppets := ce.Bridge.GetAllPuppets()
+	ce.Reply("Checking avatars of %d ghosts and emote packs in the background...", len(puppets))
+	go func() {
+		migrated := ce.Bridge.migratePuppetAvatarsToDirectMedia(puppets)
+		packs := ce.Bridge.migrateEmotePacksToDirectMedia()
+		ce.Reply("Switched %d ghost avatars to direct media and resynced %d emote packs. "+
+			"Attachments and emojis in messages that were already bridged keep their reuploaded copies, "+
+			"as Matrix events can't be changed.", migrated, packs)
+	}()
+}
+
+// migrateEmotePacksToDirectMedia resends the emote packs of bridged guilds. The packs are rebuilt with direct media URIs,
+// so the emojis and stickers that were reuploaded into the discord_file table are no longer referenced by them.
+func (br *DiscordBridge) migrateEmotePacksToDirectMedia() (synced int) {
+	if !br.Config.Bridge.EmotePacks.Enabled {
+		return
+	}
+	users := br.getAllUsersWithToken()
+	for _, guild := range br.GetAllGuilds() {
+		if guild.MXID == "" {
+			continue
+		}
+		// The emojis and stickers are taken from the state cache of any user who's in the guild
+		for _, user := range users {
+			if user.Session == nil {
+				continue
+			} else if _, err := user.Session.State.Guild(guild.ID); err == nil {
+				user.syncGuildEmotePack(guild.ID)
+				synced++
+				break
+			}
+		}
+	}
+	return
+}
+
+// migratePuppetAvatarsToDirectMedia replaces avatars that were reuploaded before direct media was enabled.
+// Already bridged messages keep their old mxc:// URIs, as Matrix events can't be changed after the fact.
+func (br *DiscordBridge) migratePuppetAvatarsToDirectMedia(puppets []*Puppet) (migrated int) {
+	serverName := br.Config.Bridge.DirectMedia.ServerName
+	for _, puppet := range puppets {
+		if puppet.Avatar == "" || puppet.AvatarURL.Homeserver == serverName {
+			continue
+		}
+		puppet.syncLock.Lock()
+		newURL := br.DMA.AvatarMXC("", puppet.ID, puppet.Avatar)
+		if newURL.IsEmpty() {
+			puppet.syncLock.Unlock()
+			continue
+		}
+		err := puppet.DefaultIntent().SetAvatarURL(newURL)
+		if err != nil {
+			puppet.log.Warn().Err(err).Msg("Failed to switch avatar to direct media")
+			puppet.syncLock.Unlock()
+			continue
+		}
+		puppet.AvatarURL = newURL
+		puppet.AvatarSet = true
+		puppet.Update()
+		puppet.syncLock.Unlock()
+		go puppet.updatePortalMeta(func(portal *Portal) {
+			if portal.UpdateAvatarFromPuppet(puppet) {
+				portal.Update()
+				portal.UpdateBridgeInfo()
+			}
+		})
+		migrated++
+	}
+	return
+}
@@ -8,7 +8,7 @@ import (
 
 func (user *User) channelIsBridgeable(channel *discordgo.Channel) bool {
 	switch channel.Type {
-	case discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildNews:
+	case discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildNews, discordgo.ChannelTypeGuildForum, discordgo.ChannelTypeGuildMedia:
 		// allowed
 	case discordgo.ChannelTypeDM, discordgo.ChannelTypeGroupDM:
 		// DMs are always bridgeable, no need for permission checks
@@ -23,7 +23,7 @@ func (user *User) channelIsBridgeable(channel *discordgo.Channel) bool {
 	member, err := user.Session.State.Member(channel.GuildID, user.DiscordID)
 	if errors.Is(err, discordgo.ErrStateNotFound) {
 		log.Debug().Msg("Fetching own membership in guild to check roles")
-		member, err = user.Session.GuildMember(channel.GuildID, user.DiscordID)
+		member, err = user.getGuildMember(channel.GuildID, user.DiscordID)
 		if err != nil {
 			log.Warn().Err(err).Msg("Failed to get own membership in guild from server")
 		} else {
@@ -0,0 +1,216 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+var discordPermissionNames = map[int64]string{
+	discordgo.PermissionManageChannels:  "Manage Channels",
+	discordgo.PermissionManageServer:    "Manage Server",
+	discordgo.PermissionManageMessages:  "Manage Messages",
+	discordgo.PermissionManageThreads:   "Manage Threads",
+	discordgo.PermissionManageWebhooks:  "Manage Webhooks",
+	discordgo.PermissionModerateMembers: "Moderate Members",
+}
+
+// DiscordPermissionError is returned when the user's Discord account isn't allowed to do something,
+// regardless of their power level on Matrix.
+type DiscordPermissionError struct {
+	Permission int64
+	GuildID    string
+	ChannelID  string
+}
+
+func (err *DiscordPermissionError) PermissionName() string {
+	if name, ok := discordPermissionNames[err.Permission]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", err.Permission)
+}
+
+func (err *DiscordPermissionError) Error() string {
+	if err.ChannelID != "" {
+		return fmt.Sprintf("missing %s permission in channel %s", err.PermissionName(), err.ChannelID)
+	}
+	return fmt.Sprintf("missing %s permission in guild %s", err.PermissionName(), err.GuildID)
+}
+
+// checkChannelPermission checks that the user has the given permission in a Discord channel.
+func (user *User) checkChannelPermission(channelID string, permission int64) error {
+	perms, err := user.Session.State.UserChannelPermissions(user.DiscordID, channelID)
+	if errors.Is(err, discordgo.ErrStateNotFound) {
+		perms, err = user.Session.UserChannelPermissions(user.DiscordID, channelID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get permissions: %w", err)
+	} else if perms&permission != permission {
+		return &DiscordPermissionError{Permission: permission, ChannelID: channelID}
+	}
+	return nil
+}
+
+// checkGuildPermission checks that the user has the given permission in a Discord guild, ignoring channel overwrites.
+func (user *User) checkGuildPermission(guildID string, permission int64) error {
+	guild, err := user.Session.State.Guild(guildID)
+	if err != nil {
+		return fmt.Errorf("failed to get guild: %w", err)
+	} else if guild.OwnerID == user.DiscordID {
+		return nil
+	}
+	member, err := user.Session.State.Member(guildID, user.DiscordID)
+	if errors.Is(err, discordgo.ErrStateNotFound) {
+		member, err = user.getGuildMember(guildID, user.DiscordID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get own guild membership: %w", err)
+	}
+	var perms int64
+	for _, role := range guild.Roles {
+		// The @everyone role has the same ID as the guild
+		if role.ID == guildID || slices.Contains(member.Roles, role.ID) {
+			perms |= role.Permissions
+		}
+	}
+	if perms&discordgo.PermissionAdministrator == 0 && perms&permission != permission {
+		return &DiscordPermissionError{Permission: permission, GuildID: guildID}
+	}
+	return nil
+}
+
+// checkGuildSettingPermission checks that the user can change the bridge settings of a guild.
+// Bridge admins always can, other users need the given permission in the guild on Discord.
+func (user *User) checkGuildSettingPermission(guildID string, permission int64) error {
+	if user.PermissionLevel >= bridgeconfig.PermissionLevelAdmin {
+		return nil
+	}
+	return user.checkGuildPermission(guildID, permission)
+}
+
+// replyPermissionCheck replies to the command with a description of the permission check error.
+// It returns true if the command can continue.
+func replyPermissionCheck(ce *WrappedCommandEvent, err error) bool {
+	var permErr *DiscordPermissionError
+	if err == nil {
+		return true
+	} else if errors.As(err, &permErr) {
+		ce.ZLog.Debug().Err(err).Msg("User doesn't have the required Discord permission")
+		where := "that channel"
+		if permErr.ChannelID == "" {
+			where = "that server"
+		}
+		ce.Reply("Your Discord account doesn't have the **%s** permission in %s", permErr.PermissionName(), where)
+	} else {
+		ce.ZLog.Warn().Err(err).Msg("Failed to check Discord permissions")
+		ce.Reply("Failed to check your Discord permissions: %v", err)
+	}
+	return false
+}
+
+// getReplyTargetMessageID finds the Discord message and thread that the command is replying to.
+func getReplyTargetMessageID(ce *WrappedCommandEvent) (messageID, channelID string, ok bool) {
+	if ce.ReplyTo == "" {
+		return "", "", false
+	}
+	msg := ce.Bridge.DB.Message.GetByMXID(ce.Portal.Key, ce.ReplyTo)
+	if msg == nil {
+		return "", "", false
+	}
+	channelID = ce.Portal.Key.ChannelID
+	if msg.ThreadID != "" {
+		channelID = msg.ThreadID
+	}
+	return msg.DiscordID, channelID, true
+}
+
+var cmdPin = &commands.FullHandler{
+	Func:    wrapCommand(fnPin),
+	Name:    "pin",
+	Aliases: []string{"unpin"},
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Pin or unpin a message on Discord. Reply to the message when using this command.",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnPin(ce *WrappedCommandEvent) {
+	messageID, channelID, ok := getReplyTargetMessageID(ce)
+	if !ok {
+		ce.Reply("You must reply to a bridged message to %s it", ce.Command)
+		return
+	}
+	// Anyone can pin messages in DMs
+	if ce.Portal.GuildID != "" && !replyPermissionCheck(ce, ce.User.checkChannelPermission(ce.Portal.Key.ChannelID, discordgo.PermissionManageMessages)) {
+		return
+	}
+	var err error
+	if ce.Command == "unpin" {
+		err = ce.User.Session.ChannelMessageUnpin(channelID, messageID, ce.Portal.RefererOptIfUser(ce.User.Session, "")...)
+	} else {
+		err = ce.User.Session.ChannelMessagePin(channelID, messageID, ce.Portal.RefererOptIfUser(ce.User.Session, "")...)
+	}
+	if err != nil {
+		ce.ZLog.Err(err).Str("message_id", messageID).Msg("Failed to change pin status of message")
+		ce.Reply("Failed to %s message: %v", ce.Command, err)
+	} else {
+		ce.Reply("Successfully %sned message", ce.Command)
+	}
+}
+
+var cmdSetTopic = &commands.FullHandler{
+	Func: wrapCommand(fnSetTopic),
+	Name: "set-topic",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Change the topic of the Discord channel",
+		Args:        "<_topic_>",
+	},
+	RequiresPortal:     true,
+	RequiresLogin:      true,
+	RequiresEventLevel: roomModerator,
+}
+
+func fnSetTopic(ce *WrappedCommandEvent) {
+	if ce.Portal.GuildID == "" {
+		ce.Reply("Only server channels have topics")
+		return
+	} else if !replyPermissionCheck(ce, ce.User.checkChannelPermission(ce.Portal.Key.ChannelID, discordgo.PermissionManageChannels)) {
+		return
+	}
+	topic := strings.TrimSpace(ce.RawArgs)
+	if topic == "" {
+		ce.Reply("**Usage:** `$cmdprefix set-topic <topic>`")
+		return
+	}
+	_, err := ce.User.Session.ChannelEditComplex(ce.Portal.Key.ChannelID, &discordgo.ChannelEdit{Topic: topic}, ce.Portal.RefererOptIfUser(ce.User.Session, "")...)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to change channel topic")
+		ce.Reply("Failed to change topic: %v", err)
+	} else {
+		ce.Reply("Changed channel topic")
+	}
+}
@@ -0,0 +1,91 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/id"
+)
+
+var cmdDMInvites = &commands.FullHandler{
+	Func:    wrapCommand(fnDMInvites),
+	Name:    "dm-invites",
+	Aliases: []string{"dm-invite"},
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Manage other Matrix accounts that are automatically invited to your new DM portals",
+		Args:        "[add|remove <_Matrix user ID_>]",
+	},
+	RequiresLogin: true,
+}
+
+func fnDMInvites(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 || ce.Args[0] == "list" {
+		invites := ce.User.GetDMInvites()
+		if len(invites) == 0 {
+			ce.Reply("No extra users are invited to your DM portals. Add one with `$cmdprefix dm-invites add <user ID>`")
+			return
+		}
+		items := make([]string, len(invites))
+		for i, userID := range invites {
+			items[i] = userID.String()
+		}
+		ce.Reply("Users invited to your new DM portals:\n\n* `%s`", strings.Join(items, "`\n* `"))
+		return
+	} else if len(ce.Args) != 2 {
+		ce.Reply("**Usage:** `$cmdprefix dm-invites [add|remove <user ID>]`")
+		return
+	}
+	userID := id.UserID(ce.Args[1])
+	if _, _, err := userID.Parse(); err != nil {
+		ce.Reply("`%s` is not a valid Matrix user ID", ce.Args[1])
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "add":
+		if userID == ce.User.MXID {
+			ce.Reply("You're already invited to your own DM portals")
+		} else if ce.Bridge.IsGhost(userID) || userID == ce.Bridge.Bot.UserID {
+			ce.Reply("Bridge users can't be added")
+		} else if ce.Bridge.Config.Bridge.Permissions.Get(userID) < bridgeconfig.PermissionLevelRelay {
+			// Only users that are allowed to use the bridge can be added, so DMs can't be leaked to arbitrary accounts
+			ce.Reply("`%s` isn't allowed to use the bridge", userID)
+		} else {
+			ce.User.AddDMInvite(userID)
+			ce.Reply("`%s` will be invited to new DM portals", userID)
+		}
+	case "remove", "delete":
+		ce.User.RemoveDMInvite(userID)
+		ce.Reply("`%s` will no longer be invited to new DM portals", userID)
+	default:
+		ce.Reply("**Usage:** `$cmdprefix dm-invites [add|remove <user ID>]`")
+	}
+}
+
+// inviteDMExtras invites the user's extra accounts to a newly created DM portal.
+func (user *User) inviteDMExtras(portal *Portal) {
+	for _, userID := range user.GetDMInvites() {
+		_, err := portal.MainIntent().InviteUser(portal.MXID, &mautrix.ReqInviteUser{UserID: userID})
+		if err != nil {
+			portal.log.Warn().Err(err).Stringer("invitee_mxid", userID).Msg("Failed to invite extra user to DM portal")
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+
+	"go.mau.fi/util/variationselector"
+)
+
+// emojiShortcodes maps shortcodes (without colons) to unicode emojis. It includes the most common
+// reactions and the names that Discord uses where they differ from other platforms. The table can be
+// extended with the bridge.emoji_shortcodes config option.
+var emojiShortcodes = map[string]string{
+	"+1":                            "\U0001F44D",
+	"thumbsup":                      "\U0001F44D",
+	"thumbup":                       "\U0001F44D",
+	"-1":                            "\U0001F44E",
+	"thumbsdown":                    "\U0001F44E",
+	"thumbdown":                     "\U0001F44E",
+	"heart":                         "❤️",
+	"red_heart":                     "❤️",
+	"orange_heart":                  "\U0001F9E1",
+	"yellow_heart":                  "\U0001F49B",
+	"green_heart":                   "\U0001F49A",
+	"blue_heart":                    "\U0001F499",
+	"purple_heart":                  "\U0001F49C",
+	"black_heart":                   "\U0001F5A4",
+	"white_heart":                   "\U0001F90D",
+	"broken_heart":                  "\U0001F494",
+	"joy":                           "\U0001F602",
+	"rofl":                          "\U0001F923",
+	"rolling_on_the_floor_laughing": "\U0001F923",
+	"smile":                         "\U0001F604",
+	"smiley":                        "\U0001F603",
+	"grinning":                      "\U0001F600",
+	"grin":                          "\U0001F601",
+	"laughing":                      "\U0001F606",
+	"satisfied":                     "\U0001F606",
+	"sweat_smile":                   "\U0001F605",
+	"slight_smile":                  "\U0001F642",
+	"slightly_smiling_face":         "\U0001F642",
+	"upside_down":                   "\U0001F643",
+	"upside_down_face":              "\U0001F643",
+	"wink":                          "\U0001F609",
+	"blush":                         "\U0001F60A",
+	"innocent":                      "\U0001F607",
+	"heart_eyes":                    "\U0001F60D",
+	"kissing_heart":                 "\U0001F618",
+	"thinking":                      "\U0001F914",
+	"thinking_face":                 "\U0001F914",
+	"neutral_face":                  "\U0001F610",
+	"expressionless":                "\U0001F611",
+	"unamused":                      "\U0001F612",
+	"rolling_eyes":                  "\U0001F644",
+	"face_with_rolling_eyes":        "\U0001F644",
+	"grimacing":                     "\U0001F62C",
+	"relieved":                      "\U0001F60C",
+	"pensive":                       "\U0001F614",
+	"sleeping":                      "\U0001F634",
+	"sunglasses":                    "\U0001F60E",
+	"nerd":                          "\U0001F913",
+	"nerd_face":                     "\U0001F913",
+	"confused":                      "\U0001F615",
+	"worried":                       "\U0001F61F",
+	"slight_frown":                  "\U0001F641",
+	"slightly_frowning_face":        "\U0001F641",
+	"open_mouth":                    "\U0001F62E",
+	"astonished":                    "\U0001F632",
+	"flushed":                       "\U0001F633",
+	"pleading_face":                 "\U0001F97A",
+	"cry":                           "\U0001F622",
+	"sob":                           "\U0001F62D",
+	"scream":                        "\U0001F631",
+	"angry":                         "\U0001F620",
+	"rage":                          "\U0001F621",
+	"skull":                         "\U0001F480",
+	"poop":                          "\U0001F4A9",
+	"hankey":                        "\U0001F4A9",
+	"clown":                         "\U0001F921",
+	"clown_face":                    "\U0001F921",
+	"eyes":                          "\U0001F440",
+	"wave":                          "\U0001F44B",
+	"ok_hand":                       "\U0001F44C",
+	"clap":                          "\U0001F44F",
+	"pray":                          "\U0001F64F",
+	"raised_hands":                  "\U0001F64C",
+	"muscle":                        "\U0001F4AA",
+	"point_up":                      "☝️",
+	"point_down":                    "\U0001F447",
+	"point_left":                    "\U0001F448",
+	"point_right":                   "\U0001F449",
+	"v":                             "✌️",
+	"fingers_crossed":               "\U0001F91E",
+	"shrug":                         "\U0001F937",
+	"person_shrugging":              "\U0001F937",
+	"facepalm":                      "\U0001F926",
+	"person_facepalming":            "\U0001F926",
+	"100":                           "\U0001F4AF",
+	"fire":                          "\U0001F525",
+	"flame":                         "\U0001F525",
+	"sparkles":                      "✨",
+	"star":                          "⭐",
+	"tada":                          "\U0001F389",
+	"party_popper":                  "\U0001F389",
+	"rocket":                        "\U0001F680",
+	"white_check_mark":              "✅",
+	"heavy_check_mark":              "✔️",
+	"x":                             "❌",
+	"warning":                       "⚠️",
+	"question":                      "❓",
+	"exclamation":                   "❗",
+	"bangbang":                      "‼️",
+	"zap":                           "⚡",
+	"boom":                          "\U0001F4A5",
+	"pushpin":                       "\U0001F4CC",
+	"tm":                            "™️",
+	"regional_indicator_a":          "\U0001F1E6",
+	"regional_indicator_b":          "\U0001F1E7",
+}
+
+// skinToneModifiers maps the skin tone names used by Discord (:thumbsup::skin-tone-1:) and
+// other platforms (:thumbsup_tone1:) to the unicode modifiers.
+var skinToneModifiers = map[string]string{
+	"1": "\U0001F3FB",
+	"2": "\U0001F3FC",
+	"3": "\U0001F3FD",
+	"4": "\U0001F3FE",
+	"5": "\U0001F3FF",
+}
+
+func (br *DiscordBridge) lookupEmojiShortcode(shortcode string) (string, bool) {
+	if emoji, ok := br.Config.Bridge.EmojiShortcodes[shortcode]; ok {
+		return emoji, true
+	}
+	emoji, ok := emojiShortcodes[shortcode]
+	return emoji, ok
+}
+
+// NormalizeEmojiShortcode converts a shortcode reaction like :thumbsup: or :thumbsup::skin-tone-2:
+// into the corresponding unicode emoji. If the input isn't a known shortcode, it's returned as-is.
+func (br *DiscordBridge) NormalizeEmojiShortcode(input string) string {
+	if len(input) < 3 || input[0] != ':' || input[len(input)-1] != ':' {
+		return input
+	}
+	shortcode := input[1 : len(input)-1]
+	var tone string
+	if base, toneName, found := strings.Cut(shortcode, "::skin-tone-"); found {
+		shortcode, tone = base, toneName
+	} else if base, toneName, found = strings.Cut(shortcode, "_tone"); found {
+		shortcode, tone = base, toneName
+	}
+	emoji, ok := br.lookupEmojiShortcode(shortcode)
+	if !ok {
+		return input
+	}
+	if tone != "" {
+		modifier, ok := skinToneModifiers[tone]
+		if !ok {
+			return input
+		}
+		// Skin tone modifiers replace the emoji presentation variation selector
+		emoji = variationselector.Remove(emoji) + modifier
+	}
+	return emoji
+}
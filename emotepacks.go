@@ -0,0 +1,240 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// guildStickersUpdateEvent isn't parsed by discordgo, so it's delivered as a raw event.
+const guildStickersUpdateEvent = "GUILD_STICKERS_UPDATE"
+
+type guildStickersUpdate struct {
+	GuildID  string               `json:"guild_id"`
+	Stickers []*discordgo.Sticker `json:"stickers"`
+}
+
+// emotePackEventType is the MSC2545 room emote pack event.
+var emotePackEventType = event.Type{Type: "im.ponies.room_emotes", Class: event.StateEventType}
+
+// emotePackStateKey is the state key of the bridge-managed pack, so that packs added by users in the same room aren't overwritten.
+const emotePackStateKey = "fi.mau.discord"
+
+type emotePackImage struct {
+	URL   id.ContentURIString `json:"url"`
+	Body  string              `json:"body,omitempty"`
+	Info  *event.FileInfo     `json:"info,omitempty"`
+	Usage []string            `json:"usage,omitempty"`
+}
+
+type emotePackMeta struct {
+	DisplayName string              `json:"display_name,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+	Usage       []string            `json:"usage,omitempty"`
+}
+
+type emotePackContent struct {
+	Pack   emotePackMeta              `json:"pack"`
+	Images map[string]*emotePackImage `json:"images"`
+}
+
+func stickerMimeType(format discordgo.StickerFormat) string {
+	switch format {
+	case discordgo.StickerFormatTypePNG:
+		return "image/png"
+	case discordgo.StickerFormatTypeAPNG:
+		return "image/apng"
+	case discordgo.StickerFormatTypeGIF:
+		return "image/gif"
+	default:
+		return ""
+	}
+}
+
+func (br *DiscordBridge) getStickerMXC(intent *appservice.IntentAPI, sticker *discordgo.Sticker) id.ContentURI {
+	mxc := br.DMA.StickerMXC(sticker.ID, sticker.FormatType)
+	if !mxc.IsEmpty() {
+		return mxc
+	}
+	dbFile, err := br.copyAttachmentToMatrix(intent, sticker.URL(), false, AttachmentMeta{
+		AttachmentID: sticker.ID,
+		MimeType:     stickerMimeType(sticker.FormatType),
+	})
+	if err != nil {
+		br.ZLog.Warn().Err(err).Str("sticker_id", sticker.ID).Msg("Failed to copy sticker to Matrix")
+		return id.ContentURI{}
+	}
+	return dbFile.MXC
+}
+
+// addImage adds an image to the pack, suffixing the shortcode if it's already taken.
+func (pack *emotePackContent) addImage(shortcode string, img *emotePackImage) {
+	if _, taken := pack.Images[shortcode]; taken {
+		for i := 2; ; i++ {
+			candidate := shortcode + "~" + strconv.Itoa(i)
+			if _, taken = pack.Images[candidate]; !taken {
+				shortcode = candidate
+				break
+			}
+		}
+	}
+	pack.Images[shortcode] = img
+}
+
+func (guild *Guild) buildEmotePack(emojis []*discordgo.Emoji, stickers []*discordgo.Sticker) *emotePackContent {
+	pack := &emotePackContent{
+		Pack: emotePackMeta{
+			DisplayName: guild.PlainName,
+			AvatarURL:   guild.AvatarURL.CUString(),
+		},
+		Images: make(map[string]*emotePackImage, len(emojis)+len(stickers)),
+	}
+	for _, emoji := range emojis {
+		if emoji.Name == "" || !emoji.Available {
+			continue
+		}
+		mxc := guild.bridge.getEmojiMXCByDiscordID(guild.bridge.Bot, emoji.ID, emoji.Name, emoji.Animated)
+		if mxc.IsEmpty() {
+			continue
+		}
+		pack.addImage(emoji.Name, &emotePackImage{
+			URL:   mxc.CUString(),
+			Body:  emoji.Name,
+			Usage: []string{"emoticon"},
+		})
+	}
+	for _, sticker := range stickers {
+		mimeType := stickerMimeType(sticker.FormatType)
+		// Lottie stickers can't be displayed by Matrix clients without conversion
+		if mimeType == "" || !sticker.Available {
+			continue
+		}
+		mxc := guild.bridge.getStickerMXC(guild.bridge.Bot, sticker)
+		if mxc.IsEmpty() {
+			continue
+		}
+		pack.addImage(sticker.Name, &emotePackImage{
+			URL:  mxc.CUString(),
+			Body: sticker.Name,
+			Info: &event.FileInfo{
+				MimeType: mimeType,
+				Width:    DiscordStickerSize,
+				Height:   DiscordStickerSize,
+			},
+			Usage: []string{"sticker"},
+		})
+	}
+	return pack
+}
+
+// sendEmotePack sends the pack to the room unless the room already has an identical pack.
+func (guild *Guild) sendEmotePack(intent *appservice.IntentAPI, roomID id.RoomID, pack *emotePackContent) {
+	newContent, err := json.Marshal(pack)
+	if err != nil {
+		return
+	}
+	var existing json.RawMessage
+	err = intent.StateEvent(roomID, emotePackEventType, emotePackStateKey, &existing)
+	if err == nil && bytes.Equal(bytes.TrimSpace(existing), newContent) {
+		return
+	}
+	_, err = intent.SendStateEvent(roomID, emotePackEventType, emotePackStateKey, json.RawMessage(newContent))
+	if err != nil {
+		guild.log.Warnfln("Failed to send emote pack to %s: %v", roomID, err)
+	}
+}
+
+// syncEmotePack mirrors the guild's emojis and stickers into an emote pack in the guild space,
+// and in the guild's portal rooms if configured.
+func (guild *Guild) syncEmotePack(emojis []*discordgo.Emoji, stickers []*discordgo.Sticker) {
+	cfg := &guild.bridge.Config.Bridge.EmotePacks
+	if !cfg.Enabled || guild.MXID == "" {
+		return
+	}
+	guild.emotePackLock.Lock()
+	defer guild.emotePackLock.Unlock()
+	pack := guild.buildEmotePack(emojis, stickers)
+	guild.sendEmotePack(guild.bridge.Bot, guild.MXID, pack)
+	if !cfg.PortalRooms {
+		return
+	}
+	for _, portal := range guild.bridge.GetAllPortalsInGuild(guild.ID) {
+		if portal.MXID != "" {
+			guild.sendEmotePack(portal.MainIntent(), portal.MXID, pack)
+		}
+	}
+}
+
+// syncGuildEmotePack syncs the emote pack of a guild using the emojis and stickers in the user's state cache.
+func (user *User) syncGuildEmotePack(guildID string) {
+	if !user.bridge.Config.Bridge.EmotePacks.Enabled || user.Session == nil {
+		return
+	}
+	guild := user.bridge.GetGuildByID(guildID, false)
+	if guild == nil {
+		return
+	}
+	state, err := user.Session.State.Guild(guildID)
+	if err != nil {
+		return
+	}
+	user.Session.State.RLock()
+	emojis := state.Emojis
+	stickers := state.Stickers
+	user.Session.State.RUnlock()
+	guild.syncEmotePack(emojis, stickers)
+}
+
+func (user *User) guildStickersUpdateHandler(evt *guildStickersUpdate) {
+	if user.Session != nil {
+		if state, err := user.Session.State.Guild(evt.GuildID); err == nil {
+			user.Session.State.Lock()
+			state.Stickers = evt.Stickers
+			user.Session.State.Unlock()
+		}
+	}
+	go user.syncGuildEmotePack(evt.GuildID)
+}
+
+// findDiscordSticker finds the guild sticker that a Matrix sticker was bridged from, so that it can be sent natively.
+func (portal *Portal) findDiscordSticker(sender *User, mxc id.ContentURI) string {
+	if mxc.IsEmpty() || portal.GuildID == "" || sender == nil || sender.Session == nil {
+		return ""
+	}
+	guild, err := sender.Session.State.Guild(portal.GuildID)
+	if err != nil {
+		return ""
+	}
+	sender.Session.State.RLock()
+	stickers := guild.Stickers
+	sender.Session.State.RUnlock()
+	for _, sticker := range stickers {
+		if portal.bridge.DMA.StickerMXC(sticker.ID, sticker.FormatType) == mxc {
+			return sticker.ID
+		} else if dbFile := portal.bridge.DB.File.Get(sticker.URL(), false); dbFile != nil && dbFile.MXC == mxc {
+			return sticker.ID
+		}
+	}
+	return ""
+}
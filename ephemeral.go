@@ -0,0 +1,76 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+)
+
+const ephemeralMessagePrefix = "(only visible to you)"
+
+// markEphemeralParts turns converted text parts of an ephemeral message into notices with a prefix.
+func markEphemeralParts(parts []*ConvertedMessage) {
+	for _, part := range parts {
+		if part.Extra == nil {
+			part.Extra = make(map[string]any)
+		}
+		part.Extra["fi.mau.discord.ephemeral"] = true
+		if part.Content.MsgType != event.MsgText && part.Content.MsgType != event.MsgNotice {
+			continue
+		}
+		part.Content.MsgType = event.MsgNotice
+		if part.Content.Format == event.FormatHTML {
+			part.Content.FormattedBody = fmt.Sprintf("<em>%s</em> %s", ephemeralMessagePrefix, part.Content.FormattedBody)
+		}
+		part.Content.Body = fmt.Sprintf("%s %s", ephemeralMessagePrefix, part.Content.Body)
+	}
+}
+
+// sendEphemeralToManagementRoom sends an ephemeral message to the receiving user's management room
+// instead of a portal shared with other Matrix users.
+func (portal *Portal) sendEphemeralToManagementRoom(ctx context.Context, user *User, puppet *Puppet, parts []*ConvertedMessage) {
+	log := zerolog.Ctx(ctx)
+	if user.ManagementRoom == "" {
+		log.Debug().Msg("Dropping ephemeral message as user doesn't have a management room")
+		return
+	}
+	header := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    fmt.Sprintf("Message only visible to you from %s in %s:", puppet.Name, portal.Name),
+		Format:  event.FormatHTML,
+		FormattedBody: fmt.Sprintf(
+			`Message only visible to you from <strong>%s</strong> in <a href="%s">%s</a>:`,
+			html.EscapeString(puppet.Name), portal.MXID.URI(portal.bridge.Config.Homeserver.Domain).MatrixToURL(), html.EscapeString(portal.Name),
+		),
+	}
+	_, err := portal.bridge.Bot.SendMessageEvent(user.ManagementRoom, event.EventMessage, header)
+	if err != nil {
+		log.Err(err).Msg("Failed to send ephemeral message header to management room")
+		return
+	}
+	for i, part := range parts {
+		_, err = portal.bridge.Bot.SendMessageEvent(user.ManagementRoom, part.Type, &event.Content{Parsed: part.Content, Raw: part.Extra})
+		if err != nil {
+			log.Err(err).Int("part_index", i).Msg("Failed to send part of ephemeral message to management room")
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-discord/config"
+)
+
+// StatePortalFeatures describes the bridge version and the features that are supported in a portal,
+// so that clients and bots can adapt to the room.
+var StatePortalFeatures = event.Type{Type: "fi.mau.discord.features", Class: event.StateEventType}
+
+type PortalFeaturesContent struct {
+	BridgeVersion string          `json:"bridge_version"`
+	Features      map[string]bool `json:"features"`
+}
+
+func (portal *Portal) getFeatures() *PortalFeaturesContent {
+	isGuild := portal.GuildID != ""
+	return &PortalFeaturesContent{
+		BridgeVersion: portal.bridge.Version,
+		Features: map[string]bool{
+			"edits":                  true,
+			"deletions":              true,
+			"reactions":              true,
+			"replies":                true,
+			"stickers":               true,
+			"threads":                isGuild && !portal.IsForum(),
+			"forum_posts":            portal.IsForum(),
+			"polls":                  false,
+			"typing":                 true,
+			"read_receipts":          true,
+			"custom_emoji_reactions": portal.bridge.Config.Bridge.CustomEmojiReactions,
+			"message_effects":        portal.bridge.Config.Bridge.MessageEffects == config.MessageEffectMarker,
+		},
+	}
+}
+
+func (content *PortalFeaturesContent) hash() string {
+	data, _ := json.Marshal(content)
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:8])
+}
+
+// updateFeatures sends the feature state event to the portal room if it changed since it was last sent,
+// e.g. after the bridge was upgraded or reconfigured.
+func (portal *Portal) updateFeatures(force bool) {
+	if portal.MXID == "" {
+		return
+	}
+	content := portal.getFeatures()
+	hash := content.hash()
+	if hash == portal.FeaturesHash && !force {
+		return
+	}
+	_, err := portal.MainIntent().SendStateEvent(portal.MXID, StatePortalFeatures, "", content)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to update feature state event")
+		return
+	}
+	portal.FeaturesHash = hash
+	portal.Update()
+}
+
+func (br *DiscordBridge) syncPortalFeatures() {
+	for _, portal := range br.GetAllPortals() {
+		portal.updateFeatures(false)
+	}
+}
@@ -17,14 +17,19 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"html"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
 	"github.com/yuin/goldmark/extension"
 	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
 	"github.com/yuin/goldmark/util"
 	"go.mau.fi/util/variationselector"
 	"golang.org/x/exp/slices"
@@ -56,22 +61,43 @@ func (b *indentableParagraphParser) CanAcceptIndentedLine() bool {
 	return true
 }
 
-var removeFeaturesExceptLinks = []any{
-	parser.NewListParser(), parser.NewListItemParser(), parser.NewHTMLBlockParser(), parser.NewRawHTMLParser(),
+// discordHeadingParser is the default ATX heading parser limited to the three levels that Discord supports.
+type discordHeadingParser struct {
+	parser.BlockParser
+}
+
+var defaultDiscordHeadingParser = &discordHeadingParser{BlockParser: parser.NewATXHeadingParser()}
+
+func (b *discordHeadingParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, _ := reader.PeekLine()
+	if bytes.HasPrefix(bytes.TrimLeft(line, " "), []byte("####")) {
+		return nil, parser.NoChildren
+	}
+	return b.BlockParser.Open(parent, reader, pc)
+}
+
+var removeUnsupportedFeatures = []any{
+	parser.NewHTMLBlockParser(), parser.NewRawHTMLParser(),
 	parser.NewSetextHeadingParser(), parser.NewThematicBreakParser(),
-	parser.NewCodeBlockParser(),
+	parser.NewCodeBlockParser(), parser.NewATXHeadingParser(),
 }
-var removeFeaturesAndLinks = append(removeFeaturesExceptLinks, parser.NewLinkParser())
+var removeBlocksAndLinks = append(slices.Clone(removeUnsupportedFeatures), parser.NewListParser(), parser.NewListItemParser(), parser.NewLinkParser())
 var fixIndentedParagraphs = goldmark.WithParserOptions(parser.WithBlockParsers(util.Prioritized(defaultIndentableParagraphParser, 500)))
+var discordHeadings = goldmark.WithParserOptions(parser.WithBlockParsers(util.Prioritized(defaultDiscordHeadingParser, 600)))
+var discordBlockExtensions = goldmark.WithExtensions(ExtDiscordSubtext)
 var discordExtensions = goldmark.WithExtensions(extension.Strikethrough, mdext.SimpleSpoiler, mdext.DiscordUnderline, ExtDiscordEveryone, ExtDiscordTag)
 
+// discordRenderer is used for places like embed titles where Discord only supports inline formatting.
 var discordRenderer = goldmark.New(
-	goldmark.WithParser(mdext.ParserWithoutFeatures(removeFeaturesAndLinks...)),
+	goldmark.WithParser(mdext.ParserWithoutFeatures(removeBlocksAndLinks...)),
 	fixIndentedParagraphs, format.HTMLOptions, discordExtensions,
 )
+
+// discordRendererWithInlineLinks is used for message content and embed descriptions,
+// which also support masked links, headings, lists and subtext.
 var discordRendererWithInlineLinks = goldmark.New(
-	goldmark.WithParser(mdext.ParserWithoutFeatures(removeFeaturesExceptLinks...)),
-	fixIndentedParagraphs, format.HTMLOptions, discordExtensions,
+	goldmark.WithParser(mdext.ParserWithoutFeatures(removeUnsupportedFeatures...)),
+	fixIndentedParagraphs, discordHeadings, format.HTMLOptions, discordExtensions, discordBlockExtensions,
 )
 
 func (portal *Portal) renderDiscordMarkdownOnlyHTML(text string, allowInlineLinks bool) string {
@@ -95,6 +121,10 @@ const formatterContextPortalKey = "fi.mau.discord.portal"
 const formatterContextAllowedMentionsKey = "fi.mau.discord.allowed_mentions"
 const formatterContextInputAllowedMentionsKey = "fi.mau.discord.input_allowed_mentions"
 
+// formatterContextEventLinkRewriterKey is set to rewriteMatrixEventLinks, which can't be referenced
+// from matrixHTMLParser directly without an initialization cycle.
+const formatterContextEventLinkRewriterKey = "fi.mau.discord.event_link_rewriter"
+
 func appendIfNotContains(arr []string, newItem string) []string {
 	for _, item := range arr {
 		if item == newItem {
@@ -127,12 +157,8 @@ func (br *DiscordBridge) pillConverter(displayname, mxid, eventID string, ctx fo
 				//} else {
 				//	// TODO is mentioning private channels possible at all?
 				//}
-			} else if msg := br.DB.Message.GetByMXID(portal.Key, id.EventID(eventID)); msg != nil {
-				guildID := portal.GuildID
-				if guildID == "" {
-					guildID = "@me"
-				}
-				return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, msg.DiscordProtoChannelID(), msg.DiscordID)
+			} else if link := br.discordLinkForEvent(portal, id.EventID(eventID)); link != "" {
+				return link
 			}
 		}
 	} else if mxid[0] == '@' {
@@ -155,6 +181,69 @@ func (br *DiscordBridge) pillConverter(displayname, mxid, eventID string, ctx fo
 	return displayname
 }
 
+// discordEmojiTag is a fake HTML tag used to wrap already converted custom emojis,
+// so that the text converter knows not to escape them.
+const discordEmojiTag = "mx-discord-emoji"
+
+var matrixDeepHeadingRegex = regexp.MustCompile(`(?i)<(/?)h[4-6]\b`)
+var matrixEmoticonRegex = regexp.MustCompile(`<img\s[^>]*\bdata-mx-emoticon\b[^>]*>`)
+var htmlAttributeRegex = regexp.MustCompile(`\b(src|alt|title)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+func (portal *Portal) findDiscordEmoji(sender *User, mxc id.ContentURI, name string) (emojiID, emojiName string, animated bool) {
+	if mxc.IsEmpty() {
+		// Only look up by name
+	} else if emojiInfo := portal.bridge.DMA.GetEmojiInfo(mxc); emojiInfo != nil {
+		return strconv.FormatUint(emojiInfo.EmojiID, 10), emojiInfo.Name, emojiInfo.Animated
+	} else if emojiFile := portal.bridge.DB.File.GetEmojiByMXC(mxc); emojiFile != nil && emojiFile.ID != "" && emojiFile.EmojiName != "" {
+		return emojiFile.ID, emojiFile.EmojiName, emojiFile.MimeType == "image/gif"
+	}
+	if name == "" || portal.GuildID == "" || sender == nil || sender.Session == nil {
+		return
+	}
+	guild, err := sender.Session.State.Guild(portal.GuildID)
+	if err != nil {
+		return
+	}
+	for _, emoji := range guild.Emojis {
+		if emoji.Name == name {
+			return emoji.ID, emoji.Name, emoji.Animated
+		}
+	}
+	return
+}
+
+// convertMatrixEmoticons replaces Matrix custom emoji images with Discord custom emojis (<:name:id>)
+// if a matching emoji is found either in the media cache or in the guild, and with the shortcode otherwise.
+func (portal *Portal) convertMatrixEmoticons(sender *User, body string) string {
+	return matrixEmoticonRegex.ReplaceAllStringFunc(body, func(tag string) string {
+		var src, name string
+		for _, attr := range htmlAttributeRegex.FindAllStringSubmatch(tag, -1) {
+			val := html.UnescapeString(attr[2] + attr[3])
+			switch attr[1] {
+			case "src":
+				src = val
+			case "alt", "title":
+				if name == "" {
+					name = strings.Trim(val, ":")
+				}
+			}
+		}
+		mxc, _ := id.ParseContentURI(src)
+		emojiID, emojiName, animated := portal.findDiscordEmoji(sender, mxc, name)
+		if emojiID == "" {
+			if name == "" {
+				return ""
+			}
+			return html.EscapeString(fmt.Sprintf(":%s:", name))
+		}
+		var prefix string
+		if animated {
+			prefix = "a"
+		}
+		return fmt.Sprintf("<%[1]s>&lt;%[2]s:%[3]s:%[4]s&gt;</%[1]s>", discordEmojiTag, prefix, html.EscapeString(emojiName), emojiID)
+	})
+}
+
 const discordLinkPattern = `https?://[^<\p{Zs}\x{feff}]*[^"'),.:;\]\p{Zs}\x{feff}]`
 
 // Discord links start with http:// or https://, contain at least two characters afterwards,
@@ -207,6 +296,12 @@ var matrixHTMLParser = &format.HTMLParser{
 		if ctx.TagStack.Has("pre") || ctx.TagStack.Has("code") {
 			// If we're in a code block, don't escape markdown
 			return s
+		} else if ctx.TagStack.Has(discordEmojiTag) || ctx.TagStack.Has(discordSubtextTag) {
+			// Converted custom emojis and subtext prefixes must be sent as-is
+			return s
+		} else if rewriteLinks, ok := ctx.ReturnData[formatterContextEventLinkRewriterKey].(func(string) string); ok && !ctx.TagStack.Has("a") {
+			// Links in <a> tags are converted by the pill converter
+			s = rewriteLinks(s)
 		}
 		return escapeDiscordMarkdown(s)
 	},
@@ -226,7 +321,7 @@ var matrixHTMLParser = &format.HTMLParser{
 	},
 }
 
-func (portal *Portal) parseMatrixHTML(content *event.MessageEventContent) (string, *discordgo.MessageAllowedMentions) {
+func (portal *Portal) parseMatrixHTML(sender *User, content *event.MessageEventContent) (string, *discordgo.MessageAllowedMentions) {
 	allowedMentions := &discordgo.MessageAllowedMentions{
 		Parse:       []discordgo.AllowedMentionType{},
 		Users:       []string{},
@@ -236,11 +331,17 @@ func (portal *Portal) parseMatrixHTML(content *event.MessageEventContent) (strin
 		ctx := format.NewContext()
 		ctx.ReturnData[formatterContextPortalKey] = portal
 		ctx.ReturnData[formatterContextAllowedMentionsKey] = allowedMentions
+		ctx.ReturnData[formatterContextEventLinkRewriterKey] = portal.bridge.rewriteMatrixEventLinks
 		if content.Mentions != nil {
 			ctx.ReturnData[formatterContextInputAllowedMentionsKey] = content.Mentions.UserIDs
 		}
-		return variationselector.FullyQualify(matrixHTMLParser.Parse(content.FormattedBody, ctx)), allowedMentions
+		formattedBody := portal.convertMatrixEmoticons(sender, content.FormattedBody)
+		// Discord only supports three levels of headings
+		formattedBody = matrixDeepHeadingRegex.ReplaceAllString(formattedBody, "<${1}h3")
+		formattedBody = convertMatrixSubtext(formattedBody)
+		return variationselector.FullyQualify(matrixHTMLParser.Parse(formattedBody, ctx)), allowedMentions
 	} else {
-		return variationselector.FullyQualify(escapeDiscordMarkdown(content.Body)), allowedMentions
+		body := portal.bridge.rewriteMatrixEventLinks(content.Body)
+		return variationselector.FullyQualify(escapeDiscordMarkdown(body)), allowedMentions
 	}
 }
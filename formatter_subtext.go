@@ -0,0 +1,127 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+type astDiscordSubtext struct {
+	ast.BaseBlock
+}
+
+var _ ast.Node = (*astDiscordSubtext)(nil)
+var astKindDiscordSubtext = ast.NewNodeKind("DiscordSubtext")
+
+func (n *astDiscordSubtext) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+func (n *astDiscordSubtext) Kind() ast.NodeKind {
+	return astKindDiscordSubtext
+}
+
+// discordSubtextParser parses Discord's `-# small text` lines.
+type discordSubtextParser struct{}
+
+var discordSubtextPrefix = []byte("-# ")
+var defaultDiscordSubtextParser = &discordSubtextParser{}
+
+func (s *discordSubtextParser) Trigger() []byte {
+	return []byte{'-'}
+}
+
+func (s *discordSubtextParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, segment := reader.PeekLine()
+	pos := pc.BlockOffset()
+	if pos < 0 || !bytes.HasPrefix(line[pos:], discordSubtextPrefix) {
+		return nil, parser.NoChildren
+	}
+	start := pos + len(discordSubtextPrefix)
+	stop := len(line) - util.TrimRightSpaceLength(line)
+	node := &astDiscordSubtext{}
+	if start < stop {
+		node.Lines().Append(text.NewSegment(segment.Start+start-segment.Padding, segment.Start+stop-segment.Padding))
+	}
+	reader.Advance(segment.Len() - 1)
+	return node, parser.NoChildren
+}
+
+func (s *discordSubtextParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	return parser.Close
+}
+
+func (s *discordSubtextParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {
+	// nothing to do
+}
+
+func (s *discordSubtextParser) CanInterruptParagraph() bool {
+	return true
+}
+
+func (s *discordSubtextParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+type discordSubtextHTMLRenderer struct{}
+
+func (r *discordSubtextHTMLRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(astKindDiscordSubtext, r.renderDiscordSubtext)
+}
+
+func (r *discordSubtextHTMLRenderer) renderDiscordSubtext(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		_, _ = w.WriteString("<p><sub>")
+	} else {
+		_, _ = w.WriteString("</sub></p>\n")
+	}
+	return ast.WalkContinue, nil
+}
+
+type discordSubtext struct{}
+
+// ExtDiscordSubtext converts Discord's `-# small text` lines into <sub> tags.
+var ExtDiscordSubtext = &discordSubtext{}
+
+func (e *discordSubtext) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithBlockParsers(
+		// Must be before the list parser, as -# would otherwise be parsed as a list containing a heading
+		util.Prioritized(defaultDiscordSubtextParser, 250),
+	))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&discordSubtextHTMLRenderer{}, 250),
+	))
+}
+
+// discordSubtextTag is a fake HTML tag used to insert the subtext prefix without it being escaped.
+const discordSubtextTag = "mx-discord-subtext"
+
+// matrixSubtextRegex matches <sub> and <small> tags at the start of a line in Matrix HTML.
+var matrixSubtextRegex = regexp.MustCompile(`(?i)(^|<p>|<br\s*/?>|\n)(\s*)<(sub|small)>`)
+
+// convertMatrixSubtext prefixes <sub> and <small> tags at the start of lines with Discord's subtext syntax.
+func convertMatrixSubtext(body string) string {
+	return matrixSubtextRegex.ReplaceAllString(body, "${1}${2}<"+discordSubtextTag+">-#</"+discordSubtextTag+"> <${3}>")
+}
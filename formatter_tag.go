@@ -88,22 +88,26 @@ func (n *astDiscordChannelMention) String() string {
 
 type discordTimestampStyle rune
 
-func (dts discordTimestampStyle) Format() string {
+func (dts discordTimestampStyle) Format(twelveHour bool) string {
+	clock, clockSeconds := "15:04", "15:04:05"
+	if twelveHour {
+		clock, clockSeconds = "3:04 PM", "3:04:05 PM"
+	}
 	switch dts {
 	case 't':
-		return "15:04 MST"
+		return clock + " MST"
 	case 'T':
-		return "15:04:05 MST"
+		return clockSeconds + " MST"
 	case 'd':
 		return "2006-01-02 MST"
 	case 'D':
 		return "2 January 2006 MST"
 	case 'F':
-		return "Monday, 2 January 2006 15:04 MST"
+		return "Monday, 2 January 2006 " + clock + " MST"
 	case 'f':
 		fallthrough
 	default:
-		return "2 January 2006 15:04 MST"
+		return "2 January 2006 " + clock + " MST"
 	}
 }
 
@@ -275,6 +279,7 @@ func (r *discordTagHTMLRenderer) renderDiscordMention(w util.BufWriter, source [
 				name = user.MXID.Localpart()
 			}
 		}
+		name = node.portal.roleColoredName(name, strconv.FormatInt(node.id, 10), nil)
 		_, _ = fmt.Fprintf(w, `<a href="%s">%s</a>`, mxid.URI().MatrixToURL(), name)
 		return
 	case *astDiscordRoleMention:
@@ -307,17 +312,17 @@ func (r *discordTagHTMLRenderer) renderDiscordMention(w util.BufWriter, source [
 			return
 		}
 	case *astDiscordTimestamp:
-		ts := time.Unix(node.timestamp, 0).UTC()
+		ts := time.Unix(node.timestamp, 0).In(node.portal.timestampLocation())
 		var formatted string
 		if node.style == 'R' {
 			formatted = relativeTimeFormat(ts)
 		} else {
-			formatted = ts.Format(node.style.Format())
+			formatted = node.portal.formatTimestamp(ts, node.style)
 		}
 		// https://github.com/matrix-org/matrix-spec-proposals/pull/3160
 		const fullDatetimeFormat = "2006-01-02T15:04:05.000-0700"
 		fullRFC := ts.Format(fullDatetimeFormat)
-		fullHumanReadable := ts.Format(discordTimestampStyle('F').Format())
+		fullHumanReadable := node.portal.formatTimestamp(ts, 'F')
 		_, _ = fmt.Fprintf(w, `<time title="%s" datetime="%s" data-discord-style="%c"><strong>%s</strong></time>`, fullHumanReadable, fullRFC, node.style, formatted)
 	}
 	stringifiable, ok := n.(fmt.Stringer)
@@ -55,3 +55,29 @@ func TestEscapeDiscordMarkdown(t *testing.T) {
 		})
 	}
 }
+
+func TestRenderDiscordMarkdownBlocks(t *testing.T) {
+	type renderTest struct {
+		name     string
+		input    string
+		expected string
+	}
+
+	tests := []renderTest{
+		{"Heading", "# foo", "<h1>foo</h1>"},
+		{"Level 3 heading", "### foo", "<h3>foo</h3>"},
+		{"Level 4 heading", "#### foo", "#### foo"},
+		{"Bullet list", "- foo\n- bar", "<ul>\n<li>foo</li>\n<li>bar</li>\n</ul>"},
+		{"Numbered list", "1. foo\n2. bar", "<ol>\n<li>foo</li>\n<li>bar</li>\n</ol>"},
+		{"Masked link", "[foo](https://example.com)", `<a href="https://example.com">foo</a>`},
+		{"Subtext", "-# foo", "<sub>foo</sub>"},
+		{"Subtext after text", "foo\n-# bar", "<p>foo</p>\n<p><sub>bar</sub></p>"},
+	}
+
+	portal := &Portal{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, portal.renderDiscordMarkdownOnlyHTML(test.input, true))
+		})
+	}
+}
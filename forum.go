@@ -0,0 +1,297 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+const (
+	forumPostHTMLTitle = `<h3>%s</h3>`
+	forumPostHTMLTags  = `<p><sub>%s</sub></p>`
+
+	// forumPostMaxNameLength is the maximum length of a post title on Discord.
+	forumPostMaxNameLength = 100
+	// forumPostMaxTags is the maximum number of tags that can be applied to a post on Discord.
+	forumPostMaxTags = 5
+)
+
+// StateForumPost contains the tags and pinned/locked state of a forum post. The state key is the ID of the post.
+var StateForumPost = event.Type{Type: "fi.mau.discord.forum_post", Class: event.StateEventType}
+
+type ForumPostContent struct {
+	Name      string     `json:"name"`
+	RootEvent id.EventID `json:"root_event_id"`
+	Tags      []string   `json:"tags"`
+	Pinned    bool       `json:"pinned"`
+	Locked    bool       `json:"locked"`
+	Archived  bool       `json:"archived"`
+}
+
+// IsForum checks if the portal is a forum or media channel, where every post is a thread.
+func (portal *Portal) IsForum() bool {
+	return portal.Type == discordgo.ChannelTypeGuildForum || portal.Type == discordgo.ChannelTypeGuildMedia
+}
+
+// getForumPostMeta finds the metadata of a forum post, which is needed for the title.
+func (portal *Portal) getForumPostMeta(user *User, postID string) *discordgo.Channel {
+	if ch, err := user.Session.State.Channel(postID); err == nil {
+		return ch
+	}
+	ch, err := user.getChannel(postID)
+	if err != nil {
+		portal.log.Warn().Err(err).Str("post_id", postID).Msg("Failed to get forum post info")
+		return nil
+	}
+	return ch
+}
+
+// forumPostTags returns the names of the tags applied to the post.
+func (portal *Portal) forumPostTags(user *User, post *discordgo.Channel) []string {
+	if len(post.AppliedTags) == 0 {
+		return nil
+	}
+	forum, err := user.Session.State.Channel(portal.Key.ChannelID)
+	if err != nil {
+		return nil
+	}
+	tagNames := make(map[string]string, len(forum.AvailableTags))
+	for _, tag := range forum.AvailableTags {
+		tagNames[tag.ID] = tag.Name
+	}
+	var tags []string
+	for _, tagID := range post.AppliedTags {
+		if name, ok := tagNames[tagID]; ok {
+			tags = append(tags, name)
+		}
+	}
+	return tags
+}
+
+// addForumPostTitle renders the post title (and tags) at the start of the post's first message,
+// which becomes the Matrix thread root.
+func (portal *Portal) addForumPostTitle(user *User, post *discordgo.Channel, parts []*ConvertedMessage) []*ConvertedMessage {
+	titleHTML := fmt.Sprintf(forumPostHTMLTitle, html.EscapeString(post.Name))
+	titleText := post.Name
+	if tags := portal.forumPostTags(user, post); len(tags) > 0 {
+		titleHTML += fmt.Sprintf(forumPostHTMLTags, html.EscapeString(strings.Join(tags, ", ")))
+		titleText += fmt.Sprintf(" [%s]", strings.Join(tags, ", "))
+	}
+	if len(parts) > 0 && parts[0].Type == event.EventMessage && parts[0].Content.MsgType == event.MsgText {
+		content := parts[0].Content
+		if content.Format != event.FormatHTML {
+			content.Format = event.FormatHTML
+			content.FormattedBody = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br>")
+		}
+		content.Body = titleText + "\n\n" + content.Body
+		content.FormattedBody = titleHTML + content.FormattedBody
+		return parts
+	}
+	return append([]*ConvertedMessage{{
+		Type: event.EventMessage,
+		Content: &event.MessageEventContent{
+			MsgType:       event.MsgText,
+			Body:          titleText,
+			Format:        event.FormatHTML,
+			FormattedBody: titleHTML,
+		},
+	}}, parts...)
+}
+
+// createForumPostRoot sends a title-only thread root for a forum post whose first message wasn't bridged,
+// so that later messages in the post still have a thread to go in.
+func (portal *Portal) createForumPostRoot(ctx context.Context, user *User, post *discordgo.Channel) *Thread {
+	parts := portal.addForumPostTitle(user, post, nil)
+	intent := portal.MainIntent()
+	resp, err := portal.sendMatrixMessage(intent, parts[0].Type, parts[0].Content, nil, snowflakeToMatrixTS(post.ID))
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("post_id", post.ID).Msg("Failed to send forum post root to Matrix")
+		return nil
+	}
+	ts, _ := discordgo.SnowflakeTimestamp(post.ID)
+	rootMsg := portal.markMessageHandled(post.ID, post.OwnerID, ts, "", intent.UserID, []database.MessagePart{{MXID: resp.EventID}})
+	portal.bridge.threadFound(ctx, user, rootMsg, post.ID, post)
+	return portal.bridge.GetThreadByID(post.ID, nil)
+}
+
+// startForumPostFromMatrix creates a new post in the forum, using the first line of the message as the title.
+func (portal *Portal) startForumPostFromMatrix(sess *discordgo.Session, content *event.MessageEventContent, sendReq *discordgo.MessageSend) (*discordgo.Message, *discordgo.Channel, error) {
+	name, _, _ := strings.Cut(strings.TrimSpace(content.Body), "\n")
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "New post"
+	} else if runes := []rune(name); len(runes) > forumPostMaxNameLength {
+		name = string(runes[:forumPostMaxNameLength-1]) + "…"
+	}
+	post, err := sess.ForumThreadStartComplex(portal.Key.ChannelID, &discordgo.ThreadStart{Name: name}, sendReq, portal.RefererOptIfUser(sess, "")...)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The first message of a post has the same ID as the post itself
+	return &discordgo.Message{ID: post.ID, ChannelID: post.ID}, post, nil
+}
+
+// updateForumPostState sends the tags and pinned/locked state of a forum post to the forum room if they changed.
+func (thread *Thread) updateForumPostState(ctx context.Context, source *User, post *discordgo.Channel) {
+	portal := thread.Parent
+	if portal == nil || portal.MXID == "" || !portal.IsForum() || source == nil || source.Session == nil || post == nil {
+		return
+	}
+	content := &ForumPostContent{
+		Name:      post.Name,
+		RootEvent: thread.RootMXID,
+		Tags:      portal.forumPostTags(source, post),
+		Pinned:    post.Flags&discordgo.ChannelFlagPinned != 0,
+	}
+	if content.Tags == nil {
+		content.Tags = []string{}
+	}
+	if post.ThreadMetadata != nil {
+		content.Locked = post.ThreadMetadata.Locked
+		content.Archived = post.ThreadMetadata.Archived
+	}
+	data, _ := json.Marshal(content)
+	thread.postStateLock.Lock()
+	defer thread.postStateLock.Unlock()
+	if thread.postState == string(data) {
+		return
+	}
+	_, err := portal.MainIntent().SendStateEvent(portal.MXID, StateForumPost, post.ID, content)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("post_id", post.ID).Msg("Failed to send forum post state event")
+		return
+	}
+	thread.postState = string(data)
+}
+
+var cmdPostTags = &commands.FullHandler{
+	Func: wrapCommand(fnPostTags),
+	Name: "post-tags",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "View or change the tags of a Discord forum post. Reply to the post or a message in it when using this command.",
+		Args:        "[add|remove <_tag_>]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func forumTagNames(tags []discordgo.ForumTag) string {
+	names := make([]string, len(tags))
+	for i, tag := range tags {
+		names[i] = tag.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+func fnPostTags(ce *WrappedCommandEvent) {
+	if !ce.Portal.IsForum() {
+		ce.Reply("This command can only be used in forum channels")
+		return
+	} else if len(ce.Args) == 1 {
+		ce.Reply("**Usage:** `$cmdprefix post-tags [add|remove <tag>]`")
+		return
+	}
+	thread := getReplyThread(ce)
+	if thread == nil {
+		return
+	} else if thread.ParentID != ce.Portal.Key.ChannelID {
+		ce.Reply("That post is not in this forum")
+		return
+	}
+	forum, err := ce.User.Session.State.Channel(ce.Portal.Key.ChannelID)
+	if err != nil {
+		ce.Reply("Failed to get forum info: %v", err)
+		return
+	}
+	post := ce.Portal.getForumPostMeta(ce.User, thread.ID)
+	if post == nil {
+		ce.Reply("Failed to get post info")
+		return
+	}
+	if len(ce.Args) == 0 {
+		tags := ce.Portal.forumPostTags(ce.User, post)
+		if len(tags) == 0 {
+			ce.Reply("The post doesn't have any tags. Available tags: %s", forumTagNames(forum.AvailableTags))
+		} else {
+			ce.Reply("Tags: %s\n\nAvailable tags: %s", strings.Join(tags, ", "), forumTagNames(forum.AvailableTags))
+		}
+		return
+	}
+
+	tagName := strings.Join(ce.Args[1:], " ")
+	var tag *discordgo.ForumTag
+	for i := range forum.AvailableTags {
+		if strings.EqualFold(forum.AvailableTags[i].Name, tagName) {
+			tag = &forum.AvailableTags[i]
+			break
+		}
+	}
+	if tag == nil {
+		ce.Reply("Unknown tag %s. Available tags: %s", tagName, forumTagNames(forum.AvailableTags))
+		return
+	}
+	tags := slices.Clone(post.AppliedTags)
+	switch strings.ToLower(ce.Args[0]) {
+	case "add":
+		if slices.Contains(tags, tag.ID) {
+			ce.Reply("The post already has the tag %s", tag.Name)
+			return
+		} else if len(tags) >= forumPostMaxTags {
+			ce.Reply("Posts can have at most %d tags", forumPostMaxTags)
+			return
+		}
+		tags = append(tags, tag.ID)
+	case "remove":
+		idx := slices.Index(tags, tag.ID)
+		if idx < 0 {
+			ce.Reply("The post doesn't have the tag %s", tag.Name)
+			return
+		}
+		tags = slices.Delete(tags, idx, idx+1)
+	default:
+		ce.Reply("**Usage:** `$cmdprefix post-tags [add|remove <tag>]`")
+		return
+	}
+	// Like on Discord, post authors can change the tags of their own posts, except for moderated tags
+	if post.OwnerID != ce.User.DiscordID || tag.Moderated {
+		if !replyPermissionCheck(ce, ce.User.checkChannelPermission(ce.Portal.Key.ChannelID, discordgo.PermissionManageThreads)) {
+			return
+		}
+	}
+	updated, err := ce.User.Session.ChannelEditComplex(thread.ID, &discordgo.ChannelEdit{AppliedTags: &tags}, thread.RefererOpt())
+	if err != nil {
+		ce.ZLog.Err(err).Str("post_id", thread.ID).Msg("Failed to change post tags")
+		ce.Reply("Failed to change post tags: %v", err)
+		return
+	}
+	thread.updateForumPostState(ce.ZLog.WithContext(context.Background()), ce.User, updated)
+	ce.React("✅")
+}
@@ -0,0 +1,244 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/id"
+)
+
+// sensitiveGatewayFields are removed from recorded payloads at any depth.
+var sensitiveGatewayFields = map[string]struct{}{
+	"token":           {},
+	"analytics_token": {},
+	"session_id":      {},
+	"email":           {},
+	"phone":           {},
+	"ip":              {},
+}
+
+// recordedGatewayEvent is one line in a gateway event recording.
+type recordedGatewayEvent struct {
+	Type      string          `json:"t"`
+	Sequence  int64           `json:"s"`
+	Timestamp int64           `json:"ts"`
+	Data      json.RawMessage `json:"d"`
+}
+
+type gatewayRecording struct {
+	file      *os.File
+	path      string
+	channelID string
+	roomID    id.RoomID
+	timer     *time.Timer
+	events    int
+}
+
+var cmdRecordEvents = &commands.FullHandler{
+	Func: wrapCommand(fnRecordEvents),
+	Name: "record-events",
+	Help: commands.HelpMeta{
+		Section: HelpSectionPortalManagement,
+		Description: "Record the raw Discord gateway events of this room to a file on the bridge server for a bug report. " +
+			"Tokens, emails and similar fields are removed, but message contents are included.",
+		Args: "<_minutes_>|stop",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnRecordEvents(ce *WrappedCommandEvent) {
+	cfg := &ce.Bridge.Config.Bridge.EventRecording
+	if !cfg.Enabled {
+		ce.Reply("Gateway event recording is not enabled on this bridge")
+		return
+	} else if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `$cmdprefix record-events <minutes>|stop`")
+		return
+	}
+	if strings.ToLower(ce.Args[0]) == "stop" {
+		path, events, ok := ce.User.stopGatewayRecording(nil)
+		if !ok {
+			ce.Reply("You're not recording gateway events")
+		} else {
+			ce.Reply("Stopped recording, saved %d events to `%s`", events, path)
+		}
+		return
+	}
+	minutes, err := strconv.Atoi(ce.Args[0])
+	if err != nil || minutes <= 0 {
+		ce.Reply("**Usage:** `$cmdprefix record-events <minutes>|stop`")
+		return
+	} else if cfg.MaxDuration > 0 && minutes > cfg.MaxDuration {
+		ce.Reply("Recordings can be at most %d minutes long", cfg.MaxDuration)
+		return
+	}
+	path, err := ce.User.startGatewayRecording(ce.Portal, ce.RoomID, time.Duration(minutes)*time.Minute)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to start gateway event recording")
+		ce.Reply("Failed to start recording: %v", err)
+		return
+	}
+	ce.Reply("Recording gateway events of this room to `%s` for %d minutes", path, minutes)
+}
+
+// startGatewayRecording starts writing the gateway events of the portal received by the user's session to a new file.
+// Only one recording per user can be active at a time, an existing recording is stopped first.
+func (user *User) startGatewayRecording(portal *Portal, roomID id.RoomID, duration time.Duration) (string, error) {
+	dir := user.bridge.Config.Bridge.EventRecording.Directory
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create recording directory: %w", err)
+	}
+	name := fmt.Sprintf("%s-%s-%s.jsonl", time.Now().UTC().Format("20060102T150405Z"), user.DiscordID, portal.Key.ChannelID)
+	path := filepath.Join(dir, name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create recording file: %w", err)
+	}
+	user.stopGatewayRecording(nil)
+	rec := &gatewayRecording{
+		file:      file,
+		path:      path,
+		channelID: portal.Key.ChannelID,
+		roomID:    roomID,
+	}
+	user.gatewayRecordingLock.Lock()
+	user.gatewayRecording = rec
+	rec.timer = time.AfterFunc(duration, func() {
+		if path, events, ok := user.stopGatewayRecording(rec); ok {
+			_, err := user.bridge.Bot.SendNotice(rec.roomID, fmt.Sprintf("Finished recording, saved %d events to %s", events, path))
+			if err != nil {
+				user.log.Warn().Err(err).Msg("Failed to send gateway recording finished notice")
+			}
+		}
+	})
+	user.gatewayRecordingLock.Unlock()
+	user.log.Info().Str("path", path).Str("channel_id", rec.channelID).Dur("duration", duration).Msg("Started recording gateway events")
+	return path, nil
+}
+
+// stopGatewayRecording stops the active recording of the user. If expected is non-nil,
+// the recording is only stopped if it's still the active one.
+func (user *User) stopGatewayRecording(expected *gatewayRecording) (path string, events int, ok bool) {
+	user.gatewayRecordingLock.Lock()
+	defer user.gatewayRecordingLock.Unlock()
+	rec := user.gatewayRecording
+	if rec == nil || (expected != nil && rec != expected) {
+		return "", 0, false
+	}
+	user.gatewayRecording = nil
+	rec.timer.Stop()
+	err := rec.file.Close()
+	if err != nil {
+		user.log.Warn().Err(err).Str("path", rec.path).Msg("Failed to close gateway recording file")
+	}
+	user.log.Info().Str("path", rec.path).Int("events", rec.events).Msg("Stopped recording gateway events")
+	return rec.path, rec.events, true
+}
+
+// recordGatewayEvent writes a raw gateway event to the user's active recording if it concerns the recorded channel.
+// It's called synchronously from the event handler, so events are recorded in the order they were received.
+func (user *User) recordGatewayEvent(evt *discordgo.Event) {
+	user.gatewayRecordingLock.Lock()
+	defer user.gatewayRecordingLock.Unlock()
+	rec := user.gatewayRecording
+	if rec == nil || !user.gatewayEventConcernsChannel(evt.RawData, rec.channelID) {
+		return
+	}
+	data, err := sanitizeGatewayPayload(evt.RawData)
+	if err != nil {
+		user.log.Warn().Err(err).Str("event_type", evt.Type).Msg("Failed to sanitize gateway event for recording")
+		return
+	}
+	line, err := json.Marshal(&recordedGatewayEvent{
+		Type:      evt.Type,
+		Sequence:  evt.Sequence,
+		Timestamp: time.Now().UnixMilli(),
+		Data:      data,
+	})
+	if err == nil {
+		_, err = rec.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		user.log.Warn().Err(err).Str("path", rec.path).Msg("Failed to write gateway event to recording")
+		return
+	}
+	rec.events++
+}
+
+// gatewayEventConcernsChannel checks if a gateway payload is about the given channel or a thread in it.
+func (user *User) gatewayEventConcernsChannel(raw json.RawMessage, channelID string) bool {
+	var ids struct {
+		ID        string `json:"id"`
+		ChannelID string `json:"channel_id"`
+		ParentID  string `json:"parent_id"`
+	}
+	if json.Unmarshal(raw, &ids) != nil {
+		return false
+	}
+	switch {
+	case ids.ChannelID == channelID, ids.ID == channelID, ids.ParentID == channelID:
+		return true
+	case ids.ChannelID != "":
+		thread := user.bridge.GetThreadByID(ids.ChannelID, nil)
+		return thread != nil && thread.ParentID == channelID
+	default:
+		return false
+	}
+}
+
+// sanitizeGatewayPayload removes sensitive fields from a gateway payload.
+// Numbers are kept as-is, so that large integers don't lose precision.
+func sanitizeGatewayPayload(raw json.RawMessage) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var data any
+	err := decoder.Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(removeSensitiveGatewayFields(data))
+}
+
+func removeSensitiveGatewayFields(data any) any {
+	switch typed := data.(type) {
+	case map[string]any:
+		for key, value := range typed {
+			if _, sensitive := sensitiveGatewayFields[key]; sensitive {
+				delete(typed, key)
+			} else {
+				typed[key] = removeSensitiveGatewayFields(value)
+			}
+		}
+	case []any:
+		for i, value := range typed {
+			typed[i] = removeSensitiveGatewayFields(value)
+		}
+	}
+	return data
+}
@@ -0,0 +1,113 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordedEventStructs are the gateway event types that replayGatewayRecording parses into discordgo structs.
+// Other events are replayed with only the raw data.
+var recordedEventStructs = map[string]func() any{
+	"MESSAGE_CREATE":          func() any { return &discordgo.MessageCreate{} },
+	"MESSAGE_UPDATE":          func() any { return &discordgo.MessageUpdate{} },
+	"MESSAGE_DELETE":          func() any { return &discordgo.MessageDelete{} },
+	"MESSAGE_REACTION_ADD":    func() any { return &discordgo.MessageReactionAdd{} },
+	"MESSAGE_REACTION_REMOVE": func() any { return &discordgo.MessageReactionRemove{} },
+	"CHANNEL_UPDATE":          func() any { return &discordgo.ChannelUpdate{} },
+	"THREAD_CREATE":           func() any { return &discordgo.ThreadCreate{} },
+	"THREAD_UPDATE":           func() any { return &discordgo.ThreadUpdate{} },
+	"TYPING_START":            func() any { return &discordgo.TypingStart{} },
+}
+
+// replayGatewayRecording reads a recording made with the record-events command and calls the handler
+// for each event in order, with the parsed struct in evt.Struct like discordgo does for live events.
+func replayGatewayRecording(t testing.TB, path string, handler func(evt *discordgo.Event)) {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var recorded recordedGatewayEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &recorded), "invalid event on line %d", line)
+		evt := &discordgo.Event{Type: recorded.Type, Sequence: recorded.Sequence, RawData: recorded.Data}
+		if newStruct, ok := recordedEventStructs[recorded.Type]; ok {
+			evt.Struct = newStruct()
+			require.NoError(t, json.Unmarshal(recorded.Data, evt.Struct), "invalid %s payload on line %d", recorded.Type, line)
+		}
+		handler(evt)
+	}
+	require.NoError(t, scanner.Err())
+}
+
+// defaultGatewayRecording is a small recording committed with the tests. It's replayed
+// unless another recording is given in the DISCORD_GATEWAY_RECORDING environment variable.
+const defaultGatewayRecording = "testdata/gateway-recording.jsonl"
+
+// expectedRecordingHTML contains the expected rendering of the messages in the default recording.
+var expectedRecordingHTML = map[string]string{
+	"MESSAGE_CREATE/1300000000000000001": "<strong>bold</strong> and <em>italic</em> with <code>code</code>",
+	"MESSAGE_CREATE/1300000000000000002": "<span data-mx-spoiler>spoiler</span> <del>strike</del> <u>underline</u>",
+	"MESSAGE_UPDATE/1300000000000000001": "<strong>bold</strong> and <em>italic</em> with <code>code</code> (edited)",
+}
+
+// TestReplayGatewayRecording renders the messages in a gateway recording. With the default recording,
+// the output is compared to the expected HTML, otherwise it's only logged.
+func TestReplayGatewayRecording(t *testing.T) {
+	path := os.Getenv("DISCORD_GATEWAY_RECORDING")
+	expected := expectedRecordingHTML
+	if path == "" {
+		path = defaultGatewayRecording
+	} else {
+		expected = nil
+	}
+	portal := &Portal{}
+	rendered := 0
+	replayGatewayRecording(t, path, func(evt *discordgo.Event) {
+		var msg *discordgo.Message
+		switch typed := evt.Struct.(type) {
+		case *discordgo.MessageCreate:
+			msg = typed.Message
+		case *discordgo.MessageUpdate:
+			msg = typed.Message
+		}
+		if msg == nil || msg.Content == "" {
+			return
+		}
+		rendered++
+		name := evt.Type + "/" + msg.ID
+		t.Run(name, func(t *testing.T) {
+			html := portal.renderDiscordMarkdownOnlyHTML(msg.Content, true)
+			if expected != nil {
+				assert.Equal(t, expected[name], html)
+			} else {
+				t.Log(html)
+			}
+		})
+	})
+	if expected != nil {
+		assert.Equal(t, len(expected), rendered)
+	}
+}
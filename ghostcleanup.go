@@ -0,0 +1,94 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func ghostCleanupKey(guildID, userID string) string {
+	return guildID + "-" + userID
+}
+
+// scheduleGhostCleanup removes the ghost of a departed guild member from the guild's portals after the grace period.
+// Every logged-in user in the guild receives the same event, so existing timers are left alone.
+func (br *DiscordBridge) scheduleGhostCleanup(guildID string, member *discordgo.User) {
+	cfg := &br.Config.Bridge.GhostCleanup
+	if !cfg.Enabled || member == nil || br.GetGuildByID(guildID, false) == nil {
+		return
+	}
+	key := ghostCleanupKey(guildID, member.ID)
+	br.ghostCleanupsLock.Lock()
+	defer br.ghostCleanupsLock.Unlock()
+	if _, ok := br.ghostCleanups[key]; ok {
+		return
+	}
+	br.ZLog.Debug().
+		Str("guild_id", guildID).
+		Str("user_id", member.ID).
+		Int("grace_period", cfg.GracePeriod).
+		Msg("Scheduling ghost cleanup for departed guild member")
+	br.ghostCleanups[key] = time.AfterFunc(time.Duration(cfg.GracePeriod)*time.Second, func() {
+		br.ghostCleanupsLock.Lock()
+		delete(br.ghostCleanups, key)
+		br.ghostCleanupsLock.Unlock()
+		br.cleanupGhost(guildID, member.ID)
+	})
+}
+
+// cancelGhostCleanup cancels a pending cleanup if the member rejoined the guild during the grace period.
+func (br *DiscordBridge) cancelGhostCleanup(guildID string, member *discordgo.User) {
+	if member == nil {
+		return
+	}
+	key := ghostCleanupKey(guildID, member.ID)
+	br.ghostCleanupsLock.Lock()
+	defer br.ghostCleanupsLock.Unlock()
+	if timer, ok := br.ghostCleanups[key]; ok {
+		timer.Stop()
+		delete(br.ghostCleanups, key)
+		br.ZLog.Debug().
+			Str("guild_id", guildID).
+			Str("user_id", member.ID).
+			Msg("Cancelled ghost cleanup as member rejoined guild")
+	}
+}
+
+func (br *DiscordBridge) cleanupGhost(guildID, userID string) {
+	log := br.ZLog.With().
+		Str("action", "ghost cleanup").
+		Str("guild_id", guildID).
+		Str("user_id", userID).
+		Logger()
+	puppet := br.GetPuppetByID(userID)
+	intent := puppet.DefaultIntent()
+	removed := 0
+	for _, portal := range br.GetAllPortalsInGuild(guildID) {
+		if portal.MXID == "" || !br.AS.StateStore.IsInRoom(portal.MXID, intent.UserID) {
+			continue
+		}
+		_, err := intent.LeaveRoom(portal.MXID)
+		if err != nil {
+			log.Warn().Err(err).Str("room_id", portal.MXID.String()).Msg("Failed to remove ghost from portal")
+		} else {
+			removed++
+		}
+	}
+	log.Debug().Int("removed_from", removed).Msg("Cleaned up ghost of departed guild member")
+}
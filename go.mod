@@ -17,8 +17,13 @@ require (
 	github.com/stretchr/testify v1.10.0
 	github.com/yuin/goldmark v1.6.0
 	go.mau.fi/util v0.2.2-0.20231228160422-22fdd4bbddeb
+	go.mau.fi/zeroconfig v0.1.2
+	go.starlark.net v0.0.0-20250417143717-f57e51f710eb
 	golang.org/x/exp v0.0.0-20250218142911-aa4b98e5adaa
 	golang.org/x/sync v0.11.0
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+	gopkg.in/yaml.v3 v3.0.1
+	maunium.net/go/mauflag v1.0.0
 	maunium.net/go/maulogger/v2 v2.4.1
 	maunium.net/go/mautrix v0.16.3-0.20240712164054-e6046fbf432c
 )
@@ -33,13 +38,9 @@ require (
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.1 // indirect
 	github.com/tidwall/sjson v1.2.5 // indirect
-	go.mau.fi/zeroconfig v0.1.2 // indirect
 	golang.org/x/crypto v0.31.0 // indirect
 	golang.org/x/net v0.33.0 // indirect
 	golang.org/x/sys v0.28.0 // indirect
-	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
-	maunium.net/go/mauflag v1.0.0 // indirect
 )
 
 replace github.com/bwmarrin/discordgo => github.com/beeper/discordgo v0.0.0-20250222175443-74051f604a97
@@ -0,0 +1,194 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Discord sends guild folder changes as protobuf settings, which discordgo doesn't parse.
+const userSettingsProtoUpdateEvent = "USER_SETTINGS_PROTO_UPDATE"
+
+// getSpaceChildren finds the current children of a space.
+func (user *User) getSpaceChildren(spaceID id.RoomID) (map[id.RoomID]struct{}, error) {
+	state, err := user.bridge.Bot.State(spaceID)
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[id.RoomID]struct{})
+	for stateKey, evt := range state[event.StateSpaceChild] {
+		if len(evt.Content.AsSpaceChild().Via) > 0 {
+			children[id.RoomID(stateKey)] = struct{}{}
+		}
+	}
+	return children, nil
+}
+
+func (user *User) setSpaceChild(spaceID, childID id.RoomID, order string) {
+	_, err := user.bridge.Bot.SendStateEvent(spaceID, event.StateSpaceChild, childID.String(), &event.SpaceChildEventContent{
+		Via:   []string{user.bridge.AS.HomeserverDomain},
+		Order: order,
+	})
+	if err != nil {
+		user.log.Warn().Err(err).
+			Str("space_id", spaceID.String()).
+			Str("child_id", childID.String()).
+			Msg("Failed to add room to space")
+	}
+}
+
+func (user *User) removeSpaceChild(spaceID, childID id.RoomID) {
+	_, err := user.bridge.Bot.SendStateEvent(spaceID, event.StateSpaceChild, childID.String(), struct{}{})
+	if err != nil {
+		user.log.Warn().Err(err).
+			Str("space_id", spaceID.String()).
+			Str("child_id", childID.String()).
+			Msg("Failed to remove room from space")
+	}
+}
+
+// syncGuildFolderSpaces mirrors the Discord guild folder layout into the user's space: each folder becomes a space
+// containing the spaces of the guilds in it, and the top-level space is ordered like the Discord guild list.
+func (user *User) syncGuildFolderSpaces() {
+	if user.Session == nil || !user.Session.IsUser || user.SpaceRoom == "" {
+		return
+	}
+	user.guildFolderLock.Lock()
+	defer user.guildFolderLock.Unlock()
+	existing := user.GetGuildFolderSpaces()
+	if !user.FolderSpaces {
+		if len(existing) > 0 {
+			user.removeGuildFolderSpaces(existing)
+		}
+		return
+	}
+	folders, err := user.fetchGuildFolders()
+	if errors.Is(err, errCapabilityUnavailable) {
+		return
+	} else if err != nil {
+		user.log.Warn().Err(err).Msg("Failed to fetch guild folders")
+		return
+	}
+	// The layout is cached so that unchanged settings don't send any state events
+	var layout strings.Builder
+	for _, folder := range folders {
+		_, _ = fmt.Fprintf(&layout, "%s:%s:%s;", folder.ID, folder.Name, strings.Join(folder.GuildIDs, ","))
+	}
+	if layout.String() == user.guildFolderLayout {
+		return
+	}
+
+	userSpace := user.GetSpaceRoom()
+	topLevelChildren, err := user.getSpaceChildren(userSpace)
+	if err != nil {
+		user.log.Warn().Err(err).Msg("Failed to get children of user space")
+		return
+	}
+	foldered := make(map[id.RoomID]struct{})
+	seenFolders := make(map[string]struct{})
+	for i, folder := range folders {
+		order := fmt.Sprintf("%04d", i)
+		if folder.ID == "" {
+			// Guilds that aren't in a folder are in a "folder" with no ID
+			for _, guildID := range folder.GuildIDs {
+				if guild := user.bridge.GetGuildByID(guildID, false); guild != nil && guild.MXID != "" {
+					user.setSpaceChild(userSpace, guild.MXID, order)
+				}
+			}
+			continue
+		}
+		folderID := folder.ID.String()
+		seenFolders[folderID] = struct{}{}
+		spaceID, ok := existing[folderID]
+		if !ok {
+			name := folder.Name
+			if name == "" {
+				name = "Folder"
+			}
+			user.getSpaceRoom(&spaceID, name, "Discord guild folder", userSpace)
+			if spaceID == "" {
+				continue
+			}
+			user.SetGuildFolderSpace(folderID, spaceID)
+		}
+		user.setSpaceChild(userSpace, spaceID, order)
+		folderChildren, err := user.getSpaceChildren(spaceID)
+		if err != nil {
+			user.log.Warn().Err(err).Str("folder_id", folderID).Msg("Failed to get children of folder space")
+		}
+		wanted := make(map[id.RoomID]struct{})
+		for j, guildID := range folder.GuildIDs {
+			guild := user.bridge.GetGuildByID(guildID, false)
+			if guild == nil || guild.MXID == "" {
+				continue
+			}
+			wanted[guild.MXID] = struct{}{}
+			foldered[guild.MXID] = struct{}{}
+			user.setSpaceChild(spaceID, guild.MXID, fmt.Sprintf("%04d", j))
+		}
+		for child := range folderChildren {
+			if _, ok = wanted[child]; !ok {
+				user.removeSpaceChild(spaceID, child)
+			}
+		}
+	}
+	for child := range topLevelChildren {
+		if _, ok := foldered[child]; ok {
+			user.removeSpaceChild(userSpace, child)
+		}
+	}
+	for folderID, spaceID := range existing {
+		if _, ok := seenFolders[folderID]; !ok {
+			user.removeSpaceChild(userSpace, spaceID)
+			user.RemoveGuildFolderSpace(folderID)
+		}
+	}
+	user.guildFolderLayout = layout.String()
+}
+
+// removeGuildFolderSpaces moves all guild spaces back to the top-level space and unlinks the folder spaces.
+func (user *User) removeGuildFolderSpaces(existing map[string]id.RoomID) {
+	userSpace := user.GetSpaceRoom()
+	for folderID, spaceID := range existing {
+		children, err := user.getSpaceChildren(spaceID)
+		if err != nil {
+			user.log.Warn().Err(err).Str("folder_id", folderID).Msg("Failed to get children of folder space")
+		}
+		for child := range children {
+			user.setSpaceChild(userSpace, child, "")
+			user.removeSpaceChild(spaceID, child)
+		}
+		user.removeSpaceChild(userSpace, spaceID)
+		user.RemoveGuildFolderSpace(folderID)
+	}
+	user.guildFolderLayout = ""
+}
+
+// SetFolderSpaces enables or disables mirroring guild folders as spaces.
+func (user *User) SetFolderSpaces(enabled bool) {
+	user.FolderSpaces = enabled
+	user.Update()
+	user.guildFolderLock.Lock()
+	user.guildFolderLayout = ""
+	user.guildFolderLock.Unlock()
+	go user.syncGuildFolderSpaces()
+}
@@ -0,0 +1,121 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+)
+
+// guildNoticeDedupSize is the number of recent structural changes remembered per guild.
+// Every logged-in user in the guild receives the same events, so each change should only be reported once.
+const guildNoticeDedupSize = 64
+
+// sendAdminNotice reports a structural change in the guild to the guild's admin notice room, if one is set.
+func (guild *Guild) sendAdminNotice(key, message string) {
+	if guild.NoticeRoom == "" || !guild.bridge.ownsGuild(guild.ID) {
+		return
+	}
+	guild.noticeLock.Lock()
+	if guild.recentNotices.Contains(key) {
+		guild.noticeLock.Unlock()
+		return
+	}
+	guild.recentNotices.Push(key, struct{}{})
+	guild.noticeLock.Unlock()
+	go func() {
+		_, err := guild.bridge.Bot.SendMessageEvent(guild.NoticeRoom, event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    fmt.Sprintf("%s: %s", guild.PlainName, message),
+		})
+		if err != nil {
+			guild.log.Warnfln("Failed to send admin notice to %s: %v", guild.NoticeRoom, err)
+		}
+	}()
+}
+
+// setKnownEmojis remembers the emojis of the guild, so that added emojis can be detected later.
+func (guild *Guild) setKnownEmojis(emojis []*discordgo.Emoji) {
+	guild.noticeLock.Lock()
+	defer guild.noticeLock.Unlock()
+	guild.knownEmojis = make(map[string]struct{}, len(emojis))
+	for _, emoji := range emojis {
+		guild.knownEmojis[emoji.ID] = struct{}{}
+	}
+}
+
+func (user *User) guildRoleCreateNotice(evt *discordgo.GuildRoleCreate) {
+	guild := user.bridge.GetGuildByID(evt.GuildID, false)
+	if guild == nil || evt.Role == nil {
+		return
+	}
+	guild.sendAdminNotice("role_create:"+evt.Role.ID, fmt.Sprintf("Role @%s was created", evt.Role.Name))
+}
+
+func (user *User) guildRoleDeleteNotice(evt *discordgo.GuildRoleDelete) {
+	guild := user.bridge.GetGuildByID(evt.GuildID, false)
+	if guild == nil {
+		return
+	}
+	name := evt.RoleID
+	if role := user.bridge.DB.Role.GetByID(evt.GuildID, evt.RoleID); role != nil {
+		name = "@" + role.Name
+	}
+	guild.sendAdminNotice("role_delete:"+evt.RoleID, fmt.Sprintf("Role %s was deleted", name))
+}
+
+func (user *User) guildChannelNotice(ch *discordgo.Channel, deleted bool) {
+	if ch.GuildID == "" {
+		return
+	}
+	guild := user.bridge.GetGuildByID(ch.GuildID, false)
+	if guild == nil {
+		return
+	}
+	name := ch.Name
+	if ch.Type == discordgo.ChannelTypeGuildText || ch.Type == discordgo.ChannelTypeGuildNews {
+		name = "#" + name
+	}
+	if deleted {
+		guild.sendAdminNotice("channel_delete:"+ch.ID, fmt.Sprintf("Channel %s was deleted", name))
+	} else {
+		guild.sendAdminNotice("channel_create:"+ch.ID, fmt.Sprintf("Channel %s was created", name))
+	}
+}
+
+func (user *User) guildEmojisUpdateHandler(evt *discordgo.GuildEmojisUpdate) {
+	guild := user.bridge.GetGuildByID(evt.GuildID, false)
+	if guild == nil {
+		return
+	}
+	guild.noticeLock.Lock()
+	var added []*discordgo.Emoji
+	if guild.knownEmojis != nil {
+		for _, emoji := range evt.Emojis {
+			if _, ok := guild.knownEmojis[emoji.ID]; !ok {
+				added = append(added, emoji)
+			}
+		}
+	}
+	guild.noticeLock.Unlock()
+	guild.setKnownEmojis(evt.Emojis)
+	for _, emoji := range added {
+		guild.sendAdminNotice("emoji_create:"+emoji.ID, fmt.Sprintf("Emoji :%s: was added", emoji.Name))
+	}
+}
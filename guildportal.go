@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"sync"
 
+	"go.mau.fi/util/exsync"
 	log "maunium.net/go/maulogger/v2"
 	"maunium.net/go/maulogger/v2/maulogadapt"
 
@@ -41,6 +42,12 @@ type Guild struct {
 	log    log.Logger
 
 	roomCreateLock sync.Mutex
+
+	recentNotices *exsync.RingBuffer[string, struct{}]
+	knownEmojis   map[string]struct{}
+	noticeLock    sync.Mutex
+
+	emotePackLock sync.Mutex
 }
 
 func (br *DiscordBridge) loadGuild(dbGuild *database.Guild, id string, createIfNotExist bool) *Guild {
@@ -88,6 +95,15 @@ func (br *DiscordBridge) GetGuildByID(id string, createIfNotExist bool) *Guild {
 	return guild
 }
 
+func (br *DiscordBridge) guildHasPortalRooms(guildID string) bool {
+	for _, portal := range br.DB.Portal.GetAllInGuild(guildID) {
+		if portal.MXID != "" {
+			return true
+		}
+	}
+	return false
+}
+
 func (br *DiscordBridge) GetAllGuilds() []*Guild {
 	return br.dbGuildsToGuilds(br.DB.Guild.GetAll())
 }
@@ -118,6 +134,8 @@ func (br *DiscordBridge) NewGuild(dbGuild *database.Guild) *Guild {
 		Guild:  dbGuild,
 		bridge: br,
 		log:    br.Log.Sub(fmt.Sprintf("Guild/%s", dbGuild.ID)),
+
+		recentNotices: exsync.NewRingBuffer[string, struct{}](guildNoticeDedupSize),
 	}
 
 	return guild
@@ -0,0 +1,108 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+)
+
+// everyoneCanView returns true if the @everyone role of the guild can view the channel,
+// i.e. Discord grants read access to everyone in the guild.
+func everyoneCanView(guild *discordgo.Guild, channel *discordgo.Channel) bool {
+	var perms int64
+	for _, role := range guild.Roles {
+		// The @everyone role has the same ID as the guild
+		if role.ID == guild.ID {
+			perms = role.Permissions
+			break
+		}
+	}
+	if perms&discordgo.PermissionAdministrator != 0 {
+		return true
+	}
+	for _, overwrite := range channel.PermissionOverwrites {
+		if overwrite.Type == discordgo.PermissionOverwriteTypeRole && overwrite.ID == guild.ID {
+			perms &^= overwrite.Deny
+			perms |= overwrite.Allow
+		}
+	}
+	return perms&discordgo.PermissionViewChannel != 0
+}
+
+// discordHistoryVisibility returns the history visibility that the portal room should have based on
+// the Discord channel permissions, or an empty string if it shouldn't be synced or can't be determined.
+func (portal *Portal) discordHistoryVisibility(source *User) event.HistoryVisibility {
+	cfg := &portal.bridge.Config.Bridge.HistoryVisibilitySync
+	if !cfg.Enabled || portal.GuildID == "" || portal.Plumbed || source.Session == nil {
+		return ""
+	}
+	guild, err := source.Session.State.Guild(portal.GuildID)
+	if err != nil {
+		return ""
+	}
+	channel, err := source.Session.State.Channel(portal.Key.ChannelID)
+	if err != nil {
+		return ""
+	}
+	if everyoneCanView(guild, channel) {
+		return cfg.Public
+	}
+	return cfg.Restricted
+}
+
+// syncHistoryVisibility updates the history visibility of the portal room if the Discord channel permissions changed.
+func (portal *Portal) syncHistoryVisibility(source *User) {
+	if portal.MXID == "" {
+		return
+	}
+	visibility := portal.discordHistoryVisibility(source)
+	if visibility == "" {
+		return
+	}
+	log := portal.log.With().Str("action", "sync history visibility").Logger()
+	intent := portal.MainIntent()
+	var current event.HistoryVisibilityEventContent
+	err := intent.StateEvent(portal.MXID, event.StateHistoryVisibility, "", &current)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get current history visibility")
+		return
+	} else if current.HistoryVisibility == visibility {
+		return
+	}
+	_, err = intent.SendStateEvent(portal.MXID, event.StateHistoryVisibility, "", &event.HistoryVisibilityEventContent{
+		HistoryVisibility: visibility,
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to update history visibility")
+	} else {
+		log.Debug().
+			Str("old_visibility", string(current.HistoryVisibility)).
+			Str("new_visibility", string(visibility)).
+			Msg("Updated history visibility from Discord permissions")
+	}
+}
+
+// syncGuildHistoryVisibility resyncs the history visibility in all portals of a guild, e.g. after the @everyone role changed.
+func (user *User) syncGuildHistoryVisibility(guildID string) {
+	if !user.bridge.Config.Bridge.HistoryVisibilitySync.Enabled {
+		return
+	}
+	for _, portal := range user.bridge.GetAllPortalsInGuild(guildID) {
+		portal.syncHistoryVisibility(user)
+	}
+}
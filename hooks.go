@@ -0,0 +1,121 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/config"
+)
+
+// HookEvent is an event fired on the internal hook bus. Fields that don't apply to the event type are empty.
+type HookEvent struct {
+	Type      config.HookEventType `json:"type"`
+	Timestamp int64                `json:"timestamp"`
+
+	UserID  id.UserID  `json:"user_id,omitempty"`
+	RoomID  id.RoomID  `json:"room_id,omitempty"`
+	EventID id.EventID `json:"event_id,omitempty"`
+
+	GuildID   string `json:"guild_id,omitempty"`
+	ChannelID string `json:"channel_id,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+
+	Handler string `json:"handler,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// HookFunc is a function that's called for hook events. Each call runs in its own goroutine.
+type HookFunc func(br *DiscordBridge, evt HookEvent)
+
+var hookFuncs = make(map[config.HookEventType][]HookFunc)
+
+// RegisterHook adds a function that's called for every hook event of the given type. It's not safe to call
+// after the bridge has started, so downstream builds should call it from an init function in their own file.
+func RegisterHook(evtType config.HookEventType, fn HookFunc) {
+	hookFuncs[evtType] = append(hookFuncs[evtType], fn)
+}
+
+func (br *DiscordBridge) fireHook(evt HookEvent) {
+	evt.Timestamp = time.Now().UnixMilli()
+	for _, fn := range hookFuncs[evt.Type] {
+		go br.runHookFunc(fn, evt)
+	}
+	for _, webhook := range br.Config.Bridge.Hooks.Webhooks {
+		if webhook.Wants(evt.Type) {
+			go br.postHookWebhook(webhook, evt)
+		}
+	}
+}
+
+func (br *DiscordBridge) runHookFunc(fn HookFunc, evt HookEvent) {
+	defer func() {
+		if err := recover(); err != nil {
+			br.ZLog.Error().
+				Str("hook_event_type", string(evt.Type)).
+				Bytes("stack", debug.Stack()).
+				Any("panic", err).
+				Msg("Panic in hook function")
+		}
+	}()
+	fn(br, evt)
+}
+
+func (br *DiscordBridge) postHookWebhook(webhook config.HookWebhook, evt HookEvent) {
+	log := br.ZLog.With().
+		Str("action", "send hook webhook").
+		Str("hook_event_type", string(evt.Type)).
+		Str("url", webhook.URL).
+		Logger()
+	body, err := json.Marshal(&evt)
+	if err != nil {
+		log.Err(err).Msg("Failed to marshal hook event")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		log.Err(err).Msg("Failed to prepare hook webhook request")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Hook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to send hook webhook")
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Warn().Int("status_code", resp.StatusCode).Msg("Hook webhook returned non-success status")
+	}
+}
@@ -0,0 +1,91 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+var cmdID = &commands.FullHandler{
+	Func: wrapCommand(fnID),
+	Name: "id",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Show the Discord and Matrix IDs of the current portal, or of a message if used as a reply.",
+	},
+}
+
+// discordMessageLink builds the same link as Discord's "Copy Message Link" option.
+func discordMessageLink(guildID, channelID, messageID string) string {
+	if guildID == "" {
+		guildID = "@me"
+	}
+	return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, channelID, messageID)
+}
+
+func fnID(ce *WrappedCommandEvent) {
+	var lines []string
+	if ce.User.DiscordID != "" {
+		lines = append(lines, fmt.Sprintf("* Your Discord user ID: `%s`", ce.User.DiscordID))
+	}
+	lines = append(lines, fmt.Sprintf("* Matrix room ID: `%s`", ce.RoomID))
+	if ce.Portal == nil {
+		ce.Reply(strings.Join(lines, "\n"))
+		return
+	}
+	portal := ce.Portal
+	lines = append(lines, fmt.Sprintf("* Discord channel ID: `%s` (type %d)", portal.Key.ChannelID, portal.Type))
+	if portal.Key.Receiver != "" {
+		lines = append(lines, fmt.Sprintf("* Portal receiver: `%s`", portal.Key.Receiver))
+	}
+	if portal.ParentID != "" {
+		lines = append(lines, fmt.Sprintf("* Discord parent channel ID: `%s`", portal.ParentID))
+	}
+	if portal.GuildID != "" {
+		lines = append(lines, fmt.Sprintf("* Discord guild ID: `%s`", portal.GuildID))
+	}
+	if portal.OtherUserID != "" {
+		lines = append(lines, fmt.Sprintf("* Other Discord user ID: `%s`", portal.OtherUserID))
+	}
+
+	if ce.ReplyTo != "" {
+		msg := ce.Bridge.DB.Message.GetByMXID(portal.Key, ce.ReplyTo)
+		if msg == nil {
+			lines = append(lines, fmt.Sprintf("* Matrix event ID: `%s` (not bridged to Discord)", ce.ReplyTo))
+		} else {
+			if msg.ThreadID != "" {
+				lines = append(lines, fmt.Sprintf("* Discord thread ID: `%s`", msg.ThreadID))
+			}
+			lines = append(lines, fmt.Sprintf("* Discord message ID: `%s`", msg.DiscordID))
+			if msg.AttachmentID != "" {
+				lines = append(lines, fmt.Sprintf("* Discord attachment ID: `%s`", msg.AttachmentID))
+			}
+			if msg.SenderID != "" {
+				lines = append(lines, fmt.Sprintf("* Discord sender ID: `%s`", msg.SenderID))
+			}
+			lines = append(lines,
+				fmt.Sprintf("* Matrix event ID: `%s`", msg.MXID),
+				fmt.Sprintf("* Matrix sender: `%s`", msg.SenderMXID),
+				fmt.Sprintf("* Discord link: %s", discordMessageLink(portal.GuildID, msg.DiscordProtoChannelID(), msg.DiscordID)),
+			)
+		}
+	}
+	ce.Reply(strings.Join(lines, "\n"))
+}
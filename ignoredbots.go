@@ -0,0 +1,90 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+func (br *DiscordBridge) loadIgnoredBots() {
+	br.ignoredBotsLock.Lock()
+	defer br.ignoredBotsLock.Unlock()
+	br.ignoredBots = make(map[database.IgnoredBot]struct{})
+	for _, bot := range br.DB.IgnoredBot.GetAll() {
+		br.ignoredBots[bot] = struct{}{}
+	}
+}
+
+// GetIgnoredBots returns the bots ignored in the given channel, including globally ignored ones.
+func (br *DiscordBridge) GetIgnoredBots(channelID string) []database.IgnoredBot {
+	br.ignoredBotsLock.RLock()
+	defer br.ignoredBotsLock.RUnlock()
+	var bots []database.IgnoredBot
+	for bot := range br.ignoredBots {
+		if bot.ChannelID == "" || bot.ChannelID == channelID {
+			bots = append(bots, bot)
+		}
+	}
+	return bots
+}
+
+// SetBotIgnored adds or removes a bot ignore rule. An empty channel ID applies to all channels.
+// The return value is false if the rule was already in the requested state.
+func (br *DiscordBridge) SetBotIgnored(botID, channelID string, ignored bool) bool {
+	bot := database.IgnoredBot{BotID: botID, ChannelID: channelID}
+	br.ignoredBotsLock.Lock()
+	defer br.ignoredBotsLock.Unlock()
+	_, alreadyIgnored := br.ignoredBots[bot]
+	if alreadyIgnored == ignored {
+		return false
+	} else if ignored {
+		br.DB.IgnoredBot.Add(bot)
+		br.ignoredBots[bot] = struct{}{}
+	} else {
+		br.DB.IgnoredBot.Remove(bot)
+		delete(br.ignoredBots, bot)
+	}
+	return true
+}
+
+func (br *DiscordBridge) isBotIgnored(channelID, botID string) bool {
+	if botID == "" {
+		return false
+	}
+	_, ignoredGlobally := br.ignoredBots[database.IgnoredBot{BotID: botID}]
+	_, ignoredInChannel := br.ignoredBots[database.IgnoredBot{BotID: botID, ChannelID: channelID}]
+	return ignoredGlobally || ignoredInChannel
+}
+
+// isMessageFromIgnoredBot checks if the author, application or webhook of a Discord message is ignored in the portal.
+func (portal *Portal) isMessageFromIgnoredBot(msg *discordgo.Message) bool {
+	br := portal.bridge
+	br.ignoredBotsLock.RLock()
+	defer br.ignoredBotsLock.RUnlock()
+	if len(br.ignoredBots) == 0 {
+		return false
+	}
+	var authorID string
+	if msg.Author != nil {
+		authorID = msg.Author.ID
+	}
+	return br.isBotIgnored(portal.Key.ChannelID, authorID) ||
+		br.isBotIgnored(portal.Key.ChannelID, msg.ApplicationID) ||
+		br.isBotIgnored(portal.Key.ChannelID, msg.WebhookID)
+}
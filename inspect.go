@@ -0,0 +1,163 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// maxRecentErrors is the number of errors kept per user for the admin inspect command.
+const maxRecentErrors = 10
+
+type userErrorRecord struct {
+	Time   time.Time
+	Source string
+	Error  string
+}
+
+// recordError stores an error that affected the user, so that admins can see it without digging through logs.
+func (user *User) recordError(source string, err error) {
+	user.recentErrorsLock.Lock()
+	defer user.recentErrorsLock.Unlock()
+	user.recentErrors = append(user.recentErrors, userErrorRecord{
+		Time:   time.Now(),
+		Source: source,
+		Error:  err.Error(),
+	})
+	if len(user.recentErrors) > maxRecentErrors {
+		user.recentErrors = user.recentErrors[len(user.recentErrors)-maxRecentErrors:]
+	}
+}
+
+func (user *User) getRecentErrors() []userErrorRecord {
+	user.recentErrorsLock.Lock()
+	defer user.recentErrorsLock.Unlock()
+	return append([]userErrorRecord(nil), user.recentErrors...)
+}
+
+var cmdAdmin = &commands.FullHandler{
+	Func: wrapCommand(fnAdmin),
+	Name: "admin",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "Inspect the state of a user for support purposes, without showing any message content.",
+		Args:        "inspect <_Matrix user ID_>",
+	},
+	RequiresAdmin: true,
+}
+
+func fnAdmin(ce *WrappedCommandEvent) {
+	if len(ce.Args) < 2 || strings.ToLower(ce.Args[0]) != "inspect" {
+		ce.Reply("**Usage:** `$cmdprefix admin inspect <Matrix user ID>`")
+		return
+	}
+	userID := id.UserID(ce.Args[1])
+	if _, _, err := userID.Parse(); err != nil {
+		ce.Reply("That doesn't look like a Matrix user ID")
+		return
+	}
+	user := ce.Bridge.GetCachedUserByMXID(userID)
+	// Don't create a user just by inspecting them
+	if user == nil && ce.Bridge.DB.User.GetByMXID(userID) != nil {
+		user = ce.Bridge.GetUserByMXID(userID)
+	}
+	if user == nil {
+		ce.Reply("%s hasn't used the bridge", userID)
+		return
+	}
+	ce.Reply(user.inspect())
+}
+
+// inspect summarizes the user's login and connection state, portals and queues for the admin inspect command.
+func (user *User) inspect() string {
+	var out strings.Builder
+	_, _ = fmt.Fprintf(&out, "#### %s\n", user.MXID)
+	_, _ = fmt.Fprintf(&out, "* **Permission level:** %d\n", user.PermissionLevel)
+
+	session := user.Session
+	switch {
+	case session != nil && session.State != nil && session.State.User != nil:
+		_, _ = fmt.Fprintf(&out, "* **Login:** logged in as %s (`%s`)\n", user.GetRemoteName(), user.DiscordID)
+	case user.DiscordToken != "":
+		_, _ = fmt.Fprintf(&out, "* **Login:** token stored for `%s`, but not connected\n", user.DiscordID)
+	default:
+		out.WriteString("* **Login:** not logged in\n")
+	}
+	if session != nil {
+		connection := "connected"
+		if user.wasDisconnected {
+			connection = "disconnected, waiting for reconnect"
+		}
+		_, _ = fmt.Fprintf(&out, "* **Connection:** %s (gateway latency %s)\n", connection, session.HeartbeatLatency().Round(time.Millisecond))
+	}
+	if user.BridgeState != nil {
+		state := user.BridgeState.GetPrev()
+		if state.StateEvent != "" {
+			_, _ = fmt.Fprintf(&out, "* **Bridge state:** %s", state.StateEvent)
+			if state.Error != "" {
+				_, _ = fmt.Fprintf(&out, " (`%s`)", state.Error)
+			}
+			_, _ = fmt.Fprintf(&out, " since %s\n", state.Timestamp.Time.UTC().Format(time.RFC3339))
+		}
+	}
+
+	portalCounts := map[string]int{}
+	var discordQueue, matrixQueue int
+	for _, up := range user.GetPortals() {
+		portalCounts[up.Type]++
+		if up.Type == database.UserPortalTypeThread {
+			continue
+		}
+		if portal := user.GetExistingPortalByID(up.DiscordID); portal != nil {
+			discordQueue += len(portal.discordMessages)
+			matrixQueue += len(portal.matrixMessages)
+		}
+	}
+	_, _ = fmt.Fprintf(&out, "* **Portals:** %d DMs, %d guilds, %d threads\n",
+		portalCounts[database.UserPortalTypeDM], portalCounts[database.UserPortalTypeGuild], portalCounts[database.UserPortalTypeThread])
+
+	user.catchupLock.Lock()
+	var catchupBuffered int
+	for _, buf := range user.catchupBuffers {
+		catchupBuffered += len(buf)
+	}
+	user.catchupLock.Unlock()
+	user.pendingInteractionsLock.Lock()
+	pendingInteractions := len(user.pendingInteractions)
+	user.pendingInteractionsLock.Unlock()
+	_, _ = fmt.Fprintf(&out, "* **Pending queues:** %d Discord events and %d Matrix events in portal queues, %d buffered during catch-up, %d pending interactions\n",
+		discordQueue, matrixQueue, catchupBuffered, pendingInteractions)
+
+	recentErrors := user.getRecentErrors()
+	if len(recentErrors) == 0 {
+		out.WriteString("* **Recent errors:** none\n")
+	} else {
+		out.WriteString("* **Recent errors:**\n")
+		for i := len(recentErrors) - 1; i >= 0; i-- {
+			rec := recentErrors[i]
+			_, _ = fmt.Fprintf(&out, "  * %s %s: `%s`\n", rec.Time.UTC().Format(time.RFC3339), rec.Source, rec.Error)
+		}
+	}
+	return out.String()
+}
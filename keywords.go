@@ -0,0 +1,168 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// keywordHighlightMaxPreview is the maximum number of characters of the message included in keyword highlights.
+const keywordHighlightMaxPreview = 300
+
+type keywordMatcher struct {
+	keyword string
+	regex   *regexp.Regexp
+}
+
+func newKeywordMatcher(keyword string) keywordMatcher {
+	return keywordMatcher{
+		keyword: keyword,
+		regex:   regexp.MustCompile(`(?i)(?:^|\W)` + regexp.QuoteMeta(keyword) + `(?:$|\W)`),
+	}
+}
+
+func (user *User) loadKeywords() {
+	if user.keywords != nil {
+		return
+	}
+	keywords := user.GetKeywords()
+	user.keywords = make([]keywordMatcher, len(keywords))
+	for i, keyword := range keywords {
+		user.keywords[i] = newKeywordMatcher(keyword)
+	}
+}
+
+// GetKeywordList returns the keyword highlights the user has registered.
+func (user *User) GetKeywordList() []string {
+	user.keywordsLock.Lock()
+	defer user.keywordsLock.Unlock()
+	user.loadKeywords()
+	keywords := make([]string, len(user.keywords))
+	for i, matcher := range user.keywords {
+		keywords[i] = matcher.keyword
+	}
+	return keywords
+}
+
+// SetKeyword adds or removes a keyword highlight. The return value is false if nothing changed.
+func (user *User) SetKeyword(keyword string, add bool) bool {
+	keyword = strings.ToLower(strings.TrimSpace(keyword))
+	user.keywordsLock.Lock()
+	defer user.keywordsLock.Unlock()
+	user.loadKeywords()
+	for i, matcher := range user.keywords {
+		if matcher.keyword != keyword {
+			continue
+		} else if add {
+			return false
+		}
+		user.RemoveKeyword(keyword)
+		user.keywords = append(user.keywords[:i], user.keywords[i+1:]...)
+		return true
+	}
+	if !add {
+		return false
+	}
+	user.AddKeyword(keyword)
+	user.keywords = append(user.keywords, newKeywordMatcher(keyword))
+	return true
+}
+
+func (user *User) matchKeyword(text string) string {
+	user.keywordsLock.Lock()
+	defer user.keywordsLock.Unlock()
+	user.loadKeywords()
+	for _, matcher := range user.keywords {
+		if matcher.regex.MatchString(text) {
+			return matcher.keyword
+		}
+	}
+	return ""
+}
+
+// canReadKeywordMessage checks that the user can see the message on Discord,
+// so that highlights don't leak messages in private channels to other members of the guild.
+func (user *User) canReadKeywordMessage(portal *Portal, msg *discordgo.Message) bool {
+	if !user.Connected() {
+		return false
+	}
+	if msg.ChannelID != portal.Key.ChannelID {
+		// Private thread membership isn't tracked, so highlights are only sent for messages in public threads
+		thread, err := user.Session.State.Channel(msg.ChannelID)
+		if err != nil || thread.Type == discordgo.ChannelTypeGuildPrivateThread {
+			return false
+		}
+	}
+	err := user.checkChannelPermission(portal.Key.ChannelID, discordgo.PermissionViewChannel)
+	if err != nil {
+		var permErr *DiscordPermissionError
+		if !errors.As(err, &permErr) {
+			portal.log.Warn().Err(err).Str("user_id", user.MXID.String()).Msg("Failed to check if keyword highlight recipient can view channel")
+		}
+		return false
+	}
+	return true
+}
+
+// sendKeywordHighlights pings users in their management room when a bridged Discord message
+// contains one of their keywords, so they notice it even if the portal is muted.
+func (portal *Portal) sendKeywordHighlights(msg *discordgo.Message, senderName string, eventID id.EventID) {
+	if portal.GuildID == "" || msg.Content == "" || eventID == "" {
+		return
+	}
+	for _, userID := range portal.bridge.DB.GetUsersInPortal(portal.GuildID) {
+		user := portal.bridge.GetCachedUserByMXID(userID)
+		if user == nil || user.ManagementRoom == "" || user.DiscordID == msg.Author.ID {
+			continue
+		}
+		keyword := user.matchKeyword(msg.Content)
+		if keyword == "" || !user.canReadKeywordMessage(portal, msg) {
+			continue
+		}
+		preview := msg.Content
+		if runes := []rune(preview); len(runes) > keywordHighlightMaxPreview {
+			preview = string(runes[:keywordHighlightMaxPreview]) + "…"
+		}
+		link := portal.MXID.EventURI(eventID, portal.bridge.Config.Homeserver.Domain).MatrixToURL()
+		content := &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    fmt.Sprintf("Keyword %q mentioned by %s in %s (%s):\n\n%s", keyword, senderName, portal.Name, link, preview),
+			Format:  event.FormatHTML,
+			FormattedBody: fmt.Sprintf(
+				`Keyword <code>%s</code> mentioned by <strong>%s</strong> in <a href="%s">%s</a>:<blockquote>%s</blockquote>`,
+				html.EscapeString(keyword), html.EscapeString(senderName), link, html.EscapeString(portal.Name),
+				strings.ReplaceAll(html.EscapeString(preview), "\n", "<br>"),
+			),
+			Mentions: &event.Mentions{UserIDs: []id.UserID{user.MXID}},
+		}
+		_, err := portal.bridge.Bot.SendMessageEvent(user.ManagementRoom, event.EventMessage, content)
+		if err != nil {
+			portal.log.Warn().Err(err).
+				Str("user_id", user.MXID.String()).
+				Str("message_id", msg.ID).
+				Msg("Failed to send keyword highlight")
+		}
+	}
+}
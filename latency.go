@@ -0,0 +1,171 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWindowSize is the number of recent messages that latency percentiles are calculated from.
+	latencyWindowSize = 1000
+	// latencyAlertMinSamples is the minimum number of samples required before alerts are sent.
+	latencyAlertMinSamples = 20
+)
+
+type latencySample struct {
+	duration time.Duration
+	failed   bool
+}
+
+// latencyTracker keeps a sliding window of Discord -> Matrix bridging latencies.
+type latencyTracker struct {
+	samples   []latencySample
+	next      int
+	lastAlert time.Time
+	lock      sync.Mutex
+}
+
+type LatencyStats struct {
+	Count     int     `json:"count"`
+	Failed    int     `json:"failed"`
+	ErrorRate float64 `json:"error_rate"`
+	P50       int64   `json:"p50_ms"`
+	P90       int64   `json:"p90_ms"`
+	P95       int64   `json:"p95_ms"`
+	P99       int64   `json:"p99_ms"`
+	Max       int64   `json:"max_ms"`
+}
+
+func (lt *latencyTracker) record(duration time.Duration, failed bool) {
+	sample := latencySample{duration: duration, failed: failed}
+	if len(lt.samples) < latencyWindowSize {
+		lt.samples = append(lt.samples, sample)
+	} else {
+		lt.samples[lt.next] = sample
+		lt.next = (lt.next + 1) % latencyWindowSize
+	}
+}
+
+func (lt *latencyTracker) stats() (stats LatencyStats) {
+	stats.Count = len(lt.samples)
+	if stats.Count == 0 {
+		return
+	}
+	durations := make([]time.Duration, len(lt.samples))
+	for i, sample := range lt.samples {
+		durations[i] = sample.duration
+		if sample.failed {
+			stats.Failed++
+		}
+	}
+	slices.Sort(durations)
+	percentile := func(p int) int64 {
+		return durations[(len(durations)-1)*p/100].Milliseconds()
+	}
+	stats.ErrorRate = float64(stats.Failed) / float64(stats.Count)
+	stats.P50 = percentile(50)
+	stats.P90 = percentile(90)
+	stats.P95 = percentile(95)
+	stats.P99 = percentile(99)
+	stats.Max = durations[len(durations)-1].Milliseconds()
+	return
+}
+
+// Stats returns percentiles and the error rate of recently bridged messages.
+func (lt *latencyTracker) Stats() LatencyStats {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	return lt.stats()
+}
+
+// RecordMessageLatency records how long it took to bridge a Discord message to Matrix,
+// and sends an alert if the configured thresholds are breached.
+func (br *DiscordBridge) RecordMessageLatency(receivedAt time.Time, failed bool) {
+	if receivedAt.IsZero() {
+		return
+	}
+	br.metrics.recordMessage(metricDirectionDiscordToMatrix, !failed, time.Since(receivedAt))
+	lt := &br.messageLatency
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	lt.record(time.Since(receivedAt), failed)
+
+	cfg := &br.Config.Bridge.LatencyAlerts
+	if cfg.WebhookURL == "" || len(lt.samples) < latencyAlertMinSamples {
+		return
+	} else if time.Since(lt.lastAlert) < time.Duration(cfg.Cooldown)*time.Second {
+		return
+	}
+	stats := lt.stats()
+	var reasons []string
+	if cfg.MaxP95 > 0 && stats.P95 > cfg.MaxP95 {
+		reasons = append(reasons, fmt.Sprintf("95th percentile latency is %d ms (threshold %d ms)", stats.P95, cfg.MaxP95))
+	}
+	if cfg.MaxErrorRate > 0 && stats.ErrorRate > cfg.MaxErrorRate {
+		reasons = append(reasons, fmt.Sprintf("error rate is %.1f%% (threshold %.1f%%)", stats.ErrorRate*100, cfg.MaxErrorRate*100))
+	}
+	if len(reasons) == 0 {
+		return
+	}
+	lt.lastAlert = time.Now()
+	go br.sendLatencyAlert(reasons, stats)
+}
+
+type latencyAlert struct {
+	Bridge  string       `json:"bridge"`
+	Reasons []string     `json:"reasons"`
+	Stats   LatencyStats `json:"stats"`
+}
+
+func (br *DiscordBridge) sendLatencyAlert(reasons []string, stats LatencyStats) {
+	log := br.ZLog.With().Str("action", "send latency alert").Logger()
+	log.Warn().Strs("reasons", reasons).Msg("Message bridging latency thresholds breached")
+	body, err := json.Marshal(&latencyAlert{
+		Bridge:  br.AS.BotMXID().String(),
+		Reasons: reasons,
+		Stats:   stats,
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to marshal latency alert")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, br.Config.Bridge.LatencyAlerts.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		log.Err(err).Msg("Failed to prepare latency alert request")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Err(err).Msg("Failed to send latency alert")
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Warn().Int("status_code", resp.StatusCode).Msg("Latency alert webhook returned non-success status")
+	}
+}
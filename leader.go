@@ -0,0 +1,85 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+)
+
+// exitCodeLeadershipLost is used when the process stops because the leader lock connection died.
+const exitCodeLeadershipLost = 30
+
+// waitForLeadership blocks until this process holds the high availability advisory lock.
+// The lock is tied to a dedicated database connection, so it's released automatically if the process dies.
+func (br *DiscordBridge) waitForLeadership() {
+	cfg := &br.Config.Bridge.HighAvailability
+	if !cfg.Enabled {
+		return
+	} else if br.DB.Dialect != dbutil.Postgres {
+		br.ZLog.Warn().Msg("High availability mode is only supported with Postgres")
+		return
+	}
+	log := br.componentLog("high availability").With().Int64("lock_id", cfg.LockID).Logger()
+	interval := time.Duration(cfg.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	loggedWaiting := false
+	for {
+		conn, err := br.Bridge.DB.RawDB.Conn(context.Background())
+		if err != nil {
+			log.Err(err).Msg("Failed to get database connection for leader lock")
+			time.Sleep(interval)
+			continue
+		}
+		var acquired bool
+		err = conn.QueryRowContext(context.Background(), "SELECT pg_try_advisory_lock($1)", cfg.LockID).Scan(&acquired)
+		if err != nil {
+			log.Err(err).Msg("Failed to try acquiring leader lock")
+		} else if acquired {
+			log.Info().Msg("Acquired leader lock, starting bridge")
+			go br.watchLeadership(conn, interval)
+			return
+		} else if !loggedWaiting {
+			log.Info().Msg("Another bridge process holds the leader lock, waiting in standby mode")
+			loggedWaiting = true
+		}
+		_ = conn.Close()
+		time.Sleep(interval)
+	}
+}
+
+// watchLeadership stops the bridge if the connection holding the leader lock dies,
+// as a standby process may have taken over at that point.
+func (br *DiscordBridge) watchLeadership(conn *sql.Conn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := conn.PingContext(ctx)
+		cancel()
+		if err != nil {
+			br.ZLog.Error().Err(err).Msg("Lost connection holding the leader lock, stopping bridge")
+			br.ManualStop(exitCodeLeadershipLost)
+			return
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/zeroconfig"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// PreInit is called by the bridge right before the logger is created from the config.
+func (br *DiscordBridge) PreInit() {
+	zeroconfig.RegisterWriter(zeroconfig.WriterTypeFile, br.compileFileWriter)
+}
+
+// compileFileWriter creates a size-rotated file writer like zeroconfig's default one,
+// and additionally rotates it periodically if logging.rotate_interval is set.
+func (br *DiscordBridge) compileFileWriter(wc *zeroconfig.WriterConfig) (io.Writer, error) {
+	writer := &lumberjack.Logger{
+		Filename:   wc.Filename,
+		MaxSize:    wc.MaxSize,
+		MaxAge:     wc.MaxAge,
+		MaxBackups: wc.MaxBackups,
+		LocalTime:  wc.LocalTime,
+		Compress:   wc.Compress,
+	}
+	err := writer.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	if interval := time.Duration(br.Config.LoggingExtras.RotateInterval) * time.Second; interval > 0 {
+		go rotateLogFilePeriodically(writer, interval)
+	}
+	return writer, nil
+}
+
+func rotateLogFilePeriodically(writer *lumberjack.Logger, interval time.Duration) {
+	for range time.Tick(interval) {
+		err := writer.Rotate()
+		if err != nil {
+			// The failing writer might be the only one, so don't log this through zerolog
+			_, _ = fmt.Fprintf(os.Stderr, "Failed to rotate log file %s: %v\n", writer.Filename, err)
+		}
+	}
+}
+
+// moduleLevel applies the level from logging.module_levels to a module's logger, if one is configured.
+func (br *DiscordBridge) moduleLevel(log zerolog.Logger, module string) zerolog.Logger {
+	if level, ok := br.Config.LoggingExtras.ModuleLevels[module]; ok {
+		return log.Level(level)
+	}
+	return log
+}
+
+// componentLog creates a logger for a bridge-wide component.
+func (br *DiscordBridge) componentLog(component string) zerolog.Logger {
+	return br.moduleLevel(br.ZLog.With().Str("component", component).Logger(), component)
+}
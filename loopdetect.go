@@ -0,0 +1,108 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// loopDetectorMaxEntries is the maximum number of recently bridged messages remembered per direction.
+	loopDetectorMaxEntries = 32
+	// loopDetectorMinLength is the minimum length of a normalized message for it to be considered in
+	// loop detection, to avoid dropping short messages like "ok" that people legitimately repeat.
+	loopDetectorMinLength = 8
+)
+
+var loopDetectorReplacer = strings.NewReplacer("*", "", "_", "", "~", "", "`", "", ">", "", "|", "", "\\", "")
+
+type loopDetectorEntry struct {
+	author  string
+	text    string
+	expires time.Time
+}
+
+// loopDetector remembers the author and text of messages that were recently bridged in one direction,
+// so that another bridge in the same room echoing them back can be recognized.
+type loopDetector struct {
+	recent []loopDetectorEntry
+	lock   sync.Mutex
+}
+
+// normalizeForLoopDetection strips formatting and whitespace differences that other bridges
+// commonly introduce when copying a message.
+func normalizeForLoopDetection(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(loopDetectorReplacer.Replace(text))), " ")
+}
+
+func (ld *loopDetector) expire() {
+	now := time.Now()
+	for len(ld.recent) > 0 && ld.recent[0].expires.Before(now) {
+		ld.recent = ld.recent[1:]
+	}
+}
+
+// Add remembers that the given text was bridged from a sender with the given name.
+func (ld *loopDetector) Add(author, text string, window time.Duration) {
+	text = normalizeForLoopDetection(text)
+	if window <= 0 || len(text) < loopDetectorMinLength {
+		return
+	}
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+	ld.expire()
+	if len(ld.recent) >= loopDetectorMaxEntries {
+		ld.recent = ld.recent[1:]
+	}
+	ld.recent = append(ld.recent, loopDetectorEntry{
+		author:  normalizeForLoopDetection(author),
+		text:    text,
+		expires: time.Now().Add(window),
+	})
+}
+
+// matches checks if a message is an exact copy of the entry. Other bridges either send the copy with the original
+// sender's name as the author, or prefix the text with the name, e.g. "<name> text" or "name: text".
+func (entry *loopDetectorEntry) matches(author, text string) bool {
+	if text == entry.text {
+		return entry.author != "" && author == entry.author
+	} else if entry.author == "" {
+		return false
+	}
+	rest, ok := strings.CutPrefix(strings.TrimLeft(text, "<[("), entry.author)
+	return ok && strings.TrimLeft(rest, ":])- ") == entry.text
+}
+
+// IsEcho checks if the given message is a copy of a recently bridged message from the same sender.
+func (ld *loopDetector) IsEcho(author, text string) bool {
+	text = normalizeForLoopDetection(text)
+	if len(text) < loopDetectorMinLength {
+		return false
+	}
+	author = normalizeForLoopDetection(author)
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+	ld.expire()
+	for _, entry := range ld.recent {
+		if entry.matches(author, text) {
+			return true
+		}
+	}
+	return false
+}
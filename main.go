@@ -17,15 +17,20 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"net/http"
+	"os"
 	"sync"
+	"time"
 
+	"github.com/rs/zerolog"
 	"go.mau.fi/util/configupgrade"
 	"go.mau.fi/util/exsync"
 	"golang.org/x/sync/semaphore"
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-discord/config"
@@ -72,10 +77,37 @@ type DiscordBridge struct {
 	guildsByID   map[string]*Guild
 	guildsLock   sync.Mutex
 
+	ignoredBots     map[database.IgnoredBot]struct{}
+	ignoredBotsLock sync.RWMutex
+
 	puppets             map[string]*Puppet
 	puppetsByCustomMXID map[id.UserID]*Puppet
 	puppetsLock         sync.Mutex
 
+	messageLatency latencyTracker
+	dbHealth       dbHealth
+	dbHealthLock   sync.Mutex
+	adminAlerts    adminAlerts
+	capabilities   discordCapabilities
+	quotas         quotaTracker
+	policies       policyLists
+	messageScript  *messageScript
+	sentry         *sentryReporter
+	metrics        bridgeMetrics
+
+	soundboardSounds     map[string]string
+	soundboardSoundsLock sync.Mutex
+
+	apiCache *discordAPICache
+
+	deactivationChecks *exsync.Set[id.UserID]
+
+	plumbingRequests     map[id.RoomID]*plumbingRequest
+	plumbingRequestsLock sync.Mutex
+
+	ghostCleanups     map[string]*time.Timer
+	ghostCleanupsLock sync.Mutex
+
 	attachmentTransfers         *exsync.Map[attachmentKey, *exsync.ReturnableOnce[*database.File]]
 	parallelAttachmentSemaphore *semaphore.Weighted
 }
@@ -93,24 +125,64 @@ func (br *DiscordBridge) GetConfigPtr() interface{} {
 }
 
 func (br *DiscordBridge) Init() {
-	br.CommandProcessor = commands.NewProcessor(&br.Bridge)
+	br.CommandProcessor = &aliasedCommandProcessor{
+		Processor: commands.NewProcessor(&br.Bridge),
+		bridge:    br,
+	}
 	br.RegisterCommands()
 
 	matrixHTMLParser.PillConverter = br.pillConverter
+	br.EventProcessor.On(event.StateMember, br.handleRelayMembership)
+	br.EventProcessor.On(event.StateMember, br.handleRelayApprovalMembership)
+	br.EventProcessor.On(event.StateMember, br.handleMatrixBan)
+	br.EventProcessor.On(event.StateMember, br.handleDeactivationCheckMembership)
+	br.EventProcessor.On(event.EphemeralEventPresence, br.handleMatrixPresence)
+	for _, evtType := range append(policyUserRuleTypes, policyServerRuleTypes...) {
+		br.EventProcessor.On(event.Type{Type: evtType, Class: event.StateEventType}, br.handlePolicyRule)
+	}
 
 	br.DB = database.New(br.Bridge.DB, br.Log.Sub("Database"))
-	discordLog = br.ZLog.With().Str("component", "discordgo").Logger()
+	br.runMaintenanceCommand()
+	br.apiCache = br.newDiscordAPICache()
+	discordLog = br.componentLog("discordgo")
 }
 
 func (br *DiscordBridge) Start() {
+	br.initSentry()
+	br.waitForLeadership()
+	if *restoreSnapshotPath != "" {
+		err := br.restoreSnapshot(context.Background(), *restoreSnapshotPath)
+		if err != nil {
+			br.ZLog.WithLevel(zerolog.FatalLevel).Err(err).Msg("Failed to restore database snapshot")
+			os.Exit(exitCodeSnapshotRestoreFailed)
+		}
+		br.ZLog.Info().Msg("Database snapshot restored")
+	}
 	if br.Config.Bridge.Provisioning.SharedSecret != "disable" {
 		br.provisioning = newProvisioningAPI(br)
 	}
-	if br.Config.Bridge.PublicAddress != "" {
-		br.AS.Router.HandleFunc("/mautrix-discord/avatar/{server}/{mediaID}/{checksum}", br.serveMediaProxy).Methods(http.MethodGet)
-	}
 	br.DMA = newDirectMediaAPI(br)
+	if br.mediaProxyAddress() != "" {
+		br.AS.Router.HandleFunc("/mautrix-discord/avatar/{server}/{mediaID}/{checksum}", br.serveMediaProxy).Methods(http.MethodGet, http.MethodHead)
+	}
+	br.loadIgnoredBots()
+	br.loadMessageScript()
+	br.startAdminAlerts()
+	go br.startMetricsListener()
+	go br.startDatabaseHealthCheck()
+	go br.startRoomTagResync()
+	go br.startCapabilityProbes()
+	go br.startStateCacheTrim()
+	go br.startSnapshots()
+	go br.startMediaPrefetch()
+	br.startCacheInvalidation()
+	if shards := br.Config.Bridge.Sharding; shards.Count > 1 {
+		br.ZLog.Info().Int("shard_index", shards.Index).Int("shard_count", shards.Count).Msg("Sharding enabled")
+	}
 	br.WaitWebsocketConnected()
+	go br.startPolicyLists()
+	go br.syncPortalFeatures()
+	br.resumeSpilledMessages()
 	go br.startUsers()
 }
 
@@ -178,6 +250,12 @@ func main() {
 		puppets:             make(map[string]*Puppet),
 		puppetsByCustomMXID: make(map[id.UserID]*Puppet),
 
+		deactivationChecks: exsync.NewSet[id.UserID](),
+
+		plumbingRequests: make(map[id.RoomID]*plumbingRequest),
+
+		ghostCleanups: make(map[string]*time.Timer),
+
 		attachmentTransfers:         exsync.NewMap[attachmentKey, *exsync.ReturnableOnce[*database.File]](),
 		parallelAttachmentSemaphore: semaphore.NewWeighted(3),
 	}
@@ -190,6 +268,8 @@ func main() {
 		BeeperServiceName: "discordgo",
 		BeeperNetworkName: "discord",
 
+		AdditionalLongFlags: " [--restore-snapshot <path>] [<maintenance command> [args...]]",
+
 		CryptoPickleKey: "maunium.net/go/mautrix-whatsapp",
 
 		ConfigUpgrader: &configupgrade.StructUpgrader{
@@ -0,0 +1,284 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"go.mau.fi/util/dbutil"
+	flag "maunium.net/go/mauflag"
+)
+
+const (
+	// exitCodeMaintenanceFailed is used when a maintenance subcommand fails.
+	exitCodeMaintenanceFailed = 32
+	// exitCodeMaintenanceUsage is used when a maintenance subcommand is unknown or has invalid arguments.
+	exitCodeMaintenanceUsage = 33
+)
+
+// maintenanceCommand is a subcommand that is run instead of starting the bridge.
+// Maintenance commands don't connect to Discord or the homeserver.
+type maintenanceCommand struct {
+	Args        string
+	Description string
+	// NeedsDB means the database schema is upgraded before running the command.
+	NeedsDB bool
+	Func    func(ctx context.Context, args []string) error
+}
+
+func (br *DiscordBridge) maintenanceCommands() map[string]maintenanceCommand {
+	return map[string]maintenanceCommand{
+		"validate-config": {
+			Description: "Check that the config file is valid",
+			Func:        br.maintenanceValidateConfig,
+		},
+		"generate-registration": {
+			Description: "Regenerate the appservice registration file (same as -g)",
+			Func: func(ctx context.Context, args []string) error {
+				br.GenerateRegistration()
+				return nil
+			},
+		},
+		"check-registration": {
+			Args:        "[offline]",
+			Description: "Check that the registration file and the homeserver's registration match the config",
+			Func:        br.maintenanceCheckRegistration,
+		},
+		"list-portals": {
+			Description: "List all portals in the database",
+			NeedsDB:     true,
+			Func:        br.maintenanceListPortals,
+		},
+		"fix-orphans": {
+			Description: "Delete rows that refer to portals, messages, guilds or users which no longer exist",
+			NeedsDB:     true,
+			Func:        br.maintenanceFixOrphans,
+		},
+		"db-vacuum": {
+			Description: "Reclaim unused space and update statistics in the database",
+			NeedsDB:     true,
+			Func:        br.maintenanceVacuum,
+		},
+		"db-query": {
+			Args:        "<sql>",
+			Description: "Run an SQL query and print the results",
+			NeedsDB:     true,
+			Func:        br.maintenanceQuery,
+		},
+	}
+}
+
+// runMaintenanceCommand runs the subcommand given as a positional argument, if any, and exits.
+// It's called after the config is loaded and the database connection is created, but before anything is started.
+func (br *DiscordBridge) runMaintenanceCommand() {
+	if flag.NArg() == 0 {
+		return
+	}
+	name, args := flag.Arg(0), flag.Args()[1:]
+	cmds := br.maintenanceCommands()
+	cmd, ok := cmds[name]
+	if !ok {
+		_, _ = fmt.Fprintf(os.Stderr, "Unknown maintenance command %q. Available commands:\n", name)
+		tw := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+		for _, cmdName := range slices.Sorted(maps.Keys(cmds)) {
+			_, _ = fmt.Fprintf(tw, "  %s %s\t%s\n", cmdName, cmds[cmdName].Args, cmds[cmdName].Description)
+		}
+		_ = tw.Flush()
+		os.Exit(exitCodeMaintenanceUsage)
+	}
+	if cmd.NeedsDB {
+		err := br.Bridge.DB.Upgrade()
+		if err != nil {
+			br.LogDBUpgradeErrorAndExit("main", err)
+		}
+	}
+	err := cmd.Func(context.Background(), args)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s failed: %v\n", name, err)
+		os.Exit(exitCodeMaintenanceFailed)
+	}
+	os.Exit(0)
+}
+
+func (br *DiscordBridge) maintenanceValidateConfig(ctx context.Context, args []string) error {
+	// The base config is already validated by the time maintenance commands run,
+	// so only check the parts that are otherwise validated when the bridge starts.
+	cfg := &br.Config.Bridge
+	var problems []string
+	if cfg.DirectMedia.Enabled && (cfg.DirectMedia.ServerName == "" || cfg.DirectMedia.ServerKey == "") {
+		problems = append(problems, "direct_media is enabled, but server_name or server_key is not set")
+	}
+	if cfg.MediaStorage.Enabled && !cfg.DirectMedia.Enabled {
+		problems = append(problems, "media_storage requires direct_media to be enabled")
+	} else if cfg.MediaStorage.Enabled && cfg.MediaStorage.S3.Endpoint == "" {
+		problems = append(problems, "media_storage is enabled, but the S3 endpoint is not set")
+	}
+	if cfg.HighAvailability.Enabled && br.Bridge.DB.Dialect != dbutil.Postgres {
+		problems = append(problems, "high_availability is only supported with Postgres")
+	}
+	if cfg.Sentry.DSN != "" {
+		if _, err := newSentryReporter(br, cfg.Sentry.DSN); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid Sentry DSN: %v", err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("config has %d problems:\n  %s", len(problems), strings.Join(problems, "\n  "))
+	}
+	fmt.Println("Config is valid")
+	return nil
+}
+
+func (br *DiscordBridge) maintenanceListPortals(ctx context.Context, args []string) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "CHANNEL ID\tRECEIVER\tTYPE\tGUILD ID\tROOM ID\tNAME")
+	for _, portal := range br.DB.Portal.GetAll() {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n",
+			portal.Key.ChannelID, portal.Key.Receiver, portal.Type, portal.GuildID, portal.MXID, portal.PlainName)
+	}
+	return tw.Flush()
+}
+
+// orphanQueries delete rows whose parent row is missing. Foreign keys prevent most of these,
+// but they aren't enforced in SQLite databases that were created without foreign keys enabled.
+var orphanQueries = []struct {
+	Table string
+	Query string
+}{
+	{"reaction", `DELETE FROM reaction WHERE NOT EXISTS (
+		SELECT 1 FROM message WHERE message.dcid=reaction.dc_msg_id AND message.dc_attachment_id=reaction.dc_first_attachment_id
+			AND message.dc_chan_id=reaction.dc_chan_id AND message.dc_chan_receiver=reaction.dc_chan_receiver
+	)`},
+	{"message", `DELETE FROM message WHERE NOT EXISTS (
+		SELECT 1 FROM portal WHERE portal.dcid=message.dc_chan_id AND portal.receiver=message.dc_chan_receiver
+	)`},
+	{"thread", `DELETE FROM thread WHERE NOT EXISTS (
+		SELECT 1 FROM portal WHERE portal.dcid=thread.parent_chan_id AND portal.receiver=thread.receiver
+	)`},
+	{"backfill_checkpoint", `DELETE FROM backfill_checkpoint WHERE NOT EXISTS (
+		SELECT 1 FROM portal WHERE portal.dcid=backfill_checkpoint.dc_chan_id AND portal.receiver=backfill_checkpoint.dc_chan_receiver
+	)`},
+	{"portal_relay_approval", `DELETE FROM portal_relay_approval WHERE NOT EXISTS (
+		SELECT 1 FROM portal WHERE portal.dcid=portal_relay_approval.dc_chan_id AND portal.receiver=portal_relay_approval.dc_chan_receiver
+	)`},
+	{"spilled_message", `DELETE FROM spilled_message WHERE NOT EXISTS (
+		SELECT 1 FROM portal WHERE portal.dcid=spilled_message.dc_chan_id AND portal.receiver=spilled_message.dc_chan_receiver
+	) OR NOT EXISTS (SELECT 1 FROM "user" WHERE "user".mxid=spilled_message.user_mxid)`},
+	{"role", `DELETE FROM role WHERE NOT EXISTS (SELECT 1 FROM guild WHERE guild.dcid=role.dc_guild_id)`},
+	{"user_portal", `DELETE FROM user_portal WHERE NOT EXISTS (SELECT 1 FROM "user" WHERE "user".mxid=user_portal.user_mxid) OR (
+		NOT EXISTS (SELECT 1 FROM portal WHERE portal.dcid=user_portal.discord_id) AND
+		NOT EXISTS (SELECT 1 FROM guild WHERE guild.dcid=user_portal.discord_id) AND
+		NOT EXISTS (SELECT 1 FROM thread WHERE thread.dcid=user_portal.discord_id)
+	)`},
+	{"user_keyword", `DELETE FROM user_keyword WHERE NOT EXISTS (SELECT 1 FROM "user" WHERE "user".mxid=user_keyword.user_mxid)`},
+	{"user_dm_invite", `DELETE FROM user_dm_invite WHERE NOT EXISTS (SELECT 1 FROM "user" WHERE "user".mxid=user_dm_invite.user_mxid)`},
+	{"user_own_message_mode", `DELETE FROM user_own_message_mode WHERE NOT EXISTS (SELECT 1 FROM "user" WHERE "user".mxid=user_own_message_mode.user_mxid)`},
+	{"user_guild_folder", `DELETE FROM user_guild_folder WHERE NOT EXISTS (SELECT 1 FROM "user" WHERE "user".mxid=user_guild_folder.user_mxid)`},
+}
+
+func (br *DiscordBridge) maintenanceFixOrphans(ctx context.Context, args []string) error {
+	tx, err := br.Bridge.DB.RawDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	total := int64(0)
+	for _, query := range orphanQueries {
+		res, err := tx.ExecContext(ctx, query.Query)
+		if err != nil {
+			return fmt.Errorf("failed to delete orphaned rows from %s: %w", query.Table, err)
+		}
+		deleted, _ := res.RowsAffected()
+		if deleted > 0 {
+			fmt.Printf("Deleted %d orphaned rows from %s\n", deleted, query.Table)
+		}
+		total += deleted
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	fmt.Printf("Deleted %d orphaned rows in total\n", total)
+	return nil
+}
+
+func (br *DiscordBridge) maintenanceVacuum(ctx context.Context, args []string) error {
+	query := "VACUUM"
+	if br.Bridge.DB.Dialect == dbutil.Postgres {
+		query = "VACUUM ANALYZE"
+	}
+	_, err := br.Bridge.DB.RawDB.ExecContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Database vacuumed")
+	return nil
+}
+
+func (br *DiscordBridge) maintenanceQuery(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "Usage: db-query <sql>")
+		os.Exit(exitCodeMaintenanceUsage)
+	}
+	rows, err := br.Bridge.DB.RawDB.QueryContext(ctx, strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, strings.Join(columns, "\t"))
+	values := make([]sql.NullString, len(columns))
+	scanTargets := make([]any, len(columns))
+	for i := range values {
+		scanTargets[i] = &values[i]
+	}
+	count := 0
+	for rows.Next() {
+		err = rows.Scan(scanTargets...)
+		if err != nil {
+			return err
+		}
+		cells := make([]string, len(values))
+		for i, val := range values {
+			if val.Valid {
+				cells[i] = val.String
+			} else {
+				cells[i] = "NULL"
+			}
+		}
+		_, _ = fmt.Fprintln(tw, strings.Join(cells, "\t"))
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	_ = tw.Flush()
+	fmt.Printf("(%d rows)\n", count)
+	return nil
+}
@@ -0,0 +1,55 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceFixOrphans(t *testing.T) {
+	br := newTestBridge(t)
+	db := br.Bridge.DB
+	ctx := context.Background()
+	// Orphans only exist in databases where foreign keys weren't enforced
+	_, err := db.Exec("PRAGMA foreign_keys = OFF")
+	require.NoError(t, err)
+	user := br.DB.User.New()
+	user.MXID = "@alive:example.com"
+	user.Insert()
+	dbGuild := br.DB.Guild.New()
+	dbGuild.ID = "guild"
+	dbGuild.Insert()
+	_, err = db.Exec(`INSERT INTO user_portal (discord_id, user_mxid, type, in_space, timestamp) VALUES
+		('guild', '@alive:example.com', 'guild', true, 0),
+		('guild', '@deleted:example.com', 'guild', true, 0)`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO spilled_message (dc_chan_id, dc_chan_receiver, seq, user_mxid, dc_thread_id, event_type, data, received_at, delayed)
+		VALUES ('deleted-channel', '', 1, '@alive:example.com', '', 'message_create', '{}', 0, false)`)
+	require.NoError(t, err)
+
+	require.NoError(t, br.maintenanceFixOrphans(ctx, nil))
+
+	var userPortals, spilled int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM user_portal").Scan(&userPortals))
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM spilled_message").Scan(&spilled))
+	assert.Equal(t, 1, userPortals, "only the user_portal row of the existing user should be kept")
+	assert.Equal(t, 0, spilled)
+}
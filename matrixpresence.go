@@ -0,0 +1,98 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+)
+
+func (user *User) getMatrixPresence() discordgo.Status {
+	user.matrixPresenceLock.Lock()
+	defer user.matrixPresenceLock.Unlock()
+	return user.matrixPresence
+}
+
+// setMatrixPresence updates the Discord presence derived from Matrix activity. Nothing is sent
+// if the user has set a presence with the status command, as that always takes priority.
+func (user *User) setMatrixPresence(status discordgo.Status) {
+	user.matrixPresenceLock.Lock()
+	defer user.matrixPresenceLock.Unlock()
+	if user.matrixPresence == status {
+		return
+	}
+	user.matrixPresence = status
+	if user.PresenceStatus != "" || !user.Connected() {
+		return
+	}
+	go func() {
+		err := user.sendPresence(status, "")
+		if err != nil {
+			user.log.Warn().Err(err).Str("status", string(status)).Msg("Failed to update presence from Matrix activity")
+		} else {
+			user.log.Debug().Str("status", string(status)).Msg("Updated presence from Matrix activity")
+		}
+	}()
+}
+
+// markMatrixActive sets the Discord presence to online and restarts the inactivity timer.
+// It's called when the user sends something through the bridge or their Matrix presence becomes online.
+func (user *User) markMatrixActive() {
+	cfg := &user.bridge.Config.Bridge.MatrixPresence
+	if !cfg.Enabled {
+		return
+	}
+	user.setMatrixPresence(discordgo.StatusOnline)
+	if cfg.IdleAfter <= 0 {
+		return
+	}
+	idleAfter := time.Duration(cfg.IdleAfter) * time.Minute
+	user.matrixPresenceLock.Lock()
+	if user.matrixIdleTimer == nil {
+		user.matrixIdleTimer = time.AfterFunc(idleAfter, func() {
+			user.setMatrixPresence(discordgo.StatusIdle)
+		})
+	} else {
+		user.matrixIdleTimer.Reset(idleAfter)
+	}
+	user.matrixPresenceLock.Unlock()
+}
+
+func (br *DiscordBridge) handleMatrixPresence(evt *event.Event) {
+	cfg := &br.Config.Bridge.MatrixPresence
+	if !cfg.Enabled {
+		return
+	}
+	user := br.GetCachedUserByMXID(evt.Sender)
+	if user == nil || !user.IsLoggedIn() {
+		return
+	}
+	switch evt.Content.AsPresence().Presence {
+	case event.PresenceOnline:
+		user.markMatrixActive()
+	case event.PresenceUnavailable:
+		user.setMatrixPresence(discordgo.StatusIdle)
+	case event.PresenceOffline:
+		if cfg.InvisibleWhenOffline {
+			user.setMatrixPresence(discordgo.StatusInvisible)
+		} else {
+			user.setMatrixPresence(discordgo.StatusIdle)
+		}
+	}
+}
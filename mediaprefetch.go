@@ -0,0 +1,106 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// attachmentAccess tracks how often an attachment is downloaded through the direct media API.
+// Only attachments are tracked, as emoji, sticker and avatar URLs don't expire.
+type attachmentAccess struct {
+	data       AttachmentMediaData
+	hits       int
+	lastAccess time.Time
+}
+
+// recordAttachmentAccess must be called with the attachment cache lock held.
+func (dma *DirectMediaAPI) recordAttachmentAccess(data *AttachmentMediaData) {
+	if dma.cfg.Prefetch.Interval <= 0 {
+		return
+	}
+	access, ok := dma.attachmentAccess[data.CacheKey()]
+	if !ok {
+		access = &attachmentAccess{data: *data}
+		dma.attachmentAccess[data.CacheKey()] = access
+	}
+	access.hits++
+	access.lastAccess = time.Now()
+}
+
+func (br *DiscordBridge) startMediaPrefetch() {
+	if br.DMA == nil || br.DMA.cfg.Prefetch.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(br.DMA.cfg.Prefetch.Interval) * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		br.DMA.prefetchAttachments()
+	}
+}
+
+// prefetchAttachments refreshes the CDN links of recently popular attachments that would expire before
+// the next run, and drops expired links that nobody has asked for from the cache.
+func (dma *DirectMediaAPI) prefetchAttachments() {
+	cfg := &dma.cfg.Prefetch
+	log := dma.log.With().Str("action", "prefetch attachments").Logger()
+	ctx := log.WithContext(context.Background())
+	// getMediaURL refreshes links that expire within 5 minutes, so refresh early enough to stay ahead of that
+	refreshBefore := time.Now().Add(2*time.Duration(cfg.Interval)*time.Minute + 5*time.Minute)
+	windowStart := time.Now().Add(-time.Duration(cfg.Window) * time.Hour)
+
+	var due []AttachmentMediaData
+	dma.attachmentCacheLock.Lock()
+	for key, access := range dma.attachmentAccess {
+		if access.lastAccess.Before(windowStart) {
+			delete(dma.attachmentAccess, key)
+		} else if cached, ok := dma.attachmentCache[key]; access.hits >= cfg.MinHits && (!ok || cached.Expiry.Before(refreshBefore)) {
+			due = append(due, access.data)
+		}
+	}
+	for key, cached := range dma.attachmentCache {
+		if _, tracked := dma.attachmentAccess[key]; !tracked && cached.Expiry.Before(time.Now()) {
+			delete(dma.attachmentCache, key)
+		}
+	}
+	dma.attachmentCacheLock.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	refreshed := 0
+	for _, data := range due {
+		dma.attachmentCacheLock.Lock()
+		_, _, err := dma.fetchNewAttachmentURL(ctx, &data)
+		if errors.Is(err, ErrAttachmentNotFound) {
+			// The message or attachment was deleted, so there's no point in trying again
+			delete(dma.attachmentAccess, data.CacheKey())
+		}
+		dma.attachmentCacheLock.Unlock()
+		if err != nil {
+			log.Debug().Err(err).
+				Uint64("channel_id", data.ChannelID).
+				Uint64("attachment_id", data.AttachmentID).
+				Msg("Failed to prefetch attachment URL")
+			continue
+		}
+		refreshed++
+	}
+	log.Debug().Int("due", len(due)).Int("refreshed", refreshed).Msg("Prefetched attachment URLs")
+}
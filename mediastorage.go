@@ -0,0 +1,79 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mau.fi/util/random"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const mediaStorageUploadTimeout = 5 * time.Minute
+
+// usesMediaStorage checks if reuploaded media should go to the external bucket instead of the homeserver.
+func (br *DiscordBridge) usesMediaStorage() bool {
+	return br.DMA != nil && br.DMA.storage != nil
+}
+
+// storeMedia uploads the file to the external bucket and returns a bridge-served mxc URI pointing at it.
+func (dma *DirectMediaAPI) storeMedia(req mautrix.ReqUploadMedia) (id.ContentURI, error) {
+	var data StoredFileMediaData
+	copy(data.ObjectID[:], random.Bytes(len(data.ObjectID)))
+	body := req.Content
+	size := req.ContentLength
+	payloadHash := s3UnsignedPayload
+	if req.ContentBytes != nil {
+		body = bytes.NewReader(req.ContentBytes)
+		size = int64(len(req.ContentBytes))
+		hash := sha256.Sum256(req.ContentBytes)
+		payloadHash = hex.EncodeToString(hash[:])
+	} else if body == nil {
+		return id.ContentURI{}, errors.New("no content to upload")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mediaStorageUploadTimeout)
+	defer cancel()
+	err := dma.storage.put(ctx, data.ObjectName(), body, size, req.ContentType, payloadHash)
+	if err != nil {
+		return id.ContentURI{}, err
+	}
+	return dma.makeMXC(&data), nil
+}
+
+// getStoredMediaURL returns the URL to redirect downloads of stored media to.
+// Presigned URLs expire, public URLs don't.
+func (dma *DirectMediaAPI) getStoredMediaURL(data *StoredFileMediaData) (string, time.Time, error) {
+	cfg := &dma.bridge.Config.Bridge.MediaStorage
+	if dma.storage == nil {
+		return "", time.Time{}, errors.New("media storage is not enabled")
+	} else if cfg.PublicURL != "" {
+		return strings.TrimSuffix(cfg.PublicURL, "/") + "/" + data.ObjectName(), time.Time{}, nil
+	}
+	expiry := time.Duration(cfg.URLExpiry) * time.Second
+	if expiry <= 0 {
+		expiry = time.Hour
+	}
+	url, err := dma.storage.presign(data.ObjectName(), expiry)
+	return url, time.Now().Add(expiry), err
+}
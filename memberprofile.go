@@ -0,0 +1,86 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/config"
+)
+
+// guildProfile computes the room-specific displayname and avatar of a ghost in the given guild.
+func (puppet *Puppet) guildProfile(guildID string, user *discordgo.User, member *discordgo.Member) (string, id.ContentURI) {
+	name := puppet.bridge.Config.Bridge.FormatServerDisplayname(config.ServerDisplaynameParams{
+		User:        user,
+		Nick:        member.Nick,
+		Displayname: puppet.Name,
+	})
+	if name == "" {
+		name = puppet.Name
+	}
+	avatarURL := puppet.AvatarURL
+	if member.Avatar != "" {
+		guildAvatarURL, _, err := puppet.bridge.reuploadUserAvatar(puppet.DefaultIntent(), guildID, user.ID, member.Avatar)
+		if err != nil {
+			puppet.log.Warn().Err(err).
+				Str("avatar_id", member.Avatar).
+				Msg("Failed to reupload guild user avatar")
+		} else {
+			avatarURL = guildAvatarURL
+		}
+	}
+	return name, avatarURL
+}
+
+// syncMemberProfile sets the room-specific profile of the ghost in the portal, if it's joined and the profile changed.
+func (portal *Portal) syncMemberProfile(puppet *Puppet, user *discordgo.User, member *discordgo.Member) {
+	if !portal.bridge.Config.Bridge.PerGuildProfiles || portal.MXID == "" || portal.GuildID == "" || user == nil || member == nil {
+		return
+	}
+	intent := puppet.DefaultIntent()
+	existing, ok := portal.bridge.StateStore.TryGetMember(portal.MXID, intent.UserID)
+	if !ok || existing.Membership != event.MembershipJoin {
+		return
+	}
+	name, avatarURL := puppet.guildProfile(portal.GuildID, user, member)
+	if existing.Displayname == name && existing.AvatarURL == avatarURL.CUString() {
+		return
+	}
+	_, err := intent.SendStateEvent(portal.MXID, event.StateMember, intent.UserID.String(), &event.MemberEventContent{
+		Membership:  event.MembershipJoin,
+		Displayname: name,
+		AvatarURL:   avatarURL.CUString(),
+	})
+	if err != nil {
+		portal.log.Warn().Err(err).
+			Str("user_id", user.ID).
+			Msg("Failed to set room-specific profile of ghost")
+	}
+}
+
+func (user *User) guildMemberProfileUpdate(member *discordgo.Member) {
+	if !user.bridge.Config.Bridge.PerGuildProfiles || member.User == nil {
+		return
+	}
+	puppet := user.bridge.GetPuppetByID(member.User.ID)
+	puppet.UpdateInfo(user, member.User, nil)
+	for _, portal := range user.bridge.GetAllPortalsInGuild(member.GuildID) {
+		portal.syncMemberProfile(puppet, member.User, member)
+	}
+}
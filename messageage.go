@@ -0,0 +1,96 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+// maxMessageAge returns the maximum age of live messages in the portal, or zero if there's no limit.
+func (portal *Portal) maxMessageAge() time.Duration {
+	minutes := portal.bridge.Config.Bridge.MaxMessageAge
+	if portal.MaxMessageAge != nil {
+		minutes = *portal.MaxMessageAge
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func (portal *Portal) isStaleMessage(msg *discordgo.Message) bool {
+	maxAge := portal.maxMessageAge()
+	if maxAge <= 0 {
+		return false
+	}
+	ts, err := discordgo.SnowflakeTimestamp(msg.ID)
+	return err == nil && time.Since(ts) > maxAge
+}
+
+// markMessageSkipped moves the skip cursor forward, so that missed message backfill doesn't bridge a dropped message anyway.
+func (portal *Portal) markMessageSkipped(messageID string) {
+	if compareMessageIDs(messageID, portal.SkippedUntil) <= 0 {
+		return
+	}
+	portal.SkippedUntil = messageID
+	portal.Update()
+}
+
+var cmdMaxMessageAge = &commands.FullHandler{
+	Func: wrapCommand(fnMaxMessageAge),
+	Name: "max-message-age",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Set how old (in minutes) new Discord messages can be before they're dropped instead of bridged to this room.",
+		Args:        "[<minutes>|off|default]",
+	},
+	RequiresPortal:     true,
+	RequiresEventLevel: roomModerator,
+}
+
+func fnMaxMessageAge(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		source := "bridge default"
+		if ce.Portal.MaxMessageAge != nil {
+			source = "room override"
+		}
+		if maxAge := ce.Portal.maxMessageAge(); maxAge > 0 {
+			ce.Reply("Messages older than %s are dropped in this room (%s)", maxAge, source)
+		} else {
+			ce.Reply("Messages aren't dropped based on age in this room (%s)", source)
+		}
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "off", "false", "no":
+		disabled := 0
+		ce.Portal.MaxMessageAge = &disabled
+	case "default":
+		ce.Portal.MaxMessageAge = nil
+	default:
+		minutes, err := strconv.Atoi(ce.Args[0])
+		if err != nil || minutes <= 0 {
+			ce.Reply("**Usage:** `$cmdprefix max-message-age [<minutes>|off|default]`")
+			return
+		}
+		ce.Portal.MaxMessageAge = &minutes
+	}
+	ce.Portal.Update()
+	ce.Reply("Updated maximum message age for this room")
+}
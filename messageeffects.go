@@ -0,0 +1,73 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-discord/config"
+)
+
+// matrixEffectNames contains the message types that Element uses for chat effects.
+var matrixEffectNames = map[event.MessageType]string{
+	"nic.custom.confetti":               "confetti",
+	"nic.custom.fireworks":              "fireworks",
+	"io.element.effect.snowfall":        "snowfall",
+	"io.element.effect.hearts":          "hearts",
+	"io.element.effect.rainfall":        "rainfall",
+	"io.element.effects.space_invaders": "space invaders",
+}
+
+// matrixEffectName returns the name of the chat effect if the message type is an effect message.
+func matrixEffectName(msgType event.MessageType) (string, bool) {
+	if name, ok := matrixEffectNames[msgType]; ok {
+		return name, true
+	} else if strings.HasPrefix(string(msgType), "io.element.effect") {
+		return "an effect", true
+	}
+	return "", false
+}
+
+// matrixEffectMarker returns the Discord subtext that is appended to messages sent with a chat effect.
+func (portal *Portal) matrixEffectMarker(effect string) string {
+	if portal.bridge.Config.Bridge.MessageEffects != config.MessageEffectMarker {
+		return ""
+	}
+	return fmt.Sprintf("\n-# sent with %s", effect)
+}
+
+// discordMessageMarkerHTML returns a small text marker for Discord message flags that have no Matrix equivalent.
+func (portal *Portal) discordMessageMarkerHTML(msg *discordgo.Message) string {
+	if portal.bridge.Config.Bridge.MessageEffects != config.MessageEffectMarker {
+		return ""
+	}
+	var markers []string
+	if msg.Flags&discordgo.MessageFlagsUrgent != 0 {
+		markers = append(markers, "urgent message")
+	}
+	if msg.Flags&discordgo.MessageFlagsSuppressNotifications != 0 {
+		markers = append(markers, "sent silently")
+	}
+	if len(markers) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("<p><sub>%s</sub></p>", strings.Join(markers, " · "))
+}
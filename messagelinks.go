@@ -0,0 +1,125 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/config"
+	"go.mau.fi/mautrix-discord/database"
+)
+
+var discordMessageLinkRegex = regexp.MustCompile(`^https://(?:(?:ptb|canary)\.)?discord(?:app)?\.com/channels/(\d+|@me)/(\d+)/(\d+)$`)
+
+// bridgedMessageURL returns a matrix.to link to the Matrix event of a Discord message,
+// or an empty string if the message hasn't been bridged to a portal room.
+func (portal *Portal) bridgedMessageURL(guildID, channelID, messageID string) string {
+	key := database.NewPortalKey(channelID, "")
+	if guildID == "@me" {
+		key.Receiver = portal.Key.Receiver
+	}
+	target := portal.bridge.GetExistingPortalByID(key)
+	if target == nil && guildID != "@me" {
+		// Messages in threads are stored in the parent channel's portal
+		if thread := portal.bridge.GetThreadByID(channelID, nil); thread != nil {
+			target = portal.bridge.GetExistingPortalByID(database.NewPortalKey(thread.ParentID, ""))
+		}
+	}
+	if target == nil || target.MXID == "" {
+		return ""
+	}
+	msg := portal.bridge.DB.Message.GetFirstByDiscordID(target.Key, messageID)
+	if msg == nil {
+		return ""
+	}
+	return target.MXID.EventURI(msg.MXID, portal.bridge.Config.Homeserver.Domain).MatrixToURL()
+}
+
+// rewriteMessageLinks replaces or annotates links to bridged Discord messages with matrix.to links,
+// depending on the message_links config option.
+func (portal *Portal) rewriteMessageLinks(text string) string {
+	mode := portal.bridge.Config.Bridge.MessageLinks
+	if mode != config.MessageLinkRewrite && mode != config.MessageLinkAppend {
+		return text
+	}
+	matches := discordLinkRegex.FindAllStringIndex(text, -1)
+	if matches == nil {
+		return text
+	}
+	var builder strings.Builder
+	offset := 0
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		link := text[start:end]
+		parts := discordMessageLinkRegex.FindStringSubmatch(link)
+		if parts == nil {
+			continue
+		}
+		matrixURL := portal.bridgedMessageURL(parts[1], parts[2], parts[3])
+		if matrixURL == "" {
+			continue
+		}
+		builder.WriteString(text[offset:start])
+		// Masked links ([text](url)) can only contain one URL, so they're always rewritten
+		if mode == config.MessageLinkAppend && (start == 0 || text[start-1] != '(') {
+			builder.WriteString(link)
+			builder.WriteString(" (")
+			builder.WriteString(matrixURL)
+			builder.WriteString(")")
+		} else {
+			builder.WriteString(matrixURL)
+		}
+		offset = end
+	}
+	builder.WriteString(text[offset:])
+	return builder.String()
+}
+
+// discordLinkForEvent returns the Discord link of the message that the given Matrix event in the portal was bridged to,
+// or an empty string if the event wasn't bridged.
+func (br *DiscordBridge) discordLinkForEvent(portal *Portal, eventID id.EventID) string {
+	msg := br.DB.Message.GetByMXID(portal.Key, eventID)
+	if msg == nil {
+		return ""
+	}
+	return discordMessageLink(portal.GuildID, msg.DiscordProtoChannelID(), msg.DiscordID)
+}
+
+// rewriteMatrixEventLinks replaces plain text matrix.to links to events in portal rooms with links to
+// the corresponding Discord messages. Links in HTML anchors are handled by the pill converter instead.
+func (br *DiscordBridge) rewriteMatrixEventLinks(text string) string {
+	if !strings.Contains(text, "matrix.to/") {
+		return text
+	}
+	return discordLinkRegex.ReplaceAllStringFunc(text, func(link string) string {
+		uri, err := id.ParseMatrixToURL(link)
+		if err != nil || uri == nil || uri.Sigil1 != '!' || uri.Sigil2 != '$' {
+			return link
+		}
+		portal := br.GetPortalByMXID(uri.RoomID())
+		if portal == nil {
+			return link
+		}
+		if discordLink := br.discordLinkForEvent(portal, uri.EventID()); discordLink != "" {
+			return discordLink
+		}
+		return link
+	})
+}
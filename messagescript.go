@@ -0,0 +1,170 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+const exitCodeMessageScriptInvalid = 34
+
+const (
+	messageScriptToMatrix  = "to_matrix"
+	messageScriptToDiscord = "to_discord"
+)
+
+// messageScript is an operator-provided Starlark script for transforming messages. The globals are frozen
+// after loading, so the functions can be called from multiple goroutines at once.
+type messageScript struct {
+	globals  starlark.StringDict
+	maxSteps uint64
+}
+
+// messageScriptInput contains the message fields that are passed to the script.
+type messageScriptInput struct {
+	Body       string
+	SenderID   string
+	SenderName string
+	GuildID    string
+	ChannelID  string
+	RoomID     string
+}
+
+// messageScriptResult is the outcome of running the script for a message.
+type messageScriptResult struct {
+	Drop bool
+	Body string
+	Tags []string
+}
+
+func (br *DiscordBridge) loadMessageScript() {
+	cfg := &br.Config.Bridge.MessageScript
+	if cfg.Path == "" {
+		return
+	}
+	thread := &starlark.Thread{Name: "load", Print: br.messageScriptPrint}
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, cfg.Path, nil, nil)
+	if err != nil {
+		br.ZLog.WithLevel(zerolog.FatalLevel).Err(err).Str("path", cfg.Path).Msg("Failed to load message script")
+		os.Exit(exitCodeMessageScriptInvalid)
+	}
+	globals.Freeze()
+	for _, name := range []string{messageScriptToMatrix, messageScriptToDiscord} {
+		if fn, ok := globals[name]; ok {
+			if _, ok = fn.(starlark.Callable); !ok {
+				br.ZLog.WithLevel(zerolog.FatalLevel).Str("path", cfg.Path).Msgf("%s in message script is not a function", name)
+				os.Exit(exitCodeMessageScriptInvalid)
+			}
+		}
+	}
+	br.messageScript = &messageScript{globals: globals, maxSteps: cfg.MaxSteps}
+	br.ZLog.Info().Str("path", cfg.Path).Msg("Loaded message script")
+}
+
+func (br *DiscordBridge) messageScriptPrint(thread *starlark.Thread, msg string) {
+	br.ZLog.Info().Str("script_function", thread.Name).Msg(msg)
+}
+
+// runMessageScript calls the given function of the message script. If there's no script or it doesn't define
+// the function, the message is returned as-is. Errors in the script also keep the original message.
+func (br *DiscordBridge) runMessageScript(log zerolog.Logger, function string, input messageScriptInput) messageScriptResult {
+	result := messageScriptResult{Body: input.Body}
+	if br.messageScript == nil {
+		return result
+	}
+	fn, ok := br.messageScript.globals[function]
+	if !ok {
+		return result
+	}
+	thread := &starlark.Thread{Name: function, Print: br.messageScriptPrint}
+	if br.messageScript.maxSteps > 0 {
+		thread.SetMaxExecutionSteps(br.messageScript.maxSteps)
+	}
+	msg := starlark.NewDict(6)
+	_ = msg.SetKey(starlark.String("body"), starlark.String(input.Body))
+	_ = msg.SetKey(starlark.String("sender_id"), starlark.String(input.SenderID))
+	_ = msg.SetKey(starlark.String("sender_name"), starlark.String(input.SenderName))
+	_ = msg.SetKey(starlark.String("guild_id"), starlark.String(input.GuildID))
+	_ = msg.SetKey(starlark.String("channel_id"), starlark.String(input.ChannelID))
+	_ = msg.SetKey(starlark.String("room_id"), starlark.String(input.RoomID))
+	output, err := starlark.Call(thread, fn, starlark.Tuple{msg}, nil)
+	if err != nil {
+		log.Err(err).Str("script_function", function).Msg("Message script failed, bridging message unchanged")
+		return result
+	}
+	parsed, err := parseMessageScriptOutput(output, result)
+	if err != nil {
+		log.Err(err).Str("script_function", function).Msg("Message script returned invalid value, bridging message unchanged")
+		return result
+	}
+	return parsed
+}
+
+func parseMessageScriptOutput(output starlark.Value, result messageScriptResult) (messageScriptResult, error) {
+	switch typed := output.(type) {
+	case starlark.NoneType:
+		// Functions without a return statement return None, so it means the message is unchanged
+	case starlark.String:
+		result.Body = string(typed)
+	case *starlark.Dict:
+		if drop, found, _ := typed.Get(starlark.String("drop")); found {
+			dropBool, ok := drop.(starlark.Bool)
+			if !ok {
+				return result, fmt.Errorf("drop must be a bool, got %s", drop.Type())
+			}
+			result.Drop = bool(dropBool)
+		}
+		if body, found, _ := typed.Get(starlark.String("body")); found {
+			bodyStr, ok := starlark.AsString(body)
+			if !ok {
+				return result, fmt.Errorf("body must be a string, got %s", body.Type())
+			}
+			result.Body = bodyStr
+		}
+		if tags, found, _ := typed.Get(starlark.String("tags")); found {
+			list, ok := tags.(*starlark.List)
+			if !ok {
+				return result, fmt.Errorf("tags must be a list, got %s", tags.Type())
+			}
+			for i := 0; i < list.Len(); i++ {
+				tag, ok := starlark.AsString(list.Index(i))
+				if !ok {
+					return result, fmt.Errorf("tags must be strings, got %s", list.Index(i).Type())
+				}
+				result.Tags = append(result.Tags, tag)
+			}
+		}
+	default:
+		return result, fmt.Errorf("expected None, string or dict, got %s", output.Type())
+	}
+	return result, nil
+}
+
+const messageScriptTagsKey = "fi.mau.discord.tags"
+
+func addMessageScriptTags(extra map[string]any, tags []string) map[string]any {
+	if extra == nil {
+		extra = make(map[string]any)
+	}
+	extra[messageScriptTagsKey] = tags
+	return extra
+}
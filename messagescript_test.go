@@ -0,0 +1,48 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.starlark.net/starlark"
+)
+
+func TestParseMessageScriptOutput(t *testing.T) {
+	original := messageScriptResult{Body: "original"}
+
+	result, err := parseMessageScriptOutput(starlark.None, original)
+	require.NoError(t, err)
+	assert.Equal(t, original, result, "None should keep the message unchanged")
+
+	result, err = parseMessageScriptOutput(starlark.String("changed"), original)
+	require.NoError(t, err)
+	assert.Equal(t, messageScriptResult{Body: "changed"}, result)
+
+	dropDict := starlark.NewDict(1)
+	require.NoError(t, dropDict.SetKey(starlark.String("drop"), starlark.True))
+	result, err = parseMessageScriptOutput(dropDict, original)
+	require.NoError(t, err)
+	assert.True(t, result.Drop)
+
+	invalidDrop := starlark.NewDict(1)
+	require.NoError(t, invalidDrop.SetKey(starlark.String("drop"), starlark.String("yes")))
+	_, err = parseMessageScriptOutput(invalidDrop, original)
+	assert.Error(t, err)
+}
@@ -0,0 +1,283 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	metricDirectionDiscordToMatrix = "discord_to_matrix"
+	metricDirectionMatrixToDiscord = "matrix_to_discord"
+)
+
+// latencyBuckets are the upper bounds of the message handling latency histogram, in seconds.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type latencyHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *latencyHistogram) observe(seconds float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+type messageMetricKey struct {
+	direction string
+	success   bool
+}
+
+// bridgeMetrics collects metrics in the Prometheus text format, so that no client library is needed.
+type bridgeMetrics struct {
+	messages      map[messageMetricKey]uint64
+	latency       map[string]*latencyHistogram
+	handlerErrors map[string]uint64
+	backfilled    uint64
+	overflows     map[string]uint64
+	lock          sync.Mutex
+}
+
+func (bm *bridgeMetrics) recordMessage(direction string, success bool, duration time.Duration) {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	if bm.messages == nil {
+		bm.messages = make(map[messageMetricKey]uint64)
+		bm.latency = make(map[string]*latencyHistogram)
+	}
+	bm.messages[messageMetricKey{direction, success}]++
+	hist, ok := bm.latency[direction]
+	if !ok {
+		hist = &latencyHistogram{}
+		bm.latency[direction] = hist
+	}
+	hist.observe(duration.Seconds())
+}
+
+func (bm *bridgeMetrics) recordHandlerError(handler string) {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	if bm.handlerErrors == nil {
+		bm.handlerErrors = make(map[string]uint64)
+	}
+	bm.handlerErrors[handler]++
+}
+
+func (bm *bridgeMetrics) recordBackfill(count int) {
+	bm.lock.Lock()
+	bm.backfilled += uint64(count)
+	bm.lock.Unlock()
+}
+
+func (bm *bridgeMetrics) recordBufferOverflow(action string, count int) {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	if bm.overflows == nil {
+		bm.overflows = make(map[string]uint64)
+	}
+	bm.overflows[action] += uint64(count)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(val float64) string {
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+func writeMetricHeader(w io.Writer, name, metricType, help string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (bm *bridgeMetrics) write(w io.Writer) {
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+
+	writeMetricHeader(w, "discord_bridge_messages_total", "counter", "Number of messages bridged, by direction and result.")
+	for _, direction := range []string{metricDirectionDiscordToMatrix, metricDirectionMatrixToDiscord} {
+		for _, success := range []bool{true, false} {
+			result := "success"
+			if !success {
+				result = "failure"
+			}
+			_, _ = fmt.Fprintf(w, "discord_bridge_messages_total{direction=%q,result=%q} %d\n",
+				direction, result, bm.messages[messageMetricKey{direction, success}])
+		}
+	}
+
+	writeMetricHeader(w, "discord_bridge_message_handling_seconds", "histogram", "Time from receiving a message to it being bridged.")
+	for _, direction := range []string{metricDirectionDiscordToMatrix, metricDirectionMatrixToDiscord} {
+		hist, ok := bm.latency[direction]
+		if !ok {
+			hist = &latencyHistogram{buckets: make([]uint64, len(latencyBuckets))}
+		}
+		for i, bound := range latencyBuckets {
+			_, _ = fmt.Fprintf(w, "discord_bridge_message_handling_seconds_bucket{direction=%q,le=%q} %d\n",
+				direction, formatFloat(bound), hist.buckets[i])
+		}
+		_, _ = fmt.Fprintf(w, "discord_bridge_message_handling_seconds_bucket{direction=%q,le=\"+Inf\"} %d\n", direction, hist.count)
+		_, _ = fmt.Fprintf(w, "discord_bridge_message_handling_seconds_sum{direction=%q} %s\n", direction, formatFloat(hist.sum))
+		_, _ = fmt.Fprintf(w, "discord_bridge_message_handling_seconds_count{direction=%q} %d\n", direction, hist.count)
+	}
+
+	writeMetricHeader(w, "discord_bridge_handler_errors_total", "counter", "Number of errors and panics in event handlers.")
+	handlers := make([]string, 0, len(bm.handlerErrors))
+	for handler := range bm.handlerErrors {
+		handlers = append(handlers, handler)
+	}
+	sort.Strings(handlers)
+	for _, handler := range handlers {
+		_, _ = fmt.Fprintf(w, "discord_bridge_handler_errors_total{handler=\"%s\"} %d\n", escapeLabel(handler), bm.handlerErrors[handler])
+	}
+
+	writeMetricHeader(w, "discord_bridge_backfilled_messages_total", "counter", "Number of Discord messages sent to Matrix by backfill.")
+	_, _ = fmt.Fprintf(w, "discord_bridge_backfilled_messages_total %d\n", bm.backfilled)
+
+	writeMetricHeader(w, "discord_bridge_portal_buffer_overflows_total", "counter", "Number of Discord events that didn't fit in a portal message buffer, by what was done with them.")
+	for _, action := range []string{bufferOverflowBlocked, bufferOverflowDropped, bufferOverflowSpilled} {
+		_, _ = fmt.Fprintf(w, "discord_bridge_portal_buffer_overflows_total{action=%q} %d\n", action, bm.overflows[action])
+	}
+}
+
+type userConnectionState struct {
+	userID    string
+	connected bool
+}
+
+// getConnectionStates returns the Discord gateway connection state of all logged-in users.
+func (br *DiscordBridge) getConnectionStates() []userConnectionState {
+	br.usersLock.Lock()
+	users := make([]*User, 0, len(br.usersByMXID))
+	for _, user := range br.usersByMXID {
+		users = append(users, user)
+	}
+	br.usersLock.Unlock()
+	states := make([]userConnectionState, 0, len(users))
+	for _, user := range users {
+		if user.DiscordID == "" {
+			continue
+		}
+		states = append(states, userConnectionState{
+			userID:    user.MXID.String(),
+			connected: user.Session != nil && !user.wasDisconnected,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].userID < states[j].userID
+	})
+	return states
+}
+
+func (br *DiscordBridge) serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	br.metrics.write(w)
+
+	writeMetricHeader(w, "discord_bridge_gateway_connected", "gauge", "Whether the Discord gateway connection of a logged-in user is up.")
+	for _, state := range br.getConnectionStates() {
+		connected := 0
+		if state.connected {
+			connected = 1
+		}
+		_, _ = fmt.Fprintf(w, "discord_bridge_gateway_connected{user_id=\"%s\"} %d\n", escapeLabel(state.userID), connected)
+	}
+
+	br.puppetsLock.Lock()
+	puppetCount := len(br.puppets)
+	br.puppetsLock.Unlock()
+	maxRatio, full := br.portalBufferSaturation()
+	writeMetricHeader(w, "discord_bridge_portal_buffer_saturation", "gauge", "Fill ratio of the fullest portal message buffer.")
+	_, _ = fmt.Fprintf(w, "discord_bridge_portal_buffer_saturation %s\n", formatFloat(maxRatio))
+	writeMetricHeader(w, "discord_bridge_portal_buffers_full", "gauge", "Number of portals whose message buffer is full.")
+	_, _ = fmt.Fprintf(w, "discord_bridge_portal_buffers_full %d\n", full)
+
+	writeMetricHeader(w, "discord_bridge_puppets", "gauge", "Number of Discord user ghosts loaded in memory.")
+	_, _ = fmt.Fprintf(w, "discord_bridge_puppets %d\n", puppetCount)
+}
+
+type respHealth struct {
+	Healthy          bool   `json:"healthy"`
+	Database         bool   `json:"database"`
+	DatabaseError    string `json:"database_error,omitempty"`
+	GatewayConnected int    `json:"gateway_connected"`
+	GatewayLoggedIn  int    `json:"gateway_logged_in"`
+	GatewayHealthy   bool   `json:"gateway_healthy"`
+}
+
+// serveHealth reports whether the database is reachable and whether all logged-in users are connected to Discord.
+// The status code is only an error if the database is down, as a single user's connection breaking doesn't affect others.
+func (br *DiscordBridge) serveHealth(w http.ResponseWriter, _ *http.Request) {
+	var resp respHealth
+	if err := br.pingDatabase(); err != nil {
+		resp.DatabaseError = err.Error()
+	} else {
+		resp.Database = true
+	}
+	for _, state := range br.getConnectionStates() {
+		resp.GatewayLoggedIn++
+		if state.connected {
+			resp.GatewayConnected++
+		}
+	}
+	resp.GatewayHealthy = resp.GatewayConnected == resp.GatewayLoggedIn
+	resp.Healthy = resp.Database
+	statusCode := http.StatusOK
+	if !resp.Healthy {
+		statusCode = http.StatusServiceUnavailable
+	}
+	jsonResponse(w, statusCode, &resp)
+}
+
+func (br *DiscordBridge) startMetricsListener() {
+	cfg := &br.Config.Metrics
+	if !cfg.Enabled || cfg.Listen == "" {
+		return
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/metrics", br.serveMetrics).Methods(http.MethodGet)
+	r.HandleFunc("/health", br.serveHealth).Methods(http.MethodGet)
+	server := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           r,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	br.ZLog.Info().Str("address", cfg.Listen).Msg("Starting metrics listener")
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		br.ZLog.Err(err).Msg("Metrics listener failed")
+	}
+}
@@ -0,0 +1,206 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+var cmdNowPlaying = &commands.FullHandler{
+	Func: wrapCommand(fnNowPlaying),
+	Name: "now-playing",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Show what a Discord user is listening to or playing. Defaults to the other user in DM portals.",
+		Args:        "[_Discord user ID or Matrix ghost_]",
+	},
+	RequiresLogin: true,
+}
+
+func fnNowPlaying(ce *WrappedCommandEvent) {
+	userID := parseWhoisTarget(ce)
+	if userID == "" {
+		ce.Reply("**Usage:** `$cmdprefix now-playing <Discord user ID or Matrix ghost>`")
+		return
+	}
+	name := ce.Bridge.GetPuppetByID(userID).Name
+	if name == "" {
+		name = userID
+	}
+	presence := ce.User.getPresence(userID)
+	if presence == nil {
+		ce.Reply("No presence is known for %s. Presences are only available for friends and members of your guilds.", name)
+		return
+	}
+	activities := describeActivities(presence.Activities)
+	if len(activities) == 0 {
+		ce.Reply("%s isn't doing anything right now", name)
+	} else {
+		ce.Reply("**%s** is:\n\n* %s", name, strings.Join(activities, "\n* "))
+	}
+}
+
+// describeActivity formats a rich presence activity for Matrix. Custom statuses return an empty string.
+func describeActivity(activity *discordgo.Activity) string {
+	switch activity.Type {
+	case discordgo.ActivityTypeListening:
+		if activity.Details == "" {
+			return fmt.Sprintf("🎵 Listening to %s", activity.Name)
+		}
+		desc := fmt.Sprintf("🎵 Listening to %s", activity.Details)
+		if activity.State != "" {
+			desc += " by " + strings.ReplaceAll(activity.State, "; ", ", ")
+		}
+		if activity.Assets.LargeText != "" && activity.Assets.LargeText != activity.Details {
+			desc += fmt.Sprintf(" (%s)", activity.Assets.LargeText)
+		}
+		return desc + " on " + activity.Name
+	case discordgo.ActivityTypeGame:
+		desc := fmt.Sprintf("🎮 Playing %s", activity.Name)
+		if details := joinNonEmpty(" - ", activity.Details, activity.State); details != "" {
+			desc += fmt.Sprintf(" (%s)", details)
+		}
+		return desc
+	case discordgo.ActivityTypeStreaming:
+		desc := fmt.Sprintf("📺 Streaming %s", joinNonEmpty(" - ", activity.Details, activity.Name))
+		if activity.URL != "" {
+			desc += fmt.Sprintf(" at %s", activity.URL)
+		}
+		return desc
+	case discordgo.ActivityTypeWatching:
+		return fmt.Sprintf("📺 Watching %s", joinNonEmpty(" - ", activity.Name, activity.Details))
+	case discordgo.ActivityTypeCompeting:
+		return fmt.Sprintf("🏆 Competing in %s", activity.Name)
+	default:
+		return ""
+	}
+}
+
+func describeActivities(activities []*discordgo.Activity) []string {
+	var descriptions []string
+	for _, activity := range activities {
+		if desc := describeActivity(activity); desc != "" {
+			descriptions = append(descriptions, desc)
+		}
+	}
+	return descriptions
+}
+
+func joinNonEmpty(sep string, parts ...string) string {
+	nonEmpty := parts[:0:0]
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, sep)
+}
+
+// getPresence finds the presence of a Discord user from friend presence updates or the guild member cache.
+func (user *User) getPresence(userID string) *discordgo.Presence {
+	user.friendPresencesLock.Lock()
+	presence, ok := user.friendPresences[userID]
+	user.friendPresencesLock.Unlock()
+	if ok {
+		return presence
+	} else if user.Session == nil {
+		return nil
+	}
+	state := user.Session.State
+	// State.Presence takes the read lock itself, so the presences are searched directly while holding it once
+	state.RLock()
+	defer state.RUnlock()
+	for _, guild := range state.Guilds {
+		for _, presence := range guild.Presences {
+			if presence.User != nil && presence.User.ID == userID {
+				return presence
+			}
+		}
+	}
+	return nil
+}
+
+func (user *User) storeFriendPresences(presences []*discordgo.Presence) {
+	user.friendPresencesLock.Lock()
+	defer user.friendPresencesLock.Unlock()
+	user.friendPresences = make(map[string]*discordgo.Presence, len(presences))
+	for _, presence := range presences {
+		if presence.User != nil {
+			user.friendPresences[presence.User.ID] = presence
+		}
+	}
+}
+
+// presenceUpdateHandler stores presences of friends, which aren't tracked in the guild state cache,
+// and sends now playing notices to DM portals if they're enabled.
+func (user *User) presenceUpdateHandler(evt *discordgo.PresenceUpdate) {
+	if evt.User == nil || evt.GuildID != "" {
+		return
+	}
+	user.friendPresencesLock.Lock()
+	if user.friendPresences == nil {
+		user.friendPresences = make(map[string]*discordgo.Presence)
+	}
+	user.friendPresences[evt.User.ID] = &evt.Presence
+	user.friendPresencesLock.Unlock()
+	if user.bridge.Config.Bridge.NowPlayingNotices.Enabled {
+		go user.sendNowPlayingNotice(evt.User.ID, evt.Activities)
+	}
+}
+
+type nowPlayingState struct {
+	description string
+	sentAt      time.Time
+}
+
+func (user *User) sendNowPlayingNotice(userID string, activities []*discordgo.Activity) {
+	description := strings.Join(describeActivities(activities), "\n* ")
+	minInterval := time.Duration(user.bridge.Config.Bridge.NowPlayingNotices.MinInterval) * time.Second
+	user.friendPresencesLock.Lock()
+	last := user.nowPlaying[userID]
+	if description == last.description || time.Since(last.sentAt) < minInterval {
+		user.friendPresencesLock.Unlock()
+		return
+	}
+	if user.nowPlaying == nil {
+		user.nowPlaying = make(map[string]nowPlayingState)
+	}
+	user.nowPlaying[userID] = nowPlayingState{description: description, sentAt: time.Now()}
+	user.friendPresencesLock.Unlock()
+	if description == "" {
+		// Don't spam a notice every time someone stops playing something
+		return
+	}
+	for _, portal := range user.bridge.GetDMPortalsWith(userID) {
+		if portal.MXID == "" || portal.Key.Receiver != user.DiscordID {
+			continue
+		}
+		content := format.RenderMarkdown("Now:\n\n* "+description, true, false)
+		content.MsgType = event.MsgNotice
+		_, err := portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, &content, nil, 0)
+		if err != nil {
+			portal.log.Warn().Err(err).Msg("Failed to send now playing notice")
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+// Modes for bridging messages that the user sent from other Discord clients.
+const (
+	ownMessagesDoublePuppet = "double-puppet"
+	ownMessagesGhost        = "ghost"
+	ownMessagesSuppress     = "suppress"
+)
+
+// getOwnMessageMode returns the user's override for the given channel, or an empty string if there isn't one.
+func (user *User) getOwnMessageMode(channelID string) string {
+	user.ownMessageModesLock.Lock()
+	defer user.ownMessageModesLock.Unlock()
+	if user.ownMessageModes == nil {
+		user.ownMessageModes = user.GetOwnMessageModes()
+	}
+	return user.ownMessageModes[channelID]
+}
+
+func (user *User) setOwnMessageMode(channelID, mode string) {
+	user.ownMessageModesLock.Lock()
+	defer user.ownMessageModesLock.Unlock()
+	if user.ownMessageModes == nil {
+		user.ownMessageModes = user.GetOwnMessageModes()
+	}
+	if mode == "" {
+		user.DeleteOwnMessageMode(channelID)
+		delete(user.ownMessageModes, channelID)
+	} else {
+		user.SetOwnMessageMode(channelID, mode)
+		user.ownMessageModes[channelID] = mode
+	}
+}
+
+// isSuppressedOwnMessage checks if the author of a message is a logged-in user who doesn't want their
+// messages from other clients bridged in this portal.
+func (portal *Portal) isSuppressedOwnMessage(authorID string) bool {
+	user := portal.bridge.GetCachedUserByID(authorID)
+	return user != nil && user.getOwnMessageMode(portal.Key.ChannelID) == ownMessagesSuppress
+}
+
+var cmdOwnMessages = &commands.FullHandler{
+	Func: wrapCommand(fnOwnMessages),
+	Name: "own-messages",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Choose how messages you send from other Discord clients are bridged in this room.",
+		Args:        "[double-puppet|ghost|suppress|default]",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+func fnOwnMessages(ce *WrappedCommandEvent) {
+	channelID := ce.Portal.Key.ChannelID
+	if len(ce.Args) == 0 {
+		switch ce.User.getOwnMessageMode(channelID) {
+		case ownMessagesDoublePuppet:
+			ce.Reply("Your messages from other clients are sent with your Matrix account in this room")
+		case ownMessagesGhost:
+			ce.Reply("Your messages from other clients are sent by your Discord ghost user in this room")
+		case ownMessagesSuppress:
+			ce.Reply("Your messages from other clients aren't bridged in this room")
+		default:
+			ce.Reply("Your messages from other clients use the default behavior in this room (see `$cmdprefix double-puppet-scope`)")
+		}
+		return
+	}
+	mode := strings.ToLower(ce.Args[0])
+	switch mode {
+	case ownMessagesDoublePuppet, ownMessagesGhost, ownMessagesSuppress:
+	case "default":
+		mode = ""
+	default:
+		ce.Reply("**Usage:** `$cmdprefix own-messages [double-puppet|ghost|suppress|default]`")
+		return
+	}
+	if mode == ownMessagesDoublePuppet && ce.Bridge.GetPuppetByID(ce.User.DiscordID).CustomIntent() == nil {
+		ce.Reply("Note: double puppeting isn't enabled for your account, so your ghost user will be used instead")
+	}
+	ce.User.setOwnMessageMode(channelID, mode)
+	ce.Reply("Updated handling of your own messages in this room")
+}
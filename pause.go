@@ -0,0 +1,144 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+var cmdPause = &commands.FullHandler{
+	Func: wrapCommand(fnPause),
+	Name: "pause",
+	Help: commands.HelpMeta{
+		Section: HelpSectionPortalManagement,
+		Description: "Temporarily stop bridging messages in this room. Discord messages sent while paused are backfilled on resume, " +
+			"Matrix messages sent while paused are not sent to Discord.",
+		Args: "[both|to-matrix|to-discord]",
+	},
+	RequiresPortal:     true,
+	RequiresEventLevel: roomModerator,
+}
+
+var cmdResume = &commands.FullHandler{
+	Func: wrapCommand(fnResume),
+	Name: "resume",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Resume bridging in this room after `pause` and backfill the Discord messages that were missed.",
+	},
+	RequiresPortal:     true,
+	RequiresEventLevel: roomModerator,
+}
+
+func pauseStatusText(portal *Portal) string {
+	switch {
+	case portal.PausedToMatrix.Load() && portal.PausedToDiscord.Load():
+		return "Bridging is paused in both directions"
+	case portal.PausedToMatrix.Load():
+		return "Bridging from Discord to Matrix is paused"
+	case portal.PausedToDiscord.Load():
+		return "Bridging from Matrix to Discord is paused"
+	default:
+		return "Bridging isn't paused"
+	}
+}
+
+func fnPause(ce *WrappedCommandEvent) {
+	direction := "both"
+	if len(ce.Args) > 0 {
+		direction = strings.ToLower(ce.Args[0])
+	}
+	switch direction {
+	case "both":
+		ce.Portal.PausedToMatrix.Store(true)
+		ce.Portal.PausedToDiscord.Store(true)
+	case "to-matrix":
+		ce.Portal.PausedToMatrix.Store(true)
+	case "to-discord":
+		ce.Portal.PausedToDiscord.Store(true)
+	default:
+		ce.Reply("**Usage:** `$cmdprefix pause [both|to-matrix|to-discord]`")
+		return
+	}
+	ce.Portal.Update()
+	ce.Reply("%s. Use `$cmdprefix resume` to continue bridging.", pauseStatusText(ce.Portal))
+}
+
+func fnResume(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	if !portal.PausedToMatrix.Load() && !portal.PausedToDiscord.Load() {
+		ce.Reply("Bridging isn't paused in this room")
+		return
+	}
+	portal.PausedToDiscord.Store(false)
+	if !portal.PausedToMatrix.Load() {
+		portal.Update()
+		ce.React("✅")
+		return
+	}
+	if ce.User.Session == nil || !ce.User.Connected() {
+		portal.resumeToMatrix(nil)
+		ce.Reply("Resumed bridging. You're not connected to Discord, so missed messages will be backfilled on the next connection.")
+		return
+	}
+	filled, err := portal.resumeToMatrix(ce.User)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to backfill messages missed while paused")
+		ce.Reply("Resumed bridging, but failed to backfill missed messages: %v", err)
+	} else if filled {
+		ce.Reply("Resumed bridging and backfilled the messages that were missed")
+	} else {
+		ce.React("✅")
+	}
+}
+
+// resumeToMatrix unpauses bridging Discord messages and backfills the messages that were dropped while paused.
+// The newest bridged message is the cursor for the backfill, since nothing is bridged while paused.
+// The backfill lock is held while unpausing, so that live messages aren't bridged before the gap is filled.
+func (portal *Portal) resumeToMatrix(source *User) (bool, error) {
+	var newestID string
+	if source != nil && !portal.IsForum() {
+		newest, err := source.Session.ChannelMessages(portal.Key.ChannelID, 1, "", "", "", portal.RefererOptIfUser(source.Session, portal.Key.ChannelID)...)
+		if err != nil {
+			portal.PausedToMatrix.Store(false)
+			portal.Update()
+			return false, fmt.Errorf("failed to get newest message: %w", err)
+		} else if len(newest) > 0 {
+			newestID = newest[0].ID
+		}
+	}
+
+	portal.forwardBackfillLock.Lock()
+	defer portal.forwardBackfillLock.Unlock()
+	portal.PausedToMatrix.Store(false)
+	portal.Update()
+	lastMessage := portal.bridge.DB.Message.GetLast(portal.Key)
+	if newestID == "" || lastMessage == nil || !shouldBackfill(lastMessage.DiscordID, newestID) {
+		return false, nil
+	}
+	log := portal.log.With().
+		Str("action", "resume backfill").
+		Str("last_bridged_message", lastMessage.DiscordID).
+		Str("last_server_message", newestID).
+		Logger()
+	log.Info().Msg("Backfilling messages missed while bridging was paused")
+	portal.backfillUnlimitedMissed(log, source, lastMessage.DiscordID, newestID, nil)
+	return true, nil
+}
@@ -0,0 +1,118 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/id"
+)
+
+// discordIDForMXID finds the Discord user that a Matrix room member represents,
+// which is either a ghost, a logged-in bridge user or a double puppeted user.
+func (br *DiscordBridge) discordIDForMXID(mxid id.UserID) string {
+	if discordID, ok := br.ParsePuppetMXID(mxid); ok {
+		return discordID
+	} else if user := br.GetCachedUserByMXID(mxid); user != nil && user.DiscordID != "" {
+		return user.DiscordID
+	} else if puppet := br.GetPuppetByCustomMXID(mxid); puppet != nil {
+		return puppet.ID
+	}
+	return ""
+}
+
+// discordMemberLevel computes the power level of a Discord user in the portal's channel.
+// The bool is false if the member isn't known, in which case the existing level should be kept.
+func (portal *Portal) discordMemberLevel(source *User, discordID string) (int, bool) {
+	member, err := source.Session.State.Member(portal.GuildID, discordID)
+	if errors.Is(err, discordgo.ErrStateNotFound) && discordID == source.DiscordID {
+		member, err = source.getGuildMember(portal.GuildID, discordID)
+		if err == nil {
+			_ = source.Session.State.MemberAdd(member)
+		}
+	}
+	if err != nil {
+		return 0, false
+	}
+	perms, err := source.Session.State.UserChannelPermissions(discordID, portal.Key.ChannelID)
+	if err != nil {
+		return 0, false
+	}
+	timedOut := member.CommunicationDisabledUntil != nil && member.CommunicationDisabledUntil.After(time.Now())
+	return portal.bridge.Config.Bridge.PermissionSync.GetLevel(perms, member.Roles, timedOut), true
+}
+
+// syncPowerLevels updates the power levels of room members that correspond to Discord users.
+// If onlyDiscordID is set, only that user's level is recomputed.
+func (portal *Portal) syncPowerLevels(source *User, onlyDiscordID string) {
+	// Plumbed rooms are managed by their community, so the bridge doesn't touch their power levels
+	if portal.MXID == "" || portal.Plumbed || source.Session == nil || !portal.bridge.Config.Bridge.PermissionSync.IsEnabledIn(portal.GuildID) {
+		return
+	}
+	portal.powerLevelSyncLock.Lock()
+	defer portal.powerLevelSyncLock.Unlock()
+	log := portal.log.With().Str("action", "sync power levels").Logger()
+	intent := portal.MainIntent()
+	members, err := intent.JoinedMembers(portal.MXID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get joined members")
+		return
+	}
+	levels, err := intent.PowerLevels(portal.MXID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get power levels")
+		return
+	}
+	// Users at the bot's own level couldn't be demoted anymore
+	maxLevel := levels.GetUserLevel(intent.UserID) - 1
+	changed := false
+	for mxid := range members.Joined {
+		if mxid == intent.UserID || mxid == portal.bridge.Bot.UserID {
+			continue
+		}
+		discordID := portal.bridge.discordIDForMXID(mxid)
+		if discordID == "" || (onlyDiscordID != "" && discordID != onlyDiscordID) {
+			continue
+		}
+		level, ok := portal.discordMemberLevel(source, discordID)
+		if !ok {
+			continue
+		}
+		changed = levels.EnsureUserLevel(mxid, min(level, maxLevel)) || changed
+	}
+	if !changed {
+		return
+	}
+	_, err = intent.SetPowerLevels(portal.MXID, levels)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to update power levels")
+	} else {
+		log.Debug().Msg("Synced power levels from Discord permissions")
+	}
+}
+
+// syncGuildPowerLevels resyncs power levels in all portals of a guild, e.g. after a role's permissions changed.
+func (user *User) syncGuildPowerLevels(guildID, onlyDiscordID string) {
+	if !user.bridge.Config.Bridge.PermissionSync.IsEnabledIn(guildID) {
+		return
+	}
+	for _, portal := range user.bridge.GetAllPortalsInGuild(guildID) {
+		portal.syncPowerLevels(user, onlyDiscordID)
+	}
+}
@@ -0,0 +1,268 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+const plumbingRequestCommandName = "bridge-matrix"
+
+// plumbingRequest is a request from a Discord user to bridge a channel into an existing Matrix room,
+// which is waiting to be accepted by a moderator of the room.
+type plumbingRequest struct {
+	bot       *User
+	channel   *discordgo.Channel
+	requester *discordgo.User
+	expires   time.Time
+}
+
+// registerPlumbingRequestCommand registers the /bridge-matrix command for the bot account.
+// Creating a command with the same name as an existing one updates it, so this is safe to do on every connection.
+func (user *User) registerPlumbingRequestCommand(appID string) {
+	permissions := int64(discordgo.PermissionManageChannels)
+	_, err := user.Session.ApplicationCommandCreate(appID, "", &discordgo.ApplicationCommand{
+		Name:                     plumbingRequestCommandName,
+		Description:              "Request bridging this channel into an existing Matrix room",
+		DefaultMemberPermissions: &permissions,
+		Contexts:                 &[]discordgo.InteractionContextType{discordgo.InteractionContextGuild},
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "room",
+			Description: "Alias or ID of the Matrix room, e.g. #room:example.com",
+			Required:    true,
+		}},
+	})
+	if err != nil {
+		user.log.Warn().Err(err).Msg("Failed to register plumbing request command")
+	} else {
+		user.log.Debug().Msg("Registered plumbing request command")
+	}
+}
+
+func (user *User) interactionCreateHandler(evt *discordgo.InteractionCreate) {
+	if evt.Type != discordgo.InteractionApplicationCommand || user.Session.IsUser || !user.bridge.Config.Bridge.PlumbingRequests.Enabled {
+		return
+	}
+	data := evt.ApplicationCommandData()
+	if data.Name != plumbingRequestCommandName {
+		return
+	}
+	reply := user.handlePlumbingRequest(evt.Interaction, data)
+	err := user.Session.InteractionRespond(evt.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: reply,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		user.log.Warn().Err(err).Str("interaction_id", evt.ID).Msg("Failed to respond to plumbing request command")
+	}
+}
+
+// canJoinPlumbingTarget checks if the bridge bot may join the target room of a plumbing request.
+// Discord users can't make the bot join arbitrary public rooms: it must be invited already,
+// or the room must be on one of the allowed servers.
+func (br *DiscordBridge) canJoinPlumbingTarget(target string, roomID id.RoomID) bool {
+	switch br.StateStore.GetMembership(roomID, br.Bot.UserID) {
+	case event.MembershipJoin, event.MembershipInvite:
+		return true
+	}
+	_, server, ok := strings.Cut(target, ":")
+	return ok && slices.Contains(br.Config.Bridge.PlumbingRequests.AllowedServers, server)
+}
+
+// sweepPlumbingRequests removes expired plumbing requests. The caller must hold plumbingRequestsLock.
+func (br *DiscordBridge) sweepPlumbingRequests() {
+	now := time.Now()
+	for roomID, req := range br.plumbingRequests {
+		if now.After(req.expires) {
+			delete(br.plumbingRequests, roomID)
+		}
+	}
+}
+
+// resolvePlumbingTarget resolves a room alias or ID given in a plumbing request.
+func (br *DiscordBridge) resolvePlumbingTarget(target string) (id.RoomID, error) {
+	switch {
+	case strings.HasPrefix(target, "!"):
+		return id.RoomID(target), nil
+	case strings.HasPrefix(target, "#"):
+		resp, err := br.Bot.ResolveAlias(id.RoomAlias(target))
+		if err != nil {
+			return "", err
+		}
+		return resp.RoomID, nil
+	default:
+		return "", errors.New("not a room alias or ID")
+	}
+}
+
+// handlePlumbingRequest validates a /bridge-matrix command and forwards it to the Matrix room.
+// The return value is the reply shown to the Discord user.
+func (user *User) handlePlumbingRequest(interaction *discordgo.Interaction, data discordgo.ApplicationCommandInteractionData) string {
+	if interaction.GuildID == "" || interaction.Member == nil {
+		return "This command can only be used in servers."
+	} else if interaction.Member.Permissions&(discordgo.PermissionManageChannels|discordgo.PermissionAdministrator) == 0 {
+		return "You need the Manage Channels permission to bridge this channel."
+	} else if len(data.Options) == 0 {
+		return "Please specify the Matrix room to bridge this channel into."
+	}
+	target := strings.TrimSpace(data.Options[0].StringValue())
+	log := user.log.With().
+		Str("action", "plumbing request").
+		Str("channel_id", interaction.ChannelID).
+		Str("requester_id", interaction.Member.User.ID).
+		Str("target", target).
+		Logger()
+	roomID, err := user.bridge.resolvePlumbingTarget(target)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to resolve plumbing request target")
+		return fmt.Sprintf("Couldn't find the Matrix room `%s`: %v", target, err)
+	} else if user.bridge.GetPortalByMXID(roomID) != nil {
+		return "That Matrix room is already bridged to a Discord channel."
+	}
+	channel, err := user.getChannel(interaction.ChannelID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get channel info for plumbing request")
+		return "Failed to get the info of this channel."
+	} else if channel.IsThread() {
+		return "Threads can't be bridged separately, use the command in the parent channel instead."
+	}
+	if portal := user.GetExistingPortalByID(channel.ID); portal != nil && portal.MXID != "" {
+		return "This channel is already bridged to a Matrix room."
+	}
+	notInvitedReply := fmt.Sprintf("The bridge bot (`%s`) isn't in that room. Invite it to the room first and try again.", user.bridge.Bot.UserID)
+	if !user.bridge.canJoinPlumbingTarget(target, roomID) {
+		return notInvitedReply
+	}
+	_, err = user.bridge.Bot.JoinRoomByID(roomID)
+	if err != nil {
+		log.Debug().Err(err).Msg("Bridge bot couldn't join plumbing request target")
+		return notInvitedReply
+	}
+
+	timeout := time.Duration(user.bridge.Config.Bridge.PlumbingRequests.Timeout) * time.Second
+	user.bridge.plumbingRequestsLock.Lock()
+	user.bridge.sweepPlumbingRequests()
+	if _, pending := user.bridge.plumbingRequests[roomID]; pending {
+		user.bridge.plumbingRequestsLock.Unlock()
+		return "There's already a pending request to bridge a channel into that room. Try again after it has been answered or has expired."
+	}
+	user.bridge.plumbingRequests[roomID] = &plumbingRequest{
+		bot:       user,
+		channel:   channel,
+		requester: interaction.Member.User,
+		expires:   time.Now().Add(timeout),
+	}
+	user.bridge.plumbingRequestsLock.Unlock()
+
+	var guildName string
+	if guild, _ := user.Session.State.Guild(interaction.GuildID); guild != nil {
+		guildName = guild.Name
+	}
+	prefix := user.bridge.Config.Bridge.CommandPrefix
+	content := format.RenderMarkdown(fmt.Sprintf(
+		"**%s** (`%s`) requested bridging the Discord channel **#%s** in **%s** into this room as a shared room. "+
+			"A room moderator can accept the request with `%s plumbing-request accept` or deny it with `%s plumbing-request deny`. "+
+			"The request expires in %d minutes.",
+		interaction.Member.User.Username, interaction.Member.User.ID, channel.Name, guildName, prefix, prefix, int(timeout.Minutes()),
+	), true, false)
+	content.MsgType = event.MsgNotice
+	_, err = user.bridge.Bot.SendMessageEvent(roomID, event.EventMessage, &content)
+	if err != nil {
+		log.Err(err).Msg("Failed to send plumbing request to Matrix room")
+		user.bridge.plumbingRequestsLock.Lock()
+		delete(user.bridge.plumbingRequests, roomID)
+		user.bridge.plumbingRequestsLock.Unlock()
+		return "Failed to send the request to the Matrix room."
+	}
+	log.Info().Stringer("room_id", roomID).Msg("Sent plumbing request to Matrix room")
+	return "Sent the request to the Matrix room. A moderator there needs to accept it to finish bridging."
+}
+
+var cmdPlumbingRequest = &commands.FullHandler{
+	Func: wrapCommand(fnPlumbingRequest),
+	Name: "plumbing-request",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Accept or deny a request from Discord to bridge a channel into this room.",
+		Args:        "<accept|deny>",
+	},
+	RequiresEventLevel: roomModerator,
+}
+
+func fnPlumbingRequest(ce *WrappedCommandEvent) {
+	var action string
+	if len(ce.Args) > 0 {
+		action = strings.ToLower(ce.Args[0])
+	}
+	if action != "accept" && action != "deny" {
+		ce.Reply("**Usage:** `$cmdprefix plumbing-request <accept|deny>`")
+		return
+	}
+	ce.Bridge.plumbingRequestsLock.Lock()
+	ce.Bridge.sweepPlumbingRequests()
+	req, ok := ce.Bridge.plumbingRequests[ce.RoomID]
+	delete(ce.Bridge.plumbingRequests, ce.RoomID)
+	ce.Bridge.plumbingRequestsLock.Unlock()
+	if !ok || time.Now().After(req.expires) {
+		ce.Reply("There's no pending request to bridge a Discord channel into this room")
+		return
+	} else if action == "deny" {
+		ce.ZLog.Info().Str("channel_id", req.channel.ID).Msg("Plumbing request denied")
+		ce.Reply("Denied the request to bridge #%s", req.channel.Name)
+		return
+	} else if ce.Portal != nil {
+		ce.Reply("This room is already bridged to a Discord channel")
+		return
+	} else if req.bot.Session == nil || !req.bot.Connected() {
+		ce.Reply("The Discord bot that received the request isn't connected anymore, please ask for a new request")
+		return
+	}
+	portal := req.bot.GetPortalByMeta(req.channel)
+	portal.roomCreateLock.Lock()
+	defer portal.roomCreateLock.Unlock()
+	if portal.MXID != "" {
+		ce.Reply("That channel was already bridged to another room")
+		return
+	}
+	ce.ZLog.Info().
+		Str("channel_id", req.channel.ID).
+		Str("requester_id", req.requester.ID).
+		Msg("Plumbing request accepted")
+	portal.BindRoom(req.bot, ce.RoomID, true)
+	ce.Reply("Room successfully bridged as a shared room")
+	_, err := req.bot.Session.ChannelMessageSendComplex(req.channel.ID, &discordgo.MessageSend{
+		Content:         fmt.Sprintf("This channel is now bridged to a Matrix room, as requested by <@%s>.", req.requester.ID),
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	}, portal.RefererOptIfUser(req.bot.Session, req.channel.ID)...)
+	if err != nil {
+		ce.ZLog.Warn().Err(err).Msg("Failed to send plumbing confirmation to Discord")
+	}
+}
@@ -0,0 +1,215 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Policy rule event types, including the legacy ones that are still used by some policy lists.
+var (
+	policyUserRuleTypes   = []string{event.StatePolicyUser.Type, "m.room.rule.user", "org.matrix.mjolnir.rule.user"}
+	policyServerRuleTypes = []string{event.StatePolicyServer.Type, "m.room.rule.server", "org.matrix.mjolnir.rule.server"}
+)
+
+// discordMaxTimeout is the longest timeout Discord allows.
+const discordMaxTimeout = 28 * 24 * time.Hour
+
+type policyRuleKey struct {
+	roomID   id.RoomID
+	evtType  string
+	stateKey string
+}
+
+type policyRule struct {
+	server  bool
+	entity  string
+	pattern *regexp.Regexp
+	reason  string
+}
+
+// policyLists contains the ban rules from the MSC2313 policy rooms in the policy_lists config.
+type policyLists struct {
+	rooms map[id.RoomID]struct{}
+	rules map[policyRuleKey]*policyRule
+	lock  sync.RWMutex
+}
+
+// globToRegex converts a policy rule glob (with * and ? wildcards) into an anchored regex.
+func globToRegex(glob string) *regexp.Regexp {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\?`, ".")
+	return regexp.MustCompile("^" + pattern + "$")
+}
+
+// parsePolicyRule parses a policy state event. The return value is nil if the event isn't a ban rule,
+// e.g. because the rule was removed by blanking the content.
+func parsePolicyRule(evt *event.Event) *policyRule {
+	var server bool
+	if slices.Contains(policyServerRuleTypes, evt.Type.Type) {
+		server = true
+	} else if !slices.Contains(policyUserRuleTypes, evt.Type.Type) {
+		return nil
+	}
+	var content event.ModPolicyContent
+	if err := json.Unmarshal(evt.Content.VeryRaw, &content); err != nil || content.Entity == "" {
+		return nil
+	} else if content.Recommendation != "m.ban" && content.Recommendation != "org.matrix.mjolnir.ban" {
+		return nil
+	}
+	return &policyRule{
+		server:  server,
+		entity:  content.Entity,
+		pattern: globToRegex(content.Entity),
+		reason:  content.Reason,
+	}
+}
+
+// startPolicyLists joins the configured policy rooms and loads their current rules.
+// Changes after that are received as normal state events.
+func (br *DiscordBridge) startPolicyLists() {
+	rooms := br.Config.Bridge.PolicyLists.Rooms
+	if len(rooms) == 0 {
+		return
+	}
+	log := br.ZLog.With().Str("action", "load policy lists").Logger()
+	br.policies.lock.Lock()
+	br.policies.rooms = make(map[id.RoomID]struct{}, len(rooms))
+	br.policies.rules = make(map[policyRuleKey]*policyRule)
+	br.policies.lock.Unlock()
+	for _, roomIDOrAlias := range rooms {
+		resp, err := br.Bot.JoinRoom(roomIDOrAlias, "", nil)
+		if err != nil {
+			log.Err(err).Str("room", roomIDOrAlias).Msg("Failed to join policy room")
+			continue
+		}
+		state, err := br.Bot.State(resp.RoomID)
+		if err != nil {
+			log.Err(err).Str("room_id", resp.RoomID.String()).Msg("Failed to get policy room state")
+			continue
+		}
+		ruleCount := 0
+		br.policies.lock.Lock()
+		br.policies.rooms[resp.RoomID] = struct{}{}
+		for evtType, events := range state {
+			for stateKey, evt := range events {
+				if rule := parsePolicyRule(evt); rule != nil {
+					br.policies.rules[policyRuleKey{resp.RoomID, evtType.Type, stateKey}] = rule
+					ruleCount++
+				}
+			}
+		}
+		br.policies.lock.Unlock()
+		log.Info().Str("room_id", resp.RoomID.String()).Int("rule_count", ruleCount).Msg("Loaded policy list")
+	}
+}
+
+func (br *DiscordBridge) handlePolicyRule(evt *event.Event) {
+	if evt.StateKey == nil {
+		return
+	}
+	br.policies.lock.Lock()
+	if _, ok := br.policies.rooms[evt.RoomID]; !ok {
+		br.policies.lock.Unlock()
+		return
+	}
+	key := policyRuleKey{evt.RoomID, evt.Type.Type, *evt.StateKey}
+	rule := parsePolicyRule(evt)
+	_, existed := br.policies.rules[key]
+	if rule == nil {
+		delete(br.policies.rules, key)
+	} else {
+		br.policies.rules[key] = rule
+	}
+	br.policies.lock.Unlock()
+
+	if rule == nil {
+		if existed {
+			br.ZLog.Debug().Str("room_id", evt.RoomID.String()).Str("state_key", *evt.StateKey).Msg("Policy rule removed")
+		}
+		return
+	}
+	br.ZLog.Info().
+		Str("room_id", evt.RoomID.String()).
+		Str("entity", rule.entity).
+		Str("reason", rule.reason).
+		Msg("Received policy ban rule")
+	if !rule.server && !existed && br.Config.Bridge.PolicyLists.DiscordTimeouts {
+		if discordID, ok := br.ParsePuppetMXID(id.UserID(rule.entity)); ok {
+			go br.timeoutBannedDiscordUser(discordID, rule.reason)
+		}
+	}
+}
+
+// isPolicyBanned checks if a Matrix user is banned by any of the subscribed policy lists.
+func (br *DiscordBridge) isPolicyBanned(userID id.UserID) (reason string, banned bool) {
+	br.policies.lock.RLock()
+	defer br.policies.lock.RUnlock()
+	server := userID.Homeserver()
+	for _, rule := range br.policies.rules {
+		if (rule.server && rule.pattern.MatchString(server)) || (!rule.server && rule.pattern.MatchString(string(userID))) {
+			return rule.reason, true
+		}
+	}
+	return "", false
+}
+
+// timeoutBannedDiscordUser times out a Discord user whose ghost was banned by a policy list in every bridged guild
+// where a logged-in user has the Moderate Members permission.
+func (br *DiscordBridge) timeoutBannedDiscordUser(discordID, reason string) {
+	log := br.ZLog.With().Str("action", "policy timeout").Str("discord_user_id", discordID).Logger()
+	br.usersLock.Lock()
+	users := make([]*User, 0, len(br.usersByID))
+	for _, user := range br.usersByID {
+		users = append(users, user)
+	}
+	br.usersLock.Unlock()
+
+	until := time.Now().Add(discordMaxTimeout)
+	handled := make(map[string]struct{})
+	for _, user := range users {
+		if user.Session == nil || !user.Connected() || user.DiscordID == discordID {
+			continue
+		}
+		for _, guild := range user.Session.State.Guilds {
+			if _, ok := handled[guild.ID]; ok {
+				continue
+			} else if dbGuild := br.GetGuildByID(guild.ID, false); dbGuild == nil || dbGuild.MXID == "" {
+				continue
+			} else if user.checkGuildPermission(guild.ID, discordgo.PermissionModerateMembers) != nil {
+				continue
+			}
+			handled[guild.ID] = struct{}{}
+			err := user.Session.GuildMemberTimeout(guild.ID, discordID, &until, discordgo.WithAuditLogReason("Matrix policy list: "+reason))
+			if err != nil {
+				log.Debug().Err(err).Str("guild_id", guild.ID).Msg("Failed to time out user")
+			} else {
+				log.Info().Str("guild_id", guild.ID).Str("moderator_id", user.DiscordID).Msg("Timed out user banned by policy list")
+			}
+		}
+	}
+}
@@ -33,6 +33,7 @@ import (
 	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/crypto/attachment"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-discord/config"
@@ -43,7 +44,10 @@ type portalDiscordMessage struct {
 	msg  interface{}
 	user *User
 
-	thread *Thread
+	thread     *Thread
+	receivedAt time.Time
+	// delayed is set for bot messages that were already held back by delayBotMessage.
+	delayed bool
 }
 
 type portalMatrixMessage struct {
@@ -67,16 +71,43 @@ type Portal struct {
 
 	discordMessages chan portalDiscordMessage
 	matrixMessages  chan portalMatrixMessage
+	// cacheReloads is signalled when another process changed the portal, see reloadCachedPortal.
+	cacheReloads chan struct{}
+
+	bufferOverflowLock sync.Mutex
+	spilling           bool
+	lastSpillSeq       int64
+	lastOverflowNotice time.Time
 
 	recentMessages *exsync.RingBuffer[string, *discordgo.Message]
 
 	commands     map[string]*discordgo.ApplicationCommand
 	commandsLock sync.RWMutex
 
-	forwardBackfillLock sync.Mutex
+	forwardBackfillLock  sync.Mutex
+	backwardBackfillLock sync.Mutex
+
+	reactionSequencer reactionSequencer
+
+	relayRosterLock sync.Mutex
+
+	sentToDiscord loopDetector
+	sentToMatrix  loopDetector
 
 	currentlyTyping     []id.UserID
 	currentlyTypingLock sync.Mutex
+
+	lastSoundboardEffect     soundboardEffectKey
+	lastSoundboardEffectTime time.Time
+	lastSoundboardEffectLock sync.Mutex
+
+	activities     map[string][]string
+	activitiesLock sync.Mutex
+
+	powerLevelSyncLock sync.Mutex
+
+	delayedBotMessages     map[string]*portalDiscordMessage
+	delayedBotMessagesLock sync.Mutex
 }
 
 const recentMessageBufferSize = 32
@@ -99,7 +130,11 @@ func (portal *Portal) MarkEncrypted() {
 }
 
 func (portal *Portal) ReceiveMatrixEvent(user bridge.User, evt *event.Event) {
-	if user.GetPermissionLevel() >= bridgeconfig.PermissionLevelUser || portal.RelayWebhookID != "" {
+	if portal.handleAliasedCommand(user, evt) {
+		return
+	}
+	if user.GetPermissionLevel() >= bridgeconfig.PermissionLevelUser || portal.RelayWebhookID != "" ||
+		(portal.RelayBotMXID != "" && user.GetPermissionLevel() >= bridgeconfig.PermissionLevelRelay) {
 		portal.matrixMessages <- portalMatrixMessage{user: user.(*User), evt: evt}
 	}
 }
@@ -257,14 +292,15 @@ func (br *DiscordBridge) NewPortal(dbPortal *database.Portal) *Portal {
 	portal := &Portal{
 		Portal: dbPortal,
 		bridge: br,
-		log: br.ZLog.With().
+		log: br.moduleLevel(br.ZLog.With().
 			Str("channel_id", dbPortal.Key.ChannelID).
 			Str("channel_receiver", dbPortal.Key.Receiver).
 			Str("room_id", dbPortal.MXID.String()).
-			Logger(),
+			Logger(), "portal"),
 
 		discordMessages: make(chan portalDiscordMessage, br.Config.Bridge.PortalMessageBuffer),
 		matrixMessages:  make(chan portalMatrixMessage, br.Config.Bridge.PortalMessageBuffer),
+		cacheReloads:    make(chan struct{}, 1),
 
 		recentMessages: exsync.NewRingBuffer[string, *discordgo.Message](recentMessageBufferSize),
 
@@ -283,6 +319,8 @@ func (portal *Portal) messageLoop() {
 			portal.handleMatrixMessages(msg)
 		case msg := <-portal.discordMessages:
 			portal.handleDiscordMessages(msg)
+		case <-portal.cacheReloads:
+			portal.reloadFromDB()
 		}
 	}
 }
@@ -363,6 +401,7 @@ func (portal *Portal) UpdateBridgeInfo() {
 	if err != nil {
 		portal.log.Warn().Err(err).Msg("Failed to update uk.half-shot.bridge")
 	}
+	portal.updateFeatures(true)
 }
 
 func (portal *Portal) shouldSetDMRoomMetadata() bool {
@@ -387,6 +426,21 @@ func (portal *Portal) CreateMatrixRoom(user *User, channel *discordgo.Channel) e
 		portal.ensureUserInvited(user, false)
 		return nil
 	}
+	unlockCreation, err := portal.bridge.DB.Portal.LockPortalCreation(context.TODO(), portal.Key)
+	if err != nil {
+		return fmt.Errorf("failed to acquire portal creation lock: %w", err)
+	}
+	defer unlockCreation()
+	// Another bridge process may have created the room while we were waiting for the lock
+	if dbPortal := portal.bridge.DB.Portal.GetByID(portal.Key); dbPortal != nil && dbPortal.MXID != "" {
+		portal.log.Info().Str("room_id", dbPortal.MXID.String()).Msg("Room was created by another process while waiting for lock")
+		portal.Portal = dbPortal
+		portal.bridge.portalsLock.Lock()
+		portal.bridge.portalsByMXID[portal.MXID] = portal
+		portal.bridge.portalsLock.Unlock()
+		portal.ensureUserInvited(user, false)
+		return nil
+	}
 	portal.log.Info().Msg("Creating Matrix room for channel")
 
 	channel = portal.UpdateInfo(user, channel)
@@ -400,6 +454,8 @@ func (portal *Portal) CreateMatrixRoom(user *User, channel *discordgo.Channel) e
 	}
 
 	bridgeInfoStateKey, bridgeInfo := portal.getBridgeInfo()
+	features := portal.getFeatures()
+	portal.FeaturesHash = features.hash()
 	initialState := []*event.Event{{
 		Type:     event.StateBridge,
 		Content:  event.Content{Parsed: bridgeInfo},
@@ -409,6 +465,9 @@ func (portal *Portal) CreateMatrixRoom(user *User, channel *discordgo.Channel) e
 		Type:     event.StateHalfShotBridge,
 		Content:  event.Content{Parsed: bridgeInfo},
 		StateKey: &bridgeInfoStateKey,
+	}, {
+		Type:    StatePortalFeatures,
+		Content: event.Content{Parsed: features},
 	}}
 
 	var invite []id.UserID
@@ -427,11 +486,11 @@ func (portal *Portal) CreateMatrixRoom(user *User, channel *discordgo.Channel) e
 		}
 	}
 
-	if !portal.AvatarURL.IsEmpty() && portal.shouldSetDMRoomMetadata() {
+	if !portal.AvatarOverride.IsEmpty() || (!portal.AvatarURL.IsEmpty() && portal.shouldSetDMRoomMetadata()) {
 		initialState = append(initialState, &event.Event{
 			Type: event.StateRoomAvatar,
 			Content: event.Content{Parsed: &event.RoomAvatarEventContent{
-				URL: portal.AvatarURL,
+				URL: portal.roomAvatar(),
 			}},
 		})
 		portal.AvatarSet = true
@@ -472,17 +531,38 @@ func (portal *Portal) CreateMatrixRoom(user *User, channel *discordgo.Channel) e
 		})
 	}
 
+	policy := portal.bridge.Config.Bridge.GetRoomPolicy(portal.Type)
+	if visibility := portal.discordHistoryVisibility(user); visibility != "" {
+		policy.HistoryVisibility = visibility
+	}
+	if policy.HistoryVisibility != "" {
+		initialState = append(initialState, &event.Event{
+			Type:    event.StateHistoryVisibility,
+			Content: event.Content{Parsed: &event.HistoryVisibilityEventContent{HistoryVisibility: policy.HistoryVisibility}},
+		})
+	}
+	if policy.GuestAccess != "" {
+		initialState = append(initialState, &event.Event{
+			Type:    event.StateGuestAccess,
+			Content: event.Content{Parsed: &event.GuestAccessEventContent{GuestAccess: policy.GuestAccess}},
+		})
+	}
+	visibility := "private"
+	if policy.Directory != "" {
+		visibility = policy.Directory
+	}
+
 	req := &mautrix.ReqCreateRoom{
-		Visibility:      "private",
-		Name:            portal.Name,
-		Topic:           portal.Topic,
+		Visibility:      visibility,
+		Name:            portal.roomName(),
+		Topic:           portal.roomTopic(),
 		Invite:          invite,
 		Preset:          "private_chat",
 		IsDirect:        portal.IsPrivateChat(),
 		InitialState:    initialState,
 		CreationContent: creationContent,
 	}
-	if !portal.shouldSetDMRoomMetadata() && !portal.FriendNick {
+	if !portal.shouldSetDMRoomMetadata() && !portal.FriendNick && portal.NameOverride == "" {
 		req.Name = ""
 	}
 
@@ -504,11 +584,11 @@ func (portal *Portal) CreateMatrixRoom(user *User, channel *discordgo.Channel) e
 	portal.NameSet = len(req.Name) > 0
 	portal.TopicSet = len(req.Topic) > 0
 	portal.MXID = resp.RoomID
-	portal.log = portal.bridge.ZLog.With().
+	portal.log = portal.bridge.moduleLevel(portal.bridge.ZLog.With().
 		Str("channel_id", portal.Key.ChannelID).
 		Str("channel_receiver", portal.Key.Receiver).
 		Str("room_id", portal.MXID.String()).
-		Logger()
+		Logger(), "portal")
 	portal.bridge.portalsLock.Lock()
 	portal.bridge.portalsByMXID[portal.MXID] = portal
 	portal.bridge.portalsLock.Unlock()
@@ -526,8 +606,15 @@ func (portal *Portal) CreateMatrixRoom(user *User, channel *discordgo.Channel) e
 		user.addPrivateChannelToSpace(portal)
 	} else {
 		portal.updateSpace(user)
+		if portal.bridge.Config.Bridge.TrimGuildSubscriptions {
+			// The guild may not have been subscribed to if this is its first portal room
+			go user.subscribeGuildIfNeeded(portal.GuildID)
+		}
 	}
 	portal.ensureUserInvited(user, true)
+	if portal.GuildID == "" {
+		user.inviteDMExtras(portal)
+	}
 	user.syncChatDoublePuppetDetails(portal, true)
 
 	portal.syncParticipants(user, channel.Recipients)
@@ -547,13 +634,65 @@ func (portal *Portal) CreateMatrixRoom(user *User, channel *discordgo.Channel) e
 		portal.Update()
 	}
 
+	portal.sendWelcomeNotice(user)
+	portal.bridge.fireHook(HookEvent{
+		Type:      config.HookPortalCreated,
+		UserID:    user.MXID,
+		RoomID:    portal.MXID,
+		GuildID:   portal.GuildID,
+		ChannelID: portal.Key.ChannelID,
+	})
+	if portal.GuildID == "" {
+		go user.enforcePortalLimit(portal)
+	}
+
 	go portal.forwardBackfillInitial(user, nil)
 	backfillStarted = true
 
 	return nil
 }
 
+// sendWelcomeNotice sends the configured welcome notice to a newly created portal room.
+func (portal *Portal) sendWelcomeNotice(user *User) {
+	if portal.Type == discordgo.ChannelTypeGuildCategory {
+		// Categories are spaces, which don't have a timeline
+		return
+	}
+	params := config.PortalWelcomeParams{
+		Name:          portal.PlainName,
+		IsDM:          portal.GuildID == "",
+		Account:       user.DiscordID,
+		Relay:         portal.RelayWebhookID != "" || portal.getRelayBot() != nil,
+		CommandPrefix: portal.bridge.Config.Bridge.CommandPrefix,
+	}
+	if portal.Guild != nil {
+		params.GuildName = portal.Guild.PlainName
+	}
+	if puppet := portal.bridge.GetPuppetByID(user.DiscordID); puppet != nil && puppet.Username != "" {
+		params.Account = puppet.Username
+	}
+	text := portal.bridge.Config.Bridge.FormatPortalWelcome(params)
+	if text == "" {
+		return
+	}
+	content := format.RenderMarkdown(text, true, false)
+	content.MsgType = event.MsgNotice
+	_, err := portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, &content, nil, 0)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to send welcome notice")
+	}
+}
+
 func (portal *Portal) handleDiscordMessages(msg portalDiscordMessage) {
+	if portal.PausedToMatrix.Load() {
+		portal.log.Debug().Type("message_type", msg.msg).Msg("Dropping Discord event in portal with paused bridging")
+		return
+	} else if portal.delayBotMessage(msg) {
+		return
+	}
+	if msgCreate, ok := msg.msg.(*discordgo.MessageCreate); ok {
+		portal.reinviteReceiver(msg.user, msgCreate.ID)
+	}
 	if portal.MXID == "" {
 		msgCreate, ok := msg.msg.(*discordgo.MessageCreate)
 		if !ok {
@@ -574,7 +713,7 @@ func (portal *Portal) handleDiscordMessages(msg portalDiscordMessage) {
 
 	switch convertedMsg := msg.msg.(type) {
 	case *discordgo.MessageCreate:
-		portal.handleDiscordMessageCreate(msg.user, convertedMsg.Message, msg.thread)
+		portal.handleDiscordMessageCreate(msg.user, convertedMsg.Message, msg.thread, msg.receivedAt)
 	case *discordgo.MessageUpdate:
 		portal.handleDiscordMessageUpdate(msg.user, convertedMsg.Message)
 	case *discordgo.MessageDelete:
@@ -608,7 +747,7 @@ func (portal *Portal) markMessageHandled(discordID string, authorID string, time
 	return msg
 }
 
-func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Message, thread *Thread) {
+func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Message, thread *Thread, receivedAt time.Time) {
 	switch msg.Type {
 	case discordgo.MessageTypeChannelNameChange, discordgo.MessageTypeChannelIconChange, discordgo.MessageTypeChannelPinnedMessage:
 		// These are handled via channel updates
@@ -625,16 +764,94 @@ func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Mess
 
 	portal.recentMessages.Push(msg.ID, msg)
 
+	if portal.isMessageFromIgnoredBot(msg) {
+		log.Debug().Msg("Dropping message from ignored bot")
+		return
+	}
 	existing := portal.bridge.DB.Message.GetByDiscordID(portal.Key, msg.ID)
 	if existing != nil {
 		log.Debug().Msg("Dropping duplicate message")
 		return
+	} else if (msg.WebhookID != "" || msg.Author.Bot) && msg.WebhookID != portal.RelayWebhookID &&
+		portal.sentToDiscord.IsEcho(msg.Author.Username, msg.Content) {
+		log.Warn().
+			Str("webhook_id", msg.WebhookID).
+			Msg("Dropping message that looks like another bridge echoing a message from Matrix")
+		return
+	}
+	isEphemeral := msg.Flags&discordgo.MessageFlagsEphemeral != 0
+	if isEphemeral && portal.bridge.Config.Bridge.EphemeralMessages == "drop" {
+		log.Debug().Msg("Dropping ephemeral message")
+		return
+	} else if _, policy := portal.promotionalPolicy(msg); policy == config.PromotionalPolicyDrop {
+		log.Debug().Msg("Dropping promotional message")
+		return
+	} else if portal.isSuppressedOwnMessage(msg.Author.ID) {
+		log.Debug().Msg("Dropping message sent from user's other client")
+		return
+	} else if !receivedAt.IsZero() && portal.isStaleMessage(msg) {
+		log.Debug().Msg("Dropping message older than maximum message age")
+		if thread == nil && msg.ChannelID == portal.Key.ChannelID {
+			portal.markMessageSkipped(msg.ID)
+		}
+		return
 	}
 
+	// Live messages always have a receive timestamp, so a zero timestamp means the message is being backfilled
+	isBackfill := receivedAt.IsZero()
 	handlingStartTime := time.Now()
 	puppet := portal.bridge.GetPuppetByID(msg.Author.ID)
 	puppet.UpdateInfo(user, msg.Author, msg)
+	scriptResult := portal.bridge.runMessageScript(log, messageScriptToMatrix, messageScriptInput{
+		Body:       msg.Content,
+		SenderID:   msg.Author.ID,
+		SenderName: puppet.Name,
+		GuildID:    portal.GuildID,
+		ChannelID:  msg.ChannelID,
+		RoomID:     portal.MXID.String(),
+	})
+	if scriptResult.Drop {
+		log.Debug().Msg("Dropping message by message script")
+		if thread == nil && msg.ChannelID == portal.Key.ChannelID {
+			portal.markMessageSkipped(msg.ID)
+		}
+		return
+	} else if scriptResult.Body != msg.Content {
+		// The message may be shared with the state cache, so modify a copy
+		msgCopy := *msg
+		msgCopy.Content = scriptResult.Body
+		msg = &msgCopy
+	}
+	if msg.Member == nil && portal.GuildID != "" && user != nil {
+		if member := user.getMessageAuthorMember(portal.GuildID, msg); member != nil {
+			msgCopy := *msg
+			msgCopy.Member = member
+			msg = &msgCopy
+		}
+	}
 	intent := puppet.IntentFor(portal)
+	if msg.Member != nil && portal.bridge.Config.Bridge.PerGuildProfiles && intent.UserID == puppet.MXID {
+		// Join first so that the room-specific profile applies to this message too
+		if err := intent.EnsureJoined(portal.MXID); err == nil {
+			portal.syncMemberProfile(puppet, msg.Author, msg.Member)
+		}
+	}
+
+	var forumPost *discordgo.Channel
+	if thread == nil && msg.ChannelID != portal.Key.ChannelID && portal.IsForum() {
+		forumPost = portal.getForumPostMeta(user, msg.ChannelID)
+		if forumPost == nil {
+			log.Warn().Str("post_id", msg.ChannelID).Msg("Dropping message in unknown forum post")
+			return
+		} else if msg.ID != forumPost.ID {
+			// The first message of the post wasn't bridged, so make a root with just the title
+			thread = portal.createForumPostRoot(ctx, user, forumPost)
+			if thread == nil {
+				return
+			}
+			forumPost = nil
+		}
+	}
 
 	var discordThreadID string
 	var threadRootEvent, lastThreadEvent id.EventID
@@ -652,6 +869,19 @@ func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Mess
 
 	ts, _ := discordgo.SnowflakeTimestamp(msg.ID)
 	parts := portal.convertDiscordMessage(ctx, puppet, intent, msg)
+	if replyTo == nil {
+		parts = portal.addReplyContextQuote(msg, parts)
+	}
+	if forumPost != nil {
+		parts = portal.addForumPostTitle(user, forumPost, parts)
+	}
+	if isEphemeral {
+		markEphemeralParts(parts)
+		if portal.Key.Receiver == "" && portal.bridge.Config.Bridge.EphemeralMessages != "room" {
+			portal.sendEphemeralToManagementRoom(ctx, user, puppet, parts)
+			return
+		}
+	}
 	dbParts := make([]database.MessagePart, 0, len(parts))
 	eventIDs := zerolog.Dict()
 	for i, part := range parts {
@@ -674,12 +904,19 @@ func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Mess
 		// Only set mentions for first event, but keep empty object for rest
 		mentions = &event.Mentions{}
 
-		resp, err := portal.sendMatrixMessage(intent, part.Type, part.Content, part.Extra, ts.UnixMilli())
+		if isBackfill && portal.bridge.Config.Bridge.Backfill.SuppressNotifications {
+			part.Extra = addBackfillMarker(part.Extra)
+		}
+		if len(scriptResult.Tags) > 0 {
+			part.Extra = addMessageScriptTags(part.Extra, scriptResult.Tags)
+		}
+		resp, err := portal.sendMatrixMessage(intent, part.Type, part.Content, part.Extra, snowflakeToMatrixTS(msg.ID))
 		if err != nil {
 			log.Err(err).
 				Int("part_index", i).
 				Str("attachment_id", part.AttachmentID).
 				Msg("Failed to send part of message to Matrix")
+			portal.bridge.ReportError("discord message", err, portal, user.MXID.String())
 			continue
 		}
 		lastThreadEvent = resp.EventID
@@ -692,10 +929,27 @@ func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Mess
 		log.Warn().Msg("Unhandled message")
 	} else if len(dbParts) == 0 {
 		log.Warn().Msg("All parts of message failed to send to Matrix")
+		portal.bridge.RecordMessageLatency(receivedAt, true)
 	} else {
+		portal.bridge.RecordMessageLatency(receivedAt, false)
 		log.Debug().Dict("event_ids", eventIDs).Msg("Finished handling Discord message")
+		portal.sentToMatrix.Add(puppet.Name, msg.Content, portal.loopDetectionWindow())
+		if !isBackfill {
+			go portal.sendKeywordHighlights(msg, puppet.Name, dbParts[0].MXID)
+			portal.bridge.fireHook(HookEvent{
+				Type:      config.HookMessageFromDiscord,
+				UserID:    user.MXID,
+				RoomID:    portal.MXID,
+				EventID:   dbParts[0].MXID,
+				GuildID:   portal.GuildID,
+				ChannelID: msg.ChannelID,
+				MessageID: msg.ID,
+			})
+		}
 		firstDBMessage := portal.markMessageHandled(msg.ID, msg.Author.ID, ts, discordThreadID, intent.UserID, dbParts)
-		if msg.Flags == discordgo.MessageFlagsHasThread {
+		if forumPost != nil {
+			portal.bridge.threadFound(ctx, user, firstDBMessage, forumPost.ID, forumPost)
+		} else if msg.Flags == discordgo.MessageFlagsHasThread {
 			portal.bridge.threadFound(ctx, user, firstDBMessage, msg.ID, msg.Thread)
 		}
 	}
@@ -766,7 +1020,7 @@ func (portal *Portal) sendThreadCreationNotice(ctx context.Context, thread *Thre
 		Body:      creationNotice,
 		MsgType:   event.MsgNotice,
 		RelatesTo: (&event.RelatesTo{}).SetThread(thread.RootMXID, thread.RootMXID),
-	}, nil, time.Now().UnixMilli())
+	}, nil, snowflakeToMatrixTS(thread.ID))
 	if err != nil {
 		log.Err(err).Msg("Failed to send thread creation notice")
 		return
@@ -879,7 +1133,7 @@ func (portal *Portal) handleDiscordMessageUpdate(user *User, msg *discordgo.Mess
 	}
 	for _, remainingEmbed := range msg.Embeds {
 		// Other types of embeds are sent inline with the text message part
-		if getEmbedType(nil, remainingEmbed) != EmbedVideo {
+		if portal.getEmbedType(nil, remainingEmbed) != EmbedVideo {
 			continue
 		}
 		embedID := "video_" + remainingEmbed.URL
@@ -914,6 +1168,9 @@ func (portal *Portal) handleDiscordMessageUpdate(user *User, msg *discordgo.Mess
 			Msg("Dropping non-text edit")
 		return
 	}
+	if converted.Content.MsgType == event.MsgText && portal.shouldBridgeAsNotice(msg) {
+		converted.Content.MsgType = event.MsgNotice
+	}
 	puppet.addWebhookMeta(converted, msg)
 	puppet.addMemberMeta(converted, msg)
 	converted.Content.Mentions = portal.convertDiscordMentions(msg, false)
@@ -1072,6 +1329,17 @@ func (portal *Portal) encrypt(intent *appservice.IntentAPI, content *event.Conte
 	return event.EventEncrypted, nil
 }
 
+// snowflakeToMatrixTS returns the creation time of a Discord snowflake as a Matrix timestamp,
+// so that bridged events have the same timestamps as on Discord. Invalid snowflakes return 0,
+// which makes sendMatrixMessage use the current time.
+func snowflakeToMatrixTS(snowflake string) int64 {
+	ts, err := discordgo.SnowflakeTimestamp(snowflake)
+	if err != nil {
+		return 0
+	}
+	return ts.UnixMilli()
+}
+
 func (portal *Portal) sendMatrixMessage(intent *appservice.IntentAPI, eventType event.Type, content *event.MessageEventContent, extraContent map[string]interface{}, timestamp int64) (*mautrix.RespSendEvent, error) {
 	wrappedContent := event.Content{Parsed: content, Raw: extraContent}
 	var err error
@@ -1089,10 +1357,19 @@ func (portal *Portal) sendMatrixMessage(intent *appservice.IntentAPI, eventType
 }
 
 func (portal *Portal) handleMatrixMessages(msg portalMatrixMessage) {
+	if portal.PausedToDiscord.Load() {
+		go portal.sendMessageMetrics(msg.evt, errBridgingPaused, "Ignoring")
+		return
+	}
+	msg.user.markMatrixActive()
 	portal.forwardBackfillLock.Lock()
 	defer portal.forwardBackfillLock.Unlock()
 	switch msg.evt.Type {
 	case event.EventMessage, event.EventSticker:
+		if err := portal.bridge.checkMessageQuota(msg.user); err != nil {
+			go portal.sendMessageMetrics(msg.evt, err, "Ignoring")
+			return
+		}
 		portal.handleMatrixMessage(msg.user, msg.evt)
 	case event.EventRedaction:
 		portal.handleMatrixRedaction(msg.user, msg.evt)
@@ -1128,11 +1405,10 @@ func (portal *Portal) getEvent(mxid id.EventID) (*event.Event, error) {
 	return evt, nil
 }
 
-func genThreadName(evt *event.Event) string {
-	body := evt.Content.AsMessage().Body
-	if len(body) == 0 {
-		return "thread"
-	}
+// discordMaxThreadNameLength is the maximum length of a thread name allowed by Discord.
+const discordMaxThreadNameLength = 100
+
+func shortenThreadName(body string) string {
 	fields := strings.Fields(body)
 	var title string
 	for _, field := range fields {
@@ -1146,15 +1422,30 @@ func genThreadName(evt *event.Event) string {
 		}
 		break
 	}
-	return title
+	return strings.TrimSpace(title)
 }
 
-func (portal *Portal) startThreadFromMatrix(sender *User, threadRoot id.EventID) (string, error) {
+func (portal *Portal) genThreadName(sender *User, rootEvt *event.Event, content *event.MessageEventContent) string {
+	senderName, _ := portal.getRelayUserMeta(sender)
+	name := strings.TrimSpace(portal.bridge.Config.Bridge.FormatThreadName(config.ThreadNameParams{
+		Root:    shortenThreadName(rootEvt.Content.AsMessage().Body),
+		Message: shortenThreadName(content.Body),
+		Sender:  senderName,
+	}))
+	if name == "" {
+		return "thread"
+	} else if runes := []rune(name); len(runes) > discordMaxThreadNameLength {
+		name = string(runes[:discordMaxThreadNameLength])
+	}
+	return name
+}
+
+func (portal *Portal) startThreadFromMatrix(sender *User, threadRoot id.EventID, content *event.MessageEventContent) (string, error) {
 	rootEvt, err := portal.getEvent(threadRoot)
 	if err != nil {
 		return "", fmt.Errorf("failed to get root event: %w", err)
 	}
-	threadName := genThreadName(rootEvt)
+	threadName := portal.genThreadName(sender, rootEvt, content)
 
 	existingMsg := portal.bridge.DB.Message.GetByMXID(portal.Key, threadRoot)
 	if existingMsg == nil {
@@ -1218,11 +1509,20 @@ var (
 	errTargetNotFound              = errors.New("target event not found")
 	errUnknownEmoji                = errors.New("unknown emoji")
 	errCantStartThread             = errors.New("can't create thread without being logged into Discord")
+	errBridgeLoop                  = errors.New("message looks like another bridge echoing a message from Discord")
+	errRelayNotApproved            = errors.New("sender hasn't been approved by a moderator for relaying")
+	errRelayLevelTooLow            = errors.New("sender's power level is too low for relaying")
+	errBridgingPaused              = errors.New("bridging to Discord is paused in this portal")
+	errPolicyBanned                = errors.New("sender is banned by a policy list")
+	errDroppedByScript             = errors.New("message was dropped by the message script")
 )
 
 func errorToStatusReason(err error) (reason event.MessageStatusReason, status event.MessageStatus, isCertain, sendNotice bool, humanMessage string, checkpointError error) {
 	var restErr *discordgo.RESTError
+	var quotaErr *quotaError
 	switch {
+	case errors.As(err, &quotaErr):
+		return event.MessageStatusNoPermission, event.MessageStatusFail, true, true, quotaErr.message, nil
 	case errors.Is(err, errUnknownMsgType),
 		errors.Is(err, errUnknownRelationType),
 		errors.Is(err, errUnexpectedParsedContentType),
@@ -1236,9 +1536,15 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 		errors.Is(err, attachment.InvalidKey),
 		errors.Is(err, attachment.InvalidInitVector):
 		return event.MessageStatusUndecryptable, event.MessageStatusFail, true, true, "", nil
-	case errors.Is(err, errUserNotReceiver), errors.Is(err, errUserNotLoggedIn):
+	case errors.Is(err, errUserNotReceiver), errors.Is(err, errUserNotLoggedIn), errors.Is(err, errPolicyBanned):
 		return event.MessageStatusNoPermission, event.MessageStatusFail, true, false, "", nil
-	case errors.Is(err, errUnknownEditTarget):
+	case errors.Is(err, errRelayNotApproved):
+		return event.MessageStatusNoPermission, event.MessageStatusFail, true, true, "Your messages won't be bridged until a moderator approves you", nil
+	case errors.Is(err, errRelayLevelTooLow):
+		return event.MessageStatusNoPermission, event.MessageStatusFail, true, true, "Your power level is too low for your messages to be bridged to Discord", nil
+	case errors.Is(err, errBridgingPaused):
+		return event.MessageStatusGenericError, event.MessageStatusFail, true, true, "Bridging to Discord is paused in this room", nil
+	case errors.Is(err, errUnknownEditTarget), errors.Is(err, errBridgeLoop), errors.Is(err, errDroppedByScript):
 		return event.MessageStatusGenericError, event.MessageStatusFail, true, false, "", nil
 	case errors.Is(err, errTargetNotFound):
 		return event.MessageStatusGenericError, event.MessageStatusFail, true, false, "", nil
@@ -1343,6 +1649,9 @@ func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part strin
 	if err != nil && part != "Ignoring" {
 		level = zerolog.ErrorLevel
 	}
+	if msgType == "message" && (err == nil || level == zerolog.ErrorLevel) {
+		portal.bridge.metrics.recordMessage(metricDirectionMatrixToDiscord, err == nil, time.Since(time.UnixMilli(evt.Timestamp)))
+	}
 	logEvt := portal.log.WithLevel(level).
 		Str("action", "send matrix message metrics").
 		Str("event_type", evt.Type.Type).
@@ -1361,6 +1670,12 @@ func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part strin
 		}
 		checkpointStatus := status.ReasonToCheckpointStatus(reason, statusCode)
 		portal.bridge.SendMessageCheckpoint(evt, status.MsgStepRemote, checkpointErr, checkpointStatus, 0)
+		if level == zerolog.ErrorLevel {
+			portal.bridge.ReportError("matrix "+msgType, err, portal, evt.Sender.String())
+			if sender := portal.bridge.GetCachedUserByMXID(evt.Sender); sender != nil {
+				sender.recordError("matrix "+msgType, err)
+			}
+		}
 		if sendNotice {
 			if humanMessage == "" {
 				humanMessage = err.Error()
@@ -1376,6 +1691,9 @@ func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part strin
 	}
 }
 
+// mediaProxyMaxSize is the largest avatar the media proxy will serve. Discord rejects larger webhook avatars anyway.
+const mediaProxyMaxSize = 10 * 1024 * 1024
+
 func (br *DiscordBridge) serveMediaProxy(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	mxc := id.ContentURI{
@@ -1392,30 +1710,37 @@ func (br *DiscordBridge) serveMediaProxy(w http.ResponseWriter, r *http.Request)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	reader, err := br.Bot.Download(mxc)
+	reader, err := br.Bot.DownloadContext(r.Context(), mxc)
 	if err != nil {
 		br.ZLog.Warn().Err(err).Msg("Failed to download media to proxy")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	buf := make([]byte, 32*1024)
-	n, err := io.ReadFull(reader, buf)
-	if err != nil && (!errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF)) {
-		br.ZLog.Warn().Err(err).Msg("Failed to read first part of media to proxy")
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, mediaProxyMaxSize+1))
+	if err != nil {
+		br.ZLog.Warn().Err(err).Msg("Failed to read media to proxy")
 		w.WriteHeader(http.StatusBadGateway)
 		return
+	} else if len(data) > mediaProxyMaxSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
 	}
-	w.Header().Add("Content-Type", http.DetectContentType(buf[:n]))
-	if n < len(buf) {
-		w.Header().Add("Content-Length", strconv.Itoa(n))
-	}
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(buf[:n])
-	if err != nil {
+	// Only avatars are proxied, so refuse to serve anything else from the bridge's domain
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
 		return
 	}
-	if n >= len(buf) {
-		_, _ = io.CopyBuffer(w, reader, buf)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none';")
+	// mxc URIs are immutable, so Discord's media proxy can cache the avatar indefinitely
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(data)
 	}
 }
 
@@ -1426,22 +1751,42 @@ func (br *DiscordBridge) hashMediaProxyURL(mxc id.ContentURI) (string, []byte) {
 	return path, checksum.Sum(nil)
 }
 
+// mediaProxyAddress returns the public base URL of the avatar proxy. If no public address is configured,
+// the direct media address is used, as it must be reachable from the outside anyway.
+func (br *DiscordBridge) mediaProxyAddress() string {
+	if br.Config.Bridge.PublicAddress != "" {
+		return br.Config.Bridge.PublicAddress
+	} else if br.DMA != nil {
+		return "https://" + br.DMA.ks.WellKnownTarget
+	}
+	return ""
+}
+
 func (br *DiscordBridge) makeMediaProxyURL(mxc id.ContentURI) string {
-	if br.Config.Bridge.PublicAddress == "" {
+	address := br.mediaProxyAddress()
+	if address == "" {
 		return ""
 	}
 	path, checksum := br.hashMediaProxyURL(mxc)
-	return br.Config.Bridge.PublicAddress + path + base64.RawURLEncoding.EncodeToString(checksum)
+	return address + path + base64.RawURLEncoding.EncodeToString(checksum)
+}
+
+// matrixDisplayname returns the displayname of the user in the portal room, or their user ID if they don't have one.
+func (portal *Portal) matrixDisplayname(sender *User) string {
+	if name := portal.bridge.StateStore.GetMember(portal.MXID, sender.MXID).Displayname; name != "" {
+		return name
+	}
+	return sender.MXID.String()
 }
 
 func (portal *Portal) getRelayUserMeta(sender *User) (name, avatarURL string) {
 	member := portal.bridge.StateStore.GetMember(portal.MXID, sender.MXID)
-	name = member.Displayname
-	if name == "" {
-		name = sender.MXID.String()
-	}
+	name = portal.bridge.Config.Bridge.FormatRelayDisplayname(config.RelayDisplaynameParams{
+		Displayname: portal.matrixDisplayname(sender),
+		UserID:      sender.MXID,
+	})
 	mxc := member.AvatarURL.ParseOrIgnore()
-	if !mxc.IsEmpty() && portal.bridge.Config.Bridge.PublicAddress != "" {
+	if !mxc.IsEmpty() {
 		avatarURL = portal.bridge.makeMediaProxyURL(mxc)
 	}
 	return
@@ -1526,22 +1871,53 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 
 	channelID := portal.Key.ChannelID
 	sess := sender.Session
+	var relayBot *User
 	if sess == nil && portal.RelayWebhookID == "" {
-		go portal.sendMessageMetrics(evt, errUserNotLoggedIn, "Ignoring")
-		return
+		relayBot = portal.getRelayBot()
+		if relayBot == nil {
+			go portal.sendMessageMetrics(evt, errUserNotLoggedIn, "Ignoring")
+			return
+		}
 	}
+	// Relay bot sends are mostly treated like webhook sends, as the sender doesn't have their own session
 	isWebhookSend := sess == nil
+	if isWebhookSend && !portal.hasRelayLevel(sender.MXID) {
+		go portal.sendMessageMetrics(evt, errRelayLevelTooLow, "Ignoring")
+		return
+	} else if isWebhookSend && !portal.isRelayApproved(sender.MXID) {
+		go portal.sendMessageMetrics(evt, errRelayNotApproved, "Ignoring")
+		return
+	} else if reason, banned := portal.bridge.isPolicyBanned(sender.MXID); isWebhookSend && banned {
+		portal.log.Debug().Str("sender", sender.MXID.String()).Str("reason", reason).Msg("Not relaying message from user banned by policy list")
+		go portal.sendMessageMetrics(evt, errPolicyBanned, "Ignoring")
+		return
+	}
 	var threadID string
+	if isWebhookSend && content.GetRelatesTo().GetReplaceID() == "" && portal.sentToMatrix.IsEcho(portal.matrixDisplayname(sender), content.Body) {
+		go portal.sendMessageMetrics(evt, errBridgeLoop, "Ignoring")
+		return
+	}
 
 	if editMXID := content.GetRelatesTo().GetReplaceID(); editMXID != "" && content.NewContent != nil {
 		edits := portal.bridge.DB.Message.GetByMXID(portal.Key, editMXID)
 		if edits != nil {
-			discordContent, allowedMentions := portal.parseMatrixHTML(content.NewContent)
+			discordContent, allowedMentions := portal.parseMatrixHTML(sender, content.NewContent)
+			if isWebhookSend {
+				discordContent = portal.escapeRelayMentions(discordContent, allowedMentions)
+			}
+			// Relayed messages are all sent by the same webhook or bot, so only the original Matrix sender can edit them
+			if isWebhookSend && (edits.SenderMXID != sender.MXID || (relayBot != nil && edits.SenderID != relayBot.DiscordID)) {
+				go portal.sendMessageMetrics(evt, errUserNotLoggedIn, "Ignoring")
+				return
+			}
 			var err error
 			var msg *discordgo.Message
 			if !isWebhookSend {
 				// TODO save edit in message table
 				msg, err = sess.ChannelMessageEdit(edits.DiscordProtoChannelID(), edits.DiscordID, discordContent)
+			} else if relayBot != nil {
+				discordContent = portal.addRelayBotPrefix(sender, discordContent)
+				msg, err = relayBot.Session.ChannelMessageEdit(edits.DiscordProtoChannelID(), edits.DiscordID, discordContent)
 			} else {
 				msg, err = relayClient.WebhookMessageEdit(portal.RelayWebhookID, portal.RelayWebhookSecret, edits.DiscordID, &discordgo.WebhookEdit{
 					Content:         &discordContent,
@@ -1561,6 +1937,14 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 		if existingThread != nil {
 			threadID = existingThread.ID
 			existingThread.initialBackfillAttempted = true
+			if existingThread.Archived && !isWebhookSend {
+				err := existingThread.Unarchive(sender)
+				if err != nil {
+					portal.log.Warn().Err(err).
+						Str("thread_id", threadID).
+						Msg("Failed to unarchive thread before sending message")
+				}
+			}
 		} else {
 			if isWebhookSend {
 				// TODO start thread with bot?
@@ -1568,7 +1952,7 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 				return
 			}
 			var err error
-			threadID, err = portal.startThreadFromMatrix(sender, threadRoot)
+			threadID, err = portal.startThreadFromMatrix(sender, threadRoot, content)
 			if err != nil {
 				portal.log.Warn().Err(err).
 					Str("thread_root_mxid", threadRoot.String()).
@@ -1579,11 +1963,22 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 	if threadID != "" {
 		channelID = threadID
 	}
+	// Top-level messages in forums start new posts, which webhooks can't do
+	isNewForumPost := portal.IsForum() && threadID == ""
+	if isNewForumPost && isWebhookSend {
+		go portal.sendMessageMetrics(evt, errCantStartThread, "Dropping")
+		return
+	}
 
 	var sendReq discordgo.MessageSend
 
 	var description string
 	if evt.Type == event.EventSticker {
+		if !isWebhookSend {
+			if stickerID := portal.findDiscordSticker(sender, content.URL.ParseOrIgnore()); stickerID != "" {
+				sendReq.StickerIDs = &[]string{stickerID}
+			}
+		}
 		content.MsgType = event.MsgImage
 		if mimeData := mimetype.Lookup(content.Info.MimeType); mimeData != nil {
 			description = content.Body
@@ -1591,6 +1986,11 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 		}
 	}
 
+	effect, isEffect := matrixEffectName(content.MsgType)
+	if isEffect {
+		content.MsgType = event.MsgText
+	}
+
 	replyToMXID := content.RelatesTo.GetNonFallbackReplyTo()
 	var replyToUser id.UserID
 	if replyToMXID != "" {
@@ -1615,21 +2015,40 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 	}
 	switch content.MsgType {
 	case event.MsgText, event.MsgEmote, event.MsgNotice:
-		sendReq.Content, sendReq.AllowedMentions = portal.parseMatrixHTML(content)
+		sendReq.Content, sendReq.AllowedMentions = portal.parseMatrixHTML(sender, content)
+		var tts bool
+		sendReq.Content, tts = parseMatrixTTS(evt, sendReq.Content)
+		// Relays may have more permissions than the Matrix user, so TTS is only allowed for the user's own account.
+		// Discord checks the Send TTS Messages permission itself and sends a normal message if it's missing.
+		if tts && !isWebhookSend {
+			sendReq.TTS = &tts
+		}
 		if content.MsgType == event.MsgEmote {
 			sendReq.Content = fmt.Sprintf("_%s_", sendReq.Content)
 		}
+		if isEffect {
+			sendReq.Content += portal.matrixEffectMarker(effect)
+		}
 	case event.MsgAudio, event.MsgFile, event.MsgImage, event.MsgVideo:
+		if sendReq.StickerIDs != nil {
+			// Guild stickers are sent natively, so there's nothing to reupload
+			break
+		}
 		data, err := downloadMatrixAttachment(portal.MainIntent(), content)
 		if err != nil {
 			go portal.sendMessageMetrics(evt, err, "Error downloading media in")
 			return
 		}
+		if err = portal.bridge.useMediaQuota(sender, len(data)); err != nil {
+			go portal.sendMessageMetrics(evt, err, "Ignoring")
+			return
+		}
 		filename := content.Body
 		if content.FileName != "" && content.FileName != content.Body {
 			filename = content.FileName
-			sendReq.Content, sendReq.AllowedMentions = portal.parseMatrixHTML(content)
+			sendReq.Content, sendReq.AllowedMentions = portal.parseMatrixHTML(sender, content)
 		}
+		filename = discordFilename(filename, content.GetInfo().MimeType, time.UnixMilli(evt.Timestamp).UTC().Format("20060102-150405"))
 
 		if portal.bridge.Config.Bridge.UseDiscordCDNUpload && !isWebhookSend && sess.IsUser {
 			att := &discordgo.MessageAttachment{
@@ -1667,6 +2086,21 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 		go portal.sendMessageMetrics(evt, fmt.Errorf("%w %q", errUnknownMsgType, content.MsgType), "Ignoring")
 		return
 	}
+	if portal.bridge.messageScript != nil {
+		scriptResult := portal.bridge.runMessageScript(portal.log.With().Str("event_id", evt.ID.String()).Logger(), messageScriptToDiscord, messageScriptInput{
+			Body:       sendReq.Content,
+			SenderID:   sender.MXID.String(),
+			SenderName: portal.bridge.StateStore.GetMember(portal.MXID, sender.MXID).Displayname,
+			GuildID:    portal.GuildID,
+			ChannelID:  channelID,
+			RoomID:     portal.MXID.String(),
+		})
+		if scriptResult.Drop {
+			go portal.sendMessageMetrics(evt, errDroppedByScript, "Ignoring")
+			return
+		}
+		sendReq.Content = scriptResult.Body
+	}
 	silentReply := content.Mentions != nil && replyToMXID != "" &&
 		(len(content.Mentions.UserIDs) == 0 || (replyToUser != "" && !slices.Contains(content.Mentions.UserIDs, replyToUser)))
 	if silentReply && sendReq.AllowedMentions != nil {
@@ -1693,11 +2127,20 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 			sendReq.AllowedMentions.Parse = append(sendReq.AllowedMentions.Parse, discordgo.AllowedMentionTypeEveryone)
 		}
 	}
+	if isWebhookSend {
+		sendReq.Content = portal.escapeRelayMentions(sendReq.Content, sendReq.AllowedMentions)
+	}
 	sendReq.Nonce = generateNonce()
 	var msg *discordgo.Message
+	var forumPost *discordgo.Channel
 	var err error
-	if !isWebhookSend {
+	if isNewForumPost {
+		msg, forumPost, err = portal.startForumPostFromMatrix(sess, content, &sendReq)
+	} else if !isWebhookSend {
 		msg, err = sess.ChannelMessageSendComplex(channelID, &sendReq, portal.RefererOptIfUser(sess, threadID)...)
+	} else if relayBot != nil {
+		sendReq.Content = portal.addRelayBotPrefix(sender, sendReq.Content)
+		msg, err = relayBot.Session.ChannelMessageSendComplex(channelID, &sendReq)
 	} else {
 		username, avatarURL := portal.getRelayUserMeta(sender)
 		msg, err = relayClient.WebhookThreadExecute(portal.RelayWebhookID, portal.RelayWebhookSecret, true, threadID, &discordgo.WebhookParams{
@@ -1722,6 +2165,8 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 		dbMsg.MXID = evt.ID
 		if sess != nil {
 			dbMsg.SenderID = sender.DiscordID
+		} else if relayBot != nil {
+			dbMsg.SenderID = relayBot.DiscordID
 		} else {
 			dbMsg.SenderID = portal.RelayWebhookID
 		}
@@ -1729,9 +2174,27 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 		dbMsg.Timestamp, _ = discordgo.SnowflakeTimestamp(msg.ID)
 		dbMsg.ThreadID = threadID
 		dbMsg.Insert()
+		portal.sentToDiscord.Add(portal.matrixDisplayname(sender), content.Body, portal.loopDetectionWindow())
+		portal.bridge.fireHook(HookEvent{
+			Type:      config.HookMessageToDiscord,
+			UserID:    sender.MXID,
+			RoomID:    portal.MXID,
+			EventID:   evt.ID,
+			GuildID:   portal.GuildID,
+			ChannelID: msg.ChannelID,
+			MessageID: msg.ID,
+		})
+		if forumPost != nil {
+			ctx := portal.log.With().Str("post_id", forumPost.ID).Logger().WithContext(context.Background())
+			portal.bridge.threadFound(ctx, sender, dbMsg, forumPost.ID, forumPost)
+		}
 	}
 }
 
+func (portal *Portal) loopDetectionWindow() time.Duration {
+	return time.Duration(portal.bridge.Config.Bridge.LoopDetectionWindow) * time.Second
+}
+
 func (portal *Portal) sendDeliveryReceipt(eventID id.EventID) {
 	if portal.bridge.Config.Bridge.DeliveryReceipts {
 		err := portal.bridge.Bot.MarkRead(portal.MXID, eventID)
@@ -1745,7 +2208,9 @@ func (portal *Portal) sendDeliveryReceipt(eventID id.EventID) {
 
 func (portal *Portal) HandleMatrixLeave(brSender bridge.User) {
 	sender := brSender.(*User)
-	if portal.IsPrivateChat() && sender.DiscordID == portal.Key.Receiver {
+	if portal.shouldReinviteReceiver(sender) {
+		portal.log.Debug().Msg("User left private chat portal, keeping it to invite them back on the next message")
+	} else if portal.IsPrivateChat() && sender.DiscordID == portal.Key.Receiver {
 		portal.log.Debug().Msg("User left private chat portal, cleaning up and deleting...")
 		portal.cleanup(false)
 		portal.RemoveMXID()
@@ -1754,6 +2219,53 @@ func (portal *Portal) HandleMatrixLeave(brSender bridge.User) {
 	}
 }
 
+// handleRelayMembership posts a notice through the relay webhook and updates the relay roster when
+// a Matrix user who doesn't have their own Discord account joins or leaves a relayed portal.
+func (br *DiscordBridge) handleRelayMembership(evt *event.Event) {
+	if !br.Config.Bridge.RelayMembershipNotices && !br.Config.Bridge.RelayRoster {
+		return
+	} else if evt.Sender == br.Bot.UserID || br.IsGhost(evt.Sender) {
+		return
+	}
+	portal := br.GetPortalByMXID(evt.RoomID)
+	if portal == nil || portal.RelayWebhookID == "" {
+		return
+	}
+	target := id.UserID(evt.GetStateKey())
+	if !br.isRelayRosterMember(target) {
+		// Logged-in users are visible on Discord anyway
+		return
+	}
+	content := evt.Content.AsMember()
+	prevMembership := getPrevMembership(evt)
+	var action string
+	if content.Membership == event.MembershipJoin && prevMembership != event.MembershipJoin {
+		action = "joined"
+	} else if content.Membership.IsLeaveOrBan() && prevMembership == event.MembershipJoin {
+		action = "left"
+	} else {
+		return
+	}
+	if br.Config.Bridge.RelayRoster {
+		go portal.updateRelayRoster()
+	}
+	if !br.Config.Bridge.RelayMembershipNotices {
+		return
+	}
+	name := content.Displayname
+	if name == "" {
+		name = target.String()
+	}
+	_, err := relayClient.WebhookExecute(portal.RelayWebhookID, portal.RelayWebhookSecret, false, &discordgo.WebhookParams{
+		Content:         fmt.Sprintf("_%s %s the room on Matrix_", escapeDiscordMarkdown(name), action),
+		Username:        br.Config.AppService.Bot.Displayname,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	if err != nil {
+		portal.log.Warn().Err(err).Str("target_user_id", target.String()).Msg("Failed to send relay membership notice")
+	}
+}
+
 func (portal *Portal) HandleMatrixKick(brSender bridge.User, brTarget bridge.Ghost)   {}
 func (portal *Portal) HandleMatrixInvite(brSender bridge.User, brTarget bridge.Ghost) {}
 
@@ -1785,6 +2297,44 @@ func (portal *Portal) cleanupIfEmpty() {
 	}
 }
 
+// BindRoom links an unbridged portal to an existing Matrix room. If plumbed is set, the room is treated as
+// a shared community room: its metadata and power levels are left alone, and Matrix users are relayed.
+// The caller must hold the portal's roomCreateLock.
+func (portal *Portal) BindRoom(user *User, roomID id.RoomID, plumbed bool) {
+	if portal.Guild != nil && portal.Guild.BridgingMode < database.GuildBridgeIfPortalExists {
+		portal.log.Debug().Str("guild_id", portal.Guild.ID).Msg("Bumping bridging mode of portal guild to if-portal-exists")
+		portal.Guild.BridgingMode = database.GuildBridgeIfPortalExists
+		portal.Guild.Update()
+	}
+	portal.log.Debug().Stringer("room_id", roomID).Bool("plumbed", plumbed).Msg("Bridging room")
+	portal.MXID = roomID
+	portal.Plumbed = plumbed
+	if plumbed && user.Session != nil && !user.Session.IsUser {
+		// Plumbing a room with a bot account means the owner wants the bot to relay messages there
+		portal.RelayBotMXID = user.MXID
+	}
+	portal.bridge.portalsLock.Lock()
+	portal.bridge.portalsByMXID[portal.MXID] = portal
+	portal.bridge.portalsLock.Unlock()
+	portal.updateRoomName()
+	portal.updateRoomAvatar()
+	portal.updateRoomTopic()
+	portal.updateSpace(user)
+	portal.UpdateBridgeInfo()
+	state, err := portal.MainIntent().State(portal.MXID)
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to update state cache for room")
+	} else {
+		encryptionEvent, isEncrypted := state[event.StateEncryption][""]
+		portal.Encrypted = isEncrypted && encryptionEvent.Content.AsEncryption().Algorithm == id.AlgorithmMegolmV1
+	}
+	portal.Update()
+	portal.log.Info().
+		Stringer("room_id", portal.MXID).
+		Bool("encrypted", portal.Encrypted).
+		Msg("Manual bridging complete")
+}
+
 func (portal *Portal) RemoveMXID() {
 	portal.bridge.portalsLock.Lock()
 	defer portal.bridge.portalsLock.Unlock()
@@ -1793,15 +2343,19 @@ func (portal *Portal) RemoveMXID() {
 	}
 	delete(portal.bridge.portalsByMXID, portal.MXID)
 	portal.MXID = ""
-	portal.log = portal.bridge.ZLog.With().
+	portal.log = portal.bridge.moduleLevel(portal.bridge.ZLog.With().
 		Str("channel_id", portal.Key.ChannelID).
 		Str("channel_receiver", portal.Key.Receiver).
 		Str("room_id", portal.MXID.String()).
-		Logger()
+		Logger(), "portal")
 	portal.AvatarSet = false
 	portal.NameSet = false
 	portal.TopicSet = false
 	portal.Encrypted = false
+	portal.Plumbed = false
+	portal.RelayBotMXID = ""
+	portal.RelayApproval = false
+	portal.RelayMinLevel = nil
 	portal.InSpace = ""
 	portal.FirstEventID = ""
 	portal.Update()
@@ -1813,7 +2367,11 @@ func (portal *Portal) cleanup(puppetsOnly bool) {
 		return
 	}
 	intent := portal.MainIntent()
-	if portal.bridge.SpecVersions.Supports(mautrix.BeeperFeatureRoomYeeting) {
+	if portal.Plumbed {
+		// Plumbed rooms belong to their community, so only the bridge's own users leave
+		portal.bridge.cleanupRoom(intent, portal.MXID, true, portal.log)
+		return
+	} else if portal.bridge.SpecVersions.Supports(mautrix.BeeperFeatureRoomYeeting) {
 		err := intent.BeeperDeleteRoom(portal.MXID)
 		if err != nil && !errors.Is(err, mautrix.MNotFound) {
 			portal.log.Err(err).Msg("Failed to delete room using hungryserv yeet endpoint")
@@ -1832,6 +2390,34 @@ func (portal *Portal) cleanup(puppetsOnly bool) {
 	portal.bridge.cleanupRoom(intent, portal.MXID, puppetsOnly, portal.log)
 }
 
+// archive makes the portal room read-only with the given notice as the last message, but keeps everyone in the room.
+func (portal *Portal) archive(notice string) {
+	if portal.MXID == "" {
+		return
+	}
+	intent := portal.MainIntent()
+	_, err := portal.sendMatrixMessage(intent, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    notice,
+	}, nil, 0)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to send archive notice")
+	}
+	levels, err := intent.PowerLevels(portal.MXID)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to get power levels to archive room")
+		return
+	}
+	ownLevel := levels.GetUserLevel(intent.UserID)
+	levels.EventsDefault = ownLevel
+	levels.StateDefaultPtr = &ownLevel
+	levels.SetEventLevel(event.EventReaction, ownLevel)
+	_, err = intent.SetPowerLevels(portal.MXID, levels)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to make archived room read-only")
+	}
+}
+
 func (br *DiscordBridge) cleanupRoom(intent *appservice.IntentAPI, mxid id.RoomID, puppetsOnly bool, log zerolog.Logger) {
 	members, err := intent.JoinedMembers(mxid)
 	if err != nil {
@@ -1882,6 +2468,9 @@ func (portal *Portal) getMatrixUsers() ([]id.UserID, error) {
 }
 
 func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event) {
+	if portal.RelayApproval && portal.handleRelayApprovalReaction(sender, evt) {
+		return
+	}
 	if portal.IsPrivateChat() && sender.DiscordID != portal.Key.Receiver {
 		go portal.sendMessageMetrics(evt, errUserNotReceiver, "Ignoring")
 		return
@@ -1931,6 +2520,16 @@ func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event) {
 			go portal.sendMessageMetrics(evt, fmt.Errorf("%w %s", errUnknownEmoji, emojiID), "Ignoring")
 			return
 		}
+	} else if normalized := portal.bridge.NormalizeEmojiShortcode(emojiID); normalized != emojiID {
+		emojiID = variationselector.FullyQualify(normalized)
+	} else if len(emojiID) > 2 && emojiID[0] == ':' && emojiID[len(emojiID)-1] == ':' {
+		// Custom emoji reactions bridged as shortcodes (see custom_emoji_reactions) come back here
+		customID, customName, _ := portal.findDiscordEmoji(sender, id.ContentURI{}, emojiID[1:len(emojiID)-1])
+		if customID == "" {
+			go portal.sendMessageMetrics(evt, fmt.Errorf("%w %s", errUnknownEmoji, emojiID), "Ignoring")
+			return
+		}
+		emojiID = fmt.Sprintf("%s:%s", customName, customID)
 	} else {
 		emojiID = variationselector.FullyQualify(emojiID)
 	}
@@ -1948,6 +2547,7 @@ func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event) {
 	err := sender.Session.MessageReactionAddUser(portal.GuildID, msg.DiscordProtoChannelID(), msg.DiscordID, emojiID)
 	go portal.sendMessageMetrics(evt, err, "Error sending")
 	if err == nil {
+		portal.reactionSequencer.Sent(makeReactionOpKey(msg.DiscordID, emojiID, sender.DiscordID), true)
 		dbReaction := portal.bridge.DB.Reaction.New()
 		dbReaction.Channel = portal.Key
 		dbReaction.MessageID = msg.DiscordID
@@ -1989,6 +2589,11 @@ func (portal *Portal) handleDiscordReaction(user *User, reaction *discordgo.Mess
 		matrixReaction = variationselector.Add(reaction.Emoji.Name)
 	}
 
+	if portal.reactionSequencer.IsEcho(makeReactionOpKey(reaction.MessageID, discordID, reaction.UserID), add) {
+		log.Debug().Str("emoji", discordID).Msg("Ignoring echo of reaction change sent from Matrix")
+		return
+	}
+
 	// Find the message that we're working with.
 	message := portal.bridge.DB.Message.GetByDiscordID(portal.Key, reaction.MessageID)
 	if message == nil {
@@ -2071,9 +2676,13 @@ func (portal *Portal) handleMatrixRedaction(sender *User, evt *event.Event) {
 	}
 
 	sess := sender.Session
+	var relayBot *User
 	if sess == nil && portal.RelayWebhookID == "" {
-		go portal.sendMessageMetrics(evt, errUserNotLoggedIn, "Ignoring")
-		return
+		relayBot = portal.getRelayBot()
+		if relayBot == nil {
+			go portal.sendMessageMetrics(evt, errUserNotLoggedIn, "Ignoring")
+			return
+		}
 	}
 
 	message := portal.bridge.DB.Message.GetByMXID(portal.Key, evt.Redacts)
@@ -2082,6 +2691,12 @@ func (portal *Portal) handleMatrixRedaction(sender *User, evt *event.Event) {
 		// TODO add support for deleting individual attachments from messages
 		if sess != nil {
 			err = sess.ChannelMessageDelete(message.DiscordProtoChannelID(), message.DiscordID, portal.RefererOptIfUser(sess, message.ThreadID)...)
+		} else if relayBot != nil {
+			if message.SenderID != relayBot.DiscordID || message.SenderMXID != sender.MXID {
+				go portal.sendMessageMetrics(evt, errUserNotLoggedIn, "Ignoring")
+				return
+			}
+			err = relayBot.Session.ChannelMessageDelete(message.DiscordProtoChannelID(), message.DiscordID)
 		} else {
 			// TODO pre-validate that the message was sent by the webhook?
 			err = relayClient.WebhookMessageDelete(portal.RelayWebhookID, portal.RelayWebhookSecret, message.DiscordID)
@@ -2099,6 +2714,7 @@ func (portal *Portal) handleMatrixRedaction(sender *User, evt *event.Event) {
 			err := sess.MessageReactionRemoveUser(portal.GuildID, reaction.DiscordProtoChannelID(), reaction.MessageID, reaction.EmojiName, reaction.Sender)
 			go portal.sendMessageMetrics(evt, err, "Error sending")
 			if err == nil {
+				portal.reactionSequencer.Sent(makeReactionOpKey(reaction.MessageID, reaction.EmojiName, reaction.Sender), false)
 				reaction.Delete()
 			}
 			return
@@ -2213,23 +2829,45 @@ func (portal *Portal) HandleMatrixTyping(newTyping []id.UserID) {
 	}
 }
 
-func (portal *Portal) UpdateName(meta *discordgo.Channel) bool {
-	var parentName, guildName string
+// channelNameParams collects the data for the channel name template. Parent and guild names are taken
+// from the bridge's own cache, or the source user's gateway state if they haven't been synced yet,
+// so that formatting names never needs to make requests to Discord.
+func (portal *Portal) channelNameParams(source *User, meta *discordgo.Channel) config.ChannelNameParams {
+	params := config.ChannelNameParams{
+		Name: meta.Name,
+		NSFW: meta.NSFW,
+		Type: meta.Type,
+	}
+	var strippedName string
+	params.Emoji, strippedName = splitChannelNameEmoji(meta.Name)
+	if portal.bridge.Config.Bridge.ChannelNameEmoji == config.ChannelNameEmojiStrip {
+		params.Name = strippedName
+	}
 	if portal.Parent != nil {
-		parentName = portal.Parent.PlainName
+		params.ParentName = portal.Parent.PlainName
 	}
 	if portal.Guild != nil {
-		guildName = portal.Guild.PlainName
+		params.GuildName = portal.Guild.PlainName
 	}
+	if source != nil && source.Session != nil {
+		if params.ParentName == "" && meta.ParentID != "" {
+			if parent, _ := source.Session.State.Channel(meta.ParentID); parent != nil {
+				params.ParentName = parent.Name
+			}
+		}
+		if params.GuildName == "" && meta.GuildID != "" {
+			if guild, _ := source.Session.State.Guild(meta.GuildID); guild != nil {
+				params.GuildName = guild.Name
+			}
+		}
+	}
+	return params
+}
+
+func (portal *Portal) UpdateName(source *User, meta *discordgo.Channel) bool {
 	plainNameChanged := portal.PlainName != meta.Name
 	portal.PlainName = meta.Name
-	return portal.UpdateNameDirect(portal.bridge.Config.Bridge.FormatChannelName(config.ChannelNameParams{
-		Name:       meta.Name,
-		ParentName: parentName,
-		GuildName:  guildName,
-		NSFW:       meta.NSFW,
-		Type:       meta.Type,
-	}), false) || plainNameChanged
+	return portal.UpdateNameDirect(portal.bridge.Config.Bridge.FormatChannelName(portal.channelNameParams(source, meta)), false) || plainNameChanged
 }
 
 func (portal *Portal) UpdateNameDirect(name string, isFriendNick bool) bool {
@@ -2249,7 +2887,10 @@ func (portal *Portal) UpdateNameDirect(name string, isFriendNick bool) bool {
 }
 
 func (portal *Portal) updateRoomName() {
-	if portal.MXID != "" && (portal.shouldSetDMRoomMetadata() || portal.FriendNick) {
+	if portal.NameOverride != "" {
+		return
+	}
+	if portal.MXID != "" && !portal.Plumbed && (portal.shouldSetDMRoomMetadata() || portal.FriendNick) {
 		_, err := portal.MainIntent().SetRoomName(portal.MXID, portal.Name)
 		if err != nil {
 			portal.log.Err(err).Msg("Failed to update room name")
@@ -2301,7 +2942,7 @@ func (portal *Portal) UpdateGroupDMAvatar(iconID string) bool {
 }
 
 func (portal *Portal) updateRoomAvatar() {
-	if portal.MXID == "" || portal.AvatarURL.IsEmpty() || !portal.shouldSetDMRoomMetadata() {
+	if portal.MXID == "" || !portal.AvatarOverride.IsEmpty() || portal.Plumbed || portal.AvatarURL.IsEmpty() || !portal.shouldSetDMRoomMetadata() {
 		return
 	}
 	_, err := portal.MainIntent().SetRoomAvatar(portal.MXID, portal.AvatarURL)
@@ -2327,7 +2968,7 @@ func (portal *Portal) UpdateTopic(topic string) bool {
 }
 
 func (portal *Portal) updateRoomTopic() {
-	if portal.MXID != "" {
+	if portal.MXID != "" && !portal.Plumbed && portal.TopicOverride == "" {
 		_, err := portal.MainIntent().SetRoomTopic(portal.MXID, portal.Topic)
 		if err != nil {
 			portal.log.Err(err).Msg("Failed to update room topic")
@@ -2412,11 +3053,11 @@ func (portal *Portal) ExpectedSpaceID() id.RoomID {
 }
 
 func (portal *Portal) updateSpace(source *User) bool {
-	if portal.MXID == "" {
+	if portal.MXID == "" || portal.Plumbed {
 		return false
 	}
 	if portal.Parent != nil {
-		if portal.Parent.MXID != "" {
+		if portal.Parent.MXID == "" {
 			portal.log.Warn().Str("parent_id", portal.ParentID).Msg("Parent portal has no Matrix room, creating...")
 			err := portal.Parent.CreateMatrixRoom(source, nil)
 			if err != nil {
@@ -2446,7 +3087,7 @@ func (portal *Portal) UpdateInfo(source *User, meta *discordgo.Channel) *discord
 		if meta == nil {
 			log.Warn().Msg("No metadata found in state cache, fetching from server via user")
 			var err error
-			meta, err = source.Session.Channel(portal.Key.ChannelID)
+			meta, err = source.getChannel(portal.Key.ChannelID)
 			if err != nil {
 				log.Err(err).Msg("Failed to fetch meta via user")
 				return nil
@@ -2465,7 +3106,7 @@ func (portal *Portal) UpdateInfo(source *User, meta *discordgo.Channel) *discord
 	if portal.OtherUserID == "" && portal.IsPrivateChat() {
 		if len(meta.Recipients) == 0 {
 			var err error
-			meta, err = source.Session.Channel(meta.ID)
+			meta, err = source.getChannel(meta.ID)
 			if err != nil {
 				log.Err(err).Msg("Failed to fetch DM channel info to find other user ID")
 			}
@@ -2482,14 +3123,16 @@ func (portal *Portal) UpdateInfo(source *User, meta *discordgo.Channel) *discord
 		changed = true
 	}
 
+	// The parent must be updated first, as its name may be used in the channel name
+	changed = portal.UpdateParent(meta.ParentID) || changed
 	switch portal.Type {
 	case discordgo.ChannelTypeDM:
 		if portal.OtherUserID != "" {
 			puppet := portal.bridge.GetPuppetByID(portal.OtherUserID)
 			changed = portal.UpdateAvatarFromPuppet(puppet) || changed
-			if rel, ok := source.relationships[portal.OtherUserID]; ok && rel.Nickname != "" {
+			if nickname := source.getFriendNick(portal.OtherUserID); nickname != "" {
 				portal.FriendNick = true
-				changed = portal.UpdateNameDirect(rel.Nickname, true) || changed
+				changed = portal.UpdateNameDirect(nickname, true) || changed
 			} else {
 				portal.FriendNick = false
 				changed = portal.UpdateNameDirect(puppet.Name, false) || changed
@@ -2497,6 +3140,9 @@ func (portal *Portal) UpdateInfo(source *User, meta *discordgo.Channel) *discord
 		}
 		if portal.MXID != "" {
 			portal.syncParticipants(source, meta.Recipients)
+			if portal.OtherUserID != "" {
+				portal.syncFriendNickProfile(portal.bridge.GetPuppetByID(portal.OtherUserID), source.getFriendNick(portal.OtherUserID))
+			}
 		}
 	case discordgo.ChannelTypeGroupDM:
 		changed = portal.UpdateGroupDMAvatar(meta.Icon) || changed
@@ -2505,13 +3151,12 @@ func (portal *Portal) UpdateInfo(source *User, meta *discordgo.Channel) *discord
 		}
 		fallthrough
 	default:
-		changed = portal.UpdateName(meta) || changed
+		changed = portal.UpdateName(source, meta) || changed
 		if portal.MXID != "" {
 			portal.ensureUserInvited(source, false)
 		}
 	}
 	changed = portal.UpdateTopic(meta.Topic) || changed
-	changed = portal.UpdateParent(meta.ParentID) || changed
 	// Private channels are added to the space in User.handlePrivateChannel
 	if portal.GuildID != "" && portal.MXID != "" && portal.ExpectedSpaceID() != portal.InSpace {
 		changed = portal.updateSpace(source) || changed
@@ -18,6 +18,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"html"
 	"strconv"
@@ -32,6 +33,8 @@ import (
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/config"
 )
 
 type ConvertedMessage struct {
@@ -52,7 +55,7 @@ func (portal *Portal) createMediaFailedMessage(bridgeErr error) *event.MessageEv
 const DiscordStickerSize = 160
 
 func (portal *Portal) convertDiscordFile(ctx context.Context, typeName string, intent *appservice.IntentAPI, id, url string, content *event.MessageEventContent) *event.MessageEventContent {
-	meta := AttachmentMeta{AttachmentID: id, MimeType: content.Info.MimeType}
+	meta := AttachmentMeta{AttachmentID: id, MimeType: content.Info.MimeType, Size: int64(content.Info.Size)}
 	if typeName == "sticker" && content.Info.MimeType == "application/json" {
 		meta.Converter = portal.bridge.convertLottie
 	}
@@ -141,8 +144,10 @@ func (portal *Portal) convertDiscordSticker(ctx context.Context, intent *appserv
 }
 
 func (portal *Portal) convertDiscordAttachment(ctx context.Context, intent *appservice.IntentAPI, messageID string, att *discordgo.MessageAttachment) *ConvertedMessage {
+	filename := matrixFilename(att.Filename, att.ContentType, att.ID)
 	content := &event.MessageEventContent{
-		Body: att.Filename,
+		Body:     filename,
+		FileName: filename,
 		Info: &event.FileInfo{
 			Height:   att.Height,
 			MimeType: att.ContentType,
@@ -154,7 +159,6 @@ func (portal *Portal) convertDiscordAttachment(ctx context.Context, intent *apps
 	}
 	if att.Description != "" {
 		content.Body = att.Description
-		content.FileName = att.Filename
 	}
 
 	var extra map[string]any
@@ -179,7 +183,9 @@ func (portal *Portal) convertDiscordAttachment(ctx context.Context, intent *apps
 		content.MsgType = event.MsgFile
 	}
 	mxc := portal.bridge.DMA.AttachmentMXC(portal.Key.ChannelID, messageID, att)
-	if mxc.IsEmpty() {
+	if mxc.IsEmpty() && content.MsgType == event.MsgVideo && portal.shouldPreviewLargeVideo(att) {
+		return portal.convertDiscordLargeVideo(ctx, intent, att)
+	} else if mxc.IsEmpty() {
 		content = portal.convertDiscordFile(ctx, "attachment", intent, att.ID, att.URL, content)
 	} else {
 		content.URL = mxc.CUString()
@@ -192,10 +198,90 @@ func (portal *Portal) convertDiscordAttachment(ctx context.Context, intent *apps
 	}
 }
 
+// shouldPreviewLargeVideo checks if a video attachment is too large to reupload and should be bridged as a preview instead.
+func (portal *Portal) shouldPreviewLargeVideo(att *discordgo.MessageAttachment) bool {
+	enabled := portal.bridge.Config.Bridge.VideoEmbeds.LargeVideoPreviews
+	if portal.LargeVideoPreviews != nil {
+		enabled = *portal.LargeVideoPreviews
+	}
+	if !enabled || att.ProxyURL == "" {
+		return false
+	}
+	maxSize := portal.bridge.MediaConfig.UploadSize
+	if inlineMax := portal.bridge.Config.Bridge.VideoEmbeds.MaxInlineSize; inlineMax > 0 && (maxSize <= 0 || inlineMax < maxSize) {
+		maxSize = inlineMax
+	}
+	return maxSize > 0 && int64(att.Size) > maxSize
+}
+
+const (
+	largeVideoHTMLTitle     = `<p><a href="%s"><strong>%s</strong></a></p>`
+	largeVideoHTMLThumbnail = `<p><a href="%s"><img src="%s" alt="" title="Video thumbnail"></a></p>`
+	largeVideoHTMLInfo      = `<p><sub>%s</sub></p>`
+)
+
+func formatFileSize(size int) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := int64(size) / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// convertDiscordLargeVideo bridges a video attachment that is too large to reupload as a thumbnail
+// linking to the Discord CDN, with the size, resolution and duration of the video.
+func (portal *Portal) convertDiscordLargeVideo(ctx context.Context, intent *appservice.IntentAPI, att *discordgo.MessageAttachment) *ConvertedMessage {
+	infoParts := []string{"Video", formatFileSize(att.Size)}
+	if att.Width > 0 && att.Height > 0 {
+		infoParts = append(infoParts, fmt.Sprintf("%d×%d", att.Width, att.Height))
+	}
+	if att.DurationSeconds > 0 {
+		infoParts = append(infoParts, (time.Duration(att.DurationSeconds) * time.Second).String())
+	}
+	info := strings.Join(infoParts, " · ")
+	htmlParts := []string{fmt.Sprintf(largeVideoHTMLTitle, html.EscapeString(att.URL), html.EscapeString(att.Filename))}
+	// Discord's media proxy returns the first frame of videos when asked for an image format
+	dbFile, err := portal.bridge.copyAttachmentToMatrix(intent, att.ProxyURL+"?format=jpeg", false, AttachmentMeta{
+		AttachmentID: att.ID + "_thumbnail",
+		MimeType:     "image/jpeg",
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("attachment_id", att.ID).Msg("Failed to reupload large video thumbnail")
+	} else {
+		htmlParts = append(htmlParts, fmt.Sprintf(largeVideoHTMLThumbnail, html.EscapeString(att.URL), dbFile.MXC))
+	}
+	htmlParts = append(htmlParts, fmt.Sprintf(largeVideoHTMLInfo, html.EscapeString(info)))
+	return &ConvertedMessage{
+		AttachmentID: att.ID,
+		Type:         event.EventMessage,
+		Content: &event.MessageEventContent{
+			MsgType:       event.MsgText,
+			Body:          fmt.Sprintf("%s (%s): %s", att.Filename, info, att.URL),
+			Format:        event.FormatHTML,
+			FormattedBody: strings.Join(htmlParts, ""),
+		},
+		Extra: map[string]any{
+			"fi.mau.discord.large_video": map[string]any{
+				"url":      att.URL,
+				"size":     att.Size,
+				"width":    att.Width,
+				"height":   att.Height,
+				"duration": int(att.DurationSeconds * 1000),
+			},
+		},
+	}
+}
+
 func (portal *Portal) convertDiscordVideoEmbed(ctx context.Context, intent *appservice.IntentAPI, embed *discordgo.MessageEmbed) *ConvertedMessage {
 	attachmentID := fmt.Sprintf("video_%s", embed.URL)
 	var proxyURL string
-	if embed.Video != nil {
+	hasVideo := embed.Video != nil && embed.Video.ProxyURL != ""
+	if hasVideo {
 		proxyURL = embed.Video.ProxyURL
 	} else if embed.Thumbnail != nil {
 		proxyURL = embed.Thumbnail.ProxyURL
@@ -210,8 +296,18 @@ func (portal *Portal) convertDiscordVideoEmbed(ctx context.Context, intent *apps
 			},
 		}
 	}
-	dbFile, err := portal.bridge.copyAttachmentToMatrix(intent, proxyURL, portal.Encrypted, NoMeta)
-	if err != nil {
+	dbFile, err := portal.bridge.copyAttachmentToMatrix(intent, proxyURL, portal.Encrypted, AttachmentMeta{
+		MaxSize: portal.bridge.Config.Bridge.VideoEmbeds.MaxInlineSize,
+	})
+	if errors.Is(err, errAttachmentTooLarge) && hasVideo && embed.Thumbnail != nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Msg("Video embed is too large, bridging as thumbnail card")
+		content := format.HTMLToContent(portal.convertDiscordVideoCard(ctx, intent, embed))
+		return &ConvertedMessage{
+			AttachmentID: attachmentID,
+			Type:         event.EventMessage,
+			Content:      &content,
+		}
+	} else if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to copy video embed to Matrix")
 		return &ConvertedMessage{
 			AttachmentID: attachmentID,
@@ -227,7 +323,7 @@ func (portal *Portal) convertDiscordVideoEmbed(ctx context.Context, intent *apps
 			Size:     dbFile.Size,
 		},
 	}
-	if embed.Video != nil {
+	if hasVideo {
 		content.MsgType = event.MsgVideo
 		content.Info.Width = embed.Video.Width
 		content.Info.Height = embed.Video.Height
@@ -268,6 +364,12 @@ func (portal *Portal) convertDiscordVideoEmbed(ctx context.Context, intent *apps
 }
 
 func (portal *Portal) convertDiscordMessage(ctx context.Context, puppet *Puppet, intent *appservice.IntentAPI, msg *discordgo.Message) []*ConvertedMessage {
+	switch kind, policy := portal.promotionalPolicy(msg); policy {
+	case config.PromotionalPolicyDrop:
+		return nil
+	case config.PromotionalPolicySimplify:
+		return []*ConvertedMessage{convertPromotionalMessage(kind, msg)}
+	}
 	predictedLength := len(msg.Attachments) + len(msg.StickerItems)
 	if msg.Content != "" {
 		predictedLength++
@@ -300,7 +402,7 @@ func (portal *Portal) convertDiscordMessage(ctx context.Context, puppet *Puppet,
 	}
 	for i, embed := range msg.Embeds {
 		// Ignore non-video embeds, they're handled in convertDiscordTextMessage
-		if getEmbedType(msg, embed) != EmbedVideo {
+		if portal.getEmbedType(msg, embed) != EmbedVideo {
 			continue
 		}
 		// Discord deduplicates embeds by URL. It makes things easier for us too.
@@ -324,13 +426,33 @@ func (portal *Portal) convertDiscordMessage(ctx context.Context, puppet *Puppet,
 			Body:    fmt.Sprintf("Created a thread: %s", msg.Thread.Name),
 		}})
 	}
+	if len(parts) == 0 {
+		if part := portal.convertUnsupportedMessage(msg); part != nil {
+			parts = append(parts, part)
+		}
+	}
+	asNotice := portal.shouldBridgeAsNotice(msg)
 	for _, part := range parts {
+		if asNotice && part.Content.MsgType == event.MsgText {
+			part.Content.MsgType = event.MsgNotice
+		}
 		puppet.addWebhookMeta(part, msg)
 		puppet.addMemberMeta(part, msg)
 	}
 	return parts
 }
 
+// shouldBridgeAsNotice checks if the text parts of a message sent by a Discord bot or application
+// should be bridged as m.notice. Webhook messages are left alone, as they're usually relayed users.
+func (portal *Portal) shouldBridgeAsNotice(msg *discordgo.Message) bool {
+	if msg.Author == nil || msg.WebhookID != "" {
+		return false
+	} else if !msg.Author.Bot && msg.ApplicationID == "" {
+		return false
+	}
+	return portal.bridge.Config.Bridge.ShouldBridgeAsNotice(msg.Author.ID, msg.ApplicationID)
+}
+
 func (puppet *Puppet) addMemberMeta(part *ConvertedMessage, msg *discordgo.Message) {
 	if msg.Member == nil {
 		return
@@ -421,8 +543,37 @@ const (
 	embedHTMLFooterOnlyDate  = `<p class="discord-embed-footer"><sub>%s</sub></p>`
 	embedHTMLDate            = `<time datetime="%s">%s</time>`
 	embedFooterDateSeparator = ` • `
+
+	embedHTMLVideoThumbnail = `<p class="discord-embed-image"><a href="%s"><img src="%s" alt="" title="Video thumbnail"></a></p>`
 )
 
+// convertDiscordVideoCard converts a video embed into a clickable thumbnail and title card.
+// It's used for external video players like YouTube and for Discord-hosted videos that are too large to reupload.
+func (portal *Portal) convertDiscordVideoCard(ctx context.Context, intent *appservice.IntentAPI, embed *discordgo.MessageEmbed) string {
+	var htmlParts []string
+	if embed.Provider != nil && embed.Provider.Name != "" {
+		htmlParts = append(htmlParts, fmt.Sprintf(embedHTMLAuthorPlain, html.EscapeString(embed.Provider.Name)))
+	}
+	title := embed.Title
+	if title == "" {
+		title = embed.URL
+	}
+	htmlParts = append(htmlParts, fmt.Sprintf(embedHTMLTitleWithLink, html.EscapeString(embed.URL), html.EscapeString(title)))
+	if embed.Thumbnail != nil && embed.Thumbnail.ProxyURL != "" {
+		dbFile, err := portal.bridge.copyAttachmentToMatrix(intent, embed.Thumbnail.ProxyURL, false, NoMeta)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to reupload video thumbnail in embed")
+		} else {
+			htmlParts = append(htmlParts, fmt.Sprintf(embedHTMLVideoThumbnail, html.EscapeString(embed.URL), dbFile.MXC))
+		}
+	}
+	compiledHTML := strings.Join(htmlParts, "")
+	if embed.Color != 0 {
+		return fmt.Sprintf(embedHTMLWrapperColor, embed.Color, compiledHTML)
+	}
+	return fmt.Sprintf(embedHTMLWrapper, compiledHTML)
+}
+
 func (portal *Portal) convertDiscordRichEmbed(ctx context.Context, intent *appservice.IntentAPI, embed *discordgo.MessageEmbed, msgID string, index int) string {
 	log := zerolog.Ctx(ctx)
 	var htmlParts []string
@@ -498,7 +649,7 @@ func (portal *Portal) convertDiscordRichEmbed(ctx context.Context, intent *appse
 		if err != nil {
 			log.Warn().Err(err).Msg("Failed to parse timestamp in embed")
 		} else {
-			formattedTime = parsedTS.Format(discordTimestampStyle('F').Format())
+			formattedTime = portal.formatTimestamp(parsedTS, 'F')
 		}
 		embedDateHTML = fmt.Sprintf(embedHTMLDate, embed.Timestamp, formattedTime)
 	}
@@ -583,6 +734,8 @@ const msgInteractionTemplateHTML = `<blockquote>
 <a href="https://matrix.to/#/%s">%s</a> used <font color="#3771bb">/%s</font>
 </blockquote>`
 
+const msgInteractionLoadingHTML = `<p><em>Thinking…</em></p>`
+
 const msgComponentTemplateHTML = `<p>This message contains interactive elements. Use the Discord app to interact with the message.</p>`
 
 type BridgeEmbedType int
@@ -592,6 +745,7 @@ const (
 	EmbedRich
 	EmbedLinkPreview
 	EmbedVideo
+	EmbedIgnore
 )
 
 func isActuallyLinkPreview(embed *discordgo.MessageEmbed) bool {
@@ -625,6 +779,36 @@ func getEmbedType(msg *discordgo.Message, embed *discordgo.MessageEmbed) BridgeE
 	}
 }
 
+// getEmbedType applies the configured link policies on top of the default embed type detection.
+func (portal *Portal) getEmbedType(msg *discordgo.Message, embed *discordgo.MessageEmbed) BridgeEmbedType {
+	embedType := getEmbedType(msg, embed)
+	if embedType != EmbedLinkPreview && embedType != EmbedVideo {
+		return embedType
+	}
+	switch portal.bridge.Config.Bridge.GetLinkPolicy(embed.URL) {
+	case config.LinkPolicyLink, config.LinkPolicyStrip:
+		return EmbedIgnore
+	case config.LinkPolicyInline:
+		if (embed.Video != nil && embed.Video.ProxyURL != "") || embed.Thumbnail != nil {
+			return EmbedVideo
+		}
+	}
+	return embedType
+}
+
+// stripPolicyLinks removes links to domains whose link policy is strip.
+func (portal *Portal) stripPolicyLinks(text string) string {
+	if len(portal.bridge.Config.Bridge.LinkPolicies) == 0 {
+		return text
+	}
+	return discordLinkRegex.ReplaceAllStringFunc(text, func(link string) string {
+		if portal.bridge.Config.Bridge.GetLinkPolicy(link) == config.LinkPolicyStrip {
+			return ""
+		}
+		return link
+	})
+}
+
 func isPlainGifMessage(msg *discordgo.Message) bool {
 	if len(msg.Embeds) != 1 {
 		return false
@@ -676,9 +860,15 @@ func (portal *Portal) convertDiscordTextMessage(ctx context.Context, intent *app
 		puppet := portal.bridge.GetPuppetByID(msg.Interaction.User.ID)
 		puppet.UpdateInfo(nil, msg.Interaction.User, nil)
 		htmlParts = append(htmlParts, fmt.Sprintf(msgInteractionTemplateHTML, puppet.MXID, puppet.Name, msg.Interaction.Name))
+		// Deferred responses are sent empty first and filled in with an edit once the bot is done
+		if msg.Flags&discordgo.MessageFlagsLoading != 0 && msg.Content == "" {
+			htmlParts = append(htmlParts, msgInteractionLoadingHTML)
+		}
 	}
 	if msg.Content != "" && !isPlainGifMessage(msg) {
-		htmlParts = append(htmlParts, portal.renderDiscordMarkdownOnlyHTML(msg.Content, true))
+		if content := portal.rewriteMessageLinks(portal.stripPolicyLinks(msg.Content)); strings.TrimSpace(content) != "" {
+			htmlParts = append(htmlParts, portal.renderDiscordMarkdownOnlyHTML(content, true))
+		}
 	}
 	previews := make([]*BeeperLinkPreview, 0)
 	for i, embed := range msg.Embeds {
@@ -688,15 +878,22 @@ func (portal *Portal) convertDiscordTextMessage(ctx context.Context, intent *app
 		with := log.With().
 			Str("embed_type", string(embed.Type)).
 			Int("embed_index", i)
-		switch getEmbedType(msg, embed) {
+		switch portal.getEmbedType(msg, embed) {
 		case EmbedRich:
 			log := with.Str("computed_embed_type", "rich").Logger()
 			htmlParts = append(htmlParts, portal.convertDiscordRichEmbed(log.WithContext(ctx), intent, embed, msg.ID, i))
 		case EmbedLinkPreview:
+			if isActuallyLinkPreview(embed) && portal.bridge.Config.Bridge.VideoEmbeds.PlayerCards {
+				log := with.Str("computed_embed_type", "video card").Logger()
+				htmlParts = append(htmlParts, portal.convertDiscordVideoCard(log.WithContext(ctx), intent, embed))
+				continue
+			}
 			log := with.Str("computed_embed_type", "link preview").Logger()
 			previews = append(previews, portal.convertDiscordLinkEmbedToBeeper(log.WithContext(ctx), intent, embed))
 		case EmbedVideo:
 			// Ignore video embeds, they're handled as separate messages
+		case EmbedIgnore:
+			// Dropped by the link policy
 		default:
 			log := with.Logger()
 			log.Warn().Msg("Unknown embed type in message")
@@ -706,6 +903,9 @@ func (portal *Portal) convertDiscordTextMessage(ctx context.Context, intent *app
 	if len(msg.Components) > 0 {
 		htmlParts = append(htmlParts, msgComponentTemplateHTML)
 	}
+	if marker := portal.discordMessageMarkerHTML(msg); marker != "" && len(htmlParts) > 0 {
+		htmlParts = append(htmlParts, marker)
+	}
 
 	if len(htmlParts) == 0 {
 		return nil
@@ -727,5 +927,9 @@ func (portal *Portal) convertDiscordTextMessage(ctx context.Context, intent *app
 		content.FormattedBody = fmt.Sprintf("<strong>%s</strong>: %s", html.EscapeString(msg.Author.Username), content.FormattedBody)
 	}
 
-	return &ConvertedMessage{Type: event.EventMessage, Content: &content, Extra: extraContent}
+	converted := &ConvertedMessage{Type: event.EventMessage, Content: &content, Extra: extraContent}
+	if msg.TTS {
+		markTTSPart(converted)
+	}
+	return converted
 }
@@ -0,0 +1,232 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+const (
+	bufferOverflowBlocked = "blocked"
+	bufferOverflowDropped = "dropped"
+	bufferOverflowSpilled = "spilled"
+)
+
+// bufferOverflowNoticeInterval is the minimum time between warnings about dropped events in the same portal.
+const bufferOverflowNoticeInterval = 5 * time.Minute
+
+// spilledEventTypes are the Discord events that can be stored in the spill queue, keyed by the gateway event name.
+var spilledEventTypes = map[string]func() any{
+	"MESSAGE_CREATE":          func() any { return &discordgo.MessageCreate{} },
+	"MESSAGE_UPDATE":          func() any { return &discordgo.MessageUpdate{} },
+	"MESSAGE_DELETE":          func() any { return &discordgo.MessageDelete{} },
+	"MESSAGE_DELETE_BULK":     func() any { return &discordgo.MessageDeleteBulk{} },
+	"MESSAGE_REACTION_ADD":    func() any { return &discordgo.MessageReactionAdd{} },
+	"MESSAGE_REACTION_REMOVE": func() any { return &discordgo.MessageReactionRemove{} },
+}
+
+func spilledEventTypeName(evt any) string {
+	switch evt.(type) {
+	case *discordgo.MessageCreate:
+		return "MESSAGE_CREATE"
+	case *discordgo.MessageUpdate:
+		return "MESSAGE_UPDATE"
+	case *discordgo.MessageDelete:
+		return "MESSAGE_DELETE"
+	case *discordgo.MessageDeleteBulk:
+		return "MESSAGE_DELETE_BULK"
+	case *discordgo.MessageReactionAdd:
+		return "MESSAGE_REACTION_ADD"
+	case *discordgo.MessageReactionRemove:
+		return "MESSAGE_REACTION_REMOVE"
+	default:
+		return ""
+	}
+}
+
+// queueDiscordMessageDroppingOldest queues a Discord event, dropping the oldest buffered events if the buffer is full.
+func (portal *Portal) queueDiscordMessageDroppingOldest(log zerolog.Logger, msg portalDiscordMessage) {
+	dropped := 0
+	for {
+		select {
+		case portal.discordMessages <- msg:
+			if dropped > 0 {
+				log.Warn().Int("dropped_events", dropped).Msg("Portal message buffer is full, dropped oldest events")
+				portal.bridge.metrics.recordBufferOverflow(bufferOverflowDropped, dropped)
+				go portal.sendBufferOverflowNotice()
+			}
+			return
+		default:
+		}
+		select {
+		case <-portal.discordMessages:
+			dropped++
+		default:
+		}
+	}
+}
+
+func (portal *Portal) sendBufferOverflowNotice() {
+	portal.bufferOverflowLock.Lock()
+	if portal.MXID == "" || time.Since(portal.lastOverflowNotice) < bufferOverflowNoticeInterval {
+		portal.bufferOverflowLock.Unlock()
+		return
+	}
+	portal.lastOverflowNotice = time.Now()
+	portal.bufferOverflowLock.Unlock()
+	_, err := portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    "Some Discord messages were not bridged here because the bridge couldn't keep up with the channel.",
+	}, nil, 0)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to send buffer overflow notice")
+	}
+}
+
+// queueOrSpillDiscordMessage queues a Discord event, or stores it in the database if the buffer is full.
+// Once events have been spilled, all new events go to the database until it has been drained, so that
+// events are always handled in the order they were received.
+func (portal *Portal) queueOrSpillDiscordMessage(log zerolog.Logger, msg portalDiscordMessage) {
+	portal.bufferOverflowLock.Lock()
+	defer portal.bufferOverflowLock.Unlock()
+	if !portal.spilling {
+		select {
+		case portal.discordMessages <- msg:
+			return
+		default:
+		}
+		log.Warn().Msg("Portal message buffer is full, spilling events to the database")
+		portal.spilling = true
+		go portal.drainSpilledMessages()
+	}
+	eventType := spilledEventTypeName(msg.msg)
+	data, err := json.Marshal(msg.msg)
+	if eventType == "" || err != nil {
+		log.Error().Err(err).Type("event_type", msg.msg).Msg("Failed to spill event, dropping it")
+		return
+	}
+	seq := time.Now().UnixNano()
+	if seq <= portal.lastSpillSeq {
+		seq = portal.lastSpillSeq + 1
+	}
+	portal.lastSpillSeq = seq
+	spilled := portal.bridge.DB.SpilledMessage.New()
+	spilled.Channel = portal.Key
+	spilled.Seq = seq
+	spilled.UserMXID = msg.user.MXID.String()
+	if msg.thread != nil {
+		spilled.ThreadID = msg.thread.ID
+	}
+	spilled.EventType = eventType
+	spilled.Data = string(data)
+	spilled.ReceivedAt = msg.receivedAt.UnixMilli()
+	spilled.Delayed = msg.delayed
+	spilled.Insert()
+	portal.bridge.metrics.recordBufferOverflow(bufferOverflowSpilled, 1)
+}
+
+// drainSpilledMessages moves spilled events back into the portal's buffer in order.
+// The lock isn't held while waiting for buffer space, so new events can be spilled meanwhile.
+func (portal *Portal) drainSpilledMessages() {
+	for {
+		portal.bufferOverflowLock.Lock()
+		spilled := portal.bridge.DB.SpilledMessage.GetOldest(portal.Key)
+		if spilled == nil {
+			portal.spilling = false
+			portal.bufferOverflowLock.Unlock()
+			portal.log.Debug().Msg("Finished queuing spilled events")
+			return
+		}
+		portal.bufferOverflowLock.Unlock()
+		if msg, err := portal.decodeSpilledMessage(spilled); err != nil {
+			portal.log.Warn().Err(err).Int64("seq", spilled.Seq).Msg("Failed to decode spilled event, dropping it")
+		} else {
+			portal.discordMessages <- msg
+		}
+		spilled.Delete()
+	}
+}
+
+func (portal *Portal) decodeSpilledMessage(spilled *database.SpilledMessage) (portalDiscordMessage, error) {
+	newEvent, ok := spilledEventTypes[spilled.EventType]
+	if !ok {
+		return portalDiscordMessage{}, fmt.Errorf("unknown event type %q", spilled.EventType)
+	}
+	evt := newEvent()
+	err := json.Unmarshal([]byte(spilled.Data), evt)
+	if err != nil {
+		return portalDiscordMessage{}, fmt.Errorf("failed to parse %s event: %w", spilled.EventType, err)
+	}
+	user := portal.bridge.GetUserByMXID(id.UserID(spilled.UserMXID))
+	if user == nil {
+		return portalDiscordMessage{}, fmt.Errorf("user %s not found", spilled.UserMXID)
+	}
+	msg := portalDiscordMessage{
+		msg:        evt,
+		user:       user,
+		receivedAt: time.UnixMilli(spilled.ReceivedAt),
+		delayed:    spilled.Delayed,
+	}
+	if spilled.ThreadID != "" {
+		msg.thread = portal.bridge.GetThreadByID(spilled.ThreadID, nil)
+	}
+	return msg, nil
+}
+
+// resumeSpilledMessages starts draining events that were spilled before the bridge was restarted.
+func (br *DiscordBridge) resumeSpilledMessages() {
+	for _, key := range br.DB.SpilledMessage.GetPortals() {
+		portal := br.GetExistingPortalByID(key)
+		if portal == nil {
+			continue
+		}
+		portal.bufferOverflowLock.Lock()
+		if !portal.spilling {
+			portal.spilling = true
+			go portal.drainSpilledMessages()
+		}
+		portal.bufferOverflowLock.Unlock()
+	}
+}
+
+// portalBufferSaturation returns the fill ratio of the fullest Discord message buffer of the loaded portals,
+// and the number of portals whose buffer is full.
+func (br *DiscordBridge) portalBufferSaturation() (maxRatio float64, full int) {
+	br.portalsLock.Lock()
+	defer br.portalsLock.Unlock()
+	for _, portal := range br.portalsByID {
+		size := cap(portal.discordMessages)
+		if size == 0 {
+			continue
+		}
+		queued := len(portal.discordMessages)
+		maxRatio = max(maxRatio, float64(queued)/float64(size))
+		if queued >= size {
+			full++
+		}
+	}
+	return
+}
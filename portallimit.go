@@ -0,0 +1,111 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+type portalLimitCandidate struct {
+	portal     *Portal
+	lastActive time.Time
+}
+
+// enforcePortalLimit archives the least recently active private chat portals of the user if they have more
+// rooms than max_portals_per_user. The newly created portal is never evicted, and neither are group DMs
+// that other Matrix users on the bridge are in.
+func (user *User) enforcePortalLimit(newPortal *Portal) {
+	limit := user.bridge.Config.Bridge.MaxPortalsPerUser
+	if limit <= 0 {
+		return
+	}
+	user.portalLimitLock.Lock()
+	defer user.portalLimitLock.Unlock()
+
+	// The new portal isn't marked in the user's portal list until its creation finishes
+	count := 1
+	var candidates []portalLimitCandidate
+	for _, up := range user.GetPortals() {
+		if up.Type != database.UserPortalTypeDM || up.DiscordID == newPortal.Key.ChannelID {
+			continue
+		}
+		portal := user.GetExistingPortalByID(up.DiscordID)
+		if portal == nil || portal.MXID == "" {
+			continue
+		}
+		count++
+		if user.PortalHasOtherUsers(up.DiscordID) {
+			continue
+		}
+		var lastActive time.Time
+		if lastMessage := user.bridge.DB.Message.GetLast(portal.Key); lastMessage != nil {
+			lastActive = lastMessage.Timestamp
+		}
+		candidates = append(candidates, portalLimitCandidate{portal, lastActive})
+	}
+	if count <= limit {
+		return
+	}
+	slices.SortFunc(candidates, func(a, b portalLimitCandidate) int {
+		return a.lastActive.Compare(b.lastActive)
+	})
+	evict := candidates[:min(count-limit, len(candidates))]
+	names := make([]string, len(evict))
+	for i, candidate := range evict {
+		names[i] = candidate.portal.Name
+		if names[i] == "" {
+			names[i] = candidate.portal.Key.ChannelID
+		}
+		user.evictPortal(candidate.portal)
+	}
+	user.log.Info().
+		Int("portal_count", count).
+		Int("limit", limit).
+		Int("evicted_count", len(evict)).
+		Msg("Archived portals to stay under the per-user portal limit")
+	if user.ManagementRoom == "" || len(evict) == 0 {
+		return
+	}
+	_, err := user.bridge.Bot.SendMessageEvent(user.ManagementRoom, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body: fmt.Sprintf("You've reached the limit of %d bridged chats, so these least recently active chats were archived: %s. "+
+			"They'll get a new room if they receive new messages.", limit, strings.Join(names, ", ")),
+	})
+	if err != nil {
+		user.log.Warn().Err(err).Msg("Failed to send portal limit notice")
+	}
+}
+
+// evictPortal archives the room of a private chat portal and unlinks it, so that a new room is created
+// if the chat receives new messages.
+func (user *User) evictPortal(portal *Portal) {
+	portal.roomCreateLock.Lock()
+	defer portal.roomCreateLock.Unlock()
+	portal.log.Info().Msg("Archiving portal to stay under the per-user portal limit")
+	portal.removeFromSpace()
+	portal.archive("This chat was archived because you reached the maximum number of bridged chats. " +
+		"A new room will be created if there are new messages.")
+	user.MarkNotInPortal(portal.Key.ChannelID)
+	portal.RemoveMXID()
+}
@@ -0,0 +1,224 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// roomName returns the name that the Matrix room should have, which is the override if one is set.
+func (portal *Portal) roomName() string {
+	if portal.NameOverride != "" {
+		return portal.NameOverride
+	}
+	return portal.Name
+}
+
+func (portal *Portal) roomTopic() string {
+	if portal.TopicOverride != "" {
+		return portal.TopicOverride
+	}
+	return portal.Topic
+}
+
+func (portal *Portal) roomAvatar() id.ContentURI {
+	if !portal.AvatarOverride.IsEmpty() {
+		return portal.AvatarOverride
+	}
+	return portal.AvatarURL
+}
+
+var cmdRoomTheme = &commands.FullHandler{
+	Func: wrapCommand(fnRoomTheme),
+	Name: "room-theme",
+	Help: commands.HelpMeta{
+		Section: HelpSectionPortalManagement,
+		Description: "Override the room name, topic or avatar so that syncing from Discord doesn't change them. " +
+			"`pin` keeps the current room name, topic and avatar. The avatar can also be set by replying to an image.",
+		Args: "[name <_name_> | topic <_topic_> | avatar [_mxc URI_] | pin | reset [name|topic|avatar]]",
+	},
+	RequiresPortal:     true,
+	RequiresEventLevel: roomModerator,
+}
+
+func fnRoomTheme(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	if portal.Plumbed {
+		ce.Reply("The room metadata of plumbed rooms is never changed by the bridge")
+		return
+	} else if len(ce.Args) == 0 {
+		ce.Reply("Current overrides:\n\n* Name: %s\n* Topic: %s\n* Avatar: %s",
+			overrideText(portal.NameOverride), overrideText(portal.TopicOverride), overrideText(portal.AvatarOverride.String()))
+		return
+	}
+	value := strings.TrimSpace(strings.Join(ce.Args[1:], " "))
+	switch strings.ToLower(ce.Args[0]) {
+	case "name":
+		if value == "" {
+			ce.Reply("**Usage:** `$cmdprefix room-theme name <name>`")
+			return
+		}
+		portal.NameOverride = value
+		portal.applyNameOverride(ce)
+	case "topic":
+		if value == "" {
+			ce.Reply("**Usage:** `$cmdprefix room-theme topic <topic>`")
+			return
+		}
+		portal.TopicOverride = value
+		portal.applyTopicOverride(ce)
+	case "avatar":
+		avatar, errMsg := getOverrideAvatar(ce, value)
+		if errMsg != "" {
+			ce.Reply(errMsg)
+			return
+		}
+		portal.AvatarOverride = avatar
+		portal.applyAvatarOverride(ce)
+	case "pin":
+		portal.pinCurrentRoomMeta(ce)
+	case "reset":
+		portal.resetRoomOverrides(ce, strings.ToLower(value))
+	default:
+		ce.Reply("**Usage:** `$cmdprefix room-theme [name <name> | topic <topic> | avatar [mxc URI] | pin | reset [name|topic|avatar]]`")
+		return
+	}
+	portal.Update()
+}
+
+func overrideText(value string) string {
+	if value == "" {
+		return "not overridden"
+	}
+	return fmt.Sprintf("`%s`", value)
+}
+
+// getOverrideAvatar parses an mxc URI argument, or finds the image in the message that the command is replying to.
+// If the avatar can't be found, the returned string is the reason.
+func getOverrideAvatar(ce *WrappedCommandEvent, arg string) (id.ContentURI, string) {
+	if arg != "" {
+		avatar, err := id.ParseContentURI(arg)
+		if err != nil || avatar.IsEmpty() {
+			return id.ContentURI{}, "That doesn't look like a valid mxc URI"
+		}
+		return avatar, ""
+	} else if ce.ReplyTo == "" {
+		return id.ContentURI{}, "**Usage:** `$cmdprefix room-theme avatar <mxc URI>`, or reply to an image"
+	}
+	evt, err := ce.Portal.MainIntent().GetEvent(ce.RoomID, ce.ReplyTo)
+	if err != nil {
+		return id.ContentURI{}, fmt.Sprintf("Failed to get the replied-to message: %v", err)
+	}
+	_ = evt.Content.ParseRaw(evt.Type)
+	content := evt.Content.AsMessage()
+	if content.MsgType != event.MsgImage || content.File != nil {
+		return id.ContentURI{}, "The replied-to message isn't an unencrypted image"
+	}
+	avatar := content.URL.ParseOrIgnore()
+	if avatar.IsEmpty() {
+		return id.ContentURI{}, "The replied-to image doesn't have a valid URL"
+	}
+	return avatar, ""
+}
+
+func (portal *Portal) applyNameOverride(ce *WrappedCommandEvent) {
+	_, err := portal.MainIntent().SetRoomName(portal.MXID, portal.roomName())
+	if err != nil {
+		ce.Reply("Failed to set room name: %v", err)
+		return
+	}
+	portal.NameSet = true
+	ce.React("✅")
+}
+
+func (portal *Portal) applyTopicOverride(ce *WrappedCommandEvent) {
+	_, err := portal.MainIntent().SetRoomTopic(portal.MXID, portal.roomTopic())
+	if err != nil {
+		ce.Reply("Failed to set room topic: %v", err)
+		return
+	}
+	portal.TopicSet = true
+	ce.React("✅")
+}
+
+func (portal *Portal) applyAvatarOverride(ce *WrappedCommandEvent) {
+	_, err := portal.MainIntent().SetRoomAvatar(portal.MXID, portal.roomAvatar())
+	if err != nil {
+		ce.Reply("Failed to set room avatar: %v", err)
+		return
+	}
+	portal.AvatarSet = true
+	ce.React("✅")
+}
+
+// pinCurrentRoomMeta stores the current room name, topic and avatar as overrides,
+// so that changes made directly in the Matrix room are kept.
+func (portal *Portal) pinCurrentRoomMeta(ce *WrappedCommandEvent) {
+	intent := portal.MainIntent()
+	var nameContent event.RoomNameEventContent
+	if err := intent.StateEvent(portal.MXID, event.StateRoomName, "", &nameContent); err == nil && nameContent.Name != "" {
+		portal.NameOverride = nameContent.Name
+	}
+	var topicContent event.TopicEventContent
+	if err := intent.StateEvent(portal.MXID, event.StateTopic, "", &topicContent); err == nil && topicContent.Topic != "" {
+		portal.TopicOverride = topicContent.Topic
+	}
+	var avatarContent event.RoomAvatarEventContent
+	if err := intent.StateEvent(portal.MXID, event.StateRoomAvatar, "", &avatarContent); err == nil && !avatarContent.URL.IsEmpty() {
+		portal.AvatarOverride = avatarContent.URL
+	}
+	ce.Reply("Pinned the current room metadata. Current overrides:\n\n* Name: %s\n* Topic: %s\n* Avatar: %s",
+		overrideText(portal.NameOverride), overrideText(portal.TopicOverride), overrideText(portal.AvatarOverride.String()))
+}
+
+// resetRoomOverrides clears the given override (or all of them) and restores the metadata from Discord.
+func (portal *Portal) resetRoomOverrides(ce *WrappedCommandEvent, field string) {
+	if field != "" && field != "name" && field != "topic" && field != "avatar" {
+		ce.Reply("**Usage:** `$cmdprefix room-theme reset [name|topic|avatar]`")
+		return
+	}
+	intent := portal.MainIntent()
+	if field == "" || field == "name" {
+		portal.NameOverride = ""
+		portal.NameSet = false
+		if portal.shouldSetDMRoomMetadata() || portal.FriendNick {
+			portal.updateRoomName()
+		} else {
+			_, _ = intent.SendStateEvent(portal.MXID, event.StateRoomName, "", map[string]any{})
+		}
+	}
+	if field == "" || field == "topic" {
+		portal.TopicOverride = ""
+		portal.TopicSet = false
+		portal.updateRoomTopic()
+	}
+	if field == "" || field == "avatar" {
+		portal.AvatarOverride = id.ContentURI{}
+		portal.AvatarSet = false
+		if !portal.AvatarURL.IsEmpty() && portal.shouldSetDMRoomMetadata() {
+			portal.updateRoomAvatar()
+		} else {
+			_, _ = intent.SendStateEvent(portal.MXID, event.StateRoomAvatar, "", map[string]any{})
+		}
+	}
+	ce.React("✅")
+}
@@ -0,0 +1,113 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+var cmdStatus = &commands.FullHandler{
+	Func: wrapCommand(fnStatus),
+	Name: "status",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Set your Discord presence and custom status. The status is restored when the bridge reconnects, use `reset` to stop setting it.",
+		Args:        "<online|idle|dnd|invisible|reset> [_custom text_]",
+	},
+	RequiresLogin: true,
+}
+
+func isValidPresenceStatus(status string) bool {
+	switch discordgo.Status(status) {
+	case discordgo.StatusOnline, discordgo.StatusIdle, discordgo.StatusDoNotDisturb, discordgo.StatusInvisible:
+		return true
+	default:
+		return false
+	}
+}
+
+// applyPresence sends the presence set with the status command, or the presence derived from Matrix activity,
+// to Discord. It's called after every new gateway session, as Discord doesn't remember presences set over the gateway.
+func (user *User) applyPresence() error {
+	if user.PresenceStatus != "" {
+		return user.sendPresence(discordgo.Status(user.PresenceStatus), user.CustomStatus)
+	} else if status := user.getMatrixPresence(); status != "" {
+		return user.sendPresence(status, "")
+	}
+	return nil
+}
+
+func (user *User) sendPresence(status discordgo.Status, customStatus string) error {
+	if user.Session == nil {
+		return ErrNotConnected
+	}
+	data := discordgo.UpdateStatusData{
+		Status:     string(status),
+		Activities: []*discordgo.Activity{},
+	}
+	if status == discordgo.StatusIdle {
+		idleSince := int(time.Now().UnixMilli())
+		data.IdleSince = &idleSince
+	}
+	if customStatus != "" {
+		data.Activities = append(data.Activities, &discordgo.Activity{
+			Name:  "Custom Status",
+			Type:  discordgo.ActivityTypeCustom,
+			State: customStatus,
+		})
+	}
+	return user.Session.UpdateStatusComplex(data)
+}
+
+func fnStatus(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		if ce.User.PresenceStatus == "" {
+			ce.Reply("You haven't set a status with the bridge.\n\n**Usage:** `$cmdprefix status <online|idle|dnd|invisible|reset> [custom text]`")
+		} else if ce.User.CustomStatus != "" {
+			ce.Reply("Your status is `%s` with the custom status \"%s\"", ce.User.PresenceStatus, ce.User.CustomStatus)
+		} else {
+			ce.Reply("Your status is `%s`", ce.User.PresenceStatus)
+		}
+		return
+	}
+	status := strings.ToLower(ce.Args[0])
+	if status == "reset" {
+		ce.User.PresenceStatus = ""
+		ce.User.CustomStatus = ""
+		ce.User.Update()
+		ce.Reply("The bridge will no longer set your status. Your current status will stay until Discord resets it.")
+		return
+	} else if !isValidPresenceStatus(status) {
+		ce.Reply("**Usage:** `$cmdprefix status <online|idle|dnd|invisible|reset> [custom text]`")
+		return
+	}
+	ce.User.PresenceStatus = status
+	ce.User.CustomStatus = strings.Join(ce.Args[1:], " ")
+	ce.User.Update()
+	if !ce.User.Connected() {
+		ce.Reply("You're not connected to Discord, your status will be set when the bridge reconnects")
+	} else if err := ce.User.applyPresence(); err != nil {
+		ce.ZLog.Err(err).Msg("Failed to update presence")
+		ce.Reply("Failed to update status: %v", err)
+	} else {
+		ce.React("✅")
+	}
+}
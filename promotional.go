@@ -0,0 +1,94 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-discord/config"
+)
+
+type promotionalKind int
+
+const (
+	promotionalNone promotionalKind = iota
+	promotionalGift
+	promotionalBoost
+	promotionalSystem
+)
+
+var giftLinkRegex = regexp.MustCompile(`https?://(?:discord\.gift|(?:www\.)?discord(?:app)?\.com/gifts)/[A-Za-z0-9]+`)
+
+// getPromotionalKind checks if the message is promotional content that's usually not useful on Matrix.
+func getPromotionalKind(msg *discordgo.Message) promotionalKind {
+	switch msg.Type {
+	case discordgo.MessageTypeUserPremiumGuildSubscription, discordgo.MessageTypeUserPremiumGuildSubscriptionTierOne,
+		discordgo.MessageTypeUserPremiumGuildSubscriptionTierTwo, discordgo.MessageTypeUserPremiumGuildSubscriptionTierThree:
+		return promotionalBoost
+	}
+	if msg.Author != nil && msg.Author.System {
+		return promotionalSystem
+	} else if giftLinkRegex.MatchString(msg.Content) {
+		return promotionalGift
+	}
+	for _, embed := range msg.Embeds {
+		if giftLinkRegex.MatchString(embed.URL) {
+			return promotionalGift
+		}
+	}
+	return promotionalNone
+}
+
+// convertPromotionalMessage makes a short notice for promotional content, which replaces all embeds in the message.
+func convertPromotionalMessage(kind promotionalKind, msg *discordgo.Message) *ConvertedMessage {
+	content := &event.MessageEventContent{MsgType: event.MsgNotice}
+	switch kind {
+	case promotionalGift:
+		links := giftLinkRegex.FindAllString(msg.Content, -1)
+		for _, embed := range msg.Embeds {
+			if giftLinkRegex.MatchString(embed.URL) {
+				links = append(links, embed.URL)
+			}
+		}
+		content.Body = fmt.Sprintf("Sent a Discord gift: %s", links[0])
+	case promotionalBoost:
+		content.MsgType = event.MsgEmote
+		content.Body = "boosted the server"
+	case promotionalSystem:
+		content.Body = strings.TrimSpace(msg.Content)
+		if content.Body == "" {
+			content.Body = "Sent an announcement from Discord"
+		}
+	}
+	return &ConvertedMessage{Type: event.EventMessage, Content: content, Extra: map[string]any{
+		"fi.mau.discord.promotional": true,
+	}}
+}
+
+// promotionalPolicy returns the configured policy for the message, or keep if the message isn't promotional.
+func (portal *Portal) promotionalPolicy(msg *discordgo.Message) (promotionalKind, config.PromotionalPolicy) {
+	kind := getPromotionalKind(msg)
+	if kind == promotionalNone {
+		return kind, config.PromotionalPolicyKeep
+	}
+	return kind, portal.bridge.Config.Bridge.PromotionalContent
+}
@@ -5,9 +5,11 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"slices"
 	"strings"
 	"time"
 
@@ -40,6 +42,12 @@ const (
 	ErrCodeLoginConnectionFailed = "FI.MAU.DISCORD.LOGIN_CONN_FAILED"
 	ErrCodeLoginFailed           = "FI.MAU.DISCORD.LOGIN_FAILED"
 	ErrCodePostLoginConnFailed   = "FI.MAU.DISCORD.POST_LOGIN_CONNECTION_FAILED"
+	ErrCodeScrollbackFailed      = "FI.MAU.DISCORD.SCROLLBACK_FAILED"
+	ErrCodeChannelAlreadyBridged = "FI.MAU.DISCORD.CHANNEL_ALREADY_BRIDGED"
+	ErrCodeChannelNotBridged     = "FI.MAU.DISCORD.CHANNEL_NOT_BRIDGED"
+	ErrCodeRoomAlreadyBridged    = "FI.MAU.DISCORD.ROOM_ALREADY_BRIDGED"
+	ErrCodeNotDeactivated        = "FI.MAU.DISCORD.NOT_DEACTIVATED"
+	ErrCodeDeactivationCheck     = "FI.MAU.DISCORD.DEACTIVATION_CHECK_FAILED"
 )
 
 type ProvisioningAPI struct {
@@ -67,16 +75,31 @@ func newProvisioningAPI(br *DiscordBridge) *ProvisioningAPI {
 	r.HandleFunc("/v1/login/token", p.tokenLogin).Methods(http.MethodPost)
 	r.HandleFunc("/v1/logout", p.logout).Methods(http.MethodPost)
 	r.HandleFunc("/v1/reconnect", p.reconnect).Methods(http.MethodPost)
+	r.HandleFunc("/v1/deactivated", p.deactivated).Methods(http.MethodPost)
 
 	r.HandleFunc("/v1/guilds", p.guildsList).Methods(http.MethodGet)
 	r.HandleFunc("/v1/guilds/{guildID}", p.guildsBridge).Methods(http.MethodPost)
 	r.HandleFunc("/v1/guilds/{guildID}", p.guildsUnbridge).Methods(http.MethodDelete)
+	r.HandleFunc("/v1/guilds/{guildID}/channels", p.guildChannels).Methods(http.MethodGet)
+
+	r.HandleFunc("/v1/channels/{channelID}", p.channelPortal).Methods(http.MethodGet)
+	r.HandleFunc("/v1/channels/{channelID}/room", p.channelBridge).Methods(http.MethodPut)
+	r.HandleFunc("/v1/channels/{channelID}/room", p.channelUnbridge).Methods(http.MethodDelete)
+	r.HandleFunc("/v1/portal/{roomID}", p.roomPortal).Methods(http.MethodGet)
+
+	r.HandleFunc("/v1/latency", p.latency).Methods(http.MethodGet)
+	r.HandleFunc("/v1/bulk/import", p.bulkImport).Methods(http.MethodPost)
+
+	if br.Config.Bridge.Backfill.Scrollback.Enabled {
+		r.HandleFunc("/v1/portal/{roomID}/scrollback", p.scrollback).Methods(http.MethodPost)
+	}
 
 	if p.bridge.Config.Bridge.Provisioning.DebugEndpoints {
 		p.log.Debugln("Enabling debug API at /debug")
-		r := p.bridge.AS.Router.PathPrefix("/debug").Subrouter()
-		r.Use(p.authMiddleware)
-		r.PathPrefix("/pprof").Handler(http.DefaultServeMux)
+		p.registerDebugEndpoints(p.bridge.AS.Router.PathPrefix("/debug").Subrouter())
+	}
+	if addr := p.bridge.Config.Bridge.Provisioning.DebugListenAddress; addr != "" {
+		go p.startDebugListener(addr)
 	}
 
 	return p
@@ -239,6 +262,36 @@ func (p *ProvisioningAPI) logout(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, http.StatusOK, Response{true, msg})
 }
 
+func (p *ProvisioningAPI) deactivated(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	// The cleanup can't be undone, so make sure the user is actually deactivated
+	if p.bridge.Config.Bridge.Deactivation.AdminToken != "" {
+		deactivated, err := p.bridge.isUserDeactivated(user.MXID)
+		if err != nil {
+			p.log.Warnfln("Failed to check if %s was deactivated: %v", user.MXID, err)
+			jsonResponse(w, http.StatusBadGateway, Error{
+				Error:   fmt.Sprintf("Failed to check if the user was deactivated: %v", err),
+				ErrCode: ErrCodeDeactivationCheck,
+			})
+			return
+		} else if !deactivated {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   "The user is not deactivated on the homeserver.",
+				ErrCode: ErrCodeNotDeactivated,
+			})
+			return
+		}
+	} else if r.URL.Query().Get("confirm") != "true" {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Deactivation can't be verified without an admin token, add ?confirm=true to clean up the user anyway.",
+			ErrCode: ErrCodeNotDeactivated,
+		})
+		return
+	}
+	p.bridge.handleUserDeactivated(user)
+	jsonResponse(w, http.StatusOK, Response{true, "Cleaned up deactivated user."})
+}
+
 func (p *ProvisioningAPI) qrLogin(w http.ResponseWriter, r *http.Request) {
 	userID := r.URL.Query().Get("user_id")
 	user := p.bridge.GetUserByMXID(id.UserID(userID))
@@ -472,7 +525,8 @@ func (p *ProvisioningAPI) guildsList(w http.ResponseWriter, r *http.Request) {
 }
 
 type reqBridgeGuild struct {
-	AutoCreateChannels bool `json:"auto_create_channels"`
+	AutoCreateChannels bool   `json:"auto_create_channels"`
+	Mode               string `json:"mode,omitempty"`
 }
 
 type respBridgeGuild struct {
@@ -502,8 +556,26 @@ func (p *ProvisioningAPI) guildsBridge(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	mode := database.GuildBridgeCreateOnMessage
+	if body.Mode != "" {
+		mode = database.ParseGuildBridgingMode(body.Mode)
+		if mode <= database.GuildBridgeNothing {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   "Invalid bridging mode",
+				ErrCode: mautrix.MInvalidParam.ErrCode,
+			})
+			return
+		}
+	} else if body.AutoCreateChannels {
+		mode = database.GuildBridgeEverything
+	}
 	alreadyExists := guild.MXID == ""
-	if err := user.bridgeGuild(guildID, body.AutoCreateChannels); err != nil {
+	if err := user.bridgeGuild(guildID, mode); errors.As(err, new(*DiscordPermissionError)) {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "Your Discord account doesn't have the permissions to bridge that guild",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+	} else if err != nil {
 		p.log.Errorfln("Error bridging %s: %v", guildID, err)
 		jsonResponse(w, http.StatusInternalServerError, Error{
 			Error:   "Internal error while trying to bridge guild",
@@ -550,3 +622,277 @@ func (p *ProvisioningAPI) guildsUnbridge(w http.ResponseWriter, r *http.Request)
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
+
+func (p *ProvisioningAPI) latency(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	if user.PermissionLevel < bridgeconfig.PermissionLevelAdmin {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "Only bridge admins can view latency statistics",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+	} else {
+		jsonResponse(w, http.StatusOK, p.bridge.messageLatency.Stats())
+	}
+}
+
+type reqScrollback struct {
+	Limit int `json:"limit"`
+}
+
+type respScrollback struct {
+	Count        int  `json:"count"`
+	ReachedStart bool `json:"reached_start"`
+}
+
+func (p *ProvisioningAPI) scrollback(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	var body reqScrollback
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   "Failed to parse request body",
+				ErrCode: mautrix.MBadJSON.ErrCode,
+			})
+			return
+		}
+	}
+	maxBatch := p.bridge.Config.Bridge.Backfill.Scrollback.MaxBatch
+	if body.Limit <= 0 || body.Limit > maxBatch {
+		body.Limit = maxBatch
+	}
+
+	portal := p.bridge.GetPortalByMXID(id.RoomID(mux.Vars(r)["roomID"]))
+	if portal == nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Portal not found",
+			ErrCode: mautrix.MNotFound.ErrCode,
+		})
+		return
+	} else if !user.Connected() {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "You're not connected to Discord",
+			ErrCode: ErrCodeNotConnected,
+		})
+		return
+	}
+	count, reachedStart, err := portal.BackfillBackwards(user, body.Limit)
+	if err != nil {
+		p.log.Warnfln("Failed to fetch older history in %s for %s: %v", portal.MXID, user.MXID, err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   fmt.Sprintf("Failed to fetch older history: %v", err),
+			ErrCode: ErrCodeScrollbackFailed,
+		})
+		return
+	}
+	jsonResponse(w, http.StatusOK, respScrollback{
+		Count:        count,
+		ReachedStart: reachedStart,
+	})
+}
+
+type channelEntry struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Type     int       `json:"type"`
+	ParentID string    `json:"parent_id,omitempty"`
+	Position int       `json:"position"`
+	MXID     id.RoomID `json:"mxid,omitempty"`
+}
+
+type respChannelsList struct {
+	Channels []channelEntry `json:"channels"`
+}
+
+func (p *ProvisioningAPI) guildChannels(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	if !user.Connected() {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "You're not connected to Discord",
+			ErrCode: ErrCodeNotConnected,
+		})
+		return
+	}
+	guild, err := user.Session.State.Guild(mux.Vars(r)["guildID"])
+	if err != nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Guild not found",
+			ErrCode: mautrix.MNotFound.ErrCode,
+		})
+		return
+	}
+	var resp respChannelsList
+	resp.Channels = []channelEntry{}
+	user.Session.State.RLock()
+	channels := slices.Clone(guild.Channels)
+	user.Session.State.RUnlock()
+	for _, ch := range channels {
+		entry := channelEntry{
+			ID:       ch.ID,
+			Name:     ch.Name,
+			Type:     int(ch.Type),
+			ParentID: ch.ParentID,
+			Position: ch.Position,
+		}
+		if portal := user.GetExistingPortalByID(ch.ID); portal != nil {
+			entry.MXID = portal.MXID
+		}
+		resp.Channels = append(resp.Channels, entry)
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+type respPortalInfo struct {
+	ChannelID string    `json:"channel_id"`
+	Receiver  string    `json:"receiver,omitempty"`
+	GuildID   string    `json:"guild_id,omitempty"`
+	Name      string    `json:"name"`
+	Type      int       `json:"type"`
+	MXID      id.RoomID `json:"mxid,omitempty"`
+}
+
+func portalInfoResponse(portal *Portal) respPortalInfo {
+	return respPortalInfo{
+		ChannelID: portal.Key.ChannelID,
+		Receiver:  portal.Key.Receiver,
+		GuildID:   portal.GuildID,
+		Name:      portal.Name,
+		Type:      int(portal.Type),
+		MXID:      portal.MXID,
+	}
+}
+
+func (p *ProvisioningAPI) channelPortal(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	portal := user.GetExistingPortalByID(mux.Vars(r)["channelID"])
+	if portal == nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Portal not found",
+			ErrCode: mautrix.MNotFound.ErrCode,
+		})
+		return
+	}
+	jsonResponse(w, http.StatusOK, portalInfoResponse(portal))
+}
+
+func (p *ProvisioningAPI) roomPortal(w http.ResponseWriter, r *http.Request) {
+	portal := p.bridge.GetPortalByMXID(id.RoomID(mux.Vars(r)["roomID"]))
+	if portal == nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Portal not found",
+			ErrCode: mautrix.MNotFound.ErrCode,
+		})
+		return
+	}
+	jsonResponse(w, http.StatusOK, portalInfoResponse(portal))
+}
+
+// canManageRoom checks if the user is a bridge admin or has the moderator level required by bridge commands in the room.
+func (p *ProvisioningAPI) canManageRoom(user *User, roomID id.RoomID) bool {
+	if user.PermissionLevel >= bridgeconfig.PermissionLevelAdmin {
+		return true
+	}
+	levels, err := p.bridge.Bot.PowerLevels(roomID)
+	if err != nil {
+		p.log.Warnfln("Failed to get power levels in %s to check permissions of %s: %v", roomID, user.MXID, err)
+		return false
+	}
+	return levels.GetUserLevel(user.MXID) >= levels.GetEventLevel(roomModerator)
+}
+
+type reqBridgeChannel struct {
+	RoomID  id.RoomID `json:"room_id"`
+	Plumbed bool      `json:"plumbed,omitempty"`
+}
+
+func (p *ProvisioningAPI) channelBridge(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	channelID := mux.Vars(r)["channelID"]
+
+	var body reqBridgeChannel
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RoomID == "" {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Failed to parse request body",
+			ErrCode: mautrix.MBadJSON.ErrCode,
+		})
+		return
+	} else if !user.Connected() {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "You're not connected to Discord",
+			ErrCode: ErrCodeNotConnected,
+		})
+		return
+	}
+	ch, err := user.Session.State.Channel(channelID)
+	if err != nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Channel not found",
+			ErrCode: mautrix.MNotFound.ErrCode,
+		})
+		return
+	} else if existing := p.bridge.GetPortalByMXID(body.RoomID); existing != nil {
+		jsonResponse(w, http.StatusConflict, Error{
+			Error:   "That room is already a portal",
+			ErrCode: ErrCodeRoomAlreadyBridged,
+		})
+		return
+	}
+	portal := user.GetPortalByMeta(ch)
+	portal.roomCreateLock.Lock()
+	defer portal.roomCreateLock.Unlock()
+	if portal.MXID != "" {
+		jsonResponse(w, http.StatusConflict, Error{
+			Error:   "That channel is already bridged",
+			ErrCode: ErrCodeChannelAlreadyBridged,
+		})
+		return
+	}
+	// The bot may need to be in the room to read its power levels, so it joins first and leaves again if the check fails
+	wasJoined := p.bridge.StateStore.IsInRoom(body.RoomID, p.bridge.Bot.UserID)
+	_, err = p.bridge.Bot.JoinRoomByID(body.RoomID)
+	if err != nil {
+		p.log.Warnfln("Failed to join %s to bridge %s: %v", body.RoomID, channelID, err)
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "The bridge bot couldn't join the room",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+		return
+	} else if !p.canManageRoom(user, body.RoomID) {
+		if !wasJoined {
+			_, err = p.bridge.Bot.LeaveRoom(body.RoomID)
+			if err != nil {
+				p.log.Warnfln("Failed to leave %s after %s wasn't allowed to bridge it: %v", body.RoomID, user.MXID, err)
+			}
+		}
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "You don't have the permissions to bridge that room",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+		return
+	}
+	portal.BindRoom(user, body.RoomID, body.Plumbed)
+	jsonResponse(w, http.StatusOK, portalInfoResponse(portal))
+}
+
+func (p *ProvisioningAPI) channelUnbridge(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	portal := user.GetExistingPortalByID(mux.Vars(r)["channelID"])
+	if portal == nil || portal.MXID == "" {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "That channel is not bridged",
+			ErrCode: ErrCodeChannelNotBridged,
+		})
+		return
+	} else if !p.canManageRoom(user, portal.MXID) {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "You don't have the permissions to unbridge that room",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+		return
+	}
+	portal.roomCreateLock.Lock()
+	defer portal.roomCreateLock.Unlock()
+	portal.removeFromSpace()
+	portal.cleanup(true)
+	portal.RemoveMXID()
+	w.WriteHeader(http.StatusNoContent)
+}
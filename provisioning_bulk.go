@@ -0,0 +1,209 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+type bulkImportEntry struct {
+	UserID id.UserID `json:"user_id"`
+	Token  string    `json:"token"`
+	// TokenType is user, bot or oauth, like in the login-token command. Defaults to user.
+	TokenType    string   `json:"token_type,omitempty"`
+	Guilds       []string `json:"guilds,omitempty"`
+	BridgingMode string   `json:"bridging_mode,omitempty"`
+}
+
+type reqBulkImport struct {
+	Users []bulkImportEntry `json:"users"`
+}
+
+type bulkImportResult struct {
+	UserID    id.UserID            `json:"user_id"`
+	Success   bool                 `json:"success"`
+	Error     string               `json:"error,omitempty"`
+	DiscordID string               `json:"discord_id,omitempty"`
+	Guilds    map[string]id.RoomID `json:"guilds,omitempty"`
+	// GuildErrors contains the guilds that failed to bridge. The login is still considered successful.
+	GuildErrors map[string]string `json:"guild_errors,omitempty"`
+}
+
+type respBulkImport struct {
+	Success bool               `json:"success"`
+	Results []bulkImportResult `json:"results"`
+}
+
+// parseBulkImportCSV parses a CSV file with a header row. The user_id and token columns are required,
+// token_type, guilds and bridging_mode are optional. Multiple guilds are separated with spaces or semicolons.
+func parseBulkImportCSV(reader io.Reader) ([]bulkImportEntry, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.TrimLeadingSpace = true
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["user_id"]; !ok {
+		return nil, errors.New("missing user_id column")
+	} else if _, ok = columns["token"]; !ok {
+		return nil, errors.New("missing token column")
+	}
+	csvReader.FieldsPerRecord = len(header)
+	var entries []bulkImportEntry
+	for {
+		record, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		entries = append(entries, bulkImportEntry{
+			UserID:    id.UserID(field("user_id")),
+			Token:     field("token"),
+			TokenType: field("token_type"),
+			Guilds: strings.FieldsFunc(field("guilds"), func(r rune) bool {
+				return r == ';' || r == ' '
+			}),
+			BridgingMode: field("bridging_mode"),
+		})
+	}
+}
+
+func (p *ProvisioningAPI) bulkImport(w http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value("user").(*User)
+	if admin.PermissionLevel < bridgeconfig.PermissionLevelAdmin {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "Only bridge admins can import users",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+		return
+	}
+
+	var entries []bulkImportEntry
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		entries, err = parseBulkImportCSV(r.Body)
+	} else {
+		var body reqBulkImport
+		err = json.NewDecoder(r.Body).Decode(&body)
+		entries = body.Users
+	}
+	if err != nil {
+		p.log.Errorln("Failed to parse bulk import request:", err)
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   fmt.Sprintf("Failed to parse request body: %v", err),
+			ErrCode: mautrix.MBadJSON.ErrCode,
+		})
+		return
+	}
+
+	resp := respBulkImport{Success: true, Results: make([]bulkImportResult, len(entries))}
+	for i, entry := range entries {
+		resp.Results[i] = p.importUser(entry)
+		if !resp.Results[i].Success {
+			resp.Success = false
+		}
+	}
+	p.log.Infofln("%s imported %d users", admin.MXID, len(entries))
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+// importUser logs in a single user from a bulk import and bridges the requested guilds.
+// Users who are already logged in keep their existing session.
+func (p *ProvisioningAPI) importUser(entry bulkImportEntry) (result bulkImportResult) {
+	result.UserID = entry.UserID
+	if _, _, err := entry.UserID.Parse(); err != nil {
+		result.Error = "Invalid Matrix user ID"
+		return
+	}
+	user := p.bridge.GetUserByMXID(entry.UserID)
+	if user == nil || user.PermissionLevel < bridgeconfig.PermissionLevelUser {
+		result.Error = "User isn't allowed to use the bridge"
+		return
+	}
+	mode := database.GuildBridgeCreateOnMessage
+	if entry.BridgingMode != "" {
+		mode = database.ParseGuildBridgingMode(entry.BridgingMode)
+		if mode <= database.GuildBridgeNothing {
+			result.Error = "Invalid bridging mode"
+			return
+		}
+	}
+	log := p.log.Sub("BulkImport").Sub(user.MXID.String())
+	if !user.IsLoggedIn() {
+		if entry.TokenType == "" {
+			entry.TokenType = "user"
+		}
+		if _, err := decodeToken(entry.Token); err != nil {
+			result.Error = "Invalid token"
+			return
+		}
+		token, ok := authorizationForToken(entry.TokenType, entry.Token)
+		if !ok {
+			result.Error = "Token type must be user, bot or oauth"
+			return
+		}
+		if err := user.Login(token); err != nil {
+			log.Errorln("Failed to connect with provided token:", err)
+			result.Error = fmt.Sprintf("Failed to connect to Discord: %v", err)
+			return
+		}
+		log.Infoln("Successfully logged in")
+	} else if !user.Connected() {
+		result.Error = "User is logged in, but not connected to Discord"
+		return
+	}
+	result.Success = true
+	result.DiscordID = user.DiscordID
+	for _, guildID := range entry.Guilds {
+		if err := user.bridgeGuild(guildID, mode); err != nil {
+			log.Errorfln("Error bridging %s: %v", guildID, err)
+			if result.GuildErrors == nil {
+				result.GuildErrors = make(map[string]string)
+			}
+			result.GuildErrors[guildID] = err.Error()
+			continue
+		}
+		if result.Guilds == nil {
+			result.Guilds = make(map[string]id.RoomID)
+		}
+		result.Guilds[guildID] = p.bridge.GetGuildByID(guildID, false).MXID
+	}
+	return
+}
@@ -44,7 +44,7 @@ func (br *DiscordBridge) NewPuppet(dbPuppet *database.Puppet) *Puppet {
 	return &Puppet{
 		Puppet: dbPuppet,
 		bridge: br,
-		log:    br.ZLog.With().Str("discord_user_id", dbPuppet.ID).Logger(),
+		log:    br.moduleLevel(br.ZLog.With().Str("discord_user_id", dbPuppet.ID).Logger(), "puppet"),
 
 		MXID: br.FormatPuppetMXID(dbPuppet.ID),
 	}
@@ -173,6 +173,17 @@ func (puppet *Puppet) DefaultIntent() *appservice.IntentAPI {
 func (puppet *Puppet) IntentFor(portal *Portal) *appservice.IntentAPI {
 	if puppet.customIntent == nil || (portal.Key.Receiver != "" && portal.Key.Receiver != puppet.ID) {
 		return puppet.DefaultIntent()
+	} else if user := puppet.bridge.GetCachedUserByID(puppet.ID); user != nil {
+		switch user.getOwnMessageMode(portal.Key.ChannelID) {
+		case ownMessagesGhost:
+			return puppet.DefaultIntent()
+		case ownMessagesDoublePuppet:
+			return puppet.customIntent
+		}
+		// Users can opt out of double puppeting in guilds to keep their Matrix account out of large rooms
+		if portal.GuildID != "" && user.DMOnlyDoublePuppet {
+			return puppet.DefaultIntent()
+		}
 	}
 
 	return puppet.customIntent
@@ -291,7 +302,7 @@ func (puppet *Puppet) UpdateInfo(source *User, info *discordgo.User, message *di
 		}
 		var err error
 		puppet.log.Debug().Str("source_user", source.DiscordID).Msg("Fetching info through user to update puppet")
-		info, err = source.Session.User(puppet.ID)
+		info, err = source.getUser(puppet.ID)
 		if err != nil {
 			puppet.log.Error().Err(err).Str("source_user", source.DiscordID).Msg("Failed to fetch info through user")
 			return
@@ -0,0 +1,164 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+var cmdPurgeMyData = &commands.FullHandler{
+	Func: wrapCommand(fnPurgeMyData),
+	Name: "purge-my-data",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Log out and delete all data the bridge has stored about you.",
+		Args:        "confirm [redact]",
+	},
+}
+
+func fnPurgeMyData(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 || strings.ToLower(ce.Args[0]) != "confirm" {
+		ce.Reply("This will log you out, delete your DM portals, your per-user settings and the records of messages you sent through the bridge. " +
+			"Adding `redact` will also redact the messages you sent through the bridge in the remaining portal rooms. " +
+			"Messages on Discord are not deleted.\n\n" +
+			"**Usage:** `$cmdprefix purge-my-data confirm [redact]`")
+		return
+	}
+	redact := len(ce.Args) > 1 && strings.ToLower(ce.Args[1]) == "redact"
+	ce.Reply("Deleting your data...")
+	dmPortals, messages := ce.Bridge.purgeUserData(ce.User, redact)
+	ce.Reply("Deleted %d DM portals and %d message records. All data about you has been removed from the bridge.", dmPortals, messages)
+}
+
+// purgeUserData removes everything the bridge stores about a user, e.g. for GDPR-style deletion requests.
+// Rooms are cleaned up in the background, the returned counts only cover the database rows.
+func (br *DiscordBridge) purgeUserData(user *User, redact bool) (dmPortals, messages int) {
+	log := user.log.With().Str("action", "purge user data").Logger()
+	discordID := user.DiscordID
+	user.Logout(false)
+
+	var portalsToClean []*Portal
+	for _, portal := range br.findUserDMPortals(user, discordID) {
+		portal.Delete()
+		portalsToClean = append(portalsToClean, portal)
+	}
+
+	// Rows in the deleted DM portals are already gone, so these are only messages in shared portals
+	sentMessages := br.DB.Message.GetAllBySenderMXID(user.MXID)
+	br.DB.Message.DeleteAllBySenderMXID(user.MXID)
+	br.DB.SpilledMessage.DeleteAllByUser(user.MXID)
+
+	spaceRooms := []id.RoomID{user.SpaceRoom, user.DMSpaceRoom}
+	for _, folderSpace := range user.GetGuildFolderSpaces() {
+		spaceRooms = append(spaceRooms, folderSpace)
+	}
+	user.Delete()
+	br.usersLock.Lock()
+	if br.usersByMXID[user.MXID] == user {
+		delete(br.usersByMXID, user.MXID)
+	}
+	br.usersLock.Unlock()
+	br.managementRoomsLock.Lock()
+	if br.managementRooms[user.ManagementRoom] == user {
+		delete(br.managementRooms, user.ManagementRoom)
+	}
+	br.managementRoomsLock.Unlock()
+	log.Info().
+		Int("dm_portals", len(portalsToClean)).
+		Int("messages", len(sentMessages)).
+		Msg("Purged user data")
+
+	go func() {
+		for _, portal := range portalsToClean {
+			portal.cleanup(false)
+		}
+		for _, roomID := range spaceRooms {
+			if roomID != "" {
+				br.cleanupRoom(br.Bot, roomID, false, log)
+			}
+		}
+		if !redact {
+			return
+		}
+		for _, msg := range sentMessages {
+			portal := br.GetExistingPortalByID(msg.Channel)
+			if portal == nil || portal.MXID == "" {
+				continue
+			}
+			_, err := portal.MainIntent().RedactEvent(portal.MXID, msg.MXID, mautrix.ReqRedact{Reason: "User requested data deletion"})
+			if err != nil {
+				log.Warn().Err(err).Str("event_id", msg.MXID.String()).Msg("Failed to redact message")
+			}
+		}
+	}()
+	return len(portalsToClean), len(sentMessages)
+}
+
+// findUserDMPortals finds the DM portals of a user. The Discord ID is empty if the user already logged out,
+// so the portals are found through the user_portal table and matched by receiver where possible.
+func (br *DiscordBridge) findUserDMPortals(user *User, discordID string) []*Portal {
+	found := make(map[database.PortalKey]*Portal)
+	if discordID != "" {
+		for _, portal := range br.GetAllPortals() {
+			if portal.Key.Receiver == discordID {
+				found[portal.Key] = portal
+			}
+		}
+	}
+	for _, up := range user.GetPortals() {
+		if up.Type != database.UserPortalTypeDM {
+			continue
+		}
+		var candidates []*database.Portal
+		for _, dbPortal := range br.DB.Portal.GetAllByChannelID(up.DiscordID) {
+			if dbPortal.Key.Receiver == "" {
+				continue
+			} else if discordID != "" && dbPortal.Key.Receiver != discordID {
+				continue
+			} else if other := br.GetUserByID(dbPortal.Key.Receiver); other != nil && other.MXID != user.MXID {
+				// Group DMs have a portal per receiver, don't delete the ones of other logged in users
+				continue
+			}
+			candidates = append(candidates, dbPortal)
+		}
+		if len(candidates) > 1 {
+			user.log.Warn().
+				Str("channel_id", up.DiscordID).
+				Int("candidates", len(candidates)).
+				Msg("Not deleting DM portal with ambiguous receiver")
+			continue
+		}
+		for _, dbPortal := range candidates {
+			if _, ok := found[dbPortal.Key]; !ok {
+				if portal := br.GetExistingPortalByID(dbPortal.Key); portal != nil {
+					found[portal.Key] = portal
+				}
+			}
+		}
+	}
+	portals := make([]*Portal, 0, len(found))
+	for _, portal := range found {
+		portals = append(portals, portal)
+	}
+	return portals
+}
@@ -0,0 +1,150 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// quotaError is returned when a user exceeds one of the public instance quotas.
+// The message is shown to the user as is.
+type quotaError struct {
+	message string
+}
+
+func (qe *quotaError) Error() string {
+	return qe.message
+}
+
+type userUsage struct {
+	day         string
+	messages    int
+	mediaBytes  int64
+	lastMessage time.Time
+}
+
+// quotaTracker keeps the daily usage of users for the public instance quotas.
+type quotaTracker struct {
+	usage      map[id.UserID]*userUsage
+	signupLock sync.Mutex
+	lock       sync.Mutex
+}
+
+// get returns the usage of the user for the current day. The caller must hold the lock.
+func (qt *quotaTracker) get(userID id.UserID) *userUsage {
+	if qt.usage == nil {
+		qt.usage = make(map[id.UserID]*userUsage)
+	}
+	today := time.Now().UTC().Format(time.DateOnly)
+	usage, ok := qt.usage[userID]
+	if !ok {
+		usage = &userUsage{day: today}
+		qt.usage[userID] = usage
+	} else if usage.day != today {
+		*usage = userUsage{day: today, lastMessage: usage.lastMessage}
+	}
+	return usage
+}
+
+func (br *DiscordBridge) quotasApply(user *User) bool {
+	return br.Config.Bridge.PublicInstance.Enabled && user.PermissionLevel < bridgeconfig.PermissionLevelAdmin
+}
+
+// checkSignupQuota checks if the user can log in for the first time without exceeding signups_per_hour.
+// Users who have logged in before are never throttled.
+func (br *DiscordBridge) checkSignupQuota(user *User) error {
+	cfg := &br.Config.Bridge.PublicInstance
+	if !br.quotasApply(user) || cfg.SignupsPerHour <= 0 || !user.SignupTS.IsZero() {
+		return nil
+	}
+	br.quotas.signupLock.Lock()
+	defer br.quotas.signupLock.Unlock()
+	if br.DB.User.CountSignupsSince(time.Now().Add(-time.Hour)) >= cfg.SignupsPerHour {
+		return &quotaError{"Too many new users have logged in recently, please try again later"}
+	}
+	return nil
+}
+
+// checkMessageQuota counts a message sent to Discord towards the user's daily quota,
+// and enforces the minimum interval between messages of new users.
+func (br *DiscordBridge) checkMessageQuota(user *User) error {
+	cfg := &br.Config.Bridge.PublicInstance
+	if !br.quotasApply(user) {
+		return nil
+	}
+	br.quotas.lock.Lock()
+	defer br.quotas.lock.Unlock()
+	usage := br.quotas.get(user.MXID)
+	isNewUser := !user.SignupTS.IsZero() && time.Since(user.SignupTS) < time.Duration(cfg.NewUserPeriod)*time.Hour
+	if interval := time.Duration(cfg.NewUserMessageInterval) * time.Second; isNewUser && time.Since(usage.lastMessage) < interval {
+		return &quotaError{fmt.Sprintf("New users can only send one message every %d seconds", cfg.NewUserMessageInterval)}
+	} else if cfg.MessagesPerDay > 0 && usage.messages >= cfg.MessagesPerDay {
+		return &quotaError{fmt.Sprintf("You've reached the limit of %d messages per day", cfg.MessagesPerDay)}
+	}
+	usage.messages++
+	usage.lastMessage = time.Now()
+	return nil
+}
+
+// useMediaQuota counts uploaded media towards the user's daily quota.
+func (br *DiscordBridge) useMediaQuota(user *User, size int) error {
+	cfg := &br.Config.Bridge.PublicInstance
+	if !br.quotasApply(user) || cfg.MediaMBPerDay <= 0 {
+		return nil
+	}
+	br.quotas.lock.Lock()
+	defer br.quotas.lock.Unlock()
+	usage := br.quotas.get(user.MXID)
+	if usage.mediaBytes+int64(size) > cfg.MediaMBPerDay*1024*1024 {
+		return &quotaError{fmt.Sprintf("You've reached the limit of %d MB of media per day", cfg.MediaMBPerDay)}
+	}
+	usage.mediaBytes += int64(size)
+	return nil
+}
+
+// checkGuildQuota checks if the user can bridge another guild without exceeding max_guilds.
+func (br *DiscordBridge) checkGuildQuota(user *User, guildID string) error {
+	cfg := &br.Config.Bridge.PublicInstance
+	if !br.quotasApply(user) || cfg.MaxGuilds <= 0 {
+		return nil
+	}
+	isBridged := func(guild *Guild) bool {
+		return guild != nil && guild.MXID != "" && guild.BridgingMode > database.GuildBridgeNothing
+	}
+	if isBridged(br.GetGuildByID(guildID, false)) {
+		// Changing the bridging mode of an already bridged guild doesn't count
+		return nil
+	}
+	bridged := 0
+	for _, up := range user.GetPortals() {
+		// Every guild the user is in has a user portal entry, so only count the ones that are actually bridged
+		if up.Type == database.UserPortalTypeGuild && isBridged(br.GetGuildByID(up.DiscordID, false)) {
+			bridged++
+		}
+	}
+	if bridged >= cfg.MaxGuilds {
+		return &quotaError{fmt.Sprintf("You've reached the limit of %d bridged guilds", cfg.MaxGuilds)}
+	}
+	return nil
+}
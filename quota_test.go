@@ -0,0 +1,58 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+func TestCheckGuildQuota(t *testing.T) {
+	br := newTestBridge(t)
+	br.Config.Bridge.PublicInstance.Enabled = true
+	br.Config.Bridge.PublicInstance.MaxGuilds = 1
+
+	user := &User{User: br.DB.User.New(), bridge: br}
+	user.MXID = "@user:example.com"
+	user.Insert()
+	addGuild := func(guildID string, bridged bool) {
+		dbGuild := br.DB.Guild.New()
+		dbGuild.ID = guildID
+		if bridged {
+			dbGuild.MXID = id.RoomID(fmt.Sprintf("!%s:example.com", guildID))
+			dbGuild.BridgingMode = database.GuildBridgeEverything
+		}
+		dbGuild.Insert()
+		// Joined guilds are added to the user's space even if they aren't bridged
+		user.MarkInPortal(database.UserPortal{DiscordID: guildID, Type: database.UserPortalTypeGuild, Timestamp: time.Now()})
+	}
+	addGuild("1", true)
+	addGuild("2", false)
+
+	assert.NoError(t, br.checkGuildQuota(user, "1"), "changing the mode of a bridged guild should be allowed")
+	assert.Error(t, br.checkGuildQuota(user, "2"), "joined but unbridged guild should be refused")
+	assert.Error(t, br.checkGuildQuota(user, "3"), "unknown guild should be refused")
+
+	br.Config.Bridge.PublicInstance.MaxGuilds = 2
+	assert.NoError(t, br.checkGuildQuota(user, "2"))
+}
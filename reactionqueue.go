@@ -0,0 +1,97 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"go.mau.fi/util/variationselector"
+)
+
+// reactionEchoTimeout is how long the bridge waits for Discord to echo back a reaction change made from Matrix.
+const reactionEchoTimeout = 1 * time.Minute
+
+type reactionOpKey struct {
+	MessageID string
+	Emoji     string
+	UserID    string
+}
+
+type pendingReactionOp struct {
+	add     bool
+	expires time.Time
+}
+
+// reactionSequencer tracks reaction changes that were sent to Discord from Matrix, so that the
+// echoes of rapid toggles (add, remove, add, ...) can be recognized and dropped instead of being
+// bridged back to Matrix out of order.
+type reactionSequencer struct {
+	pending map[reactionOpKey][]pendingReactionOp
+	lock    sync.Mutex
+}
+
+func makeReactionOpKey(messageID, emoji, userID string) reactionOpKey {
+	return reactionOpKey{
+		MessageID: messageID,
+		Emoji:     variationselector.Remove(emoji),
+		UserID:    userID,
+	}
+}
+
+// Sent records that a reaction add or remove was successfully sent to Discord.
+func (rs *reactionSequencer) Sent(key reactionOpKey, add bool) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if rs.pending == nil {
+		rs.pending = make(map[reactionOpKey][]pendingReactionOp)
+	}
+	rs.pending[key] = append(rs.expire(key), pendingReactionOp{add: add, expires: time.Now().Add(reactionEchoTimeout)})
+}
+
+// IsEcho checks if an incoming Discord reaction event is the echo of an operation sent from Matrix.
+// If the incoming event doesn't match the next expected operation, the sequence is reset and the
+// event should be handled normally.
+func (rs *reactionSequencer) IsEcho(key reactionOpKey, add bool) bool {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	queue := rs.expire(key)
+	if len(queue) == 0 {
+		return false
+	} else if queue[0].add != add {
+		delete(rs.pending, key)
+		return false
+	}
+	if len(queue) == 1 {
+		delete(rs.pending, key)
+	} else {
+		rs.pending[key] = queue[1:]
+	}
+	return true
+}
+
+func (rs *reactionSequencer) expire(key reactionOpKey) []pendingReactionOp {
+	queue := rs.pending[key]
+	now := time.Now()
+	for len(queue) > 0 && queue[0].expires.Before(now) {
+		queue = queue[1:]
+	}
+	if len(queue) == 0 {
+		delete(rs.pending, key)
+	}
+	return queue
+}
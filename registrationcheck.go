@@ -0,0 +1,141 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+)
+
+// registrationSampleDiscordID is used to check that ghost user IDs are covered by the registration namespaces.
+const registrationSampleDiscordID = "123456789012345678"
+
+// namespaceMatches returns the namespaces that match the given user ID. Invalid regexes are reported as problems.
+func namespaceMatches(namespaces appservice.NamespaceList, userID id.UserID, problems *[]string) (matches []appservice.Namespace) {
+	for _, ns := range namespaces {
+		regex, err := regexp.Compile(ns.Regex)
+		if err != nil {
+			*problems = append(*problems, fmt.Sprintf("namespace regex %q is invalid: %v", ns.Regex, err))
+			continue
+		}
+		if regex.MatchString(string(userID)) {
+			matches = append(matches, ns)
+		}
+	}
+	return
+}
+
+// checkRegistrationFile compares the registration file with the one that would be generated from the config.
+func (br *DiscordBridge) checkRegistrationFile(reg *appservice.Registration) (problems []string) {
+	asCfg := &br.Config.AppService
+	if reg.ID != asCfg.ID {
+		problems = append(problems, fmt.Sprintf("id is %q, but the config has %q", reg.ID, asCfg.ID))
+	}
+	if reg.URL != asCfg.Address {
+		problems = append(problems, fmt.Sprintf("url is %q, but the config has %q", reg.URL, asCfg.Address))
+	}
+	if reg.AppToken != asCfg.ASToken {
+		problems = append(problems, "as_token doesn't match the config")
+	}
+	if reg.ServerToken != asCfg.HSToken {
+		problems = append(problems, "hs_token doesn't match the config")
+	}
+	if asCfg.EphemeralEvents && !reg.EphemeralEvents && !reg.SoruEphemeralEvents {
+		problems = append(problems, "ephemeral events are enabled in the config, but not in the registration")
+	}
+
+	botMXID := br.Bot.UserID
+	ghostMXID := br.FormatPuppetMXID(registrationSampleDiscordID)
+	for _, userID := range []id.UserID{botMXID, ghostMXID} {
+		matches := namespaceMatches(reg.Namespaces.UserIDs, userID, &problems)
+		if len(matches) == 0 {
+			problems = append(problems, fmt.Sprintf("%s isn't in any user namespace", userID))
+		} else if !matches[0].Exclusive {
+			problems = append(problems, fmt.Sprintf("the user namespace for %s isn't exclusive", userID))
+		}
+	}
+	// A namespace that's too broad would make the homeserver send events for unrelated users to the bridge
+	// and prevent those users from registering.
+	unrelatedMXID := id.NewUserID("registration-check-"+strings.ToLower(registrationSampleDiscordID), br.Config.Homeserver.Domain)
+	if matches := namespaceMatches(reg.Namespaces.UserIDs, unrelatedMXID, &problems); len(matches) > 0 {
+		problems = append(problems, fmt.Sprintf("user namespace %q also matches users who aren't bridged", matches[0].Regex))
+	}
+	return
+}
+
+// checkHomeserverRegistration checks that the homeserver has loaded a registration with the same
+// as_token and namespaces as the config.
+func (br *DiscordBridge) checkHomeserverRegistration() (problems []string, err error) {
+	// Intents would register the users, so use plain clients that only make the requested calls
+	botClient := br.AS.NewMautrixClient(br.Bot.UserID)
+	botClient.DefaultHTTPRetries = 0
+	whoami, err := botClient.Whoami()
+	if errors.Is(err, mautrix.MUnknownToken) {
+		return []string{"the homeserver doesn't accept the as_token, the registration isn't installed or is outdated"}, nil
+	} else if errors.Is(err, mautrix.MForbidden) || errors.Is(err, mautrix.MExclusive) {
+		return []string{fmt.Sprintf("the homeserver doesn't allow the bridge to use %s: %v", br.Bot.UserID, err)}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to check bot user: %w", err)
+	} else if whoami.UserID != br.Bot.UserID {
+		problems = append(problems, fmt.Sprintf("the homeserver thinks the bot is %s, but the config has %s", whoami.UserID, br.Bot.UserID))
+	}
+	// Usernames in exclusive appservice namespaces can't be registered by anyone else,
+	// so the availability check shows whether the homeserver knows about the ghost namespace.
+	ghostMXID := br.FormatPuppetMXID(registrationSampleDiscordID)
+	localpart, _, _ := ghostMXID.Parse()
+	anonClient := br.AS.NewMautrixClient("")
+	anonClient.AccessToken = ""
+	anonClient.SetAppServiceUserID = false
+	anonClient.DefaultHTTPRetries = 0
+	_, err = anonClient.RegisterAvailable(localpart)
+	if err == nil {
+		problems = append(problems, fmt.Sprintf("the homeserver's registration doesn't reserve ghost users like %s", ghostMXID))
+	} else if !errors.Is(err, mautrix.MExclusive) && !errors.Is(err, mautrix.MUserInUse) {
+		problems = append(problems, fmt.Sprintf("couldn't check if the homeserver reserves ghost users: %v", err))
+	}
+	return problems, nil
+}
+
+// maintenanceCheckRegistration validates the registration file and the registration loaded by the homeserver
+// against the config. Pass "offline" to skip the homeserver check.
+func (br *DiscordBridge) maintenanceCheckRegistration(ctx context.Context, args []string) error {
+	reg, err := appservice.LoadRegistration(br.RegistrationPath)
+	if err != nil {
+		return fmt.Errorf("failed to load registration from %s: %w", br.RegistrationPath, err)
+	}
+	problems := br.checkRegistrationFile(reg)
+	if len(args) == 0 || args[0] != "offline" {
+		hsProblems, err := br.checkHomeserverRegistration()
+		if err != nil {
+			return err
+		}
+		problems = append(problems, hsProblems...)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("registration has %d problems:\n  %s\nUse generate-registration to create a new registration from the config",
+			len(problems), strings.Join(problems, "\n  "))
+	}
+	fmt.Println("Registration matches the config")
+	return nil
+}
@@ -0,0 +1,68 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+// shouldReinviteReceiver returns true if the portal should be kept when the given user leaves it,
+// so that they can be invited back when a new message arrives.
+func (portal *Portal) shouldReinviteReceiver(user *User) bool {
+	return portal.bridge.Config.Bridge.ReinviteOnLeave.Enabled && portal.IsPrivateChat() && user.DiscordID == portal.Key.Receiver
+}
+
+// reinviteReceiver invites the receiver of a DM portal back into the room if they left it.
+// If the room can't be used anymore, e.g. because it was purged from the homeserver,
+// the portal forgets the room so that a new one is created for the incoming message.
+func (portal *Portal) reinviteReceiver(user *User, messageID string) {
+	if portal.MXID == "" || !portal.shouldReinviteReceiver(user) || portal.bridge.StateStore.IsInvited(portal.MXID, user.MXID) {
+		return
+	}
+	log := portal.log.With().Str("action", "reinvite receiver").Logger()
+	_, err := portal.MainIntent().JoinedMembers(portal.MXID)
+	if err != nil {
+		log.Warn().Err(err).Msg("DM portal room is no longer usable, creating a new room")
+		portal.RemoveMXID()
+		return
+	}
+	if !portal.ensureUserInvited(user, true) {
+		return
+	}
+	log.Info().Msg("Invited user back to DM portal they had left")
+	if portal.bridge.Config.Bridge.ReinviteOnLeave.Backfill {
+		portal.backfillAfterReinvite(user, messageID)
+	}
+}
+
+// backfillAfterReinvite bridges messages between the last bridged message and the incoming message,
+// which exist if messages failed to bridge while the user wasn't in the room.
+func (portal *Portal) backfillAfterReinvite(user *User, messageID string) {
+	limit := portal.bridge.Config.Bridge.Backfill.Limits.Missed.DM
+	lastMessage := portal.bridge.DB.Message.GetLast(portal.Key)
+	if limit == 0 || lastMessage == nil {
+		return
+	}
+	log := portal.log.With().
+		Str("action", "reinvite backfill").
+		Int("limit", limit).
+		Str("last_bridged_message", lastMessage.DiscordID).
+		Logger()
+	portal.forwardBackfillLock.Lock()
+	defer portal.forwardBackfillLock.Unlock()
+	if limit < 0 {
+		portal.backfillUnlimitedMissed(log, user, lastMessage.DiscordID, messageID, nil)
+	} else {
+		portal.backfillLimited(log, user, limit, lastMessage.DiscordID, nil)
+	}
+}
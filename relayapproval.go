@@ -0,0 +1,293 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mau.fi/util/variationselector"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// relayApprovalReaction is the reaction that moderators can put on an approval notice to approve the user.
+const relayApprovalReaction = "✅"
+
+// isRelayApproved checks if messages from the given relayed user may be sent to Discord.
+func (portal *Portal) isRelayApproved(userID id.UserID) bool {
+	if !portal.RelayApproval {
+		return true
+	}
+	approved, _ := portal.GetRelayApproval(userID)
+	return approved
+}
+
+func (portal *Portal) isRoomModerator(userID id.UserID) bool {
+	levels, err := portal.MainIntent().PowerLevels(portal.MXID)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to get power levels to check moderator rights")
+		return false
+	}
+	return levels.GetUserLevel(userID) >= levels.GetEventLevel(roomModerator)
+}
+
+// queueRelayApproval adds a new relayed user to the approval queue and asks moderators to approve them.
+func (portal *Portal) queueRelayApproval(userID id.UserID, name string) {
+	if _, found := portal.GetRelayApproval(userID); found {
+		return
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body: fmt.Sprintf(
+			"%s joined the room and must be approved by a moderator before their messages are bridged to Discord. "+
+				"React with %s or use `%s relay-approve %s` to approve them.",
+			name, relayApprovalReaction, portal.bridge.Config.Bridge.CommandPrefix, userID,
+		),
+		Mentions: &event.Mentions{},
+	}
+	resp, err := portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, content, nil, 0)
+	if err != nil {
+		portal.log.Warn().Err(err).Stringer("target_user_id", userID).Msg("Failed to send relay approval notice")
+	}
+	var noticeID id.EventID
+	if resp != nil {
+		noticeID = resp.EventID
+	}
+	portal.SetRelayApproval(userID, false, noticeID)
+}
+
+// handleRelayApprovalReaction approves a pending user if a moderator reacted to their approval notice.
+// It returns true if the reaction was to an approval notice, so that it isn't bridged to Discord.
+func (portal *Portal) handleRelayApprovalReaction(sender *User, evt *event.Event) bool {
+	reaction := evt.Content.AsReaction()
+	if reaction.RelatesTo.Type != event.RelAnnotation {
+		return false
+	}
+	userID := portal.GetPendingRelayApprovalByNotice(reaction.RelatesTo.EventID)
+	if userID == "" {
+		return false
+	} else if variationselector.Remove(reaction.RelatesTo.Key) != variationselector.Remove(relayApprovalReaction) {
+		return true
+	} else if !portal.isRoomModerator(sender.MXID) {
+		portal.log.Debug().
+			Stringer("sender_id", sender.MXID).
+			Stringer("target_user_id", userID).
+			Msg("Ignoring relay approval reaction from non-moderator")
+		return true
+	}
+	portal.SetRelayApproval(userID, true, "")
+	portal.log.Debug().
+		Stringer("sender_id", sender.MXID).
+		Stringer("target_user_id", userID).
+		Msg("Approved relayed user by reaction")
+	_, err := portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, &event.MessageEventContent{
+		MsgType:  event.MsgNotice,
+		Body:     fmt.Sprintf("%s was approved by %s", userID, sender.MXID),
+		Mentions: &event.Mentions{},
+	}, nil, 0)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to send relay approval confirmation")
+	}
+	return true
+}
+
+// handleRelayApprovalMembership queues new relayed users in portals that require approval.
+func (br *DiscordBridge) handleRelayApprovalMembership(evt *event.Event) {
+	if evt.Sender == br.Bot.UserID || br.IsGhost(evt.Sender) {
+		return
+	}
+	portal := br.GetPortalByMXID(evt.RoomID)
+	if portal == nil || !portal.RelayApproval {
+		return
+	}
+	target := id.UserID(evt.GetStateKey())
+	if !br.isRelayRosterMember(target) {
+		return
+	}
+	content := evt.Content.AsMember()
+	prevMembership := getPrevMembership(evt)
+	if content.Membership == event.MembershipJoin && prevMembership != event.MembershipJoin {
+		name := content.Displayname
+		if name == "" {
+			name = target.String()
+		}
+		portal.queueRelayApproval(target, name)
+	} else if content.Membership == event.MembershipBan {
+		portal.DeleteRelayApproval(target)
+	} else if content.Membership.IsLeaveOrBan() {
+		// Pending users are asked about again if they rejoin, but approvals are kept
+		if approved, found := portal.GetRelayApproval(target); found && !approved {
+			portal.DeleteRelayApproval(target)
+		}
+	}
+}
+
+// getPrevMembership returns the membership that a member event replaced.
+func getPrevMembership(evt *event.Event) event.Membership {
+	if evt.Unsigned.PrevContent == nil {
+		return ""
+	}
+	_ = evt.Unsigned.PrevContent.ParseRaw(evt.Type)
+	if prevContent, ok := evt.Unsigned.PrevContent.Parsed.(*event.MemberEventContent); ok {
+		return prevContent.Membership
+	}
+	return ""
+}
+
+// approveCurrentRelayMembers approves everyone who's already in the room when approvals are enabled,
+// so that only new members need to be approved.
+func (portal *Portal) approveCurrentRelayMembers() (int, error) {
+	members, err := portal.MainIntent().JoinedMembers(portal.MXID)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for userID := range members.Joined {
+		if portal.bridge.isRelayRosterMember(userID) {
+			portal.SetRelayApproval(userID, true, "")
+			count++
+		}
+	}
+	return count, nil
+}
+
+var cmdRelayApproval = &commands.FullHandler{
+	Func: wrapCommand(fnRelayApproval),
+	Name: "relay-approval",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Require moderators to approve new Matrix users before their messages are relayed to Discord",
+		Args:        "[on|off]",
+	},
+	RequiresPortal:     true,
+	RequiresEventLevel: roomModerator,
+}
+
+func fnRelayApproval(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		if !ce.Portal.RelayApproval {
+			ce.Reply("Relay approval is disabled in this room")
+			return
+		}
+		pending := ce.Portal.GetPendingRelayApprovals()
+		if len(pending) == 0 {
+			ce.Reply("Relay approval is enabled in this room, and nobody is waiting for approval")
+			return
+		}
+		items := make([]string, len(pending))
+		for i, userID := range pending {
+			items[i] = userID.String()
+		}
+		ce.Reply("Relay approval is enabled in this room. Users waiting for approval:\n\n* `%s`", strings.Join(items, "`\n* `"))
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "on", "true", "yes":
+		if ce.Portal.RelayApproval {
+			ce.Reply("Relay approval is already enabled in this room")
+			return
+		}
+		count, err := ce.Portal.approveCurrentRelayMembers()
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to get members to approve")
+			ce.Reply("Failed to get room members: %v", err)
+			return
+		}
+		ce.Portal.RelayApproval = true
+		ce.Portal.Update()
+		ce.Reply("Relay approval enabled. %d users already in the room were approved automatically", count)
+	case "off", "false", "no":
+		ce.Portal.RelayApproval = false
+		ce.Portal.Update()
+		ce.Reply("Relay approval disabled")
+	default:
+		ce.Reply("**Usage:** `$cmdprefix relay-approval [on|off]`")
+	}
+}
+
+var cmdRelayApprove = &commands.FullHandler{
+	Func: wrapCommand(fnRelayApprove),
+	Name: "relay-approve",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Approve a Matrix user, so that their messages are relayed to Discord",
+		Args:        "<_Matrix user ID_>",
+	},
+	RequiresPortal:     true,
+	RequiresEventLevel: roomModerator,
+}
+
+func fnRelayApprove(ce *WrappedCommandEvent) {
+	userID, ok := parseRelayApprovalTarget(ce, "relay-approve")
+	if !ok {
+		return
+	}
+	ce.Portal.SetRelayApproval(userID, true, "")
+	ce.Reply("Approved `%s`", userID)
+}
+
+var cmdRelayDeny = &commands.FullHandler{
+	Func: wrapCommand(fnRelayDeny),
+	Name: "relay-deny",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Deny a pending Matrix user or revoke an approval, and remove them from the room",
+		Args:        "<_Matrix user ID_>",
+	},
+	RequiresPortal:     true,
+	RequiresEventLevel: roomModerator,
+}
+
+func fnRelayDeny(ce *WrappedCommandEvent) {
+	userID, ok := parseRelayApprovalTarget(ce, "relay-deny")
+	if !ok {
+		return
+	}
+	ce.Portal.DeleteRelayApproval(userID)
+	_, err := ce.Portal.MainIntent().KickUser(ce.Portal.MXID, &mautrix.ReqKickUser{
+		UserID: userID,
+		Reason: "Not approved for bridging to Discord",
+	})
+	if err != nil {
+		ce.ZLog.Warn().Err(err).Stringer("target_user_id", userID).Msg("Failed to kick denied user")
+		ce.Reply("Denied `%s`, but failed to remove them from the room: %v", userID, err)
+	} else {
+		ce.Reply("Denied `%s` and removed them from the room", userID)
+	}
+}
+
+func parseRelayApprovalTarget(ce *WrappedCommandEvent, command string) (id.UserID, bool) {
+	if !ce.Portal.RelayApproval {
+		ce.Reply("Relay approval isn't enabled in this room. Enable it with `$cmdprefix relay-approval on`")
+		return "", false
+	} else if len(ce.Args) != 1 {
+		ce.Reply("**Usage:** `$cmdprefix %s <user ID>`", command)
+		return "", false
+	}
+	userID := id.UserID(ce.Args[0])
+	if _, _, err := userID.Parse(); err != nil {
+		ce.Reply("`%s` is not a valid Matrix user ID", ce.Args[0])
+		return "", false
+	} else if !ce.Bridge.isRelayRosterMember(userID) {
+		ce.Reply("`%s` doesn't need approval, as they're not relayed", userID)
+		return "", false
+	}
+	return userID, true
+}
@@ -0,0 +1,44 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+)
+
+// getRelayBot returns the Discord bot account that relays messages in the portal if there is no relay webhook.
+// Relay bots are only used if their owner explicitly set them up for the portal with `set-relay --bot`,
+// or by plumbing the room with their bot account.
+func (portal *Portal) getRelayBot() *User {
+	if portal.RelayBotMXID == "" || portal.GuildID == "" {
+		return nil
+	}
+	user := portal.bridge.GetCachedUserByMXID(portal.RelayBotMXID)
+	if user == nil || !user.Connected() || user.Session.IsUser {
+		return nil
+	} else if _, err := user.Session.State.Guild(portal.GuildID); err != nil {
+		return nil
+	}
+	return user
+}
+
+// addRelayBotPrefix prefixes the content of a message sent through the relay bot with the Matrix sender's name,
+// as bots can't change their name per message like webhooks can.
+func (portal *Portal) addRelayBotPrefix(sender *User, content string) string {
+	name, _ := portal.getRelayUserMeta(sender)
+	return fmt.Sprintf("**%s**: %s", escapeDiscordMarkdown(name), content)
+}
@@ -0,0 +1,131 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+const testRelayRoomID = id.RoomID("!portal:example.com")
+
+// newTestCommandEvent creates a command event in the given portal whose replies are collected into the returned slice.
+func newTestCommandEvent(t *testing.T, br *DiscordBridge, user *User, portal *Portal, args ...string) (*WrappedCommandEvent, *[]string) {
+	var replies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/send/") {
+			var content event.MessageEventContent
+			if json.NewDecoder(r.Body).Decode(&content) == nil {
+				replies = append(replies, content.Body)
+			}
+		}
+		_, _ = w.Write([]byte(`{"event_id":"$reply"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	as := appservice.Create()
+	as.HomeserverDomain = "example.com"
+	as.Registration = &appservice.Registration{AppToken: "as_token", SenderLocalpart: "discordbot"}
+	require.NoError(t, as.SetHomeserverURL(srv.URL))
+	bot := as.BotIntent()
+	as.StateStore.MarkRegistered(bot.UserID)
+	as.StateStore.SetMembership(testRelayRoomID, bot.UserID, event.MembershipJoin)
+
+	br.Bridge.Config.Bridge = &br.Config.Bridge
+	ce := &WrappedCommandEvent{
+		Event: &commands.Event{
+			Bot:     bot,
+			Bridge:  &br.Bridge,
+			RoomID:  testRelayRoomID,
+			User:    user,
+			Args:    args,
+			ZLog:    &zerolog.Logger{},
+			EventID: "$command",
+		},
+		Bridge: br,
+		User:   user,
+		Portal: portal,
+	}
+	return ce, &replies
+}
+
+func newTestRelayPortal(br *DiscordBridge) *Portal {
+	dbPortal := br.DB.Portal.New()
+	dbPortal.Key = database.NewPortalKey("2", "")
+	dbPortal.GuildID = "1"
+	dbPortal.MXID = testRelayRoomID
+	dbPortal.Insert()
+	return &Portal{Portal: dbPortal, bridge: br, log: zerolog.Nop()}
+}
+
+func newTestRelayUser(t *testing.T, br *DiscordBridge, isUser bool) *User {
+	state := discordgo.NewState()
+	require.NoError(t, state.GuildAdd(&discordgo.Guild{ID: "1"}))
+	dbUser := br.DB.User.New()
+	dbUser.MXID = "@owner:example.com"
+	return &User{User: dbUser, bridge: br, log: zerolog.Nop(), Session: &discordgo.Session{State: state, IsUser: isUser}}
+}
+
+func TestSetRelayBot(t *testing.T) {
+	t.Run("UserToken", func(t *testing.T) {
+		br := newTestBridge(t)
+		portal := newTestRelayPortal(br)
+		ce, replies := newTestCommandEvent(t, br, newTestRelayUser(t, br, true), portal, "--bot")
+		fnSetRelay(ce)
+		assert.Equal(t, []string{"Only bot accounts can be used for relaying"}, *replies)
+		assert.Empty(t, portal.RelayBotMXID)
+		assert.Empty(t, br.DB.Portal.GetByMXID(portal.MXID).RelayBotMXID)
+	})
+	t.Run("BotToken", func(t *testing.T) {
+		br := newTestBridge(t)
+		portal := newTestRelayPortal(br)
+		ce, replies := newTestCommandEvent(t, br, newTestRelayUser(t, br, false), portal, "--bot")
+		fnSetRelay(ce)
+		assert.Equal(t, []string{"Messages from Matrix users who aren't logged in will now be relayed through your bot account"}, *replies)
+		assert.Equal(t, id.UserID("@owner:example.com"), portal.RelayBotMXID)
+		assert.Equal(t, id.UserID("@owner:example.com"), br.DB.Portal.GetByMXID(portal.MXID).RelayBotMXID)
+	})
+}
+
+func TestUnsetRelayClearsBot(t *testing.T) {
+	br := newTestBridge(t)
+	portal := newTestRelayPortal(br)
+	portal.RelayWebhookID = "3"
+	portal.RelayWebhookSecret = "secret"
+	portal.RelayBotMXID = "@owner:example.com"
+	portal.Update()
+	ce, replies := newTestCommandEvent(t, br, newTestRelayUser(t, br, false), portal)
+	fnUnsetRelay(ce)
+	assert.Equal(t, []string{"Relay webhook and bot disabled"}, *replies)
+	dbPortal := br.DB.Portal.GetByMXID(portal.MXID)
+	assert.Empty(t, dbPortal.RelayWebhookID)
+	assert.Empty(t, dbPortal.RelayBotMXID)
+}
@@ -0,0 +1,77 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/id"
+)
+
+// hasRelayLevel checks if the user's power level in the room is high enough for their messages to be relayed.
+func (portal *Portal) hasRelayLevel(userID id.UserID) bool {
+	if portal.RelayMinLevel == nil {
+		return true
+	}
+	levels, err := portal.MainIntent().PowerLevels(portal.MXID)
+	if err != nil {
+		// Fail closed, as the setting exists to stop people from talking on Discord
+		portal.log.Warn().Err(err).Msg("Failed to get power levels to check relay permission")
+		return false
+	}
+	return levels.GetUserLevel(userID) >= *portal.RelayMinLevel
+}
+
+var cmdRelayLevel = &commands.FullHandler{
+	Func: wrapCommand(fnRelayLevel),
+	Name: "relay-level",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Set the power level that Matrix users need for their messages to be relayed to Discord",
+		Args:        "[<level>|off]",
+	},
+	RequiresPortal:     true,
+	RequiresEventLevel: roomModerator,
+}
+
+func fnRelayLevel(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		if ce.Portal.RelayMinLevel == nil {
+			ce.Reply("Everyone in this room can use the relay")
+		} else {
+			ce.Reply("Users need power level %d or higher to use the relay in this room", *ce.Portal.RelayMinLevel)
+		}
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "off", "none", "default":
+		ce.Portal.RelayMinLevel = nil
+		ce.Portal.Update()
+		ce.Reply("Everyone in this room can now use the relay")
+	default:
+		level, err := strconv.Atoi(ce.Args[0])
+		if err != nil {
+			ce.Reply("**Usage:** `$cmdprefix relay-level [<level>|off]`")
+			return
+		}
+		ce.Portal.RelayMinLevel = &level
+		ce.Portal.Update()
+		ce.Reply("Users now need power level %d or higher to use the relay in this room", level)
+	}
+}
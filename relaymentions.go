@@ -0,0 +1,74 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"regexp"
+	"slices"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var discordMentionRegex = regexp.MustCompile(`<@([!&]?)(\d+)>|@(everyone|here)`)
+
+// escapedMention returns a mention that renders as plain text on Discord.
+func escapedMention(name string) string {
+	return "@\u200b" + escapeDiscordMarkdown(name)
+}
+
+// escapeRelayMentions replaces mentions in a relayed message with plain text names, except for the users and roles
+// in the allowlist, and removes the escaped users from the allowed mentions. Mentions in the allowlist are always allowed.
+// @everyone and @here are only kept if they were already allowed based on the sender's power level.
+func (portal *Portal) escapeRelayMentions(content string, allowedMentions *discordgo.MessageAllowedMentions) string {
+	cfg := &portal.bridge.Config.Bridge.RelayMentionEscaping
+	if !cfg.Enabled {
+		return content
+	}
+	return discordMentionRegex.ReplaceAllStringFunc(content, func(mention string) string {
+		match := discordMentionRegex.FindStringSubmatch(mention)
+		kind, mentionID, everyone := match[1], match[2], match[3]
+		switch {
+		case everyone != "":
+			if allowedMentions != nil && slices.Contains(allowedMentions.Parse, discordgo.AllowedMentionTypeEveryone) {
+				return mention
+			}
+			return escapedMention(everyone)
+		case slices.Contains(cfg.Allowlist, mentionID):
+			if allowedMentions != nil && kind == "&" {
+				allowedMentions.Roles = appendIfNotContains(allowedMentions.Roles, mentionID)
+			} else if allowedMentions != nil {
+				allowedMentions.Users = appendIfNotContains(allowedMentions.Users, mentionID)
+			}
+			return mention
+		case kind == "&":
+			if role := portal.bridge.DB.Role.GetByID(portal.GuildID, mentionID); role != nil {
+				return escapedMention(role.Name)
+			}
+			return escapedMention(mentionID)
+		default:
+			if allowedMentions != nil {
+				allowedMentions.Users = slices.DeleteFunc(allowedMentions.Users, func(userID string) bool {
+					return userID == mentionID
+				})
+			}
+			if puppet := portal.bridge.GetPuppetByID(mentionID); puppet != nil && puppet.Name != "" {
+				return escapedMention(puppet.Name)
+			}
+			return escapedMention(mentionID)
+		}
+	})
+}
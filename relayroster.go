@@ -0,0 +1,141 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/id"
+)
+
+// relayRosterMaxNames is the maximum number of names listed in the relay roster message.
+// The rest are summarized as a count to stay well below Discord's message length limit.
+const relayRosterMaxNames = 50
+
+func (portal *Portal) buildRelayRoster() (string, error) {
+	members, err := portal.MainIntent().JoinedMembers(portal.MXID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get member list: %w", err)
+	}
+	var names []string
+	for userID, member := range members.Joined {
+		if !portal.bridge.isRelayRosterMember(userID) {
+			continue
+		}
+		name := member.DisplayName
+		if name == "" {
+			name = userID.String()
+		}
+		names = append(names, escapeDiscordMarkdown(name))
+	}
+	if len(names) == 0 {
+		return "**Matrix users in this channel:** _nobody_", nil
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	})
+	count := len(names)
+	var extra string
+	if count > relayRosterMaxNames {
+		extra = fmt.Sprintf("\n_...and %d more_", count-relayRosterMaxNames)
+		names = names[:relayRosterMaxNames]
+	}
+	return fmt.Sprintf("**Matrix users in this channel (%d):**\n• %s%s", count, strings.Join(names, "\n• "), extra), nil
+}
+
+// updateRelayRoster sends or edits the relay webhook message that lists the Matrix users in the room.
+func (portal *Portal) updateRelayRoster() {
+	if !portal.bridge.Config.Bridge.RelayRoster || portal.MXID == "" || portal.RelayWebhookID == "" {
+		return
+	}
+	portal.relayRosterLock.Lock()
+	defer portal.relayRosterLock.Unlock()
+	log := portal.log.With().Str("action", "update relay roster").Logger()
+
+	content, err := portal.buildRelayRoster()
+	if err != nil {
+		log.Err(err).Msg("Failed to build relay roster")
+		return
+	}
+	if portal.RelayRosterMessageID != "" {
+		_, err = relayClient.WebhookMessageEdit(portal.RelayWebhookID, portal.RelayWebhookSecret, portal.RelayRosterMessageID, &discordgo.WebhookEdit{
+			Content:         &content,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		var restErr *discordgo.RESTError
+		if err == nil {
+			return
+		} else if !errors.As(err, &restErr) || restErr.Response.StatusCode != http.StatusNotFound {
+			log.Err(err).Str("message_id", portal.RelayRosterMessageID).Msg("Failed to edit relay roster message")
+			return
+		}
+		log.Debug().Str("message_id", portal.RelayRosterMessageID).Msg("Relay roster message was deleted, sending a new one")
+	}
+	msg, err := relayClient.WebhookExecute(portal.RelayWebhookID, portal.RelayWebhookSecret, true, &discordgo.WebhookParams{
+		Content:         content,
+		Username:        portal.bridge.Config.AppService.Bot.Displayname,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to send relay roster message")
+		return
+	}
+	portal.RelayRosterMessageID = msg.ID
+	portal.Update()
+	log.Debug().Str("message_id", msg.ID).Msg("Sent new relay roster message")
+	portal.pinRelayRoster(msg.ID)
+}
+
+// pinRelayRoster tries to pin the roster message using the account of any logged-in user who is
+// allowed to pin messages in the channel, as webhooks can't pin their own messages.
+func (portal *Portal) pinRelayRoster(messageID string) {
+	for _, user := range portal.bridge.getAllUsersWithToken() {
+		if user.Session == nil || !user.IsLoggedIn() {
+			continue
+		}
+		perms, err := user.Session.State.UserChannelPermissions(user.DiscordID, portal.Key.ChannelID)
+		if err != nil || perms&discordgo.PermissionManageMessages == 0 {
+			continue
+		}
+		err = user.Session.ChannelMessagePin(portal.Key.ChannelID, messageID, portal.RefererOptIfUser(user.Session, "")...)
+		if err != nil {
+			portal.log.Warn().Err(err).
+				Str("message_id", messageID).
+				Str("user_id", user.MXID.String()).
+				Msg("Failed to pin relay roster message")
+			continue
+		}
+		portal.log.Debug().Str("message_id", messageID).Str("user_id", user.MXID.String()).Msg("Pinned relay roster message")
+		return
+	}
+}
+
+// isRelayRosterMember checks if the given Matrix user only reaches Discord through the relay webhook.
+// Logged-in users are always loaded at startup, so there's no need to hit the database here.
+func (br *DiscordBridge) isRelayRosterMember(userID id.UserID) bool {
+	if userID == br.Bot.UserID || br.IsGhost(userID) {
+		return false
+	} else if user := br.GetCachedUserByMXID(userID); user != nil && user.DiscordID != "" {
+		return false
+	}
+	return true
+}
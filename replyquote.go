@@ -0,0 +1,102 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	replyQuoteHTML      = `<blockquote><strong>%s</strong>: %s</blockquote>`
+	crosspostQuoteHTML  = `<blockquote>Crossposted from <a href="%s">another server</a></blockquote>`
+	replyQuoteMaxLength = 100
+)
+
+// replyQuoteSnippet returns a short single-line summary of the referenced message.
+func replyQuoteSnippet(msg *discordgo.Message) string {
+	snippet := strings.Join(strings.Fields(msg.Content), " ")
+	if snippet == "" {
+		switch {
+		case len(msg.Attachments) > 0:
+			snippet = "[attachment]"
+		case len(msg.StickerItems) > 0:
+			snippet = "[sticker]"
+		case len(msg.Embeds) > 0:
+			snippet = "[embed]"
+		default:
+			snippet = "[message]"
+		}
+	}
+	if runes := []rune(snippet); len(runes) > replyQuoteMaxLength {
+		snippet = string(runes[:replyQuoteMaxLength-1]) + "…"
+	}
+	return snippet
+}
+
+// getReplyContextQuote builds a quote of the message that a Discord message replies to or was crossposted from.
+// It's only used when the referenced message isn't in the room, so that the context isn't lost.
+func (portal *Portal) getReplyContextQuote(msg *discordgo.Message) (plain, formatted string) {
+	if msg.Flags&discordgo.MessageFlagsIsCrossPosted != 0 && msg.MessageReference != nil {
+		ref := msg.MessageReference
+		link := fmt.Sprintf("https://discord.com/channels/%s/%s/%s", ref.GuildID, ref.ChannelID, ref.MessageID)
+		return fmt.Sprintf("> Crossposted from %s", link), fmt.Sprintf(crosspostQuoteHTML, html.EscapeString(link))
+	} else if msg.ReferencedMessage != nil && msg.ReferencedMessage.Author != nil {
+		ref := msg.ReferencedMessage
+		name := portal.bridge.Config.Bridge.FormatDisplayname(ref.Author, ref.WebhookID != "", false)
+		snippet := replyQuoteSnippet(ref)
+		htmlName := portal.roleColoredName(html.EscapeString(name), ref.Author.ID, ref.Member)
+		return fmt.Sprintf("> %s: %s", name, snippet), fmt.Sprintf(replyQuoteHTML, htmlName, html.EscapeString(snippet))
+	}
+	return "", ""
+}
+
+// addReplyContextQuote adds the reply context quote to the start of the message's text part,
+// or as a separate part if the message doesn't have text.
+func (portal *Portal) addReplyContextQuote(msg *discordgo.Message, parts []*ConvertedMessage) []*ConvertedMessage {
+	if !portal.bridge.Config.Bridge.ReplyContextQuotes || len(parts) == 0 {
+		return parts
+	}
+	quotePlain, quoteHTML := portal.getReplyContextQuote(msg)
+	if quotePlain == "" {
+		return parts
+	}
+	if parts[0].Type == event.EventMessage && parts[0].AttachmentID == "" &&
+		(parts[0].Content.MsgType == event.MsgText || parts[0].Content.MsgType == event.MsgNotice) {
+		content := parts[0].Content
+		if content.Format != event.FormatHTML {
+			content.Format = event.FormatHTML
+			content.FormattedBody = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br>")
+		}
+		content.Body = quotePlain + "\n\n" + content.Body
+		content.FormattedBody = quoteHTML + content.FormattedBody
+		return parts
+	}
+	return append([]*ConvertedMessage{{
+		Type: event.EventMessage,
+		Content: &event.MessageEventContent{
+			MsgType:       event.MsgText,
+			Body:          quotePlain,
+			Format:        event.FormatHTML,
+			FormattedBody: quoteHTML,
+		},
+	}}, parts...)
+}
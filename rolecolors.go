@@ -0,0 +1,73 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// findGuildMember finds a member of the portal's guild in the state of any connected user who's in the guild.
+func (portal *Portal) findGuildMember(discordID string) *discordgo.Member {
+	for _, userID := range portal.bridge.DB.GetUsersInPortal(portal.GuildID) {
+		user := portal.bridge.GetCachedUserByMXID(userID)
+		if user == nil || user.Session == nil {
+			continue
+		}
+		if member, err := user.Session.State.Member(portal.GuildID, discordID); err == nil {
+			return member
+		}
+	}
+	return nil
+}
+
+// memberRoleColor returns the color of the highest colored role of a guild member, or 0 if the member
+// has no colored roles or isn't known. If member is nil, it's looked up from the Discord state.
+func (portal *Portal) memberRoleColor(discordID string, member *discordgo.Member) int {
+	if portal.GuildID == "" {
+		return 0
+	}
+	if member == nil {
+		member = portal.findGuildMember(discordID)
+		if member == nil {
+			return 0
+		}
+	}
+	var color, position int
+	for _, roleID := range member.Roles {
+		role := portal.bridge.DB.Role.GetByID(portal.GuildID, roleID)
+		if role != nil && role.Color != 0 && (color == 0 || role.Position > position) {
+			color = role.Color
+			position = role.Position
+		}
+	}
+	return color
+}
+
+// roleColoredName wraps an already escaped name in a font tag with the member's top role color,
+// if the role_colored_names option is enabled and the member has a colored role.
+func (portal *Portal) roleColoredName(name, discordID string, member *discordgo.Member) string {
+	if !portal.bridge.Config.Bridge.RoleColoredNames {
+		return name
+	}
+	color := portal.memberRoleColor(discordID, member)
+	if color == 0 {
+		return name
+	}
+	return fmt.Sprintf(`<font color="#%06x">%s</font>`, color, name)
+}
@@ -0,0 +1,229 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/appservice"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+const (
+	roomTagLowPriority = "m.lowpriority"
+	// bridgedRoomTagKey is added to the custom data of tags set by the bridge, so that tags added manually
+	// by the user are never removed.
+	bridgedRoomTagKey = "fi.mau.discord.bridged"
+)
+
+type guildFolder struct {
+	// The ID is null for "folders" that only contain a single guild
+	ID       json.Number `json:"id"`
+	Name     string      `json:"name"`
+	GuildIDs []string    `json:"guild_ids"`
+}
+
+// fetchGuildFolders gets the user's guild folders from the legacy user settings endpoint,
+// as the gateway only sends them as protobuf settings nowadays.
+func (user *User) fetchGuildFolders() ([]guildFolder, error) {
+	if !user.bridge.hasCapability(capabilityUserSettings) {
+		return nil, errCapabilityUnavailable
+	}
+	var resp struct {
+		GuildFolders []guildFolder `json:"guild_folders"`
+	}
+	data, err := user.Session.RequestWithBucketID("GET", discordgo.EndpointUserSettings("@me"), nil, discordgo.EndpointUserSettings(""))
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &resp)
+	return resp.GuildFolders, err
+}
+
+func (user *User) setGuildSettings(settings *discordgo.UserGuildSettings) {
+	user.roomTagsLock.Lock()
+	defer user.roomTagsLock.Unlock()
+	if user.guildSettings == nil {
+		user.guildSettings = make(map[string]*discordgo.UserGuildSettings)
+	}
+	user.guildSettings[settings.GuildID] = settings
+}
+
+// isMuted checks if the guild or channel is muted on Discord. DM settings are stored under an empty guild ID.
+func (user *User) isMuted(guildID, channelID string) bool {
+	user.roomTagsLock.Lock()
+	defer user.roomTagsLock.Unlock()
+	settings, ok := user.guildSettings[guildID]
+	if !ok {
+		return false
+	} else if guildID != "" && settings.Muted {
+		return true
+	}
+	for _, override := range settings.ChannelOverrides {
+		if override.ChannelID == channelID {
+			return override.Muted
+		}
+	}
+	return false
+}
+
+func (user *User) userGuildSettingsUpdateHandler(evt *discordgo.UserGuildSettingsUpdate) {
+	if evt.UserGuildSettings == nil {
+		return
+	}
+	user.setGuildSettings(evt.UserGuildSettings)
+	go user.syncGuildRoomTags(evt.GuildID)
+}
+
+func (user *User) roomTagIntent() *appservice.IntentAPI {
+	if !user.bridge.Config.Bridge.RoomTags.Enabled || user.Session == nil || !user.Session.IsUser {
+		return nil
+	}
+	dp := user.GetIDoublePuppet()
+	if dp == nil {
+		return nil
+	}
+	return dp.CustomIntent()
+}
+
+// syncRoomTags refreshes guild folders and updates the tags of all the user's portals.
+func (user *User) syncRoomTags() {
+	intent := user.roomTagIntent()
+	if intent == nil {
+		return
+	}
+	// Folder tags are kept as-is while the settings endpoint is unavailable, the capability probe already alerted admins
+	if user.bridge.Config.Bridge.RoomTags.FolderTags && user.bridge.hasCapability(capabilityUserSettings) {
+		folders, err := user.fetchGuildFolders()
+		if err != nil {
+			user.log.Warn().Err(err).Msg("Failed to fetch guild folders")
+		} else {
+			folderTags := make(map[string]string)
+			for _, folder := range folders {
+				if folder.Name == "" {
+					continue
+				}
+				for _, guildID := range folder.GuildIDs {
+					folderTags[guildID] = "u." + folder.Name
+				}
+			}
+			user.roomTagsLock.Lock()
+			user.guildFolderTags = folderTags
+			user.roomTagsLock.Unlock()
+		}
+	}
+	for _, userPortal := range user.GetPortals() {
+		switch userPortal.Type {
+		case database.UserPortalTypeDM:
+			portal := user.GetExistingPortalByID(userPortal.DiscordID)
+			if portal != nil {
+				user.syncPortalRoomTags(intent, portal)
+			}
+		case database.UserPortalTypeGuild:
+			for _, portal := range user.bridge.GetAllPortalsInGuild(userPortal.DiscordID) {
+				user.syncPortalRoomTags(intent, portal)
+			}
+		}
+	}
+}
+
+// syncGuildRoomTags updates the tags of portals in a single guild, or all DMs if the guild ID is empty.
+func (user *User) syncGuildRoomTags(guildID string) {
+	intent := user.roomTagIntent()
+	if intent == nil {
+		return
+	}
+	if guildID == "" {
+		for _, userPortal := range user.GetPortals() {
+			if userPortal.Type != database.UserPortalTypeDM {
+				continue
+			}
+			if portal := user.GetExistingPortalByID(userPortal.DiscordID); portal != nil {
+				user.syncPortalRoomTags(intent, portal)
+			}
+		}
+	} else if user.IsInPortal(guildID) {
+		for _, portal := range user.bridge.GetAllPortalsInGuild(guildID) {
+			user.syncPortalRoomTags(intent, portal)
+		}
+	}
+}
+
+func (user *User) syncPortalRoomTags(intent *appservice.IntentAPI, portal *Portal) {
+	if portal.MXID == "" {
+		return
+	}
+	log := user.log.With().Str("room_id", portal.MXID.String()).Logger()
+	var resp struct {
+		Tags map[string]map[string]any `json:"tags"`
+	}
+	err := intent.GetTagsWithCustomData(portal.MXID, &resp)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get room tags through double puppet")
+		return
+	}
+	wanted := make(map[string]struct{})
+	if user.bridge.Config.Bridge.RoomTags.MutedLowPriority && user.isMuted(portal.GuildID, portal.Key.ChannelID) {
+		wanted[roomTagLowPriority] = struct{}{}
+	}
+	user.roomTagsLock.Lock()
+	folderTag := user.guildFolderTags[portal.GuildID]
+	user.roomTagsLock.Unlock()
+	if folderTag != "" {
+		wanted[folderTag] = struct{}{}
+	}
+	for tag := range wanted {
+		if _, ok := resp.Tags[tag]; ok {
+			continue
+		}
+		err = intent.AddTagWithCustomData(portal.MXID, tag, map[string]any{bridgedRoomTagKey: true})
+		if err != nil {
+			log.Warn().Err(err).Str("tag", tag).Msg("Failed to add room tag through double puppet")
+		}
+	}
+	for tag, data := range resp.Tags {
+		if _, ok := wanted[tag]; ok {
+			continue
+		} else if bridged, _ := data[bridgedRoomTagKey].(bool); !bridged {
+			continue
+		}
+		err = intent.RemoveTag(portal.MXID, tag)
+		if err != nil {
+			log.Warn().Err(err).Str("tag", tag).Msg("Failed to remove room tag through double puppet")
+		}
+	}
+}
+
+// startRoomTagResync periodically resyncs room tags of all connected users.
+func (br *DiscordBridge) startRoomTagResync() {
+	cfg := &br.Config.Bridge.RoomTags
+	if !cfg.Enabled || cfg.ResyncInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(cfg.ResyncInterval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, user := range br.getAllUsersWithToken() {
+			if user.Connected() {
+				user.syncRoomTags()
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/mautrix-discord/config"
+)
+
+// s3UnsignedPayload is used as the payload hash when the body is streamed without hashing it first.
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// s3Client uploads and downloads objects from S3-compatible storage using path-style URLs
+// and AWS signature v4, so that no SDK is needed.
+type s3Client struct {
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+func newS3Client(cfg config.S3Config) *s3Client {
+	return &s3Client{
+		endpoint:  strings.TrimSuffix(cfg.Endpoint, "/"),
+		region:    cfg.Region,
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+	}
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signature signs the canonical request and returns the hex signature along with the credential scope.
+func (sc *s3Client) signature(now time.Time, canonicalRequest string) (signature, scope string) {
+	date := now.Format("20060102")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	scope = fmt.Sprintf("%s/%s/s3/aws4_request", date, sc.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", now.Format("20060102T150405Z"), scope, hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+sc.secretKey), date)
+	key = hmacSHA256(key, sc.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign)), scope
+}
+
+// sign adds the AWS signature v4 headers to the request. The payload hash must be the hex SHA-256 of the body,
+// or s3UnsignedPayload if the body isn't hashed.
+func (sc *s3Client) sign(req *http.Request, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	signature, scope := sc.signature(now, strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", req.URL.Host, payloadHash, amzDate),
+		signedHeaders,
+		payloadHash,
+	}, "\n"))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sc.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+// presign creates a URL that can be used to download the object without credentials until it expires.
+func (sc *s3Client) presign(name string, expiry time.Duration) (string, error) {
+	parsed, err := url.Parse(sc.objectURL(name))
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	_, scope := sc.signature(now, "")
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", sc.accessKey+"/"+scope)
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expiry.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	// Encode sorts the keys, which is what the canonical query string needs
+	canonicalQuery := strings.ReplaceAll(query.Encode(), "+", "%20")
+	signature, _ := sc.signature(now, strings.Join([]string{
+		http.MethodGet,
+		parsed.EscapedPath(),
+		canonicalQuery,
+		fmt.Sprintf("host:%s\n", parsed.Host),
+		"host",
+		s3UnsignedPayload,
+	}, "\n"))
+	parsed.RawQuery = canonicalQuery + "&X-Amz-Signature=" + signature
+	return parsed.String(), nil
+}
+
+func (sc *s3Client) objectURL(name string) string {
+	return sc.endpoint + "/" + url.PathEscape(name)
+}
+
+func (sc *s3Client) put(ctx context.Context, name string, body io.Reader, size int64, contentType, payloadHash string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, sc.objectURL(name), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	sc.sign(req, payloadHash)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+func (sc *s3Client) uploadFile(ctx context.Context, name, path, contentType string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return fmt.Errorf("failed to hash file: %w", err)
+	} else if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return sc.put(ctx, name, file, size, contentType, hex.EncodeToString(hasher.Sum(nil)))
+}
+
+func (sc *s3Client) download(ctx context.Context, name string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sc.objectURL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	emptyHash := sha256.Sum256(nil)
+	sc.sign(req, hex.EncodeToString(emptyHash[:]))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,79 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix"
+)
+
+var errScrollbackUnsupported = errors.New("the homeserver doesn't support inserting history")
+
+// BackfillBackwards fetches Discord messages older than the oldest bridged message in the portal
+// and inserts them at the start of the Matrix room. This is used to fetch history on demand when
+// a Matrix client paginates past the oldest bridged message.
+//
+// The returned bool is true if the start of the Discord channel was reached.
+func (portal *Portal) BackfillBackwards(source *User, limit int) (int, bool, error) {
+	if !portal.bridge.SpecVersions.Supports(mautrix.BeeperFeatureBatchSending) {
+		return 0, false, errScrollbackUnsupported
+	}
+	portal.backwardBackfillLock.Lock()
+	defer portal.backwardBackfillLock.Unlock()
+	log := portal.log.With().
+		Str("action", "backward backfill").
+		Str("room_id", portal.MXID.String()).
+		Int("limit", limit).
+		Logger()
+
+	var before string
+	if firstMessage := portal.bridge.DB.Message.GetFirst(portal.Key); firstMessage != nil {
+		before = firstMessage.DiscordID
+	}
+	var messages []*discordgo.Message
+	var reachedStart bool
+	for len(messages) < limit {
+		log.Debug().Str("before_id", before).Msg("Fetching messages for backward backfill")
+		chunkSize := min(messageFetchChunkSize, limit-len(messages))
+		chunk, err := source.Session.ChannelMessages(portal.Key.ChannelID, chunkSize, before, "", "", portal.RefererOptIfUser(source.Session, portal.Key.ChannelID)...)
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to fetch messages: %w", err)
+		}
+		messages = append(messages, chunk...)
+		if len(chunk) < chunkSize {
+			reachedStart = true
+			break
+		}
+		before = chunk[len(chunk)-1].ID
+	}
+	if len(messages) == 0 {
+		return 0, reachedStart, nil
+	}
+	sort.Sort(MessageSlice(messages))
+	log.Info().
+		Int("count", len(messages)).
+		Bool("reached_start", reachedStart).
+		Msg("Collected messages for backward backfill")
+	if !portal.batchSend(log, source, messages, nil, false) {
+		return 0, false, fmt.Errorf("failed to send history to Matrix")
+	}
+	return len(messages), reachedStart, nil
+}
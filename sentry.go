@@ -0,0 +1,208 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mau.fi/util/random"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/config"
+)
+
+// sentryReporter sends errors to Sentry using the store endpoint, so that no SDK is needed.
+type sentryReporter struct {
+	bridge    *DiscordBridge
+	storeURL  string
+	authValue string
+}
+
+type sentryException struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger"`
+	Platform    string            `json:"platform"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Message     string            `json:"message,omitempty"`
+	Fingerprint []string          `json:"fingerprint"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Extra       map[string]any    `json:"extra,omitempty"`
+	Exception   struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+}
+
+// newSentryReporter parses a DSN in the https://<key>@<host>/<project ID> format.
+func newSentryReporter(br *DiscordBridge, dsn string) (*sentryReporter, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	} else if parsed.User == nil || parsed.User.Username() == "" {
+		return nil, errors.New("missing public key")
+	}
+	projectID := strings.Trim(parsed.Path, "/")
+	if projectID == "" {
+		return nil, errors.New("missing project ID")
+	}
+	return &sentryReporter{
+		bridge:   br,
+		storeURL: fmt.Sprintf("%s://%s/api/%s/store/", parsed.Scheme, parsed.Host, projectID),
+		authValue: fmt.Sprintf("Sentry sentry_version=7, sentry_client=mautrix-discord/%s, sentry_key=%s",
+			br.Version, parsed.User.Username()),
+	}, nil
+}
+
+func (br *DiscordBridge) initSentry() {
+	cfg := &br.Config.Bridge.Sentry
+	if cfg.DSN == "" {
+		return
+	}
+	reporter, err := newSentryReporter(br, cfg.DSN)
+	if err != nil {
+		br.ZLog.Err(err).Msg("Invalid Sentry DSN, error reporting is disabled")
+		return
+	}
+	br.sentry = reporter
+	br.ZLog.Info().Msg("Sentry error reporting enabled")
+}
+
+// hashIdentifier hashes user and portal identifiers, so that events can be correlated without sending them to Sentry.
+func hashIdentifier(identifier string) string {
+	if identifier == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(identifier))
+	return hex.EncodeToString(hash[:8])
+}
+
+// innermostErrorType returns the type of the deepest wrapped error, which is more stable than the message.
+func innermostErrorType(err error) string {
+	for {
+		next := errors.Unwrap(err)
+		if next == nil {
+			return fmt.Sprintf("%T", err)
+		}
+		err = next
+	}
+}
+
+// ReportError sends an error to Sentry if it's enabled. Events are fingerprinted by the handler and error type,
+// so that the same failure is grouped across deployments regardless of the IDs in the message.
+func (br *DiscordBridge) ReportError(handler string, err error, portal *Portal, userID string) {
+	if err == nil {
+		return
+	}
+	br.metrics.recordHandlerError(handler)
+	hookEvt := HookEvent{Type: config.HookError, UserID: id.UserID(userID), Handler: handler, Error: err.Error()}
+	if portal != nil {
+		hookEvt.RoomID = portal.MXID
+		hookEvt.GuildID = portal.GuildID
+		hookEvt.ChannelID = portal.Key.ChannelID
+	}
+	br.fireHook(hookEvt)
+	if br.sentry == nil {
+		return
+	}
+	errType := innermostErrorType(err)
+	br.sentry.send(handler, errType, err.Error(), portal, userID, nil)
+}
+
+// ReportPanic sends a recovered panic to Sentry if it's enabled.
+func (br *DiscordBridge) ReportPanic(handler string, recovered any, stack []byte, userID string) {
+	br.metrics.recordHandlerError(handler)
+	br.fireHook(HookEvent{Type: config.HookError, UserID: id.UserID(userID), Handler: handler, Error: fmt.Sprint(recovered)})
+	if br.sentry == nil {
+		return
+	}
+	br.sentry.send(handler, fmt.Sprintf("panic %T", recovered), fmt.Sprint(recovered), nil, userID, map[string]any{
+		"stack": string(stack),
+	})
+}
+
+func (sr *sentryReporter) send(handler, errType, message string, portal *Portal, userID string, extra map[string]any) {
+	cfg := &sr.bridge.Config.Bridge.Sentry
+	evt := sentryEvent{
+		EventID:     hex.EncodeToString(random.Bytes(16)),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Level:       "error",
+		Logger:      handler,
+		Platform:    "go",
+		Release:     sr.bridge.Version,
+		Environment: cfg.Environment,
+		Message:     message,
+		Fingerprint: []string{handler, errType},
+		Tags:        map[string]string{"handler": handler},
+		Extra:       extra,
+	}
+	evt.Exception.Values = []sentryException{{Type: errType, Value: message}}
+	if userID != "" {
+		evt.Tags["user_hash"] = hashIdentifier(userID)
+	}
+	if portal != nil {
+		evt.Tags["portal_hash"] = hashIdentifier(portal.Key.String())
+		evt.Tags["portal_type"] = fmt.Sprintf("%d", portal.Type)
+		if portal.GuildID != "" {
+			evt.Tags["guild_hash"] = hashIdentifier(portal.GuildID)
+		}
+	}
+	go sr.post(&evt)
+}
+
+func (sr *sentryReporter) post(evt *sentryEvent) {
+	log := sr.bridge.ZLog.With().Str("action", "send sentry event").Logger()
+	body, err := json.Marshal(evt)
+	if err != nil {
+		log.Err(err).Msg("Failed to marshal Sentry event")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sr.storeURL, bytes.NewReader(body))
+	if err != nil {
+		log.Err(err).Msg("Failed to prepare Sentry request")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", sr.authValue)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to send Sentry event")
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Warn().Int("status_code", resp.StatusCode).Msg("Sentry returned non-success status")
+	}
+}
@@ -0,0 +1,44 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"hash/fnv"
+)
+
+// shardForID deterministically maps a Discord ID to a shard index.
+func shardForID(id string, count int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return int(h.Sum32() % uint32(count))
+}
+
+// ownsChannel checks if this bridge process is responsible for bridging events from the given Discord channel.
+// Threads should be checked using the ID of their parent channel, as they're bridged into the parent portal.
+func (br *DiscordBridge) ownsChannel(channelID string) bool {
+	shards := &br.Config.Bridge.Sharding
+	if shards.Count <= 1 {
+		return true
+	}
+	return shardForID(channelID, shards.Count) == shards.Index
+}
+
+// ownsGuild checks if this bridge process is responsible for guild-level events that aren't tied to a channel,
+// like the guild admin notices. Those are sharded by the guild ID, so that only one process sends them.
+func (br *DiscordBridge) ownsGuild(guildID string) bool {
+	return br.ownsChannel(guildID)
+}
@@ -0,0 +1,409 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	flag "maunium.net/go/mauflag"
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+var restoreSnapshotPath = flag.Make().LongKey("restore-snapshot").Usage("Restore a database snapshot (local path or s3:<name>) before starting").String()
+
+const (
+	// exitCodeSnapshotRestoreFailed is used when the snapshot given with --restore-snapshot couldn't be restored.
+	exitCodeSnapshotRestoreFailed = 31
+
+	snapshotFilePrefix = "mautrix-discord-"
+	snapshotFileSuffix = ".json.gz"
+	snapshotS3Prefix   = "s3:"
+)
+
+// snapshotTableColumns are the tables and columns included in snapshots, in an order that satisfies foreign keys when restoring.
+// Columns are listed explicitly so that secrets never end up in snapshots: user tables aren't included as they contain
+// Discord tokens, puppet double puppeting access tokens are left out, and so are relay webhooks, which need to be set up
+// again after restoring.
+var snapshotTableColumns = []struct {
+	name    string
+	columns []string
+}{{
+	name: "guild",
+	columns: []string{
+		"dcid", "mxid", "plain_name", "name", "name_set", "avatar", "avatar_url", "avatar_set", "bridging_mode", "notice_room",
+	},
+}, {
+	name: "portal",
+	columns: []string{
+		"dcid", "receiver", "other_user_id", "type", "dc_guild_id", "dc_parent_id", "dc_parent_receiver",
+		"mxid", "plain_name", "name", "name_set", "friend_nick", "topic", "topic_set", "avatar", "avatar_url", "avatar_set",
+		"encrypted", "in_space", "first_event_id", "large_video_previews", "plumbed", "relay_approval", "max_message_age",
+		"skipped_until", "relay_min_level", "name_override", "topic_override", "avatar_override",
+		"paused_to_matrix", "paused_to_discord", "features_hash", "relay_bot_mxid",
+	},
+}, {
+	name: "thread",
+	columns: []string{
+		"dcid", "parent_chan_id", "root_msg_dcid", "root_msg_mxid", "creation_notice_mxid", "archived", "locked", "receiver",
+	},
+}, {
+	name: "puppet",
+	columns: []string{
+		"id", "name", "name_set", "avatar", "avatar_url", "avatar_set", "contact_info_set",
+		"global_name", "username", "discriminator", "is_bot", "is_webhook", "is_application", "custom_mxid",
+	},
+}, {
+	name: "message",
+	columns: []string{
+		"dcid", "dc_attachment_id", "dc_chan_id", "dc_chan_receiver", "dc_sender", "timestamp", "dc_edit_timestamp",
+		"dc_thread_id", "mxid", "sender_mxid",
+	},
+}}
+
+// snapshotOrderBy makes sure that parent rows are restored before their children.
+var snapshotOrderBy = map[string]string{
+	"portal": " ORDER BY dc_parent_id IS NOT NULL",
+}
+
+var snapshotColumnRegex = regexp.MustCompile(`^[a-z_]+$`)
+
+type snapshotTable struct {
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+}
+
+type snapshotFile struct {
+	Version   int                       `json:"version"`
+	CreatedAt time.Time                 `json:"created_at"`
+	Tables    map[string]*snapshotTable `json:"tables"`
+}
+
+func (br *DiscordBridge) getDatabaseVersion(ctx context.Context) (version int, err error) {
+	err = br.Bridge.DB.QueryRowContext(ctx, fmt.Sprintf("SELECT version FROM %s", br.Bridge.DB.VersionTable)).Scan(&version)
+	return
+}
+
+// writeSnapshotTable writes the given columns of a table as a JSON object. Rows are encoded one by one,
+// so that the whole message table doesn't need to fit in memory.
+func writeSnapshotTable(ctx context.Context, tx *sql.Tx, w *bufio.Writer, table string, columns []string) (int, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s%s", strings.Join(columns, ", "), table, snapshotOrderBy[table])
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columnsJSON, _ := json.Marshal(columns)
+	_, _ = fmt.Fprintf(w, `{"columns":%s,"rows":[`, columnsJSON)
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	count := 0
+	for rows.Next() {
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return count, err
+		}
+		for i, val := range values {
+			// Text columns may be returned as bytes, which would otherwise be encoded as base64
+			if bytesVal, ok := val.([]byte); ok {
+				values[i] = string(bytesVal)
+			}
+		}
+		rowJSON, err := json.Marshal(values)
+		if err != nil {
+			return count, err
+		}
+		if count > 0 {
+			_ = w.WriteByte(',')
+		}
+		_, _ = w.Write(rowJSON)
+		count++
+	}
+	_, _ = w.WriteString("]}")
+	return count, rows.Err()
+}
+
+// writeSnapshot writes a gzipped snapshot of the tables to w using a single transaction, so that the tables are consistent.
+func (br *DiscordBridge) writeSnapshot(ctx context.Context, w io.Writer) error {
+	opts := &sql.TxOptions{}
+	if br.Bridge.DB.Dialect == dbutil.Postgres {
+		opts = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	}
+	tx, err := br.Bridge.DB.RawDB.BeginTx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	var version int
+	err = tx.QueryRowContext(ctx, fmt.Sprintf("SELECT version FROM %s", br.Bridge.DB.VersionTable)).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("failed to get database version: %w", err)
+	}
+	gzipWriter := gzip.NewWriter(w)
+	bufWriter := bufio.NewWriter(gzipWriter)
+	createdAt, _ := json.Marshal(time.Now().UTC())
+	_, _ = fmt.Fprintf(bufWriter, `{"version":%d,"created_at":%s,"tables":{`, version, createdAt)
+	for i, table := range snapshotTableColumns {
+		if i > 0 {
+			_ = bufWriter.WriteByte(',')
+		}
+		_, _ = fmt.Fprintf(bufWriter, `%q:`, table.name)
+		count, err := writeSnapshotTable(ctx, tx, bufWriter, table.name, table.columns)
+		if err != nil {
+			return fmt.Errorf("failed to export %s table: %w", table.name, err)
+		}
+		br.ZLog.Debug().Str("table", table.name).Int("rows", count).Msg("Exported table to snapshot")
+	}
+	_, _ = bufWriter.WriteString("}}")
+	if err = bufWriter.Flush(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+// createSnapshot writes a new snapshot to the snapshot directory and uploads it to S3 if configured.
+func (br *DiscordBridge) createSnapshot(ctx context.Context) (string, error) {
+	cfg := &br.Config.Bridge.Snapshots
+	err := os.MkdirAll(cfg.Directory, 0700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	name := snapshotFilePrefix + time.Now().UTC().Format("20060102T150405Z") + snapshotFileSuffix
+	finalPath := filepath.Join(cfg.Directory, name)
+	tempPath := finalPath + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	err = br.writeSnapshot(ctx, file)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return "", err
+	}
+	err = os.Rename(tempPath, finalPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to move snapshot into place: %w", err)
+	}
+	if cfg.S3.Endpoint != "" {
+		err = newS3Client(br.Config.Bridge.Snapshots.S3).uploadFile(ctx, name, finalPath, "application/gzip")
+		if err != nil {
+			return finalPath, fmt.Errorf("failed to upload snapshot to S3: %w", err)
+		}
+	}
+	br.pruneSnapshots()
+	return finalPath, nil
+}
+
+// pruneSnapshots deletes the oldest local snapshots beyond the configured number to keep.
+func (br *DiscordBridge) pruneSnapshots() {
+	cfg := &br.Config.Bridge.Snapshots
+	if cfg.Keep <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(cfg.Directory)
+	if err != nil {
+		br.ZLog.Warn().Err(err).Msg("Failed to list snapshots to prune")
+		return
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), snapshotFilePrefix) && strings.HasSuffix(entry.Name(), snapshotFileSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	// The timestamp format sorts chronologically
+	slices.Sort(names)
+	for len(names) > cfg.Keep {
+		err = os.Remove(filepath.Join(cfg.Directory, names[0]))
+		if err != nil {
+			br.ZLog.Warn().Err(err).Str("snapshot", names[0]).Msg("Failed to delete old snapshot")
+		}
+		names = names[1:]
+	}
+}
+
+func (br *DiscordBridge) startSnapshots() {
+	cfg := &br.Config.Bridge.Snapshots
+	if cfg.Interval <= 0 {
+		return
+	}
+	log := br.ZLog.With().Str("action", "scheduled snapshot").Logger()
+	ticker := time.NewTicker(time.Duration(cfg.Interval) * time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		start := time.Now()
+		path, err := br.createSnapshot(context.Background())
+		if err != nil {
+			log.Err(err).Msg("Failed to create database snapshot")
+		} else {
+			log.Info().Str("path", path).Dur("duration", time.Since(start)).Msg("Created database snapshot")
+		}
+	}
+}
+
+// readSnapshot reads a snapshot from a local file, or from S3 if the path has the s3: prefix.
+func (br *DiscordBridge) readSnapshot(ctx context.Context, path string) (*snapshotFile, error) {
+	var reader io.ReadCloser
+	if name, isS3 := strings.CutPrefix(path, snapshotS3Prefix); isS3 {
+		if br.Config.Bridge.Snapshots.S3.Endpoint == "" {
+			return nil, errors.New("S3 snapshot storage isn't configured")
+		}
+		var err error
+		reader, err = newS3Client(br.Config.Bridge.Snapshots.S3).download(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download snapshot: %w", err)
+		}
+	} else {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		reader = file
+	}
+	defer reader.Close()
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open gzip stream: %w", err)
+	}
+	var snapshot snapshotFile
+	decoder := json.NewDecoder(gzipReader)
+	decoder.UseNumber()
+	err = decoder.Decode(&snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+	return &snapshot, nil
+}
+
+func snapshotValue(val any) any {
+	if number, ok := val.(json.Number); ok {
+		if intVal, err := number.Int64(); err == nil {
+			return intVal
+		}
+		floatVal, _ := number.Float64()
+		return floatVal
+	}
+	return val
+}
+
+// restoreSnapshot inserts all rows from a snapshot that don't exist in the database yet.
+func (br *DiscordBridge) restoreSnapshot(ctx context.Context, path string) error {
+	log := br.ZLog.With().Str("action", "restore snapshot").Str("path", path).Logger()
+	snapshot, err := br.readSnapshot(ctx, path)
+	if err != nil {
+		return err
+	}
+	currentVersion, err := br.getDatabaseVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get database version: %w", err)
+	} else if snapshot.Version > currentVersion {
+		return fmt.Errorf("snapshot is from a newer database schema (v%d > v%d)", snapshot.Version, currentVersion)
+	}
+	log.Info().
+		Time("created_at", snapshot.CreatedAt).
+		Int("snapshot_version", snapshot.Version).
+		Msg("Restoring database snapshot")
+	tx, err := br.Bridge.DB.RawDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	for _, tableColumns := range snapshotTableColumns {
+		tableName := tableColumns.name
+		table, ok := snapshot.Tables[tableName]
+		if !ok {
+			continue
+		}
+		placeholders := make([]string, len(table.Columns))
+		for i, column := range table.Columns {
+			if !snapshotColumnRegex.MatchString(column) {
+				return fmt.Errorf("invalid column name %q in %s table", column, tableName)
+			}
+			placeholders[i] = fmt.Sprintf("$%d", i+1)
+		}
+		query := fmt.Sprintf(
+			"INSERT INTO %s (%s) VALUES (%s) ON CONFLICT DO NOTHING",
+			tableName, strings.Join(table.Columns, ", "), strings.Join(placeholders, ", "),
+		)
+		inserted := 0
+		for _, row := range table.Rows {
+			if len(row) != len(table.Columns) {
+				return fmt.Errorf("row in %s table has %d values, expected %d", tableName, len(row), len(table.Columns))
+			}
+			args := make([]any, len(row))
+			for i, val := range row {
+				args[i] = snapshotValue(val)
+			}
+			res, err := tx.ExecContext(ctx, query, args...)
+			if err != nil {
+				return fmt.Errorf("failed to restore row in %s table: %w", tableName, err)
+			}
+			if affected, _ := res.RowsAffected(); affected > 0 {
+				inserted++
+			}
+		}
+		log.Info().Str("table", tableName).Int("rows", len(table.Rows)).Int("inserted", inserted).Msg("Restored table")
+	}
+	return tx.Commit()
+}
+
+var cmdSnapshot = &commands.FullHandler{
+	Func: wrapCommand(fnSnapshot),
+	Name: "snapshot",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "Create a database snapshot for disaster recovery now.",
+	},
+	RequiresAdmin: true,
+}
+
+func fnSnapshot(ce *WrappedCommandEvent) {
+	ce.Reply("Creating snapshot in the background...")
+	go func() {
+		path, err := ce.Bridge.createSnapshot(context.Background())
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to create snapshot")
+			ce.Reply("Failed to create snapshot: %v", err)
+		} else {
+			ce.Reply("Created snapshot `%s`", path)
+		}
+	}()
+}
@@ -0,0 +1,57 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotExcludesSecrets(t *testing.T) {
+	br := newTestBridge(t)
+	_, err := br.Bridge.DB.Exec(`
+		INSERT INTO portal (dcid, receiver, type, plain_name, name, name_set, friend_nick, topic, topic_set, avatar, avatar_url,
+		                    avatar_set, encrypted, in_space, first_event_id, relay_webhook_id, relay_webhook_secret)
+		VALUES ('123', '', 0, '', 'general', false, false, '', false, '', '', false, false, '', '', '456', 'webhook-secret-token')
+	`)
+	require.NoError(t, err)
+	_, err = br.Bridge.DB.Exec(`
+		INSERT INTO puppet (id, name, avatar, avatar_url, custom_mxid, access_token, next_batch)
+		VALUES ('789', 'tulir', '', '', '@tulir:example.com', 'puppet-secret-token', 'batch-secret-token')
+	`)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, br.writeSnapshot(context.Background(), &buf))
+	gzipReader, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	data, err := io.ReadAll(gzipReader)
+	require.NoError(t, err)
+
+	snapshot := string(data)
+	assert.Contains(t, snapshot, "general")
+	assert.Contains(t, snapshot, "@tulir:example.com")
+	for _, secret := range []string{"webhook-secret-token", "puppet-secret-token", "batch-secret-token", "access_token", "relay_webhook_secret"} {
+		assert.NotContains(t, snapshot, secret)
+	}
+}
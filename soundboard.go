@@ -0,0 +1,172 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+)
+
+// soundboardEffectDedupWindow is how long an identical effect is ignored for, as every logged-in user
+// in the channel receives the same event.
+const soundboardEffectDedupWindow = 5 * time.Second
+
+type voiceChannelEffect struct {
+	ChannelID string           `json:"channel_id"`
+	GuildID   string           `json:"guild_id"`
+	UserID    string           `json:"user_id"`
+	Emoji     *discordgo.Emoji `json:"emoji"`
+	// Default sounds have integer IDs, guild sounds have string snowflakes
+	SoundID     json.Number `json:"sound_id"`
+	SoundVolume float64     `json:"sound_volume"`
+}
+
+type soundboardSound struct {
+	SoundID   json.Number `json:"sound_id"`
+	Name      string      `json:"name"`
+	EmojiName string      `json:"emoji_name"`
+}
+
+type soundboardEffectKey struct {
+	userID  string
+	soundID string
+}
+
+func (user *User) voiceChannelEffectHandler(effect *voiceChannelEffect) {
+	if effect.SoundID == "" || !user.bridge.Config.Bridge.SoundboardNotices {
+		// Plain emoji effects aren't bridged
+		return
+	}
+	portal := user.GetExistingPortalByID(effect.ChannelID)
+	if portal == nil || portal.MXID == "" || !user.bridge.ownsChannel(portal.Key.ChannelID) {
+		return
+	}
+	if !portal.markSoundboardEffect(soundboardEffectKey{userID: effect.UserID, soundID: effect.SoundID.String()}) {
+		return
+	}
+	go portal.handleDiscordSoundboardEffect(user, effect)
+}
+
+// markSoundboardEffect returns false if the same effect was already handled recently.
+func (portal *Portal) markSoundboardEffect(key soundboardEffectKey) bool {
+	portal.lastSoundboardEffectLock.Lock()
+	defer portal.lastSoundboardEffectLock.Unlock()
+	if portal.lastSoundboardEffect == key && time.Since(portal.lastSoundboardEffectTime) < soundboardEffectDedupWindow {
+		return false
+	}
+	portal.lastSoundboardEffect = key
+	portal.lastSoundboardEffectTime = time.Now()
+	return true
+}
+
+// getSoundboardSoundName finds the name of a default or guild soundboard sound, caching the results.
+func (br *DiscordBridge) getSoundboardSoundName(source *User, guildID, soundID string) string {
+	br.soundboardSoundsLock.Lock()
+	defer br.soundboardSoundsLock.Unlock()
+	if name, ok := br.soundboardSounds[soundID]; ok {
+		return name
+	}
+	if br.soundboardSounds == nil {
+		br.soundboardSounds = make(map[string]string)
+	}
+	var sounds []soundboardSound
+	if guildID != "" {
+		var resp struct {
+			Items []soundboardSound `json:"items"`
+		}
+		url := discordgo.EndpointGuild(guildID) + "/soundboard-sounds"
+		data, err := source.Session.RequestWithBucketID("GET", url, nil, discordgo.EndpointGuild(guildID))
+		if err == nil {
+			err = json.Unmarshal(data, &resp)
+		}
+		if err != nil {
+			source.log.Warn().Err(err).Str("guild_id", guildID).Msg("Failed to fetch guild soundboard sounds")
+		}
+		sounds = resp.Items
+	}
+	if _, ok := br.soundboardSounds["default"]; !ok && br.hasCapability(capabilitySoundboard) {
+		url := discordgo.EndpointAPI + "soundboard-default-sounds"
+		var defaultSounds []soundboardSound
+		data, err := source.Session.RequestWithBucketID("GET", url, nil, url)
+		if err == nil {
+			err = json.Unmarshal(data, &defaultSounds)
+		}
+		if err != nil {
+			source.log.Warn().Err(err).Msg("Failed to fetch default soundboard sounds")
+		} else {
+			// Mark the default sounds as fetched so they're not requested again for unknown sounds
+			br.soundboardSounds["default"] = ""
+		}
+		sounds = append(sounds, defaultSounds...)
+	}
+	for _, sound := range sounds {
+		br.soundboardSounds[sound.SoundID.String()] = sound.Name
+	}
+	return br.soundboardSounds[soundID]
+}
+
+func (portal *Portal) handleDiscordSoundboardEffect(source *User, effect *voiceChannelEffect) {
+	soundID := effect.SoundID.String()
+	log := portal.log.With().
+		Str("action", "discord soundboard effect").
+		Str("sender_id", effect.UserID).
+		Str("sound_id", soundID).
+		Logger()
+	puppet := portal.bridge.GetPuppetByID(effect.UserID)
+	intent := puppet.IntentFor(portal)
+	err := intent.EnsureJoined(portal.MXID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to ensure ghost is joined for soundboard notice")
+		return
+	}
+
+	name := portal.bridge.getSoundboardSoundName(source, effect.GuildID, soundID)
+	if name == "" {
+		name = "a sound"
+	} else if effect.Emoji != nil && effect.Emoji.Name != "" {
+		name = fmt.Sprintf("%s %s", effect.Emoji.Name, name)
+	}
+	_, err = portal.sendMatrixMessage(intent, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    fmt.Sprintf("Played %s from the soundboard", name),
+	}, nil, 0)
+	if err != nil {
+		log.Err(err).Msg("Failed to send soundboard notice")
+		return
+	}
+
+	content := &event.MessageEventContent{
+		MsgType: event.MsgAudio,
+		Body:    fmt.Sprintf("sound-%s.ogg", soundID),
+		Info:    &event.FileInfo{MimeType: "audio/ogg"},
+	}
+	ctx := log.WithContext(context.Background())
+	content = portal.convertDiscordFile(ctx, "soundboard sound", intent, "soundboard_"+soundID, discordgo.EndpointCDN+"soundboard-sounds/"+soundID, content)
+	if content.MsgType != event.MsgAudio {
+		// The sound couldn't be downloaded, the notice is enough
+		return
+	}
+	_, err = portal.sendMatrixMessage(intent, event.EventMessage, content, nil, 0)
+	if err != nil {
+		log.Err(err).Msg("Failed to send soundboard sound")
+	}
+}
@@ -0,0 +1,103 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func (br *DiscordBridge) startStateCacheTrim() {
+	cfg := &br.Config.Bridge.StateCache
+	if cfg.TrimInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(cfg.TrimInterval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, user := range br.getAllUsersWithToken() {
+			if user.Connected() {
+				user.trimStateCache()
+			}
+		}
+	}
+}
+
+// trimStateCache drops cached members and presences that exceed the configured limits.
+// The user's own membership is always kept, as it's needed for permission checks.
+// The guilds are trimmed in place while holding the state lock, so that concurrent gateway events aren't lost.
+func (user *User) trimStateCache() {
+	cfg := &user.bridge.Config.Bridge.StateCache
+	state := user.Session.State
+	var removed []*discordgo.Member
+	trimmedGuilds := 0
+	state.Lock()
+	for _, guild := range state.Guilds {
+		limit := cfg.MaxMembersPerGuild
+		if !cfg.UnbridgedGuildMembers {
+			if dbGuild := user.bridge.GetGuildByID(guild.ID, false); dbGuild == nil || dbGuild.MXID == "" {
+				limit = 1
+			}
+		}
+		dropPresences := !cfg.TrackPresences && len(guild.Presences) > 0
+		if (limit <= 0 || len(guild.Members) <= limit) && !dropPresences {
+			continue
+		}
+		trimmedGuilds++
+		if limit > 0 && len(guild.Members) > limit {
+			kept := make([]*discordgo.Member, 0, limit)
+			for _, member := range guild.Members {
+				if member.User != nil && member.User.ID == user.DiscordID {
+					kept = append(kept, member)
+				}
+			}
+			for _, member := range guild.Members {
+				if member.User == nil || member.User.ID == user.DiscordID {
+					continue
+				} else if len(kept) < limit {
+					kept = append(kept, member)
+				} else {
+					if member.GuildID == "" {
+						member.GuildID = guild.ID
+					}
+					removed = append(removed, member)
+				}
+			}
+			guild.Members = kept
+		}
+		if dropPresences {
+			guild.Presences = []*discordgo.Presence{}
+		}
+	}
+	state.Unlock()
+	// The member map of the state is private, so removed members are dropped from it separately.
+	// MemberRemove returns ErrStateNotFound as they're already gone from the guild's member list.
+	for _, member := range removed {
+		err := state.MemberRemove(member)
+		if err != nil && !errors.Is(err, discordgo.ErrStateNotFound) {
+			user.log.Warn().Err(err).Str("guild_id", member.GuildID).Msg("Failed to remove trimmed member from state cache")
+		}
+	}
+	if trimmedGuilds > 0 {
+		user.log.Debug().
+			Int("guilds", trimmedGuilds).
+			Int("removed_members", len(removed)).
+			Msg("Trimmed Discord state cache")
+	}
+}
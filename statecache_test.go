@@ -0,0 +1,61 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrimStateCache(t *testing.T) {
+	br := newTestBridge(t)
+	br.Config.Bridge.StateCache.UnbridgedGuildMembers = true
+	br.Config.Bridge.StateCache.MaxMembersPerGuild = 2
+
+	state := discordgo.NewState()
+	user := &User{bridge: br, Session: &discordgo.Session{State: state}, log: zerolog.Nop()}
+	user.User = br.DB.User.New()
+	user.DiscordID = "self"
+	guild := &discordgo.Guild{ID: "guild", Name: "Old name"}
+	for i := 0; i < 4; i++ {
+		guild.Members = append(guild.Members, &discordgo.Member{GuildID: "guild", User: &discordgo.User{ID: fmt.Sprintf("member%d", i)}})
+	}
+	guild.Members = append(guild.Members, &discordgo.Member{GuildID: "guild", User: &discordgo.User{ID: "self"}})
+	require.NoError(t, state.GuildAdd(guild))
+	// Changes made to the live guild must survive the trim
+	guild.Name = "New name"
+
+	user.trimStateCache()
+
+	cached, err := state.Guild("guild")
+	require.NoError(t, err)
+	assert.Equal(t, "New name", cached.Name)
+	assert.Len(t, cached.Members, 2)
+	_, err = state.Member("guild", "self")
+	assert.NoError(t, err, "own membership should be kept")
+	_, err = state.Member("guild", "member0")
+	assert.NoError(t, err)
+	for _, userID := range []string{"member1", "member2", "member3"} {
+		_, err = state.Member("guild", userID)
+		assert.ErrorIs(t, err, discordgo.ErrStateNotFound, userID)
+	}
+}
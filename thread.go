@@ -8,6 +8,7 @@ import (
 	"github.com/bwmarrin/discordgo"
 	"github.com/rs/zerolog"
 	"golang.org/x/exp/slices"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-discord/database"
@@ -19,6 +20,11 @@ type Thread struct {
 
 	creationNoticeLock       sync.Mutex
 	initialBackfillAttempted bool
+	archiveLock              sync.Mutex
+
+	// postState is the last forum post state event sent for the thread, see updateForumPostState.
+	postState     string
+	postStateLock sync.Mutex
 }
 
 func (br *DiscordBridge) GetThreadByID(id string, root *database.Message) *Thread {
@@ -85,6 +91,10 @@ func (br *DiscordBridge) threadFound(ctx context.Context, source *User, rootMess
 	if thread.CreationNoticeMXID == "" {
 		thread.Parent.sendThreadCreationNotice(ctx, thread)
 	}
+	if metadata != nil {
+		thread.UpdateArchiveState(ctx, metadata.ThreadMetadata)
+		thread.updateForumPostState(ctx, source, metadata)
+	}
 	// TODO member_ids_preview is probably not guaranteed to contain the source user
 	if source != nil && metadata != nil && slices.Contains(metadata.MemberIDsPreview, source.DiscordID) && !source.IsInPortal(thread.ID) {
 		source.MarkInPortal(database.UserPortal{
@@ -112,6 +122,77 @@ func (thread *Thread) maybeInitialBackfill(source *User) {
 	thread.Parent.forwardBackfillInitial(source, thread)
 }
 
+// UpdateArchiveState stores the archive state from Discord and sends a notice to the Matrix thread if it changed.
+func (thread *Thread) UpdateArchiveState(ctx context.Context, meta *discordgo.ThreadMetadata) {
+	if meta == nil {
+		return
+	}
+	thread.archiveLock.Lock()
+	defer thread.archiveLock.Unlock()
+	if thread.Archived == meta.Archived && thread.Locked == meta.Locked {
+		return
+	}
+	wasArchived := thread.Archived
+	thread.Archived = meta.Archived
+	thread.Locked = meta.Locked
+	thread.Update()
+	log := zerolog.Ctx(ctx)
+	log.Debug().
+		Bool("archived", thread.Archived).
+		Bool("locked", thread.Locked).
+		Msg("Thread archive state changed")
+
+	var notice string
+	switch {
+	case thread.Locked:
+		notice = "This thread was locked on Discord. Only moderators can unarchive it."
+	case thread.Archived:
+		notice = "This thread was archived on Discord. Sending a message in it will unarchive it."
+	case wasArchived:
+		notice = "This thread was unarchived on Discord."
+	default:
+		return
+	}
+	thread.sendNotice(ctx, notice)
+}
+
+func (thread *Thread) sendNotice(ctx context.Context, notice string) {
+	portal := thread.Parent
+	if portal == nil || portal.MXID == "" {
+		return
+	}
+	lastThreadEvent := thread.RootMXID
+	lastInThread := portal.bridge.DB.Message.GetLastInThread(portal.Key, thread.ID)
+	if lastInThread != nil {
+		lastThreadEvent = lastInThread.MXID
+	}
+	_, err := portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, &event.MessageEventContent{
+		Body:      notice,
+		MsgType:   event.MsgNotice,
+		RelatesTo: (&event.RelatesTo{}).SetThread(thread.RootMXID, lastThreadEvent),
+	}, nil, 0)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to send thread archive state notice")
+	}
+}
+
+// Unarchive unarchives the thread on Discord so that a message from Matrix can be sent to it.
+func (thread *Thread) Unarchive(user *User) error {
+	thread.archiveLock.Lock()
+	defer thread.archiveLock.Unlock()
+	if !thread.Archived {
+		return nil
+	}
+	archived := false
+	_, err := user.Session.ChannelEditComplex(thread.ID, &discordgo.ChannelEdit{Archived: &archived}, thread.RefererOpt())
+	if err != nil {
+		return err
+	}
+	thread.Archived = false
+	thread.Update()
+	return nil
+}
+
 func (thread *Thread) RefererOpt() discordgo.RequestOption {
 	return discordgo.WithThreadReferer(thread.Parent.GuildID, thread.ParentID, thread.ID)
 }
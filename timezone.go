@@ -0,0 +1,84 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+var cmdTimezone = &commands.FullHandler{
+	Func: wrapCommand(fnTimezone),
+	Name: "timezone",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "View or change the timezone used for rendering Discord timestamps in your DMs and group DMs.",
+		Args:        "[<IANA timezone name>|reset]",
+	},
+}
+
+func fnTimezone(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		if ce.User.Timezone == "" {
+			ce.Reply("You're using the default timezone (%s)", ce.Bridge.Config.Bridge.TimestampLocation())
+		} else {
+			ce.Reply("Your timezone is %s", ce.User.Timezone)
+		}
+		return
+	} else if len(ce.Args) > 1 {
+		ce.Reply("**Usage:** `$cmdprefix timezone [<IANA timezone name>|reset]`")
+		return
+	}
+	if strings.ToLower(ce.Args[0]) == "reset" {
+		ce.User.Timezone = ""
+	} else if loc, err := time.LoadLocation(ce.Args[0]); err != nil || ce.Args[0] == "" || strings.EqualFold(ce.Args[0], "local") {
+		ce.Reply("Unknown timezone `%s`, use a name from the IANA timezone database like `Europe/Helsinki`", ce.Args[0])
+		return
+	} else {
+		ce.User.Timezone = loc.String()
+	}
+	ce.User.Update()
+	ce.React("✅")
+}
+
+// timestampLocation returns the user's timezone, or the bridge default if the user hasn't set one.
+func (user *User) timestampLocation() *time.Location {
+	if user.Timezone != "" {
+		if loc, err := time.LoadLocation(user.Timezone); err == nil {
+			return loc
+		}
+	}
+	return user.bridge.Config.Bridge.TimestampLocation()
+}
+
+// timestampLocation returns the timezone that timestamps in the portal should be rendered in.
+// Private chats only have one Matrix user, so their timezone is used, other portals use the bridge default.
+func (portal *Portal) timestampLocation() *time.Location {
+	if portal.Key.Receiver != "" {
+		if user := portal.bridge.GetCachedUserByID(portal.Key.Receiver); user != nil {
+			return user.timestampLocation()
+		}
+	}
+	return portal.bridge.Config.Bridge.TimestampLocation()
+}
+
+// formatTimestamp formats a timestamp for a Matrix message in the portal's timezone.
+func (portal *Portal) formatTimestamp(ts time.Time, style discordTimestampStyle) string {
+	return ts.In(portal.timestampLocation()).Format(style.Format(portal.bridge.Config.Bridge.Timestamps.TwelveHour))
+}
@@ -0,0 +1,54 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	ttsContentKey    = "fi.mau.discord.tts"
+	ttsMessagePrefix = "🔊"
+	// ttsCommandPrefix can be used at the start of a Matrix message to send it as TTS, like the Discord client's /tts command.
+	ttsCommandPrefix = "/tts "
+)
+
+// markTTSPart marks the text part of a Discord TTS message, so that clients can tell it apart from normal messages.
+func markTTSPart(part *ConvertedMessage) {
+	if part.Extra == nil {
+		part.Extra = make(map[string]any)
+	}
+	part.Extra[ttsContentKey] = true
+	if part.Content.Format == event.FormatHTML {
+		part.Content.FormattedBody = fmt.Sprintf("%s %s", ttsMessagePrefix, part.Content.FormattedBody)
+	}
+	part.Content.Body = fmt.Sprintf("%s %s", ttsMessagePrefix, part.Content.Body)
+}
+
+// parseMatrixTTS checks if a Matrix message asks to be sent as TTS, either with the content flag or the /tts prefix.
+// The prefix is stripped from the returned Discord message content.
+func parseMatrixTTS(evt *event.Event, discordContent string) (string, bool) {
+	if flag, ok := evt.Content.Raw[ttsContentKey].(bool); ok && flag {
+		return discordContent, true
+	} else if strings.HasPrefix(discordContent, ttsCommandPrefix) {
+		return strings.TrimPrefix(discordContent, ttsCommandPrefix), true
+	}
+	return discordContent, false
+}
@@ -0,0 +1,54 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+)
+
+// describeUnsupportedMessage returns a short description of why a Discord message couldn't be converted to anything.
+func describeUnsupportedMessage(msg *discordgo.Message) string {
+	switch {
+	case msg.Poll != nil:
+		return "poll"
+	case msg.Type != discordgo.MessageTypeDefault && msg.Type != discordgo.MessageTypeReply &&
+		msg.Type != discordgo.MessageTypeChatInputCommand && msg.Type != discordgo.MessageTypeContextMenuCommand:
+		return fmt.Sprintf("message type %d", msg.Type)
+	case len(msg.Components) > 0:
+		return "message components"
+	default:
+		return "empty message"
+	}
+}
+
+// convertUnsupportedMessage returns a placeholder notice for a Discord message that produced no Matrix events,
+// so that users know something was missed. It returns nil if unsupported event notices are disabled.
+func (portal *Portal) convertUnsupportedMessage(msg *discordgo.Message) *ConvertedMessage {
+	if !portal.bridge.Config.Bridge.UnsupportedEventNotices {
+		return nil
+	}
+	kind := describeUnsupportedMessage(msg)
+	return &ConvertedMessage{Type: event.EventMessage, Content: &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    fmt.Sprintf("[unsupported Discord event: %s]", kind),
+	}, Extra: map[string]any{
+		"fi.mau.discord.unsupported": kind,
+	}}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -30,6 +31,7 @@ import (
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/pushrules"
 
+	"go.mau.fi/mautrix-discord/config"
 	"go.mau.fi/mautrix-discord/database"
 )
 
@@ -59,6 +61,11 @@ type User struct {
 	wasDisconnected bool
 	wasLoggedOut    bool
 
+	// pendingAccountSwitch is the Discord account that the token switched to, until the user confirms the switch.
+	pendingAccountSwitch   *discordgo.User
+	confirmedAccountSwitch string
+	accountSwitchLock      sync.Mutex
+
 	markedOpened     map[string]time.Time
 	markedOpenedLock sync.Mutex
 
@@ -68,6 +75,54 @@ type User struct {
 	nextDiscordUploadID atomic.Int32
 
 	relationships map[string]*discordgo.Relationship
+
+	notes     map[string]string
+	notesLock sync.RWMutex
+
+	awaySkipped map[awayCursor]string
+	awayLock    sync.Mutex
+
+	portalLimitLock sync.Mutex
+
+	// matrixPresence is the Discord presence derived from Matrix activity when matrix_presence is enabled.
+	matrixPresence     discordgo.Status
+	matrixIdleTimer    *time.Timer
+	matrixPresenceLock sync.Mutex
+
+	friendPresences     map[string]*discordgo.Presence
+	nowPlaying          map[string]nowPlayingState
+	friendPresencesLock sync.Mutex
+
+	gatewayRecording     *gatewayRecording
+	gatewayRecordingLock sync.Mutex
+
+	keywords     []keywordMatcher
+	keywordsLock sync.Mutex
+
+	ownMessageModes     map[string]string
+	ownMessageModesLock sync.Mutex
+
+	// subscribedGuilds contains the guilds subscribed to on the current gateway connection.
+	subscribedGuilds     map[string]struct{}
+	subscribedGuildsLock sync.Mutex
+
+	catchupBuffers  map[*Portal][]portalDiscordMessage
+	catchupFinished map[*Portal]struct{}
+	catchupLock     sync.Mutex
+
+	// readStates contains the last message the user has read on Discord in each channel.
+	readStates     map[string]string
+	readStatesLock sync.Mutex
+
+	guildSettings   map[string]*discordgo.UserGuildSettings
+	guildFolderTags map[string]string
+	roomTagsLock    sync.Mutex
+
+	guildFolderLayout string
+	guildFolderLock   sync.Mutex
+
+	recentErrors     []userErrorRecord
+	recentErrorsLock sync.Mutex
 }
 
 func (user *User) GetRemoteID() string {
@@ -208,7 +263,7 @@ func (br *DiscordBridge) NewUser(dbUser *database.User) *User {
 	user := &User{
 		User:   dbUser,
 		bridge: br,
-		log:    br.ZLog.With().Str("user_id", string(dbUser.MXID)).Logger(),
+		log:    br.moduleLevel(br.ZLog.With().Str("user_id", string(dbUser.MXID)).Logger(), "user"),
 
 		markedOpened:    make(map[string]time.Time),
 		PermissionLevel: br.Config.Bridge.Permissions.Get(dbUser.MXID),
@@ -437,6 +492,9 @@ func (user *User) NextDiscordUploadID() string {
 }
 
 func (user *User) Login(token string) error {
+	if err := user.bridge.checkSignupQuota(user); err != nil {
+		return err
+	}
 	user.bridgeStateLock.Lock()
 	user.wasLoggedOut = false
 	user.bridgeStateLock.Unlock()
@@ -447,7 +505,11 @@ Loop:
 	for i := 0; i < maxRetries; i++ {
 		err = user.Connect()
 		if err == nil {
+			if user.SignupTS.IsZero() {
+				user.SignupTS = time.Now()
+			}
 			user.Update()
+			user.bridge.fireHook(HookEvent{Type: config.HookLogin, UserID: user.MXID})
 			return nil
 		}
 		user.log.Error().Err(err).Msg("Error connecting for login")
@@ -568,13 +630,17 @@ func (user *User) Connect() error {
 	} else {
 		session.LogLevel = discordgo.LogInformational
 	}
-	userDiscordLog := user.log.With().Str("component", "discordgo").Logger()
+	userDiscordLog := user.bridge.moduleLevel(user.log.With().Str("component", "discordgo").Logger(), "discordgo")
 	session.Logger = func(msgL, caller int, format string, a ...interface{}) {
 		userDiscordLog.WithLevel(discordToZeroLevel(msgL)).Caller(caller+1).Msgf(strings.TrimSpace(format), a...) // zerolog-allow-msgf
 	}
 	if !session.IsUser {
 		session.Identify.Intents = BotIntents
+		if threshold := user.bridge.Config.Bridge.GatewayLargeThreshold; threshold != 0 {
+			session.Identify.LargeThreshold = threshold
+		}
 	}
+	session.State.TrackPresences = user.bridge.Config.Bridge.StateCache.TrackPresences
 	session.EventHandler = user.eventHandlerSync
 
 	if session.IsUser {
@@ -598,6 +664,12 @@ func (user *User) Connect() error {
 }
 
 func (user *User) eventHandlerSync(rawEvt any) {
+	if user.interceptAccountSwitch(rawEvt) {
+		return
+	}
+	if evt, ok := rawEvt.(*discordgo.Event); ok {
+		user.recordGatewayEvent(evt)
+	}
 	go user.eventHandler(rawEvt)
 }
 
@@ -605,12 +677,16 @@ func (user *User) eventHandler(rawEvt any) {
 	defer func() {
 		err := recover()
 		if err != nil {
+			stack := debug.Stack()
 			user.log.Error().
-				Bytes(zerolog.ErrorStackFieldName, debug.Stack()).
+				Bytes(zerolog.ErrorStackFieldName, stack).
 				Any(zerolog.ErrorFieldName, err).
 				Msg("Panic in Discord event handler")
+			user.bridge.ReportPanic(fmt.Sprintf("discord event %T", rawEvt), err, stack, user.MXID.String())
+			user.recordError(fmt.Sprintf("discord event %T", rawEvt), fmt.Errorf("panic: %v", err))
 		}
 	}()
+	user.bridge.invalidateAPICache(rawEvt)
 	switch evt := rawEvt.(type) {
 	case *discordgo.Ready:
 		user.readyHandler(evt)
@@ -622,6 +698,8 @@ func (user *User) eventHandler(rawEvt any) {
 		user.disconnectedHandler(evt)
 	case *discordgo.InvalidAuth:
 		user.invalidAuthHandler(evt)
+	case *discordgo.RateLimit:
+		user.rateLimitHandler(evt)
 	case *discordgo.GuildCreate:
 		user.guildCreateHandler(evt)
 	case *discordgo.GuildDelete:
@@ -629,14 +707,37 @@ func (user *User) eventHandler(rawEvt any) {
 	case *discordgo.GuildUpdate:
 		user.guildUpdateHandler(evt)
 	case *discordgo.GuildRoleCreate:
+		user.guildRoleCreateNotice(evt)
 		user.discordRoleToDB(evt.GuildID, evt.Role, nil, nil)
 	case *discordgo.GuildRoleUpdate:
 		user.discordRoleToDB(evt.GuildID, evt.Role, nil, nil)
+		go user.syncGuildPowerLevels(evt.GuildID, "")
+		if evt.Role.ID == evt.GuildID {
+			go user.syncGuildHistoryVisibility(evt.GuildID)
+		}
 	case *discordgo.GuildRoleDelete:
+		user.guildRoleDeleteNotice(evt)
 		user.bridge.DB.Role.DeleteByID(evt.GuildID, evt.RoleID)
+		go user.syncGuildPowerLevels(evt.GuildID, "")
+	case *discordgo.GuildMemberUpdate:
+		go user.syncGuildPowerLevels(evt.GuildID, evt.User.ID)
+		go user.guildMemberProfileUpdate(evt.Member)
+	case *discordgo.GuildMemberAdd:
+		user.bridge.cancelGhostCleanup(evt.GuildID, evt.User)
+	case *discordgo.GuildMemberRemove:
+		user.bridge.scheduleGhostCleanup(evt.GuildID, evt.User)
+	case *discordgo.GuildBanAdd:
+		go user.guildBanAddHandler(evt)
+	case *discordgo.GuildBanRemove:
+		go user.guildBanRemoveHandler(evt)
+	case *discordgo.GuildEmojisUpdate:
+		user.guildEmojisUpdateHandler(evt)
+		go user.syncGuildEmotePack(evt.GuildID)
 	case *discordgo.ChannelCreate:
+		user.guildChannelNotice(evt.Channel, false)
 		user.channelCreateHandler(evt)
 	case *discordgo.ChannelDelete:
+		user.guildChannelNotice(evt.Channel, true)
 		user.channelDeleteHandler(evt)
 	case *discordgo.ChannelUpdate:
 		user.channelUpdateHandler(evt)
@@ -650,6 +751,8 @@ func (user *User) eventHandler(rawEvt any) {
 		user.relationshipRemoveHandler(evt)
 	case *discordgo.RelationshipUpdate:
 		user.relationshipUpdateHandler(evt)
+	case *discordgo.UserNoteUpdate:
+		user.userNoteUpdateHandler(evt)
 	case *discordgo.MessageCreate:
 		user.pushPortalMessage(evt, "message create", evt.ChannelID, evt.GuildID)
 	case *discordgo.MessageDelete:
@@ -664,19 +767,68 @@ func (user *User) eventHandler(rawEvt any) {
 		user.pushPortalMessage(evt, "reaction remove", evt.ChannelID, evt.GuildID)
 	case *discordgo.MessageAck:
 		user.messageAckHandler(evt)
+	case *discordgo.UserGuildSettingsUpdate:
+		user.userGuildSettingsUpdateHandler(evt)
+	case *discordgo.UserSettingsUpdate:
+		if _, ok := (*evt)["guild_folders"]; ok {
+			go user.syncGuildFolderSpaces()
+		}
 	case *discordgo.TypingStart:
 		user.typingStartHandler(evt)
+	case *discordgo.PresenceUpdate:
+		user.presenceUpdateHandler(evt)
 	case *discordgo.InteractionSuccess:
 		user.interactionSuccessHandler(evt)
+	case *discordgo.InteractionCreate:
+		user.interactionCreateHandler(evt)
 	case *discordgo.ThreadListSync:
 		user.threadListSyncHandler(evt)
+	case *discordgo.ThreadUpdate:
+		user.threadUpdateHandler(evt)
 	case *discordgo.Event:
-		// Ignore
+		user.rawEventHandler(evt)
 	default:
 		user.log.Debug().Type("event_type", evt).Msg("Unhandled event")
 	}
 }
 
+// Event types that discordgo doesn't know about, which are delivered as raw events.
+const (
+	voiceChannelEffectSendEvent = "VOICE_CHANNEL_EFFECT_SEND"
+	embeddedActivityUpdateEvent = "EMBEDDED_ACTIVITY_UPDATE"
+)
+
+func (user *User) rawEventHandler(evt *discordgo.Event) {
+	switch evt.Type {
+	case voiceChannelEffectSendEvent:
+		var effect voiceChannelEffect
+		err := json.Unmarshal(evt.RawData, &effect)
+		if err != nil {
+			user.log.Warn().Err(err).Msg("Failed to parse voice channel effect")
+			return
+		}
+		user.voiceChannelEffectHandler(&effect)
+	case userSettingsProtoUpdateEvent:
+		go user.syncGuildFolderSpaces()
+	case embeddedActivityUpdateEvent:
+		var update embeddedActivityUpdate
+		err := json.Unmarshal(evt.RawData, &update)
+		if err != nil {
+			user.log.Warn().Err(err).Msg("Failed to parse embedded activity update")
+			return
+		}
+		user.embeddedActivityUpdateHandler(&update)
+	case guildStickersUpdateEvent:
+		var update guildStickersUpdate
+		err := json.Unmarshal(evt.RawData, &update)
+		if err != nil {
+			user.log.Warn().Err(err).Msg("Failed to parse guild stickers update")
+			return
+		}
+		user.guildStickersUpdateHandler(&update)
+	}
+}
+
 func (user *User) Disconnect() error {
 	user.Lock()
 	defer user.Unlock()
@@ -742,10 +894,32 @@ func (user *User) readyHandler(r *discordgo.Ready) {
 	}
 	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateBackfilling})
 	user.tryAutomaticDoublePuppeting()
+	if err := user.applyPresence(); err != nil {
+		user.log.Warn().Err(err).Msg("Failed to restore presence")
+	}
+	user.storeFriendPresences(r.Presences)
+	if !user.Session.IsUser && r.Application != nil && user.bridge.Config.Bridge.PlumbingRequests.Enabled {
+		go user.registerPlumbingRequestCommand(r.Application.ID)
+	}
+	go user.probeCapabilitiesOnStartup()
+	if r.ReadState != nil {
+		// Store read states before backfilling so that backfills can set read markers correctly
+		for _, entry := range r.ReadState.Entries {
+			user.setReadState(entry.ID, string(entry.LastMessageID))
+		}
+	}
+	if r.UserGuildSettings != nil {
+		for _, settings := range r.UserGuildSettings.Entries {
+			user.setGuildSettings(settings)
+		}
+	}
+	user.startCatchup()
+	defer user.finishCatchup()
 
 	for _, relationship := range r.Relationships {
 		user.relationships[relationship.ID] = relationship
 	}
+	user.setNotes(r.Notes)
 
 	updateTS := time.Now()
 	portalsInSpace := make(map[string]bool)
@@ -776,6 +950,8 @@ func (user *User) readyHandler(r *discordgo.Ready) {
 	}
 
 	go user.subscribeGuilds(2 * time.Second)
+	go user.syncRoomTags()
+	go user.syncGuildFolderSpaces()
 
 	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
 }
@@ -784,25 +960,63 @@ func (user *User) subscribeGuilds(delay time.Duration) {
 	if !user.Session.IsUser {
 		return
 	}
+	// Subscriptions don't carry over to a new connection
+	user.subscribedGuildsLock.Lock()
+	user.subscribedGuilds = make(map[string]struct{})
+	user.subscribedGuildsLock.Unlock()
 	for _, guildMeta := range user.Session.State.Guilds {
-		guild := user.bridge.GetGuildByID(guildMeta.ID, false)
-		if guild != nil && guild.MXID != "" {
-			user.log.Debug().Str("guild_id", guild.ID).Msg("Subscribing to guild")
-			dat := discordgo.GuildSubscribeData{
-				GuildID:    guild.ID,
-				Typing:     true,
-				Activities: true,
-				Threads:    true,
-			}
-			err := user.Session.SubscribeGuild(dat)
-			if err != nil {
-				user.log.Warn().Err(err).Str("guild_id", guild.ID).Msg("Failed to subscribe to guild")
-			}
+		if user.subscribeGuild(guildMeta.ID) {
 			time.Sleep(delay)
 		}
 	}
 }
 
+// subscribeGuild subscribes to typing notifications and other events in a bridged guild.
+// If subscription trimming is enabled, guilds without any portal rooms are skipped,
+// and presence updates (which aren't bridged) aren't requested.
+func (user *User) subscribeGuild(guildID string) bool {
+	if !user.Session.IsUser {
+		return false
+	}
+	guild := user.bridge.GetGuildByID(guildID, false)
+	if guild == nil || guild.MXID == "" {
+		return false
+	}
+	trim := user.bridge.Config.Bridge.TrimGuildSubscriptions
+	if trim && !user.bridge.guildHasPortalRooms(guildID) {
+		user.log.Debug().Str("guild_id", guildID).Msg("Not subscribing to guild without portal rooms")
+		return false
+	}
+	user.log.Debug().Str("guild_id", guildID).Msg("Subscribing to guild")
+	err := user.Session.SubscribeGuild(discordgo.GuildSubscribeData{
+		GuildID:    guildID,
+		Typing:     true,
+		Activities: !trim,
+		Threads:    true,
+	})
+	if err != nil {
+		user.log.Warn().Err(err).Str("guild_id", guildID).Msg("Failed to subscribe to guild")
+	} else {
+		user.subscribedGuildsLock.Lock()
+		if user.subscribedGuilds == nil {
+			user.subscribedGuilds = make(map[string]struct{})
+		}
+		user.subscribedGuilds[guildID] = struct{}{}
+		user.subscribedGuildsLock.Unlock()
+	}
+	return true
+}
+
+// subscribeGuildIfNeeded subscribes to a guild unless it was already subscribed to on the current connection.
+func (user *User) subscribeGuildIfNeeded(guildID string) {
+	user.subscribedGuildsLock.Lock()
+	_, subscribed := user.subscribedGuilds[guildID]
+	user.subscribedGuildsLock.Unlock()
+	if !subscribed {
+		user.subscribeGuild(guildID)
+	}
+}
+
 func (user *User) resumeHandler(_ *discordgo.Resumed) {
 	user.log.Debug().Msg("Discord connection resumed")
 	user.subscribeGuilds(0 * time.Second)
@@ -850,6 +1064,7 @@ func (user *User) handleRelationshipChange(userID, nickname string) {
 		return
 	}
 
+	portal.syncFriendNickProfile(puppet, nickname)
 	updated := portal.FriendNick == (nickname != "")
 	portal.FriendNick = nickname != ""
 	if nickname != "" {
@@ -875,6 +1090,9 @@ func (user *User) handleRelationshipChange(userID, nickname string) {
 }
 
 func (user *User) handlePrivateChannel(portal *Portal, meta *discordgo.Channel, timestamp time.Time, create, isInSpace bool) {
+	if !user.bridge.ownsChannel(portal.Key.ChannelID) {
+		return
+	}
 	if create && portal.MXID == "" {
 		err := portal.CreateMatrixRoom(user, meta)
 		if err != nil {
@@ -972,9 +1190,12 @@ func (user *User) handleGuildRoles(guildID string, newRoles []*discordgo.Role) {
 func (user *User) handleGuild(meta *discordgo.Guild, timestamp time.Time, isInSpace bool) {
 	guild := user.bridge.GetGuildByID(meta.ID, true)
 	guild.UpdateInfo(user, meta)
+	if meta.Emojis != nil {
+		guild.setKnownEmojis(meta.Emojis)
+	}
 	if len(meta.Channels) > 0 {
 		for _, ch := range meta.Channels {
-			if !user.channelIsBridgeable(ch) {
+			if !user.channelIsBridgeable(ch) || !user.bridge.ownsChannel(ch.ID) {
 				continue
 			}
 			portal := user.GetPortalByMeta(ch)
@@ -988,7 +1209,9 @@ func (user *User) handleGuild(meta *discordgo.Guild, timestamp time.Time, isInSp
 				}
 			} else {
 				portal.UpdateInfo(user, ch)
-				if user.bridge.Config.Bridge.Backfill.MaxGuildMembers < 0 || meta.MemberCount < user.bridge.Config.Bridge.Backfill.MaxGuildMembers {
+				if user.Away && portal.isLowPriority() {
+					user.markSkippedWhileAway(portal, nil, ch.LastMessageID)
+				} else if user.bridge.Config.Bridge.Backfill.MaxGuildMembers < 0 || meta.MemberCount < user.bridge.Config.Bridge.Backfill.MaxGuildMembers {
 					portal.ForwardBackfillMissed(user, ch.LastMessageID, nil)
 				}
 			}
@@ -998,6 +1221,10 @@ func (user *User) handleGuild(meta *discordgo.Guild, timestamp time.Time, isInSp
 		user.handleGuildRoles(meta.ID, meta.Roles)
 	}
 	user.addGuildToSpace(guild, isInSpace, timestamp)
+	if meta.Emojis != nil || meta.Stickers != nil {
+		go guild.syncEmotePack(meta.Emojis, meta.Stickers)
+	}
+	go user.syncGuildPowerLevels(meta.ID, "")
 }
 
 func (user *User) connectedHandler(_ *discordgo.Connect) {
@@ -1076,6 +1303,9 @@ func (user *User) guildUpdateHandler(g *discordgo.GuildUpdate) {
 
 func (user *User) threadListSyncHandler(t *discordgo.ThreadListSync) {
 	for _, meta := range t.Threads {
+		if !user.bridge.ownsChannel(meta.ParentID) {
+			continue
+		}
 		log := user.log.With().
 			Str("action", "thread list sync").
 			Str("guild_id", t.GuildID).
@@ -1093,13 +1323,38 @@ func (user *User) threadListSyncHandler(t *discordgo.ThreadListSync) {
 				user.bridge.threadFound(ctx, user, msg[0], meta.ID, meta)
 			}
 		} else {
-			thread.Parent.ForwardBackfillMissed(user, meta.LastMessageID, thread)
+			thread.UpdateArchiveState(ctx, meta.ThreadMetadata)
+			thread.updateForumPostState(ctx, user, meta)
+			if user.Away && thread.Parent.isLowPriority() {
+				user.markSkippedWhileAway(thread.Parent, thread, meta.LastMessageID)
+			} else {
+				thread.Parent.ForwardBackfillMissed(user, meta.LastMessageID, thread)
+			}
 		}
 	}
 }
 
+func (user *User) threadUpdateHandler(t *discordgo.ThreadUpdate) {
+	thread := user.bridge.GetThreadByID(t.ID, nil)
+	if thread == nil || thread.Parent == nil || !user.bridge.ownsChannel(thread.ParentID) {
+		return
+	}
+	log := user.log.With().
+		Str("action", "thread update").
+		Str("parent_id", t.ParentID).
+		Str("thread_id", t.ID).
+		Logger()
+	ctx := log.WithContext(context.Background())
+	thread.UpdateArchiveState(ctx, t.ThreadMetadata)
+	thread.updateForumPostState(ctx, user, t.Channel)
+}
+
 func (user *User) channelCreateHandler(c *discordgo.ChannelCreate) {
-	if user.getGuildBridgingMode(c.GuildID) < database.GuildBridgeEverything {
+	if !user.bridge.ownsChannel(c.ID) {
+		return
+	} else if c.Type == discordgo.ChannelTypeGuildCategory && user.getGuildBridgingMode(c.GuildID) > database.GuildBridgeNothing {
+		// Categories are created in all bridged guilds, so that the space hierarchy stays in sync
+	} else if user.getGuildBridgingMode(c.GuildID) < database.GuildBridgeEverything {
 		user.log.Debug().
 			Str("guild_id", c.GuildID).Str("channel_id", c.ID).
 			Msg("Ignoring channel create event in unbridged guild")
@@ -1129,6 +1384,9 @@ func (user *User) channelCreateHandler(c *discordgo.ChannelCreate) {
 }
 
 func (user *User) channelDeleteHandler(c *discordgo.ChannelDelete) {
+	if !user.bridge.ownsChannel(c.ID) {
+		return
+	}
 	portal := user.GetExistingPortalByID(c.ID)
 	if portal == nil {
 		user.log.Debug().
@@ -1139,8 +1397,18 @@ func (user *User) channelDeleteHandler(c *discordgo.ChannelDelete) {
 	user.log.Info().
 		Str("guild_id", c.GuildID).Str("channel_id", c.ID).
 		Msg("Got channel delete event, cleaning up portal")
+	if portal.MXID != "" {
+		portal.removeFromSpace()
+	}
 	portal.Delete()
-	portal.cleanup(!user.bridge.Config.Bridge.DeletePortalOnChannelDelete)
+	switch user.bridge.Config.Bridge.ChannelDeleteAction {
+	case "archive":
+		portal.archive("This channel was deleted on Discord. The room has been archived and is no longer bridged.")
+	case "delete":
+		portal.cleanup(false)
+	default:
+		portal.cleanup(true)
+	}
 	if c.GuildID == "" {
 		user.MarkNotInPortal(portal.Key.ChannelID)
 	}
@@ -1150,11 +1418,17 @@ func (user *User) channelDeleteHandler(c *discordgo.ChannelDelete) {
 }
 
 func (user *User) channelUpdateHandler(c *discordgo.ChannelUpdate) {
+	if !user.bridge.ownsChannel(c.ID) {
+		return
+	}
 	portal := user.GetPortalByMeta(c.Channel)
 	if c.GuildID == "" {
 		user.handlePrivateChannel(portal, c.Channel, time.Now(), true, user.IsInSpace(portal.Key.String()))
 	} else {
 		portal.UpdateInfo(user, c.Channel)
+		// Permission overwrites may have changed
+		go portal.syncPowerLevels(user, "")
+		go portal.syncHistoryVisibility(user)
 	}
 }
 
@@ -1181,12 +1455,19 @@ func (user *User) findPortal(channelID string) (*Portal, *Thread) {
 	if thread != nil && thread.Parent != nil {
 		return thread.Parent, thread
 	}
+	// Forum posts are threads that don't have a root message in the parent channel,
+	// so the thread is created when the first message in the post is bridged.
+	if channel, _ := user.Session.State.Channel(channelID); channel != nil && channel.IsThread() {
+		if parent := user.GetExistingPortalByID(channel.ParentID); parent != nil && parent.IsForum() {
+			return parent, nil
+		}
+	}
 	if !user.Session.IsUser {
 		channel, _ := user.Session.State.Channel(channelID)
 		if channel == nil {
 			user.log.Debug().Str("channel_id", channelID).Msg("Fetching info of unknown channel to handle message")
 			var err error
-			channel, err = user.Session.Channel(channelID)
+			channel, err = user.getChannel(channelID)
 			if err != nil {
 				user.log.Warn().Err(err).Str("channel_id", channelID).Msg("Failed to get info of unknown channel")
 			} else {
@@ -1227,22 +1508,45 @@ func (user *User) pushPortalMessage(msg interface{}, typeName, channelID, guildI
 	}
 	if mode := user.getGuildBridgingMode(portal.GuildID); mode <= database.GuildBridgeNothing || (portal.MXID == "" && mode <= database.GuildBridgeIfPortalExists) {
 		return
+	} else if !user.bridge.ownsChannel(portal.Key.ChannelID) {
+		return
+	}
+
+	if user.skipWhileAway(portal, thread, msg) {
+		return
 	}
 
 	wrappedMsg := portalDiscordMessage{
-		msg:    msg,
-		user:   user,
-		thread: thread,
+		msg:        msg,
+		user:       user,
+		thread:     thread,
+		receivedAt: time.Now(),
 	}
-	select {
-	case portal.discordMessages <- wrappedMsg:
+	if user.bufferDuringCatchup(portal, wrappedMsg) {
+		return
+	}
+	user.sendPortalMessage(portal, wrappedMsg, typeName)
+}
+
+func (user *User) sendPortalMessage(portal *Portal, wrappedMsg portalDiscordMessage, typeName string) {
+	log := user.log.With().
+		Str("discord_event", typeName).
+		Str("guild_id", portal.GuildID).
+		Str("channel_id", portal.Key.ChannelID).
+		Logger()
+	switch user.bridge.Config.Bridge.PortalMessageBufferOverflow {
+	case config.BufferOverflowSpill:
+		portal.queueOrSpillDiscordMessage(log, wrappedMsg)
+	case config.BufferOverflowDropOldest:
+		portal.queueDiscordMessageDroppingOldest(log, wrappedMsg)
 	default:
-		user.log.Warn().
-			Str("discord_event", typeName).
-			Str("guild_id", guildID).
-			Str("channel_id", channelID).
-			Msg("Portal message buffer is full")
-		portal.discordMessages <- wrappedMsg
+		select {
+		case portal.discordMessages <- wrappedMsg:
+		default:
+			log.Warn().Msg("Portal message buffer is full")
+			user.bridge.metrics.recordBufferOverflow(bufferOverflowBlocked, 1)
+			portal.discordMessages <- wrappedMsg
+		}
 	}
 }
 
@@ -1271,8 +1575,9 @@ func (user *User) makeReadMarkerContent(eventID id.EventID) *CustomReadMarkers {
 }
 
 func (user *User) messageAckHandler(m *discordgo.MessageAck) {
+	user.setReadState(m.ChannelID, m.MessageID)
 	portal := user.GetExistingPortalByID(m.ChannelID)
-	if portal == nil || portal.MXID == "" {
+	if portal == nil || portal.MXID == "" || !user.bridge.ownsChannel(portal.Key.ChannelID) {
 		return
 	}
 	dp := user.GetIDoublePuppet()
@@ -1308,7 +1613,7 @@ func (user *User) typingStartHandler(t *discordgo.TypingStart) {
 		return
 	}
 	portal := user.GetExistingPortalByID(t.ChannelID)
-	if portal == nil || portal.MXID == "" {
+	if portal == nil || portal.MXID == "" || !user.bridge.ownsChannel(portal.Key.ChannelID) {
 		return
 	}
 	targetUser := user.bridge.GetCachedUserByID(t.UserID)
@@ -1455,10 +1760,17 @@ func (user *User) updateDirectChats(chats map[id.UserID][]id.RoomID) {
 	}
 }
 
-func (user *User) bridgeGuild(guildID string, everything bool) error {
+func (user *User) bridgeGuild(guildID string, mode database.GuildBridgingMode) error {
+	if mode <= database.GuildBridgeNothing {
+		return errors.New("invalid bridging mode")
+	}
 	guild := user.bridge.GetGuildByID(guildID, false)
 	if guild == nil {
 		return errors.New("guild not found")
+	} else if err := user.checkGuildSettingPermission(guildID, discordgo.PermissionManageChannels); err != nil {
+		return err
+	} else if err := user.bridge.checkGuildQuota(user, guildID); err != nil {
+		return err
 	}
 	meta, _ := user.Session.State.Guild(guildID)
 	err := guild.CreateMatrixRoom(user, meta)
@@ -1467,8 +1779,10 @@ func (user *User) bridgeGuild(guildID string, everything bool) error {
 	}
 	log := user.log.With().Str("guild_id", guild.ID).Logger()
 	user.addGuildToSpace(guild, false, time.Now())
+	everything := mode == database.GuildBridgeEverything
 	for _, ch := range meta.Channels {
 		portal := user.GetPortalByMeta(ch)
+		// Categories are always created, as they're the subspaces that channel portals are put in
 		if (everything && user.channelIsBridgeable(ch)) || ch.Type == discordgo.ChannelTypeGuildCategory {
 			err = portal.CreateMatrixRoom(user, ch)
 			if err != nil {
@@ -1477,25 +1791,10 @@ func (user *User) bridgeGuild(guildID string, everything bool) error {
 			}
 		}
 	}
-	if everything {
-		guild.BridgingMode = database.GuildBridgeEverything
-	} else {
-		guild.BridgingMode = database.GuildBridgeCreateOnMessage
-	}
+	guild.BridgingMode = mode
 	guild.Update()
 
-	if user.Session.IsUser {
-		log.Debug().Msg("Subscribing to guild after bridging")
-		err = user.Session.SubscribeGuild(discordgo.GuildSubscribeData{
-			GuildID:    guild.ID,
-			Typing:     true,
-			Activities: true,
-			Threads:    true,
-		})
-		if err != nil {
-			log.Warn().Err(err).Msg("Failed to subscribe to guild")
-		}
-	}
+	user.subscribeGuild(guild.ID)
 
 	return nil
 }
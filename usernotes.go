@@ -0,0 +1,147 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func (user *User) setNotes(notes map[string]string) {
+	user.notesLock.Lock()
+	user.notes = notes
+	user.notesLock.Unlock()
+}
+
+// getNote returns the logged-in user's personal note about another Discord user.
+func (user *User) getNote(userID string) string {
+	user.notesLock.RLock()
+	defer user.notesLock.RUnlock()
+	return user.notes[userID]
+}
+
+func (user *User) userNoteUpdateHandler(evt *discordgo.UserNoteUpdate) {
+	user.notesLock.Lock()
+	defer user.notesLock.Unlock()
+	if user.notes == nil {
+		user.notes = make(map[string]string)
+	}
+	if evt.Note == "" {
+		delete(user.notes, evt.ID)
+	} else {
+		user.notes[evt.ID] = evt.Note
+	}
+}
+
+// getFriendNick returns the nickname the logged-in user has set for a friend, or an empty string.
+func (user *User) getFriendNick(userID string) string {
+	if rel, ok := user.relationships[userID]; ok {
+		return rel.Nickname
+	}
+	return ""
+}
+
+// syncFriendNickProfile sets the room-specific displayname of the other user's ghost in a DM portal to the
+// friend nickname, so that the nickname is only visible to the user who set it.
+func (portal *Portal) syncFriendNickProfile(puppet *Puppet, nickname string) {
+	if !portal.bridge.Config.Bridge.FriendNickDisplaynames || portal.MXID == "" || portal.Type != discordgo.ChannelTypeDM {
+		return
+	}
+	intent := puppet.DefaultIntent()
+	existing, ok := portal.bridge.StateStore.TryGetMember(portal.MXID, intent.UserID)
+	if !ok || existing.Membership != event.MembershipJoin {
+		return
+	}
+	name := nickname
+	if name == "" {
+		name = puppet.Name
+	}
+	if existing.Displayname == name {
+		return
+	}
+	_, err := intent.SendStateEvent(portal.MXID, event.StateMember, intent.UserID.String(), &event.MemberEventContent{
+		Membership:  event.MembershipJoin,
+		Displayname: name,
+		AvatarURL:   puppet.AvatarURL.CUString(),
+	})
+	if err != nil {
+		portal.log.Warn().Err(err).Str("user_id", puppet.ID).Msg("Failed to set friend nickname as ghost displayname")
+	}
+}
+
+var cmdWhois = &commands.FullHandler{
+	Func: wrapCommand(fnWhois),
+	Name: "whois",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Show info about a Discord user, including your friend nickname and note for them. Defaults to the other user in DM portals.",
+		Args:        "[_Discord user ID or Matrix ghost_]",
+	},
+	RequiresLogin: true,
+}
+
+// parseWhoisTarget finds the Discord user ID from a raw ID, a Discord mention or a Matrix ghost user ID.
+func parseWhoisTarget(ce *WrappedCommandEvent) string {
+	if len(ce.Args) == 0 {
+		if ce.Portal != nil && ce.Portal.Type == discordgo.ChannelTypeDM {
+			return ce.Portal.OtherUserID
+		}
+		return ""
+	}
+	arg := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(ce.Args[0], "<@"), "!"), ">")
+	if isNumber(arg) {
+		return arg
+	} else if discordID, ok := ce.Bridge.ParsePuppetMXID(id.UserID(ce.Args[0])); ok {
+		return discordID
+	}
+	return ""
+}
+
+func fnWhois(ce *WrappedCommandEvent) {
+	userID := parseWhoisTarget(ce)
+	if userID == "" {
+		ce.Reply("**Usage:** `$cmdprefix whois <Discord user ID or Matrix ghost>`")
+		return
+	}
+	info, err := ce.User.Session.User(userID)
+	if err != nil {
+		ce.Reply("Failed to get user info: %v", err)
+		return
+	}
+	puppet := ce.Bridge.GetPuppetByID(userID)
+	puppet.UpdateInfo(ce.User, info, nil)
+	lines := []string{
+		fmt.Sprintf("**%s** (`%s`)", puppet.Name, info.ID),
+		fmt.Sprintf("* Username: `%s`", info.String()),
+		fmt.Sprintf("* Matrix ghost: [%s](%s)", puppet.MXID, puppet.MXID.URI().MatrixToURL()),
+	}
+	if info.Bot {
+		lines = append(lines, "* Bot account")
+	}
+	if nick := ce.User.getFriendNick(userID); nick != "" {
+		lines = append(lines, fmt.Sprintf("* Friend nickname: %s", nick))
+	}
+	if note := ce.User.getNote(userID); note != "" {
+		lines = append(lines, fmt.Sprintf("* Note: %s", note))
+	}
+	ce.Reply(strings.Join(lines, "\n"))
+}